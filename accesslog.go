@@ -0,0 +1,60 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+//AccessLogEntry is written as a JSON line to the access log at the end of every query
+type AccessLogEntry struct {
+	Time          string `json:"time"`
+	Remote        string `json:"remote"`
+	Collector     string `json:"collector"`
+	Descriminator string `json:"descriminator"`
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	Records       int64  `json:"records"` //messages sent to the client
+	Bytes         int64  `json:"bytes"`   //bytes sent to the client
+	DurationMs    int64  `json:"durationMs"`
+}
+
+var (
+	accesslogmu sync.Mutex
+	accesslog   io.Writer //nil disables the access log
+)
+
+//SetAccessLog sets where the access log is written. A nil writer disables it.
+func SetAccessLog(w io.Writer) {
+	accesslogmu.Lock()
+	defer accesslogmu.Unlock()
+	accesslog = w
+}
+
+//logAccess writes an entry for a query of the archive that started at startt
+func (fsa *fsarchive) logAccess(qp *queryParams, ta, tb time.Time, records, bytes int64, startt time.Time) {
+	accesslogmu.Lock()
+	defer accesslogmu.Unlock()
+	if accesslog == nil {
+		return
+	}
+	ent := AccessLogEntry{
+		Time:          startt.UTC().Format(time.RFC3339),
+		Collector:     fsa.collectorstr,
+		Descriminator: fsa.descriminator,
+		Start:         ta.UTC().Format(time.RFC3339),
+		End:           tb.UTC().Format(time.RFC3339),
+		Records:       records,
+		Bytes:         bytes,
+		DurationMs:    int64(time.Since(startt) / time.Millisecond),
+	}
+	if qp != nil {
+		ent.Remote = qp.remote
+	}
+	b, err := json.Marshal(ent)
+	if err != nil {
+		return
+	}
+	accesslog.Write(append(b, '\n'))
+}
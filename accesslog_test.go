@@ -0,0 +1,52 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	SetAccessLog(&buf)
+	defer SetAccessLog(nil)
+	ar := newTestArchive(t, quarterFiles)
+	values := testRange(5*time.Minute, 20*time.Minute)
+	values.Set("remoteaddr", "203.0.113.9")
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	//the query is over once its reply channel is closed
+	accesslogmu.Lock()
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	accesslogmu.Unlock()
+	if len(lines) != 1 {
+		t.Fatalf("got %d access log lines, want 1: %q", len(lines), buf.String())
+	}
+	var ent AccessLogEntry
+	if err := json.Unmarshal(lines[0], &ent); err != nil {
+		t.Fatalf("%s in %s", err, lines[0])
+	}
+	want := AccessLogEntry{
+		Time:          ent.Time,
+		Remote:        "203.0.113.9",
+		Collector:     "testcol",
+		Descriminator: "updates",
+		Start:         testEpoch.Add(5 * time.Minute).Format(time.RFC3339),
+		End:           testEpoch.Add(20 * time.Minute).Format(time.RFC3339),
+		Records:       int64(len(splitRecords(t, body))),
+		Bytes:         int64(len(body)),
+		DurationMs:    ent.DurationMs,
+	}
+	if ent != want {
+		t.Errorf("got the entry %+v, want %+v", ent, want)
+	}
+	if _, err := time.Parse(time.RFC3339, ent.Time); err != nil {
+		t.Errorf("the time of the entry: %s", err)
+	}
+	if want.Records == 0 {
+		t.Error("the query sent no records")
+	}
+}
@@ -0,0 +1,207 @@
+package bgparchive
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net/url"
+)
+
+var (
+	errunauth = errors.New("missing or wrong admin token")
+	errbadcmd = errors.New("unknown admin command. should be SCAN, RESCAN or FULLRESCAN")
+)
+
+//ArchiveAdmin lets an operator send scan commands to the archives over HTTP,
+//like after a manual backfill. Requests must carry the shared secret token
+//in an Authorization: Bearer header.
+type ArchiveAdmin struct {
+	ars   MrtArchives
+	token string
+	api.GetNotAllowed
+	api.PutNotAllowed
+	api.DeleteNotAllowed
+}
+
+//NewArchiveAdmin returns the admin resource of the archives. An empty token
+//rejects every request.
+func NewArchiveAdmin(ars MrtArchives, token string) *ArchiveAdmin {
+	return &ArchiveAdmin{ars: ars, token: token}
+}
+
+//AdminResult is the state of an archive after an admin command
+type AdminResult struct {
+	Collector     string `json:"collector"`
+	Descriminator string `json:"descriminator"`
+	FilesBefore   int    `json:"filesBefore"`
+	FilesAfter    int    `json:"filesAfter"`
+}
+
+//bearerAuthorized is true if the authorization value of the request carries
+//token in a Bearer header. An empty token authorizes nothing.
+func bearerAuthorized(values url.Values, token string) bool {
+	if token == "" {
+		return false
+	}
+	auth := []byte(values.Get("authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1
+}
+
+func (aa *ArchiveAdmin) authorized(values url.Values) bool {
+	return bearerAuthorized(values, aa.token)
+}
+
+//Post sends the cmd parameter to the archives of the collector and desc
+//parameters, or to all of them if they are not set, and replies once
+//every archive is done with it.
+func (aa *ArchiveAdmin) Post(values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	h := api.HdrReply{Code: 200, ContentType: "application/json"}
+	var (
+		err error
+		ars MrtArchives
+	)
+	cmd := values.Get("cmd")
+	if !aa.authorized(values) {
+		warnf("unauthorized admin request from %s", values.Get("remoteaddr"))
+		err = errunauth
+	} else if cmd != "SCAN" && cmd != "RESCAN" && cmd != "FULLRESCAN" {
+		err = errbadcmd
+	} else {
+		for _, ar := range aa.ars {
+			if c := values.Get("collector"); c != "" && c != ar.collectorstr {
+				continue
+			}
+			if d := values.Get("desc"); d != "" && d != ar.descriminator {
+				continue
+			}
+			ars = append(ars, ar)
+		}
+		if len(ars) == 0 {
+			err = errnoar
+		}
+	}
+	if err != nil {
+		h.Code = httpCode(err)
+		countRequestError(h.Code)
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}()
+		return h, retc
+	}
+	go func() {
+		defer close(retc)
+		res := make([]AdminResult, len(ars))
+		for i, ar := range ars {
+			res[i] = AdminResult{Collector: ar.collectorstr, Descriminator: ar.descriminator, FilesBefore: len(ar.getEntryFiles())}
+			infof("admin request from %s: %s on archive:%s", values.Get("remoteaddr"), cmd, ar.descriminator)
+			if !ar.requestDone(cmd) {
+				retc <- api.Reply{Data: nil, Err: errstopped}
+				return
+			}
+			res[i].FilesAfter = len(ar.getEntryFiles())
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			retc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+	}()
+	return h, retc
+}
+
+var errbadrevoke = errors.New("revoking sessions needs the id of a session or the ip of the sessions to revoke")
+
+//ArchiveSessions lets an operator see the continuous pulling sessions of the
+//archives and revoke them, like those of a client that keeps beginning new
+//ones. It takes the token of the admin resource.
+type ArchiveSessions struct {
+	admin *ArchiveAdmin
+	api.PutNotAllowed
+	api.PostNotAllowed
+}
+
+//NewArchiveSessions returns the sessions resource of the archives of the admin resource
+func NewArchiveSessions(aa *ArchiveAdmin) *ArchiveSessions {
+	return &ArchiveSessions{admin: aa}
+}
+
+//Get lists the sessions of the archives of the collector and desc parameters,
+//or of all of them if they are not set.
+func (as *ArchiveSessions) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return as.send(values, contCmd{cmd: CONT_LIST})
+}
+
+//Delete revokes the session of the id parameter, or all the sessions of the ip
+//parameter, in the archives of the collector and desc parameters, and replies
+//with the sessions it revoked.
+func (as *ArchiveSessions) Delete(values url.Values) (api.HdrReply, chan api.Reply) {
+	return as.send(values, contCmd{cmd: CONT_REVOKE, cli: contCli{id: values.Get("id"), ip: values.Get("ip")}})
+}
+
+//send routes cmd through the continuous pulling event loop of every archive it
+//applies to, and replies with the sessions they return.
+func (as *ArchiveSessions) send(values url.Values, cmd contCmd) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	h := api.HdrReply{Code: 200, ContentType: "application/json"}
+	var (
+		err error
+		ars MrtArchives
+	)
+	if !as.admin.authorized(values) {
+		warnf("unauthorized sessions request from %s", values.Get("remoteaddr"))
+		err = errunauth
+	} else if cmd.cmd == CONT_REVOKE && cmd.cli.id == "" && cmd.cli.ip == "" {
+		err = errbadrevoke
+	} else {
+		for _, ar := range as.admin.ars {
+			if c := values.Get("collector"); c != "" && c != ar.collectorstr {
+				continue
+			}
+			if d := values.Get("desc"); d != "" && d != ar.descriminator {
+				continue
+			}
+			ars = append(ars, ar)
+		}
+		if len(ars) == 0 {
+			err = errnoar
+		}
+	}
+	if err != nil {
+		h.Code = httpCode(err)
+		countRequestError(h.Code)
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}()
+		return h, retc
+	}
+	go func() {
+		defer close(retc)
+		res := []ContSession{}
+		for _, ar := range ars {
+			if cmd.cmd == CONT_REVOKE {
+				infof("admin request from %s: revoking sessions of id:%q ip:%q on archive:%s", values.Get("remoteaddr"), cmd.cli.id, cmd.cli.ip, ar.descriminator)
+			}
+			sessions, ok := ar.contRequest(cmd)
+			if !ok {
+				retc <- api.Reply{Data: nil, Err: errstopped}
+				return
+			}
+			for _, s := range sessions {
+				s.Collector, s.Descriminator = ar.collectorstr, ar.descriminator
+				res = append(res, s)
+			}
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			retc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+	}()
+	return h, retc
+}
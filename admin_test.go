@@ -0,0 +1,248 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//getResource is a resource whose Get is get, to query the other methods with testQuery
+type getResource struct {
+	get func(url.Values) (api.HdrReply, chan api.Reply)
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func (gr getResource) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return gr.get(values)
+}
+
+func TestArchiveAdmin(t *testing.T) {
+	dir, _ := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(dir)
+	ar := scanTestArchive(dir)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	defer wg.Wait()
+	defer ar.Close()
+	//a file backfilled after the scan
+	added := testFile{start: 45 * time.Minute, n: 15, step: time.Minute}
+	var data []byte
+	for _, rec := range added.records() {
+		data = append(data, rec...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "2013.01", added.name()), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	admin := getResource{get: NewArchiveAdmin(MrtArchives{ar}, "secret").Post}
+	auth := "Bearer secret"
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		code   int
+		res    []AdminResult
+	}{
+		{"no token", url.Values{"cmd": {"RESCAN"}}, 401, nil},
+		{"wrong token", url.Values{"cmd": {"RESCAN"}, "authorization": {"Bearer nope"}}, 401, nil},
+		{"unknown command", url.Values{"cmd": {"STOP"}, "authorization": {auth}}, 400, nil},
+		{"other collector", url.Values{"cmd": {"RESCAN"}, "authorization": {auth}, "collector": {"nope"}}, 404, nil},
+		{"rescan", url.Values{"cmd": {"RESCAN"}, "authorization": {auth}}, 200, []AdminResult{{"testcol", "updates", 3, 4}}},
+		{"rescan again", url.Values{"cmd": {"RESCAN"}, "authorization": {auth}, "desc": {"updates"}}, 200, []AdminResult{{"testcol", "updates", 4, 4}}},
+	} {
+		h, body, errs := testQuery(admin, tc.values)
+		if h.Code != tc.code {
+			t.Errorf("%s: got code %d and errors %v, want %d", tc.name, h.Code, errs, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var res []AdminResult
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("%s: %s in %s", tc.name, err, body)
+		}
+		if fmt.Sprint(res) != fmt.Sprint(tc.res) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, res, tc.res)
+		}
+	}
+	//the reply came once the rescan was done
+	if h, body, _ := testQuery(ar, testRange(added.start, added.start+15*time.Minute-time.Second)); h.Code != 200 || !bytes.Equal(body, data) {
+		t.Errorf("the backfilled file got code %d and %d bytes, want %d", h.Code, len(body), len(data))
+	}
+	//an admin without a token takes no requests
+	if h, _, _ := testQuery(getResource{get: NewArchiveAdmin(MrtArchives{ar}, "").Post}, url.Values{"cmd": {"RESCAN"}, "authorization": {"Bearer "}}); h.Code != 401 {
+		t.Errorf("the empty token got code %d", h.Code)
+	}
+}
+
+func TestArchiveSessions(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles[:1])
+	ar.contctx.Serve()
+	defer ar.contctx.Stop()
+	//two sessions of one client and one of another
+	ids := map[string][]string{}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}, "remoteaddr": {ip}})
+		if h.Code != 200 || h.Extra == "" || len(errs) != 0 {
+			t.Fatalf("got code %d id %q and errors %v", h.Code, h.Extra, errs)
+		}
+		ids[ip] = append(ids[ip], h.Extra)
+	}
+	sessions := NewArchiveSessions(NewArchiveAdmin(MrtArchives{ar}, "secret"))
+	auth := "Bearer secret"
+	for _, tc := range []struct {
+		name   string
+		revoke bool
+		values url.Values
+		code   int
+		ids    []string //of the sessions in the reply
+	}{
+		{"no token", false, url.Values{}, 401, nil},
+		{"wrong token", true, url.Values{"authorization": {"Bearer nope"}, "ip": {"192.0.2.2"}}, 401, nil},
+		{"list", false, url.Values{"authorization": {auth}}, 200, append(append([]string{}, ids["192.0.2.1"]...), ids["192.0.2.2"]...)},
+		{"other collector", false, url.Values{"authorization": {auth}, "collector": {"nope"}}, 404, nil},
+		{"revoke nothing", true, url.Values{"authorization": {auth}}, 400, nil},
+		{"revoke id of another ip", true, url.Values{"authorization": {auth}, "id": {ids["192.0.2.1"][0]}, "ip": {"192.0.2.2"}}, 200, []string{}},
+		{"revoke id", true, url.Values{"authorization": {auth}, "id": {ids["192.0.2.1"][0]}}, 200, ids["192.0.2.1"][:1]},
+		{"revoke ip", true, url.Values{"authorization": {auth}, "ip": {"192.0.2.2"}}, 200, ids["192.0.2.2"]},
+		{"revoke again", true, url.Values{"authorization": {auth}, "ip": {"192.0.2.2"}}, 200, []string{}},
+		{"list left", false, url.Values{"authorization": {auth}, "collector": {"testcol"}, "desc": {"updates"}}, 200, ids["192.0.2.1"][1:]},
+	} {
+		get := sessions.Get
+		if tc.revoke {
+			get = sessions.Delete
+		}
+		h, body, errs := testQuery(getResource{get: get}, tc.values)
+		if h.Code != tc.code {
+			t.Errorf("%s: got code %d and errors %v, want %d", tc.name, h.Code, errs, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var res []ContSession
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("%s: %s in %s", tc.name, err, body)
+		}
+		got := []string{}
+		for _, s := range res {
+			if s.Collector != "testcol" || s.Descriminator != "updates" || s.AgeSec < 0 {
+				t.Errorf("%s: got the session %+v", tc.name, s)
+			}
+			got = append(got, s.Id)
+		}
+		want := append([]string{}, tc.ids...)
+		sort.Strings(got)
+		sort.Strings(want)
+		if len(got) != len(want) {
+			t.Errorf("%s: got the sessions %v, want %v", tc.name, got, want)
+			continue
+		}
+		for k := range got {
+			if got[k] != want[k] {
+				t.Errorf("%s: got the sessions %v, want %v", tc.name, got, want)
+				break
+			}
+		}
+	}
+	//the revoked sessions can't pull anymore
+	for ip, sids := range ids {
+		for k, id := range sids {
+			h, _, _ := testQuery(ar, url.Values{"continuous": {id}, "remoteaddr": {ip}})
+			if revoked := h.Code == 404; revoked != (ip == "192.0.2.2" || k == 0) {
+				t.Errorf("session %s of %s: got code %d", id, ip, h.Code)
+			}
+		}
+	}
+}
+
+func TestArchiveSessionsStopped(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles[:1])
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	ar.Close()
+	wg.Wait()
+	sessions := NewArchiveSessions(NewArchiveAdmin(MrtArchives{ar}, "secret"))
+	auth := url.Values{"authorization": {"Bearer secret"}, "ip": {"192.0.2.1"}}
+	for name, get := range map[string]func(url.Values) (api.HdrReply, chan api.Reply){"list": sessions.Get, "revoke": sessions.Delete} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h, _, errs := testQuery(getResource{get: get}, auth)
+			if h.Code != 200 || len(errs) != 1 || errs[0] != errstopped {
+				t.Errorf("%s: got code %d and errors %v", name, h.Code, errs)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the request to a stopped archive blocked", name)
+		}
+	}
+}
+
+//TestRevokeExpiring revokes the sessions of a client while their timers fire,
+//so that the expiries reach the event loop after the sessions are gone.
+func TestRevokeExpiring(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles[:1])
+	savepath := filepath.Join(t.TempDir(), "sessions")
+	//the saved sessions all expire 50ms after the load
+	expiry := time.Now().Add(50 * time.Millisecond)
+	saved := make([]contSession, CONTCLISZ)
+	for k := range saved {
+		pulled := expiry.Add(-CONT_TIMEOUT)
+		saved[k] = contSession{Id: fmt.Sprintf("%032x", k), Ip: "192.0.2.1", T1pull: pulled, Begun: pulled}
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(savepath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var wg, scanwg sync.WaitGroup
+	ar.SetContSavePath(savepath)
+	ar.Serve(&wg, &scanwg)
+	sessions := NewArchiveSessions(NewArchiveAdmin(MrtArchives{ar}, "secret"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		//keep the event loop busy until the timers have fired and the revoke waits
+		busy := contCmd{cmd: CONT_LIST, sess: make(chan []ContSession)}
+		ar.contctx.reqch <- busy
+		time.Sleep(time.Until(expiry.Add(50 * time.Millisecond)))
+		revoked := make(chan struct{})
+		go func() {
+			defer close(revoked)
+			h, _, errs := testQuery(getResource{get: sessions.Delete}, url.Values{"authorization": {"Bearer secret"}, "ip": {"192.0.2.1"}})
+			if h.Code != 200 || len(errs) != 0 {
+				t.Errorf("revoking got code %d and errors %v", h.Code, errs)
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		<-busy.sess
+		<-revoked
+		h, body, errs := testQuery(getResource{get: sessions.Get}, url.Values{"authorization": {"Bearer secret"}})
+		if h.Code != 200 || len(errs) != 0 || string(body) != "[]\n" {
+			t.Errorf("got code %d sessions %s and errors %v after the revoke", h.Code, body, errs)
+		}
+		ar.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("revoking expiring sessions blocked the event loop")
+	}
+	wg.Wait()
+}
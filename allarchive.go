@@ -0,0 +1,207 @@
+package bgparchive
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//allarchive queries all the registered mrt archives at once and merges
+//their messages into a single stream ordered by time.
+type allarchive struct {
+	ars []*fsarchive
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewAllArchive(ars MrtArchives) *allarchive {
+	aa := &allarchive{}
+	for _, ar := range ars {
+		aa.ars = append(aa.ars, ar.fsarchive)
+	}
+	return aa
+}
+
+func (aa *allarchive) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return aa.GetContext(context.Background(), values)
+}
+
+func (aa *allarchive) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	h := api.HdrReply{Code: 200}
+	if f, ok := lookupFormat(values.Get("format")); ok {
+		h.ContentType = f.contentType
+	}
+	sub, err := aa.selectCollectors(values["collectors"])
+	if err != nil {
+		h.Code = httpCode(err)
+		countRequestError(h.Code)
+		retc := make(chan api.Reply)
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}()
+		return h, retc
+	}
+	return getTimerange(ctx, values, sub, h)
+}
+
+//selectCollectors returns an allarchive of the archives of the collectors,
+//which can be repeated or comma separated values. No collectors selects all.
+func (aa *allarchive) selectCollectors(cvals []string) (*allarchive, error) {
+	want := make(map[string]bool)
+	for _, cv := range cvals {
+		for _, c := range strings.Split(cv, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				want[c] = true
+			}
+		}
+	}
+	if len(want) == 0 {
+		return aa, nil
+	}
+	sub := &allarchive{}
+	found := make(map[string]bool)
+	for _, ar := range aa.ars {
+		if want[ar.GetCollectorString()] {
+			sub.ars = append(sub.ars, ar)
+			found[ar.GetCollectorString()] = true
+		}
+	}
+	for c := range want {
+		if !found[c] {
+			return nil, fmt.Errorf("unknown collector:%s. valid collectors are %s", c, strings.Join(aa.collectors(), ","))
+		}
+	}
+	return sub, nil
+}
+
+//collectors returns the names of the collectors of the archives, sorted
+func (aa *allarchive) collectors() []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, ar := range aa.ars {
+		if c := ar.GetCollectorString(); !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//getFileIndexRange only checks that at least one archive can serve the range.
+//the files are looked up by every archive when it is queried.
+func (aa *allarchive) getFileIndexRange(ta, tb time.Time) (TimeEntrySlice, int, int, error) {
+	err := errempty
+	for _, ar := range aa.ars {
+		if _, _, _, err = ar.getFileIndexRange(ta, tb); err == nil {
+			return nil, 0, 0, nil
+		}
+	}
+	return nil, 0, 0, err
+}
+
+//msgTimestamp returns the MRT header timestamp of a reply
+func msgTimestamp(r api.Reply) uint32 {
+	if len(r.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(r.Data)
+}
+
+//Query fires a raw MRT query on every archive that has the range, and merges
+//the replies by their timestamps. The limit and the json lines and headers only
+//formats are applied after the merge so that they see the messages in their final order.
+func (aa *allarchive) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("all archives query from %s to %s\n", ta, tb)
+	//Always add to the waitgroup before calling the go statement.
+	wg.Add(1)
+	go func(rc chan<- api.Reply) {
+		defer wg.Done()
+		var (
+			sub   *queryParams
+			trans transformer
+			ins   []chan api.Reply
+		)
+		if qp != nil {
+			cp := *qp
+			cp.limit, cp.sent, cp.format, cp.hdrsonly, cp.normalize = 0, 0, "", false, ""
+			cp.span = nil //only the messages that make it past the merge are sent
+			sub = &cp
+			if qp.format != "" || qp.hdrsonly || qp.normalize != "" {
+				trans = newQueryTransformer(qp)
+			}
+		}
+		for _, ar := range aa.ars {
+			if _, _, _, err := ar.getFileIndexRange(ta, tb); err != nil {
+				continue
+			}
+			in := make(chan api.Reply, FILE_REPLY_BUFSZ)
+			go func(ar *fsarchive) {
+				defer close(in)
+				transformAndSendBytes(ar, ta, tb, sub, in, nil, 0)
+			}(ar)
+			ins = append(ins, in)
+		}
+		//if we stop early the archives still running must not block on their channels
+		defer func() {
+			for _, in := range ins {
+				go func(in chan api.Reply) {
+					for range in {
+					}
+				}(in)
+			}
+		}()
+		heads := make([]api.Reply, len(ins))
+		live := make([]bool, len(ins))
+		for n, in := range ins {
+			heads[n], live[n] = <-in
+		}
+		for {
+			next := -1
+			for n := range heads {
+				if !live[n] {
+					continue
+				}
+				if heads[n].Err != nil { //errors are sent as soon as they show up
+					next = n
+					break
+				}
+				if next == -1 {
+					next = n
+					continue
+				}
+				a, b := msgTimestamp(heads[n]), msgTimestamp(heads[next])
+				if (!qp.isDesc() && a < b) || (qp.isDesc() && a > b) {
+					next = n
+				}
+			}
+			if next == -1 {
+				return
+			}
+			r := heads[next]
+			heads[next], live[next] = <-ins[next]
+			if r.Err == nil {
+				if !qp.take() {
+					return
+				}
+				qp.sentAt(msgTimestamp(r))
+				if trans != nil {
+					r.Data, r.Err = trans(r.Data)
+				}
+			}
+			select {
+			case rc <- r:
+			case <-qp.doneChan():
+				return
+			}
+		}
+	}(retc)
+}
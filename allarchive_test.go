@@ -0,0 +1,96 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//collectorArchive returns an archive of the collector with the updates of the peer,
+//one every 20 seconds from the offset for 10 minutes
+func collectorArchive(t *testing.T, col, peer string, offset time.Duration) *mrtarchive {
+	var recs [][]byte
+	for d := offset; d < 10*time.Minute; d += 20 * time.Second {
+		recs = append(recs, bgp4mpUpdate(testTs(d), 3356, peer, []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil))
+	}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 15 * time.Minute, n: 1}})
+	ar.collectorstr = col
+	return ar
+}
+
+//peerCounts returns the number of records of every peer in the reply, and
+//whether their timestamps never decrease
+func peerCounts(t *testing.T, body []byte) (map[string]int, bool) {
+	counts, sorted, last := make(map[string]int), true, uint32(0)
+	for _, rec := range splitRecords(t, body) {
+		counts[net.IP(rec[24:28]).String()]++
+		ts := binary.BigEndian.Uint32(rec)
+		sorted = sorted && ts >= last
+		last = ts
+	}
+	return counts, sorted
+}
+
+func TestAllArchiveMerge(t *testing.T) {
+	ars := MrtArchives{
+		collectorArchive(t, "col1", "192.0.2.1", 0),
+		collectorArchive(t, "col2", "192.0.2.2", 5*time.Second),
+	}
+	h, body, errs := testQuery(NewAllArchive(ars), testRange(0, 10*time.Minute))
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	counts, sorted := peerCounts(t, body)
+	if counts["192.0.2.1"] != 30 || counts["192.0.2.2"] != 30 || len(counts) != 2 {
+		t.Errorf("got the records of the peers %v, want 30 of each archive", counts)
+	}
+	if !sorted {
+		t.Error("the merged records are not ordered by time")
+	}
+}
+
+func TestAllArchiveCollectors(t *testing.T) {
+	aa := NewAllArchive(MrtArchives{
+		collectorArchive(t, "col1", "192.0.2.1", 0),
+		collectorArchive(t, "col2", "192.0.2.2", 5*time.Second),
+		collectorArchive(t, "col3", "192.0.2.3", 10*time.Second),
+	})
+	for _, tc := range []struct {
+		name       string
+		collectors []string
+		peers      []string
+	}{
+		{"all", nil, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{"comma separated", []string{"col1,col3"}, []string{"192.0.2.1", "192.0.2.3"}},
+		{"repeated", []string{"col3", "col2"}, []string{"192.0.2.2", "192.0.2.3"}},
+		{"one", []string{" col2 "}, []string{"192.0.2.2"}},
+	} {
+		values := testRange(0, 10*time.Minute)
+		values["collectors"] = tc.collectors
+		h, body, errs := testQuery(aa, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+			continue
+		}
+		counts, sorted := peerCounts(t, body)
+		if len(counts) != len(tc.peers) || !sorted {
+			t.Errorf("%s: got the records of the peers %v sorted:%v, want %v", tc.name, counts, sorted, tc.peers)
+		}
+		for _, p := range tc.peers {
+			if counts[p] == 0 {
+				t.Errorf("%s: no records of the peer %s", tc.name, p)
+			}
+		}
+	}
+	values := testRange(0, 10*time.Minute)
+	values["collectors"] = []string{"col1,col4"}
+	h, _, errs := testQuery(aa, values)
+	if h.Code != 400 || len(errs) != 1 || !strings.Contains(errs[0].Error(), "col4") || !strings.Contains(errs[0].Error(), "col1,col2,col3") {
+		t.Errorf("an unknown collector got code %d and errors %v", h.Code, errs)
+	}
+	if _, err := aa.selectCollectors([]string{"col2", "col2,"}); err != nil {
+		t.Errorf("a repeated collector got the error %s", err)
+	}
+}
@@ -0,0 +1,53 @@
+package bgparchive
+
+import (
+	"math"
+)
+
+//ANOMALY_WINDOW is how many of the previous stats buckets the moving average
+//and standard deviation of the anomaly detection are computed over.
+const ANOMALY_WINDOW = 60
+
+//ANOMALY_MIN_BUCKETS is how many buckets have to be seen before any is flagged
+const ANOMALY_MIN_BUCKETS = 10
+
+//anomalyDetector flags the stats buckets with more messages than the mean
+//plus k standard deviations of the buckets before them.
+type anomalyDetector struct {
+	k      float64
+	window [ANOMALY_WINDOW]float64 //ring of the previous totals
+	next   int
+	n      int //number of totals in the window
+}
+
+func newAnomalyDetector(k float64) *anomalyDetector {
+	return &anomalyDetector{k: k}
+}
+
+//check returns true if the total is anomalous and adds it to the window.
+//a nil detector never flags anything.
+func (ad *anomalyDetector) check(total int) bool {
+	if ad == nil {
+		return false
+	}
+	v := float64(total)
+	anomalous := false
+	if ad.n >= ANOMALY_MIN_BUCKETS {
+		var sum, sqsum float64
+		for _, w := range ad.window[:ad.n] {
+			sum += w
+		}
+		mean := sum / float64(ad.n)
+		for _, w := range ad.window[:ad.n] {
+			sqsum += (w - mean) * (w - mean)
+		}
+		std := math.Sqrt(sqsum / float64(ad.n))
+		anomalous = v > mean+ad.k*std
+	}
+	ad.window[ad.next] = v
+	ad.next = (ad.next + 1) % ANOMALY_WINDOW
+	if ad.n < ANOMALY_WINDOW {
+		ad.n++
+	}
+	return anomalous
+}
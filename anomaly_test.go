@@ -0,0 +1,91 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	//a noisy baseline of 10 and 12
+	var baseline []int
+	for k := 0; k < 20; k++ {
+		baseline = append(baseline, 10+2*(k%2))
+	}
+	bursts := append([]int{}, baseline...)
+	bursts[5], bursts[15] = 30, 30
+	for _, tc := range []struct {
+		name   string
+		totals []int
+		k      float64
+		want   []int
+	}{
+		{"baseline", baseline, 3, nil},
+		//the first burst comes before ANOMALY_MIN_BUCKETS
+		{"bursts", bursts, 3, []int{15}},
+		//the 12s are one standard deviation over the mean of the 10s and 12s
+		{"low k", baseline, 0.5, []int{11, 13, 15, 17, 19}},
+	} {
+		var flagged []int
+		ad := newAnomalyDetector(tc.k)
+		for k, total := range tc.totals {
+			if ad.check(total) {
+				flagged = append(flagged, k)
+			}
+		}
+		if !reflect.DeepEqual(flagged, tc.want) {
+			t.Errorf("%s: got the anomalies %v, want %v", tc.name, flagged, tc.want)
+		}
+	}
+	var ad *anomalyDetector
+	if ad.check(1000) {
+		t.Error("a nil detector flagged a total")
+	}
+}
+
+func TestStatsAnomalies(t *testing.T) {
+	//a message a minute and a burst of 50 in the minute 20
+	var recs [][]byte
+	for m := 0; m < 30; m++ {
+		n := 1
+		if m == 20 {
+			n = 50
+		}
+		for k := 0; k < n; k++ {
+			recs = append(recs, bgp4mpUpdate(testTs(time.Duration(m)*time.Minute+time.Duration(k)*time.Second), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil))
+		}
+	}
+	st := NewFsarstat(newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 30 * time.Minute, n: 1}}).fsarchive)
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		want   []int
+	}{
+		{"off", url.Values{"bucket": {"60"}}, nil},
+		{"burst", url.Values{"bucket": {"60"}, "anomaly": {"3"}}, []int{20}},
+		{"streamed", url.Values{"bucket": {"60"}, "anomaly": {"3"}, "stream": {"true"}}, []int{20}},
+	} {
+		values := testRange(0, 30*time.Minute-time.Second)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		var stats BgpStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("%s: %s in %s", tc.name, err, body)
+		}
+		if !reflect.DeepEqual(stats.Anomalies, tc.want) {
+			t.Errorf("%s: got the anomalies %v, want %v", tc.name, stats.Anomalies, tc.want)
+		}
+	}
+	for _, bad := range []string{"0", "-1", "x"} {
+		if h, _, _ := testQuery(st, url.Values{"start": {"20130101000000"}, "end": {"20130101001000"}, "anomaly": {bad}}); h.Code != 400 {
+			t.Errorf("the anomaly %s got code %d", bad, h.Code)
+		}
+	}
+}
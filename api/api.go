@@ -1,11 +1,18 @@
 package api
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -18,15 +25,58 @@ const (
 //we now need to wrap the integer HTTP Reply code in this struct
 //to be able to support the correct ID for the continuous pulling scheme
 type HdrReply struct {
-	Code  int
-	Extra string
+	Code          int
+	Extra         string
+	ContentType   string
+	RetryAfter    int    //seconds. sets the Retry-After header when not zero
+	ContentLength int64  //sets the Content-Length header when not zero
+	ContentRange  string //sets the Content-Range header of 206 and 416 replies
+	Filename      string //sets a Content-Disposition header that downloads the reply as this file
+	Cache         string //sets the X-Cache header, HIT or MISS for replies that can be cached
+	AcceptRanges  bool   //the resource accepts a Range header for this reply
+	ETag          string //sets the ETag header. requests with a matching If-None-Match get a 304
+	//sets the Last-Modified header when not zero. requests with an
+	//If-Modified-Since that is not before it get a 304
+	LastModified time.Time
+	//Trailers are the names of the trailers that TrailerValues returns
+	//once all the data is sent. Empty values are left out.
+	Trailers      []string
+	TrailerValues func() map[string]string
 }
 
+//STREAM_ERROR_TRAILER is the HTTP trailer that carries the first error
+//sent in a reply, for clients that can't look for errors in the data.
+const STREAM_ERROR_TRAILER = "X-Stream-Error"
+
 type Reply struct {
 	Data []byte
 	Err  error
 }
 
+//StatusCoder can be implemented by the errors sent in a Reply to
+//set the code of the JSON error object they are written as.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+//JsonError is how errors are written in replies with a JSON content type
+type JsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+func errorBytes(err error, jsonerr bool) []byte {
+	if !jsonerr {
+		return []byte(fmt.Sprintf("%s\n", err))
+	}
+	jerr := JsonError{Error: err.Error(), Code: 500}
+	if sc, ok := err.(StatusCoder); ok {
+		jerr.Code = sc.StatusCode()
+	}
+	b, _ := json.Marshal(jerr)
+	return append(b, '\n')
+}
+
 type Resource interface {
 	Get(url.Values) (HdrReply, chan Reply)
 	Put(url.Values) (HdrReply, chan Reply)
@@ -34,6 +84,20 @@ type Resource interface {
 	Delete(url.Values) (HdrReply, chan Reply)
 }
 
+//ContextGetter can be implemented by resources whose Get should stop
+//sending data once the client has gone away. The context passed is
+//the one of the HTTP request.
+type ContextGetter interface {
+	GetContext(context.Context, url.Values) (HdrReply, chan Reply)
+}
+
+//BodyPoster can be implemented by resources whose Post reads the body of
+//the request, like file uploads. The body is only valid until the reply
+//channel is closed.
+type BodyPoster interface {
+	PostBody(io.Reader, url.Values) (HdrReply, chan Reply)
+}
+
 type (
 	GetNotAllowed    struct{}
 	PutNotAllowed    struct{}
@@ -61,6 +125,25 @@ type API struct {
 	mux *http.ServeMux
 }
 
+var debug int32 //accessed atomically. see SetDebug
+
+//SetDebug turns the logging of every request and of the errors sent in
+//the replies on or off. It is off by default.
+func SetDebug(a bool) {
+	var d int32
+	if a {
+		d = 1
+	}
+	atomic.StoreInt32(&debug, d)
+}
+
+func debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debug) == 0 {
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, v...))
+}
+
 func NewAPI() *API {
 	return &API{http.NewServeMux()}
 }
@@ -71,48 +154,182 @@ func (api *API) requestHandlerFunc(resource Resource) http.HandlerFunc {
 			datac chan Reply
 			code  HdrReply
 		)
-		log.Printf("--Request From:%s --", req.RemoteAddr)
+		debugf("--Request From:%s --", req.RemoteAddr)
 		req.ParseForm()
 		method := req.Method
 		vals := req.Form
 		//here i plug the remote address in the vals map for the Get function to have
 		ip := strings.Split(req.RemoteAddr, ":") //split cause it's ip:port
 		vals["remoteaddr"] = ip
+		//the Authorization header is always set, so that it can't come from the URL
+		vals["authorization"] = []string{req.Header.Get("Authorization")}
+		//and so is the Range header, for the resources that can send part of a reply
+		if rhdr := req.Header.Get("Range"); rhdr != "" {
+			vals["rangeheader"] = []string{rhdr}
+		} else {
+			delete(vals, "rangeheader")
+		}
 		switch method {
 		case GET:
-			code, datac = resource.Get(vals)
+			if cg, ok := resource.(ContextGetter); ok {
+				code, datac = cg.GetContext(req.Context(), vals)
+			} else {
+				code, datac = resource.Get(vals)
+			}
 		case PUT:
 			code, datac = resource.Put(vals)
 		case POST:
-			code, datac = resource.Post(vals)
+			if bp, ok := resource.(BodyPoster); ok {
+				code, datac = bp.PostBody(req.Body, vals)
+			} else {
+				code, datac = resource.Post(vals)
+			}
 		case DELETE:
 			code, datac = resource.Delete(vals)
 		}
 		if code.Extra != "" { //he have a uuid for continuous pulling
 			rw.Header().Set("Next-Pull-ID", code.Extra)
 		}
+		if code.ContentType != "" {
+			rw.Header().Set("Content-Type", code.ContentType)
+		}
+		if code.RetryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(code.RetryAfter))
+		}
+		if code.ContentLength > 0 {
+			rw.Header().Set("Content-Length", strconv.FormatInt(code.ContentLength, 10))
+		}
+		if code.ContentRange != "" {
+			rw.Header().Set("Content-Range", code.ContentRange)
+		}
+		if code.Cache != "" {
+			rw.Header().Set("X-Cache", code.Cache)
+		}
+		if code.Filename != "" {
+			rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", code.Filename))
+		}
+		if code.AcceptRanges {
+			rw.Header().Set("Accept-Ranges", "bytes")
+		}
+		if code.ETag != "" {
+			rw.Header().Set("ETag", code.ETag)
+		}
+		if !code.LastModified.IsZero() {
+			rw.Header().Set("Last-Modified", code.LastModified.UTC().Format(http.TimeFormat))
+		}
 		//set the CORS header
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		if code.Code == 200 && notModified(req, code) {
+			if datac != nil { //let the resource finish sending
+				go func() {
+					for range datac {
+					}
+				}()
+			}
+			rw.WriteHeader(304)
+			return
+		}
+		var w io.Writer = rw
+		//a 204 has no body to compress or to carry trailers
+		body := datac != nil && code.Code != http.StatusNoContent
+		//the ranges of a partial reply are of the uncompressed data
+		if body && code.ContentRange == "" && wantsGzip(req, vals) {
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Header().Add("Vary", "Accept-Encoding")
+			rw.Header().Del("Content-Length")
+			gzw := gzip.NewWriter(rw)
+			defer gzw.Close()
+			w = gzw
+		}
+		//a reply with a Content-Length can't have trailers
+		trailer := body && code.ContentLength == 0
+		if trailer {
+			rw.Header().Set("Trailer", strings.Join(append([]string{STREAM_ERROR_TRAILER}, code.Trailers...), ", "))
+		}
 		rw.WriteHeader(code.Code)
 		if datac != nil { // we got a proper channel to get datafrom
+			//errors in JSON replies are JSON objects so that clients can still parse the reply
+			jsonerr := strings.Contains(code.ContentType, "json")
 			//go func(dc <-chan Reply) { // fire a goroutine that will end upon the chan getting closed
 			for r := range datac {
 				if r.Err == nil {
-					rw.Write(r.Data)
+					w.Write(r.Data)
 				} else {
-					log.Printf("Error in received from data channel:%s\n", r.Err)
-					rw.Write([]byte(fmt.Sprintf("%s\n", r.Err)))
+					debugf("Error in received from data channel:%s\n", r.Err)
+					w.Write(errorBytes(r.Err, jsonerr))
+					if trailer && rw.Header().Get(STREAM_ERROR_TRAILER) == "" {
+						rw.Header().Set(STREAM_ERROR_TRAILER, r.Err.Error())
+					}
 				}
 			}
 			//}(datac)
+			if trailer && code.TrailerValues != nil {
+				for k, v := range code.TrailerValues() {
+					if v != "" {
+						rw.Header().Set(k, v)
+					}
+				}
+			}
 		}
 	}
 }
 
+//notModified is true if the conditional headers of the request say that the
+//client already has the reply. If-None-Match takes precedence over If-Modified-Since.
+func notModified(req *http.Request, code HdrReply) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if code.ETag == "" {
+			return false
+		}
+		//the comparison is weak, so W/ prefixes are ignored
+		etag := strings.TrimPrefix(code.ETag, "W/")
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !code.LastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		//the header has a resolution of seconds
+		return err == nil && !code.LastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+//wantsGzip is true if the client asked for a gzip compressed reply either
+//with the Accept-Encoding header or with the compress=gzip parameter.
+func wantsGzip(req *http.Request, vals url.Values) bool {
+	if vals.Get("compress") == "gzip" {
+		return true
+	}
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.Index(enc, ";"); i != -1 { //ignore the qvalue unless it's zero
+			if strings.Replace(enc[i+1:], " ", "", -1) == "q=0" {
+				continue
+			}
+			enc = enc[:i]
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
 func (api *API) AddResource(resource Resource, path string) {
 	api.mux.HandleFunc(path, api.requestHandlerFunc(resource))
 }
 
+//AddHandler mounts a plain http.Handler, for endpoints that are
+//not RESTful resources like metrics.
+func (api *API) AddHandler(handler http.Handler, path string) {
+	api.mux.Handle(path, handler)
+}
+
 func (api *API) Start(port int) {
 	portstr := fmt.Sprintf(":%d", port)
 	http.ListenAndServe(portstr, api.mux)
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//replyResource replies to a Get with the header and the replies
+type replyResource struct {
+	h       HdrReply
+	replies []Reply
+	PutNotAllowed
+	PostNotAllowed
+	DeleteNotAllowed
+}
+
+func (rr *replyResource) Get(url.Values) (HdrReply, chan Reply) {
+	retc := make(chan Reply)
+	go func() {
+		defer close(retc)
+		for _, r := range rr.replies {
+			retc <- r
+		}
+	}()
+	return rr.h, retc
+}
+
+func TestStreamErrors(t *testing.T) {
+	data := []byte("0123456789")
+	errfirst, errsecond := errors.New("file:a stopped early"), errors.New("file:b stopped early")
+	for _, tc := range []struct {
+		name    string
+		h       HdrReply
+		replies []Reply
+		trailer string //the X-Stream-Error trailer
+		body    string
+	}{
+		{"no errors", HdrReply{Code: 200}, []Reply{{Data: data}, {Data: data}}, "", string(data) + string(data)},
+		{"raw", HdrReply{Code: 200}, []Reply{{Data: data}, {Err: errfirst}, {Data: data}, {Err: errsecond}}, errfirst.Error(),
+			string(data) + errfirst.Error() + "\n" + string(data) + errsecond.Error() + "\n"},
+		{"json", HdrReply{Code: 200, ContentType: "application/json"}, []Reply{{Data: data}, {Err: errfirst}}, errfirst.Error(),
+			string(data) + `{"error":"file:a stopped early","code":500}` + "\n"},
+		//a reply with a Content-Length can't have trailers
+		{"content length", HdrReply{Code: 200, ContentLength: int64(len(data))}, []Reply{{Data: data}}, "", string(data)},
+	} {
+		a := NewAPI()
+		a.AddResource(&replyResource{h: tc.h, replies: tc.replies}, "/")
+		srv := httptest.NewServer(a.mux)
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got the body %q, want %q", tc.name, body, tc.body)
+		}
+		if got := resp.Trailer.Get(STREAM_ERROR_TRAILER); got != tc.trailer {
+			t.Errorf("%s: got the trailer %q, want %q", tc.name, got, tc.trailer)
+		}
+		//the client moves the announced trailers to resp.Trailer
+		if _, announced := resp.Trailer[STREAM_ERROR_TRAILER]; announced != (tc.h.ContentLength == 0) {
+			t.Errorf("%s: the trailer is announced:%v with a Content-Length of %d", tc.name, announced, tc.h.ContentLength)
+		}
+		if strings.Contains(tc.h.ContentType, "json") {
+			for _, line := range strings.Split(strings.TrimSpace(strings.TrimPrefix(string(body), string(data))), "\n") {
+				var je JsonError
+				if err := json.Unmarshal([]byte(line), &je); err != nil {
+					t.Errorf("%s: %s in %s", tc.name, err, line)
+				}
+			}
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, tc := range []struct {
+		name   string
+		query  string
+		accept string
+		gzip   bool
+	}{
+		{"plain", "", "", false},
+		{"parameter", "?compress=gzip", "", true},
+		{"header", "", "gzip", true},
+		{"header list", "", "deflate, gzip;q=0.5", true},
+		{"refused", "", "gzip;q=0", false},
+		{"other", "", "br", false},
+	} {
+		a := NewAPI()
+		a.AddResource(&replyResource{h: HdrReply{Code: 200}, replies: []Reply{{Data: data[:5000]}, {Data: data[5000:]}}}, "/")
+		srv := httptest.NewServer(a.mux)
+		req, _ := http.NewRequest(GET, srv.URL+tc.query, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept-Encoding", tc.accept)
+		}
+		//keep the client from asking for and decompressing gzip itself
+		resp, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gz := resp.Header.Get("Content-Encoding") == "gzip"; gz != tc.gzip {
+			t.Errorf("%s: got a gzip reply:%v, want %v", tc.name, gz, tc.gzip)
+			continue
+		}
+		if tc.gzip {
+			gzr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+				continue
+			}
+			if body, err = ioutil.ReadAll(gzr); err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+				continue
+			}
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("%s: got %d bytes that differ from the %d sent", tc.name, len(body), len(data))
+		}
+	}
+}
+
+//codeError is an error with a status code for the JSON error objects
+type codeError int
+
+func (c codeError) Error() string {
+	return "bad request"
+}
+
+func (c codeError) StatusCode() int {
+	return int(c)
+}
+
+func TestErrorBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     error
+		jsonerr bool
+		want    string
+	}{
+		{"raw", errors.New("bad \"start\""), false, "bad \"start\"\n"},
+		{"json", errors.New("bad \"start\""), true, `{"error":"bad \"start\"","code":500}` + "\n"},
+		{"status code", codeError(400), true, `{"error":"bad request","code":400}` + "\n"},
+		{"raw status code", codeError(400), false, "bad request\n"},
+	} {
+		if got := string(errorBytes(tc.err, tc.jsonerr)); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	mod := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		h      HdrReply
+		header string
+		value  string
+		code   int
+	}{
+		{"unconditional", HdrReply{Code: 200, ETag: `W/"a"`}, "", "", 200},
+		{"same tag", HdrReply{Code: 200, ETag: `W/"a"`}, "If-None-Match", `W/"a"`, 304},
+		{"strong tag", HdrReply{Code: 200, ETag: `W/"a"`}, "If-None-Match", `"a"`, 304},
+		{"tag list", HdrReply{Code: 200, ETag: `W/"a"`}, "If-None-Match", `W/"b", W/"a"`, 304},
+		{"any tag", HdrReply{Code: 200, ETag: `W/"a"`}, "If-None-Match", "*", 304},
+		{"other tag", HdrReply{Code: 200, ETag: `W/"a"`}, "If-None-Match", `W/"b"`, 200},
+		{"no tag", HdrReply{Code: 200}, "If-None-Match", `W/"a"`, 200},
+		{"not modified since", HdrReply{Code: 200, LastModified: mod.Add(500 * time.Millisecond)}, "If-Modified-Since", mod.Format(http.TimeFormat), 304},
+		{"modified since", HdrReply{Code: 200, LastModified: mod.Add(time.Second)}, "If-Modified-Since", mod.Format(http.TimeFormat), 200},
+		{"error", HdrReply{Code: 400, ETag: `W/"a"`}, "If-None-Match", `W/"a"`, 400},
+	} {
+		a := NewAPI()
+		a.AddResource(&replyResource{h: tc.h, replies: []Reply{{Data: []byte("conf")}}}, "/")
+		srv := httptest.NewServer(a.mux)
+		req, _ := http.NewRequest(GET, srv.URL, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got code %d, want %d", tc.name, resp.StatusCode, tc.code)
+		}
+		if resp.StatusCode == 304 && len(body) != 0 {
+			t.Errorf("%s: got a body of %d bytes with a 304", tc.name, len(body))
+		}
+		if got := resp.Header.Get("ETag"); got != tc.h.ETag {
+			t.Errorf("%s: got the ETag %q, want %q", tc.name, got, tc.h.ETag)
+		}
+	}
+}
+
+//valsResource keeps the values of the last Get
+type valsResource struct {
+	vals url.Values
+	replyResource
+}
+
+func (vr *valsResource) Get(vals url.Values) (HdrReply, chan Reply) {
+	vr.vals = vals
+	return vr.replyResource.Get(vals)
+}
+
+func TestHeaderValues(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rng   string //the Range header
+		query string
+		want  []string //the rangeheader value
+	}{
+		{"header", "bytes=0-1", "", []string{"bytes=0-1"}},
+		{"no header", "", "", nil},
+		//the values of the headers can't come from the URL
+		{"url", "", "?rangeheader=bytes%3D0-1&authorization=Bearer+a", nil},
+		{"header and url", "bytes=2-3", "?rangeheader=bytes%3D0-1", []string{"bytes=2-3"}},
+	} {
+		vr := &valsResource{replyResource: replyResource{h: HdrReply{Code: 200}}}
+		a := NewAPI()
+		a.AddResource(vr, "/")
+		srv := httptest.NewServer(a.mux)
+		req, _ := http.NewRequest(GET, srv.URL+tc.query, nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		if got := vr.vals["rangeheader"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got the rangeheader %q, want %q", tc.name, got, tc.want)
+		}
+		if got := vr.vals["authorization"]; !reflect.DeepEqual(got, []string{""}) {
+			t.Errorf("%s: got the authorization %q without the header", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	"errors"
+	ppmrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"net"
+	"time"
+)
+
+//MRT types, subtypes and BGP attribute codes that we need to walk a BGP4MP
+//update without fully parsing it into protobufs.
+const (
+	MRT_BGP4MP    = 16
+	MRT_BGP4MP_ET = 17
+
+	BGP4MP_STATE_CHANGE              = 0
+	BGP4MP_MESSAGE                   = 1
+	BGP4MP_STATE_CHANGE_AS4          = 5
+	BGP4MP_MESSAGE_AS4               = 4
+	BGP4MP_MESSAGE_LOCAL             = 6
+	BGP4MP_MESSAGE_AS4_LOCAL         = 7
+	BGP4MP_MESSAGE_ADDPATH           = 8
+	BGP4MP_MESSAGE_AS4_ADDPATH       = 9
+	BGP4MP_MESSAGE_LOCAL_ADDPATH     = 10
+	BGP4MP_MESSAGE_AS4_LOCAL_ADDPATH = 11
+
+	BGP_MARKER_LEN   = 16
+	BGP_HEADER_LEN   = 19
+	BGP_OPEN         = 1
+	BGP_UPDATE       = 2
+	BGP_NOTIFICATION = 3
+	BGP_KEEPALIVE    = 4
+
+	ATTR_AS_PATH         = 2
+	ATTR_MP_REACH_NLRI   = 14
+	ATTR_MP_UNREACH_NLRI = 15
+	ATTR_AS4_PATH        = 17
+
+	AS_SET        = 1
+	AS_SEQUENCE   = 2
+	AS_CONFED_SET = 4
+
+	AFI_IP  = 1
+	AFI_IP6 = 2
+
+	SAFI_UNICAST   = 1
+	SAFI_MULTICAST = 2
+)
+
+var (
+	errnotbgp4mp = errors.New("MRT record is not a BGP4MP message")
+	errshortmsg  = errors.New("MRT record is truncated")
+)
+
+//bgp4mpMsg holds the parts of a BGP4MP message that the query filters
+//and the JSON lines output need to look at.
+type bgp4mpMsg struct {
+	timestamp   uint32
+	as4         bool
+	addpath     bool
+	statechange bool
+	peerAS      uint32
+	peerIP      net.IP
+	msgtype     uint8        //BGP message type. only set if this is not a state change
+	hdrlen      int          //length of the record up to the end of the BGP header, or all of a state change
+	withdrawn   []*net.IPNet //withdrawn routes and MP_UNREACH prefixes
+	announced   []*net.IPNet //NLRI and MP_REACH prefixes
+	mpreach     int          //number of MP_REACH routes of any family, including the ones we can't decode
+	mpunreach   int          //number of MP_UNREACH routes of any family
+	aspath      []asPathSegment
+	as4path     []asPathSegment //only set by 2 byte AS sessions carrying an AS4_PATH
+}
+
+type asPathSegment struct {
+	set  bool //AS_SET (or AS_CONFED_SET) instead of a sequence
+	asns []uint32
+}
+
+//prefixes returns all the prefixes announced or withdrawn by an update.
+func (up *bgp4mpMsg) prefixes() []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(up.withdrawn)+len(up.announced))
+	ret = append(ret, up.withdrawn...)
+	return append(ret, up.announced...)
+}
+
+//origin returns the ASNs that could have originated the update. That is the last
+//ASN of the path, or all the members of the set if the path ends with an AS_SET.
+func (up *bgp4mpMsg) origin() []uint32 {
+	if len(up.aspath) == 0 {
+		return nil
+	}
+	last := up.aspath[len(up.aspath)-1]
+	if last.set || len(last.asns) == 0 {
+		return last.asns
+	}
+	return last.asns[len(last.asns)-1:]
+}
+
+//contains returns true if the ASN appears anywhere in the AS path.
+func (up *bgp4mpMsg) contains(asn uint32) bool {
+	for _, seg := range up.aspath {
+		for _, a := range seg.asns {
+			if a == asn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mrtType(data []byte) (typ, subtyp uint16, err error) {
+	if len(data) < ppmrt.MRT_HEADER_LEN {
+		return 0, 0, errshortmsg
+	}
+	return binary.BigEndian.Uint16(data[4:6]), binary.BigEndian.Uint16(data[6:8]), nil
+}
+
+//mrtTime returns the time of a raw MRT record, with the microseconds of the
+//extended timestamp of BGP4MP_ET records, so that records in the same second
+//can still be told apart by time.
+func mrtTime(data []byte) time.Time {
+	t := time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+	if typ, _, err := mrtType(data); err == nil && typ == MRT_BGP4MP_ET && len(data) >= ppmrt.MRT_HEADER_LEN+4 {
+		t = t.Add(time.Duration(binary.BigEndian.Uint32(data[ppmrt.MRT_HEADER_LEN:])) * time.Microsecond)
+	}
+	return t
+}
+
+//decodeBGP4MP walks a raw MRT record and returns the information we filter on.
+//It returns errnotbgp4mp for anything that is not a BGP4MP message or state change.
+//Only updates get their routes and AS path decoded.
+func decodeBGP4MP(data []byte) (*bgp4mpMsg, error) {
+	up, body, err := decodeBGP4MPHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if up.statechange || up.msgtype != BGP_UPDATE {
+		return up, nil
+	}
+	//withdrawn routes
+	if len(body) < 2 {
+		return nil, errshortmsg
+	}
+	wlen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < wlen {
+		return nil, errshortmsg
+	}
+	if up.withdrawn, err = appendPrefixes(up.withdrawn, body[:wlen], AFI_IP, up.addpath); err != nil {
+		return nil, err
+	}
+	body = body[wlen:]
+	//path attributes
+	if len(body) < 2 {
+		return nil, errshortmsg
+	}
+	alen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < alen {
+		return nil, errshortmsg
+	}
+	if err = up.decodeAttrs(body[:alen]); err != nil {
+		return nil, err
+	}
+	if up.as4path != nil {
+		up.aspath = mergeAS4Path(up.aspath, up.as4path)
+	}
+	//whatever is left is NLRI
+	if up.announced, err = appendPrefixes(up.announced, body[alen:], AFI_IP, up.addpath); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+func (up *bgp4mpMsg) decodeAttrs(attrs []byte) (err error) {
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return errshortmsg
+		}
+		flags, code := attrs[0], attrs[1]
+		hl, vl := 3, int(attrs[2])
+		if flags&0x10 != 0 { //extended length
+			if len(attrs) < 4 {
+				return errshortmsg
+			}
+			hl, vl = 4, int(binary.BigEndian.Uint16(attrs[2:4]))
+		}
+		if len(attrs) < hl+vl {
+			return errshortmsg
+		}
+		val := attrs[hl : hl+vl]
+		attrs = attrs[hl+vl:]
+		switch code {
+		case ATTR_AS_PATH:
+			asl := 2
+			if up.as4 {
+				asl = 4
+			}
+			if up.aspath, err = decodeASPath(val, asl); err != nil {
+				return
+			}
+		case ATTR_AS4_PATH:
+			if up.as4 { //should not be sent between AS4 speakers
+				continue
+			}
+			if up.as4path, err = decodeASPath(val, 4); err != nil {
+				return
+			}
+		case ATTR_MP_REACH_NLRI:
+			//afi, safi, next hop length, next hop, reserved byte
+			if len(val) < 4 || len(val) < 5+int(val[3]) {
+				return errshortmsg
+			}
+			afi, safi, nlri := binary.BigEndian.Uint16(val), val[2], val[5+int(val[3]):]
+			if up.mpreach, err = countPrefixes(nlri, up.addpath); err != nil {
+				return
+			}
+			if !plainPrefixes(safi) {
+				continue
+			}
+			if up.announced, err = appendPrefixes(up.announced, nlri, afi, up.addpath); err != nil {
+				return
+			}
+		case ATTR_MP_UNREACH_NLRI:
+			//afi, safi
+			if len(val) < 3 {
+				return errshortmsg
+			}
+			afi, safi := binary.BigEndian.Uint16(val), val[2]
+			if up.mpunreach, err = countPrefixes(val[3:], up.addpath); err != nil {
+				return
+			}
+			if !plainPrefixes(safi) {
+				continue
+			}
+			if up.withdrawn, err = appendPrefixes(up.withdrawn, val[3:], afi, up.addpath); err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+//decodeBGP4MPHeader decodes a BGP4MP record up to the end of the BGP header,
+//and returns the body of the BGP message, which is empty for state changes.
+func decodeBGP4MPHeader(data []byte) (*bgp4mpMsg, []byte, error) {
+	typ, subtyp, err := mrtType(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	up := &bgp4mpMsg{timestamp: binary.BigEndian.Uint32(data)}
+	body := data[ppmrt.MRT_HEADER_LEN:]
+	switch typ {
+	case MRT_BGP4MP:
+	case MRT_BGP4MP_ET:
+		if len(body) < 4 { //microsecond timestamp
+			return nil, nil, errshortmsg
+		}
+		body = body[4:]
+	default:
+		return nil, nil, errnotbgp4mp
+	}
+	switch subtyp {
+	case BGP4MP_STATE_CHANGE:
+		up.statechange = true
+	case BGP4MP_STATE_CHANGE_AS4:
+		up.as4, up.statechange = true, true
+	case BGP4MP_MESSAGE, BGP4MP_MESSAGE_LOCAL:
+	case BGP4MP_MESSAGE_AS4, BGP4MP_MESSAGE_AS4_LOCAL:
+		up.as4 = true
+	case BGP4MP_MESSAGE_ADDPATH, BGP4MP_MESSAGE_LOCAL_ADDPATH:
+		up.addpath = true
+	case BGP4MP_MESSAGE_AS4_ADDPATH, BGP4MP_MESSAGE_AS4_LOCAL_ADDPATH:
+		up.as4, up.addpath = true, true
+	default:
+		return nil, nil, errnotbgp4mp
+	}
+	asl := 2
+	if up.as4 {
+		asl = 4
+	}
+	//peer AS, local AS, interface index and address family
+	if len(body) < 2*asl+4 {
+		return nil, nil, errshortmsg
+	}
+	if up.as4 {
+		up.peerAS = binary.BigEndian.Uint32(body)
+	} else {
+		up.peerAS = uint32(binary.BigEndian.Uint16(body))
+	}
+	afi := binary.BigEndian.Uint16(body[2*asl+2:])
+	body = body[2*asl+4:]
+	ipl := net.IPv4len
+	if afi == AFI_IP6 {
+		ipl = net.IPv6len
+	}
+	if len(body) < 2*ipl {
+		return nil, nil, errshortmsg
+	}
+	up.peerIP = net.IP(append([]byte(nil), body[:ipl]...))
+	body = body[2*ipl:]
+	if up.statechange {
+		up.hdrlen = len(data)
+		return up, nil, nil
+	}
+	if len(body) < BGP_HEADER_LEN {
+		return nil, nil, errshortmsg
+	}
+	up.msgtype = body[BGP_MARKER_LEN+2]
+	up.hdrlen = len(data) - len(body) + BGP_HEADER_LEN
+	return up, body[BGP_HEADER_LEN:], nil
+}
+
+//plainPrefixes is true if the routes of a SAFI are just length/prefix encoded.
+//Labeled and VPN routes have more in front of the prefix, so they are only counted.
+func plainPrefixes(safi uint8) bool {
+	return safi == SAFI_UNICAST || safi == SAFI_MULTICAST
+}
+
+//appendPrefixes decodes a sequence of length/prefix encoded routes.
+func appendPrefixes(pfxs []*net.IPNet, buf []byte, afi uint16, addpath bool) ([]*net.IPNet, error) {
+	ipl := net.IPv4len
+	if afi == AFI_IP6 {
+		ipl = net.IPv6len
+	} else if afi != AFI_IP {
+		//we don't know how to make a prefix out of other families
+		return pfxs, nil
+	}
+	for len(buf) > 0 {
+		if addpath { //path identifier
+			if len(buf) < 4 {
+				return pfxs, errshortmsg
+			}
+			buf = buf[4:]
+		}
+		if len(buf) < 1 {
+			return pfxs, errshortmsg
+		}
+		bits := int(buf[0])
+		nb := (bits + 7) / 8
+		if bits > ipl*8 || len(buf) < 1+nb {
+			return pfxs, errshortmsg
+		}
+		ip := make(net.IP, ipl)
+		copy(ip, buf[1:1+nb])
+		pfxs = append(pfxs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, ipl*8)})
+		buf = buf[1+nb:]
+	}
+	return pfxs, nil
+}
+
+//countPrefixes counts a sequence of length/prefix encoded routes without
+//decoding them, so it works for any family. Labeled and VPN routes carry
+//their label and route distinguisher in the length, so they are skipped whole.
+func countPrefixes(buf []byte, addpath bool) (n int, err error) {
+	for len(buf) > 0 {
+		if addpath { //path identifier
+			if len(buf) < 4 {
+				return n, errshortmsg
+			}
+			buf = buf[4:]
+		}
+		if len(buf) < 1 {
+			return n, errshortmsg
+		}
+		nb := (int(buf[0]) + 7) / 8
+		if len(buf) < 1+nb {
+			return n, errshortmsg
+		}
+		buf = buf[1+nb:]
+		n++
+	}
+	return n, nil
+}
+
+//decodeASPath decodes the segments of an AS_PATH or AS4_PATH attribute
+//where each ASN is asl bytes long.
+func decodeASPath(buf []byte, asl int) (segs []asPathSegment, err error) {
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, errshortmsg
+		}
+		styp, cnt := buf[0], int(buf[1])
+		buf = buf[2:]
+		if len(buf) < cnt*asl {
+			return nil, errshortmsg
+		}
+		seg := asPathSegment{set: styp == AS_SET || styp == AS_CONFED_SET, asns: make([]uint32, cnt)}
+		for i := range seg.asns {
+			if asl == 4 {
+				seg.asns[i] = binary.BigEndian.Uint32(buf[i*4:])
+			} else {
+				seg.asns[i] = uint32(binary.BigEndian.Uint16(buf[i*2:]))
+			}
+		}
+		buf = buf[cnt*asl:]
+		segs = append(segs, seg)
+	}
+	return
+}
+
+//pathLen is the length of the path as defined for AS4_PATH reconstruction,
+//where a set counts as a single hop.
+func pathLen(segs []asPathSegment) (n int) {
+	for _, seg := range segs {
+		if seg.set {
+			n++
+		} else {
+			n += len(seg.asns)
+		}
+	}
+	return
+}
+
+//mergeAS4Path reconstructs the 4 byte AS path of a 2 byte AS session as in RFC6793.
+//The leading hops of the AS_PATH that aren't in the AS4_PATH are kept and the
+//rest are replaced by the AS4_PATH.
+func mergeAS4Path(aspath, as4path []asPathSegment) []asPathSegment {
+	keep := pathLen(aspath) - pathLen(as4path)
+	if keep < 0 { //the AS4_PATH must be ignored
+		return aspath
+	}
+	var ret []asPathSegment
+	for _, seg := range aspath {
+		if keep == 0 {
+			break
+		}
+		if seg.set {
+			ret = append(ret, seg)
+			keep--
+			continue
+		}
+		n := len(seg.asns)
+		if n > keep {
+			n = keep
+		}
+		ret = append(ret, asPathSegment{asns: seg.asns[:n]})
+		keep -= n
+	}
+	return append(ret, as4path...)
+}
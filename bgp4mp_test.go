@@ -0,0 +1,89 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+//mpReach returns an MP_REACH_NLRI attribute with an IPv4 next hop
+func mpReach(afi uint16, safi byte, nlri []byte) []byte {
+	val := []byte{byte(afi >> 8), byte(afi), safi, 4, 192, 0, 2, 1, 0}
+	return bgpAttr(0x80, ATTR_MP_REACH_NLRI, append(val, nlri...))
+}
+
+//mpUnreach returns an MP_UNREACH_NLRI attribute
+func mpUnreach(afi uint16, safi byte, nlri []byte) []byte {
+	return bgpAttr(0x80, ATTR_MP_UNREACH_NLRI, append([]byte{byte(afi >> 8), byte(afi), safi}, nlri...))
+}
+
+func TestDecodeMPRoutes(t *testing.T) {
+	//a label and 10.1.0.0/16, and a label, a route distinguisher and 10.2.0.0/16
+	labeled := []byte{24 + 16, 0x00, 0x01, 0x01, 10, 1}
+	vpn := []byte{24 + 64 + 16, 0x00, 0x01, 0x01, 0, 0, 0xfd, 0xe8, 0, 0, 0, 1, 10, 2}
+	tests := []struct {
+		name                 string
+		attrs                [][]byte
+		reach, unreach       int
+		announced, withdrawn []string
+	}{
+		{"unicast", [][]byte{mpReach(AFI_IP6, SAFI_UNICAST, encodePrefixes([]string{"2001:db8::/32", "2001:db8:1::/48"}))}, 2, 0, []string{"2001:db8::/32", "2001:db8:1::/48"}, nil},
+		{"multicast", [][]byte{mpUnreach(AFI_IP, SAFI_MULTICAST, encodePrefixes([]string{"232.0.0.0/8"}))}, 0, 1, nil, []string{"232.0.0.0/8"}},
+		{"labeled", [][]byte{mpReach(AFI_IP, 4, labeled)}, 1, 0, nil, nil},
+		{"vpn", [][]byte{mpReach(AFI_IP, 128, vpn), mpUnreach(AFI_IP, 128, append(append([]byte(nil), vpn...), vpn...))}, 1, 2, nil, nil},
+	}
+	for _, tt := range tests {
+		rec := mrtRecord(testTs(0), MRT_BGP4MP, BGP4MP_MESSAGE_AS4, bgp4mpBody(3356, "192.0.2.1", BGP_UPDATE, bgpUpdate([]uint32{3356}, []string{"8.8.8.0/24"}, nil, tt.attrs...)))
+		up, err := decodeBGP4MP(rec)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if up.mpreach != tt.reach || up.mpunreach != tt.unreach {
+			t.Errorf("%s: got %d reach and %d unreach routes, want %d and %d", tt.name, up.mpreach, up.mpunreach, tt.reach, tt.unreach)
+		}
+		//the NLRI of the update itself comes after the attributes
+		checkPrefixes(t, tt.name+" announced", up.announced, append(tt.announced, "8.8.8.0/24"))
+		checkPrefixes(t, tt.name+" withdrawn", up.withdrawn, tt.withdrawn)
+	}
+}
+
+func checkPrefixes(t *testing.T, name string, got []*net.IPNet, want []string) {
+	if len(got) != len(want) {
+		t.Errorf("%s: got prefixes %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i].String() != want[i] {
+			t.Errorf("%s: got prefixes %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+//bgp4mpETUpdate returns a BGP4MP_ET record of an update with the microseconds
+func bgp4mpETUpdate(ts uint32, usecs uint32) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, usecs)
+	body = append(body, bgp4mpBody(3356, "192.0.2.1", BGP_UPDATE, bgpUpdate([]uint32{3356}, []string{"8.8.8.0/24"}, nil))...)
+	return mrtRecord(ts, MRT_BGP4MP_ET, BGP4MP_MESSAGE_AS4, body)
+}
+
+func TestMrtTime(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rec  []byte
+		want time.Time
+	}{
+		{"bgp4mp", bgp4mpUpdate(testTs(time.Minute), 3356, "192.0.2.1", nil, nil, nil), testEpoch.Add(time.Minute)},
+		{"et", bgp4mpETUpdate(testTs(time.Minute), 250000), testEpoch.Add(time.Minute + 250*time.Millisecond)},
+		{"et without microseconds", bgp4mpETUpdate(testTs(time.Minute), 0), testEpoch.Add(time.Minute)},
+		{"et cut short", mrtRecord(testTs(time.Minute), MRT_BGP4MP_ET, BGP4MP_MESSAGE_AS4, []byte{0, 3}), testEpoch.Add(time.Minute)},
+		{"rib", mrtRecord(testTs(time.Minute), MRT_TABLE_DUMP_V2, 2, []byte{0, 3, 0xd0, 0x90}), testEpoch.Add(time.Minute)},
+	} {
+		if got := mrtTime(tc.rec); !got.Equal(tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
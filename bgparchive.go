@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"compress/bzip2"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
@@ -14,19 +16,25 @@ import (
 	pb "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
 	pp "github.com/CSUNetSec/protoparse"
 	ppmrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rogpeppe/fastuuid"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,7 +49,8 @@ const (
 
 	IMPORTANT NOTE: BGP data can be large. For example, one hour's worth of updates from routeviews2 can be around 8MB. RIBs are larger. Please exercise care when making requests for long time ranges.
 
-	Start and end times are specified in the YYYMMDDMMSS format.
+	Start and end times are specified in the YYYYMMDDHHMMSS format. RFC3339 times (2013-01-01T00:00:00Z) and unix seconds are also accepted, as long as start and end use the same format.
+	YYYYMMDDHHMMSS times are in UTC, unless the tz parameter names another time zone, like tz=America/Denver or tz=-07:00. RFC3339 and unix times carry their own zone and ignore tz.
 
 	Below are examples of how to use the interface. You may fetch data from one collector at a time. All examples below fetch data from the routeviews2 collector (currently the largest collector).
 
@@ -51,12 +60,75 @@ const (
 	Fetch updates in MRT format from 01/01/2013 00:00:00 to 01/01/2013 01:00:00 UTC:
 	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000
 
+	Fetch updates as one JSON object per line, with the timestamp, peer, message type, withdrawn and announced prefixes and AS path of each message:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&format=json
+
+	Any reply can be gzip compressed on the wire by sending an Accept-Encoding: gzip header or by adding the compress=gzip parameter:
+	curl --compressed -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000
+	curl -o updates.gz http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&compress=gzip
+
 	Fetch updates in JSON format from 01/01/2013 00:00:00 to 01/01/2013 01:00:00 UTC:
 	curl -o updates http://bgpmon.io/archive/json/routeviews2/updates?start=20130101000000\&end=20130101010000
 
 	Fetch updates as protocol buffers from 01/01/2013 00:00:00 to 01/01/2013 01:00:00 UTC:
 	curl -o updates http://bgpmon.io/archive/pb/routeviews2/updates?start=20130101000000\&end=20130101010000
 
+	Fetch only the updates that announce or withdraw a prefix within, or covering, any of the given prefixes:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&prefix=8.8.8.0/24\&prefix=2001:4860::/32
+
+	Fetch only the updates originated by AS15169, or that have AS3356 anywhere in their AS path. The two parameters can be combined with prefix:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&aspath=origin:15169
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&aspath=3356
+
+	Fetch only the messages of the peer 198.32.160.1, or of the peers with AS6939. Addresses can be IPv4 or IPv6:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&peer=198.32.160.1
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&peeras=6939
+
+	Archive files can overlap at their seams, so a query can return the same record twice. Drop the repeated records of a query with dedup=true. Records are only remembered within a single request, so querying adjacent ranges in separate requests can still return the records at the boundary twice, because both ranges are widened by a second:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&dedup=true
+
+	Fetch only some types of MRT records. The types can be update, statechange (peer up and down), rib, or the numeric MRT type with an optional subtype like 16:5:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&mrttype=statechange
+
+	A range that is entirely before the first file or after the last file of an archive gets a 416 and one in a gap between its files a 404. The error has the range of the archive, and of the gap, to adjust the request to. A range is in a gap when it is after the last record of a file and before the start of the next one.
+
+	Errors that happen after the reply has started, like an archive file that can't be read to the end, are written in the reply as a line of text, or as a JSON object with the format=json and the stats and count endpoints. So that raw MRT clients can tell that their reply is incomplete without looking for text in it, the first such error is also sent in the X-Stream-Error HTTP trailer:
+	curl --raw -s -D - -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000
+
+	The X-Data-First and X-Data-Last trailers have the RFC3339 timestamps of the earliest and latest messages sent, so clients can tell whether the archive had data for the whole range, or how far a continuous pull got. Replies of whole files that are sent with a Content-Length can't have trailers.
+
+	If the server keeps a cache of recent replies, the replies of the ranges that don't reach the newest archive file have an X-Cache header that is HIT when they were sent from the cache, and MISS otherwise.
+
+	Messages from one second before start to one second after end are included by default. Use exact=true to only get the messages from start up to, but not including, end:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&exact=true
+
+	Collectors that dump at a different cadence may need more than that second. slop=N includes the messages less than N seconds before start or after end, up to 900 seconds, instead of the one second. slop=0 leaves out the messages at start and end. It can't be used with exact=true:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&slop=30
+
+	Instead of continuous pulling, a websocket client can connect to the ws endpoint with a start up to 24 hours ago. It gets the updates from start to now, and then the updates of every new archive file once the file stops growing. The updates are binary messages, or text messages with format=json, and the other query parameters are also accepted:
+	websocat ws://bgpmon.io/archive/mrt/routeviews2/updates/ws?start=20130101000000\&format=json
+
+	When a query returns whole uncompressed archive files, without any filters, its size is known in advance and an interrupted download can be resumed with a Range header:
+	curl -C - -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000
+
+	Check a query without running it. The reply tells how many archive files the query would scan, their dates and their size on disk. Invalid queries fail exactly like they would without validate:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&validate=true
+
+	Fetch updates with the most recent first. Keep in mind that the messages of each archive file (15 minutes of updates, or a whole RIB) are held in memory on the server before being sent, so results start arriving later than in the default ascending order:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&order=desc
+
+	The messages of each archive file are sent in the order they are in the file, and adjacent files can overlap by a few messages. Get all the messages of the range strictly ordered by their timestamps with sorted=true. Files are merged as the range reaches them instead of being read ahead, so the reply is slower but doesn't use more memory:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&sorted=true
+
+	Fetch only the headers of the messages, for timing or per peer analysis without the routes. Raw MRT records are cut after their BGP header, and with format=json only the timestamp, peer and type are set:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&headersonly=true
+
+	Archives can mix BGP4MP records with and without the extended timestamp. Get all of them as BGP4MP_ET with normalize=et (the records without one get 0 microseconds), or as BGP4MP with normalize=plain (dropping the microseconds):
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&normalize=et
+
+	Fetch at most the first 100 updates of the range. With order=desc this returns the 100 most recent ones:
+	curl -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&limit=100
+
 	Start a continuous pull for updates. The HTTP return header contains the UUID for each consecutive pull under the field Next-Pull-ID:
 	curl -v http://bgpmon.io/archive/mrt/routeviews2/updates?continuous=begin
 
@@ -66,6 +138,11 @@ const (
 	Then once we get the id:
 	curl -v -o updates http://bgpmon.io/archive/mrt/routeviews2/updatescontinuous=115786068dca20709955f88faa71d241
 	Note that the state will timeout after 30 minutes of inactivity and you will need to start a new session.
+	A pull that has no new messages yet is answered with 204 No Content, still with a Next-Pull-ID, so wait a bit before the next pull.
+	If a pull was cut short, send the time of the last record you got from it with ack, using RFC3339 for the microseconds of BGP4MP_ET records. The next pull then starts from that record, which is sent again, instead of where the cut pull ended:
+	curl -v -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?continuous=115786068dca20709955f88faa71d241\&ack=2015-11-05T10:15:02.123456Z
+	The file the collector is writing right now can have a truncated last record. With lag, a duration like 15m or true for one dump interval of the archive, the pulls end that long before the time of the request, so only the complete files are sent. Send it with the begin request and with every pull. It also caps the end of the other queries:
+	curl -v http://bgpmon.io/archive/mrt/routeviews2/updates?continuous=begin\&lag=true
 
 	Fetch all RIBs exported from 01/01/2013 00:00:00 to 01/01/2013 01:00:00 UTC:
 	curl -o ribs http://bgpmon.io/archive/mrt/routeviews2/ribs?start=20130101000000\&end=20130101010000
@@ -76,15 +153,73 @@ const (
 	Get the original MRT file names from the the archive back end:
 	curl http://bgpmon.io/archive/mrt/routeviews2/updates/conf?files
 
+	Get, as JSON, the size of every file of the archive and how many offsets its index has. Files without offsets can be indexed with indextool:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/conf?stats
+
+	Get, as JSON, the number of files of the archive, their total and average size in bytes and the dates of the first and last file:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/conf?summary
+
+	Get, as JSON, the peers (IP address and AS) that have updates in the archive, optionally only in a range. The peers come from the index written by indextool, and the 3 most recent files without one are scanned for theirs:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/peers?start=20130101000000\&end=20130101010000
+
+	Get the number of messages, their total size in bytes and the number of archive files a query would return, without downloading them. The prefix, aspath, peer, peeras and limit parameters are also accepted:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/count?start=20130101000000\&end=20130101010000
+
 	Get JSON-encoded statistics about the requested time range in the following format:
 	<# of all types of all messages in the requested time range>
 	followed by a matrix with three rows and a # columns equal to the number of seconds in the requested interval
 	row 0 - # of all types messages: <# of all types of messages at sec 0>, <# of all messages at sec 1>, ...
 	row 1 - # of MPReach   messages: <# of MPReach messages at sec 0>, <# of MPReach at sec 1>, ...
 	row 2 - # of MPUnreach messages: <# of MPUnreach messages at sec 0>, <# of MPUnreach messages at sec 1>, ...
+	For RIB archives the RibPrefixes and RibEntries rows count the prefixes and the RIB entries (one per peer that has a route to the prefix) dumped at each second.
 
 	curl http://bgpmon.io/archive/mrt/routeviews2/updates/stats?start=20160101000000\&end=20160101010000
 
+	The columns are one second each by default. Use the bucket parameter to get coarser columns, like one per minute. Delta_sec in the reply is the size of the columns in seconds:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/stats?start=20160101000000\&end=20160102000000\&bucket=60
+
+	The prefix, aspath, peer and peeras parameters work on stats too, so that they only count the matching updates:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/stats?start=20160101000000\&end=20160101010000\&aspath=origin:15169
+
+	Flag the columns with bursts of messages, like during routing incidents. With anomaly=k the Anomalies array has the indexes of the columns with more messages than the mean plus k standard deviations of the 60 columns before them:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/stats?start=20160101000000\&end=20160101010000\&anomaly=3
+
+	The stats of a wide range are held in memory until they are all counted. With stream=true the reply is the same, but TotalPerDelta is sent as it is counted and the other columns are kept in temporary files until it is done. TotalMsgs and an Errors array with the files that couldn't be read come last:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates/stats?start=20160101000000\&end=20160102000000\&stream=true
+
+	The server also exposes its own operational metrics (queries, scans, continuous pull clients) in the prometheus format:
+	curl http://bgpmon.io/archive/metrics
+
+	Fetch the updates and RIBs of all the collectors merged in a single stream ordered by time. All the query parameters of the updates are also accepted:
+	curl -o all http://bgpmon.io/archive/all?start=20130101000000\&end=20130101001500
+
+	Only merge the archives of some of the collectors with collectors, which can be repeated or a comma separated list:
+	curl -o all http://bgpmon.io/archive/all?start=20130101000000\&end=20130101001500\&collectors=routeviews2,rrc00
+
+	The same list of collectors and their time range as a JSON array:
+	curl http://bgpmon.io/archive/list
+
+	Download a single archive file, by one of the names listed with ?files:
+	curl -o updates.20130101.0000.bz2 http://bgpmon.io/archive/mrt/routeviews2/updates/file?name=updates.20130101.0000.bz2
+
+	Download the archive files of a range as they are, in a tar archive (or a gzip compressed one with bundle=tar.gz). The files are the whole ones that have messages in the range, so it can't be used with the filters or the other parameters that change the messages:
+	curl -OJ http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&bundle=tar
+
+	Get, as JSON, a manifest of what a query returns instead of its messages: the archive files it covers with their dates, sizes and how many of their records and bytes match, and the parameters of the query. Keep it along with the download to know later what it was:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&peeras=3356\&manifest=true
+
+	Get the messages around a few instants instead of a whole range, like at the top of every hour. Every at value returns the messages from 30 seconds before to 30 seconds after it, and up to 96 can be given:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates?at=20160101000000\&at=20160101010000\&at=20160101020000
+
+	Get the RIB as it was at some time, which is the single RIB dump that started at or right before it, with asof instead of start and end. It is only accepted by the RIB archives:
+	curl -o rib http://bgpmon.io/archive/mrt/routeviews2/ribs?asof=20160101013000
+
+	Get the messages from some time ago up to now with since, which is either a duration like 15m or 2h, or a time in any of the start formats. It is used instead of start and end, and the range can't be longer than a day either:
+	curl http://bgpmon.io/archive/mrt/routeviews2/updates?since=15m
+
+	Find out where the time of a slow query goes with profile=true. The X-Query-Profile trailer has a JSON object with how long finding the files, opening, scanning, decoding and sending took, for the whole query and for every file, so the messages are sent as usual. It skips the cache, and can't be used with bundle or manifest:
+	curl --raw -s -D - -o updates http://bgpmon.io/archive/mrt/routeviews2/updates?start=20130101000000\&end=20130101010000\&profile=true
+
 	Collectors and their time range:
 
 	`
@@ -92,13 +227,117 @@ const (
 
 var (
 	errbadreq  = errors.New("malformed request")
-	errbaddate = errors.New("dates should be in a YYYYMMDDHHMMSS format and start should be earlier than end")
+	errbaddate = errors.New("dates should be in a YYYYMMDDHHMMSS, RFC3339 or unix seconds format and start should be earlier than end")
 	errempty   = errors.New("archive empty")
 	errdate    = errors.New("no such date in archive")
+	errbefore  = errors.New("the range is before the first file of the archive")
+	errafter   = errors.New("the range is after the last file of the archive")
+	errgap     = errors.New("the range is in a gap between the files of the archive")
+	errbadack  = errors.New("ack should be the time of the last record received in a YYYYMMDDHHMMSS, RFC3339 or unix seconds format")
 	errbigdt   = errors.New("The requested duration is too large. Try something smaller than 24h")
 	errnoar    = errors.New("no such archive")
+	errbusy    = errors.New("too many concurrent queries. try again later")
+	errstopped = errors.New("the archive has been stopped")
+	errnofile  = errors.New("no such file in archive")
+	errrange   = errors.New("the requested byte range is not satisfiable")
+	errmanyat  = fmt.Errorf("too many at values. at most %d instants can be requested", MAX_AT)
+	errasof    = errors.New("asof is only accepted by the RIB archives")
+	errsince   = errors.New("since should be a positive duration like 15m or a past time in a YYYYMMDDHHMMSS, RFC3339 or unix seconds format")
+	errlag     = errors.New("lag should be a positive duration like 15m, or true for one dump interval of the archive")
+	errlagged  = errors.New("the range is within the lag of the current time")
 )
 
+//the trailers with the timestamps of the earliest and latest messages sent,
+//and the profile of a query with profile=true
+const (
+	DATA_FIRST_TRAILER = "X-Data-First"
+	DATA_LAST_TRAILER  = "X-Data-Last"
+	PROFILE_TRAILER    = "X-Query-Profile"
+)
+
+//setSpanTrailers makes the reply end with the span of the messages that
+//were actually sent, so clients can tell how much of the range had data.
+//A profiled query also ends with its profile, once all its messages are sent.
+//Replies with a Content-Length can't have trailers so they don't get them.
+func setSpanTrailers(h *api.HdrReply, qp *queryParams) {
+	h.Trailers = []string{DATA_FIRST_TRAILER, DATA_LAST_TRAILER}
+	if qp.profiling() {
+		h.Trailers = append(h.Trailers, PROFILE_TRAILER)
+	}
+	h.TrailerValues = func() map[string]string {
+		ret := make(map[string]string)
+		if first, last, ok := qp.sentSpan(); ok {
+			ret[DATA_FIRST_TRAILER] = first.Format(time.RFC3339)
+			ret[DATA_LAST_TRAILER] = last.Format(time.RFC3339)
+		}
+		if qp.profiling() {
+			b, err := qp.profileJSON()
+			if err != nil {
+				warnf("error in encoding the query profile:%s", err)
+			} else {
+				ret[PROFILE_TRAILER] = string(b)
+			}
+		}
+		return ret
+	}
+}
+
+//MAX_AT is how many at values a request can have
+const MAX_AT = 96
+
+//DEFAULT_MAX_RANGES is how many start and end pairs a request can have
+//unless SetMaxRanges is called. Every range is a query of its own.
+const DEFAULT_MAX_RANGES = 8
+
+var maxranges = DEFAULT_MAX_RANGES
+
+//SetMaxRanges sets how many start and end pairs a request can have.
+//Requests with more are rejected before any file is scanned.
+func SetMaxRanges(a int) {
+	if a < 1 {
+		a = DEFAULT_MAX_RANGES
+	}
+	maxranges = a
+}
+
+//AT_WINDOW is how far before and after every at value the messages are returned
+const AT_WINDOW = 30 * time.Second
+
+//DEFAULT_MAX_QUERIES is how many requests can be querying the archives
+//at the same time unless SetMaxQueries is called.
+const DEFAULT_MAX_QUERIES = 16
+
+//QUERY_RETRY_AFTER is the Retry-After in seconds of requests that are
+//rejected because of the concurrency limit.
+const QUERY_RETRY_AFTER = 5
+
+//querysem holds a slot for every request being queried, across all the archives.
+var querysem = make(chan struct{}, DEFAULT_MAX_QUERIES)
+
+//SetMaxQueries sets how many requests can be querying the archives
+//at the same time. It should be called before the archives are served.
+func SetMaxQueries(a int) {
+	if a < 1 {
+		a = DEFAULT_MAX_QUERIES
+	}
+	querysem = make(chan struct{}, a)
+}
+
+//acquireQuery reserves a query slot without blocking. It returns
+//false if all the slots are taken.
+func acquireQuery() bool {
+	select {
+	case querysem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseQuery() {
+	<-querysem
+}
+
 type HelpMsg struct {
 	ars []*fsarconf
 	api.PutNotAllowed
@@ -117,8 +356,30 @@ func (h *HelpMsg) Get(values url.Values) (api.HdrReply, chan api.Reply) {
 		}
 		return
 	}()
-	return api.HdrReply{Code: 200}, retc
+	hdr := api.HdrReply{Code: 200}
+	hdr.ETag, hdr.LastModified = h.entriesTag()
+	return hdr, retc
+}
 
+//entriesTag combines the tags of the archives, since the help shows their ranges
+func (h *HelpMsg) entriesTag() (string, time.Time) {
+	var (
+		mod  time.Time
+		tags []string
+	)
+	for _, ar := range h.ars {
+		tag, armod := ar.getEntriesTag()
+		if tag == "" {
+			return "", time.Time{}
+		}
+		tags = append(tags, tag)
+		if armod.After(mod) {
+			mod = armod
+		}
+	}
+	sum := fnv.New64a()
+	fmt.Fprintf(sum, "%s\n%s", HELPSTR, strings.Join(tags, " "))
+	return fmt.Sprintf("W/\"%x\"", sum.Sum64()), mod
 }
 
 func riborupdatestr(a string) string {
@@ -134,23 +395,111 @@ func (h *HelpMsg) AddArchive(ar *fsarconf) {
 	h.ars = append(h.ars, ar)
 }
 
+//ArchiveNotFound answers the requests for archive paths that are not registered
+//with a 404 that lists the collectors, so that typos are easy to fix.
+type ArchiveNotFound struct {
+	h *HelpMsg
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewArchiveNotFound(h *HelpMsg) *ArchiveNotFound {
+	return &ArchiveNotFound{h: h}
+}
+
+func (nf *ArchiveNotFound) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	countRequestError(httpCode(errnoar))
+	go func() {
+		defer close(retc)
+		retc <- api.Reply{Data: nil, Err: errnoar}
+		retc <- api.Reply{Data: []byte("available collectors:\n"), Err: nil}
+		for _, ar := range nf.h.ars {
+			arstr := fmt.Sprintf("\t%-8s archive: %s\n", riborupdatestr(ar.descriminator), ar.GetCollectorString())
+			retc <- api.Reply{Data: []byte(arstr), Err: nil}
+		}
+	}()
+	return api.HdrReply{Code: httpCode(errnoar)}, retc
+}
+
+//ArchiveInfo describes one of the archives of the help message
+type ArchiveInfo struct {
+	Collector     string `json:"collector"`
+	Descriminator string `json:"descriminator"`
+	StartDate     string `json:"startDate,omitempty"` //empty if the archive has no files
+	EndDate       string `json:"endDate,omitempty"`
+	FileCount     int    `json:"fileCount"`
+}
+
+//ArchiveList is the machine readable counterpart of HelpMsg.
+//It lists the same archives with their date ranges as a JSON array.
+type ArchiveList struct {
+	h *HelpMsg
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewArchiveList(h *HelpMsg) *ArchiveList {
+	return &ArchiveList{h: h}
+}
+
+func (al *ArchiveList) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	go func() {
+		defer close(retc)
+		infos := make([]ArchiveInfo, 0, len(al.h.ars))
+		for _, ar := range al.h.ars {
+			files := ar.getEntryFiles()
+			info := ArchiveInfo{
+				Collector:     ar.GetCollectorString(),
+				Descriminator: ar.descriminator,
+				FileCount:     len(files),
+			}
+			if len(files) > 0 {
+				info.StartDate = files[0].Sdate.UTC().Format(time.RFC3339)
+				info.EndDate = files[len(files)-1].Sdate.UTC().Format(time.RFC3339)
+			}
+			infos = append(infos, info)
+		}
+		b, err := json.Marshal(infos)
+		if err != nil {
+			retc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+	}()
+	return api.HdrReply{Code: 200, ContentType: "application/json"}, retc
+}
+
 type BgpStats struct {
 	StartTime                                          string
 	EndTime                                            string
 	Delta_sec                                          int
 	TotalMsgs                                          int64
 	TotalPerDelta, Withdrawn, NLRI, MPReach, MPUnreach []int
+	//RIB records. every TABLE_DUMP_V2 record is one prefix with many entries
+	//and every TABLE_DUMP one is a single entry
+	RibPrefixes, RibEntries []int
+	//with anomaly=k, the buckets with more messages than the mean plus k
+	//standard deviations of the ANOMALY_WINDOW buckets before them
+	Anomalies []int `json:",omitempty"`
+	//with stream=true, the files that couldn't be read to the end. without
+	//it they are sent before the stats
+	Errors []string `json:",omitempty"`
 }
 
 //To perform a query asynchronously on possibly many files we fire multiple goroutines
 //that all write their results to chan api.Reply, and we also need the waitgroup
 //to know when we should close the channel to end the http transaction
 type archive interface {
-	Query(time.Time, time.Time, chan api.Reply, *sync.WaitGroup)
+	Query(time.Time, time.Time, *queryParams, chan api.Reply, *sync.WaitGroup)
+	getFileIndexRange(time.Time, time.Time) (TimeEntrySlice, int, int, error)
 }
 
 type contpuller interface {
-	getContextChans() (chan contCmd, chan contCli)
+	contReply(cmd contCmd) (contCli, bool)
 }
 
 type contarchive interface {
@@ -169,6 +518,21 @@ type ArchEntryFile struct {
 	Sdate   time.Time
 	Sz      int64
 	Offsets []EntryOffset
+	//the BGP4MP peers of the file, set by indextool. Peer queries skip
+	//the files whose peers are indexed and don't include theirs.
+	Peers        []FilePeer
+	PeersIndexed bool
+}
+
+//indexPoints returns the number of offsets that can be seeked to,
+//skipping the zero valued ones at the tail like getOffset.
+func (a ArchEntryFile) indexPoints() (n int) {
+	for _, o := range a.Offsets {
+		if !o.Time.IsZero() {
+			n++
+		}
+	}
+	return
 }
 
 func (a ArchEntryFile) String() string {
@@ -185,6 +549,8 @@ func (a TimeEntrySlice) String() string {
 	return strings.Join(ret, " ")
 }
 
+//ToGobFile writes a headerless gob index file. New index files
+//should be written with ToFile.
 func (t *TimeEntrySlice) ToGobFile(fname string) (err error) {
 	m := new(bytes.Buffer)
 	enc := gob.NewEncoder(m)
@@ -194,7 +560,7 @@ func (t *TimeEntrySlice) ToGobFile(fname string) (err error) {
 		return
 	}
 
-	err = ioutil.WriteFile(fname, m.Bytes(), 0600)
+	err = writeFileAtomic(fname, m.Bytes())
 	return
 }
 
@@ -210,6 +576,90 @@ func (t *TimeEntrySlice) FromGobFile(fname string) (err error) {
 	return
 }
 
+const (
+	//INDEX_MAGIC starts every index file written by ToFile. Files without it
+	//are legacy headerless gob files (version 0).
+	INDEX_MAGIC = "BGPARIDX"
+	//INDEX_VERSION is the version of the ArchEntryFile schema written by ToFile.
+	//Bump it whenever ArchEntryFile changes in a way old binaries can't decode.
+	//Version 2 added the checksum.
+	INDEX_VERSION uint32 = 2
+)
+
+//ToFile writes the entries in a versioned index file. The file starts with
+//INDEX_MAGIC and the big endian INDEX_VERSION followed by the gob encoded entries
+//and the big endian CRC32 (IEEE) of them.
+func (t *TimeEntrySlice) ToFile(fname string) (err error) {
+	m := new(bytes.Buffer)
+	m.WriteString(INDEX_MAGIC)
+	binary.Write(m, binary.BigEndian, INDEX_VERSION)
+	hdrlen := m.Len()
+	enc := gob.NewEncoder(m)
+	if err = enc.Encode(t); err != nil {
+		return
+	}
+	binary.Write(m, binary.BigEndian, crc32.ChecksumIEEE(m.Bytes()[hdrlen:]))
+	err = writeFileAtomic(fname, m.Bytes())
+	return
+}
+
+//writeFileAtomic writes, syncs and renames so that a crash never leaves a
+//truncated index file behind, only the previous one. The temporary file has
+//a unique name, so that two writers of the same file don't write over each other.
+func writeFileAtomic(fname string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//FromFile reads an index file written by ToFile, or a legacy file written by
+//ToGobFile. It refuses files of a newer version than INDEX_VERSION and the ones
+//that don't match their checksum. Files older than version 2 have none.
+func (t *TimeEntrySlice) FromFile(fname string) (err error) {
+	n, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	if !bytes.HasPrefix(n, []byte(INDEX_MAGIC)) { //version 0
+		return gob.NewDecoder(bytes.NewBuffer(n)).Decode(t)
+	}
+	n = n[len(INDEX_MAGIC):]
+	if len(n) < 4 {
+		return fmt.Errorf("index file:%s is truncated", fname)
+	}
+	ver := binary.BigEndian.Uint32(n)
+	if ver == 0 || ver > INDEX_VERSION {
+		return fmt.Errorf("index file:%s has version %d but only versions up to %d are supported", fname, ver, INDEX_VERSION)
+	}
+	n = n[4:]
+	if ver >= 2 {
+		if len(n) < 4 {
+			return fmt.Errorf("index file:%s is truncated", fname)
+		}
+		sum := binary.BigEndian.Uint32(n[len(n)-4:])
+		n = n[:len(n)-4]
+		if crc32.ChecksumIEEE(n) != sum {
+			return fmt.Errorf("index file:%s is corrupt. its checksum does not match", fname)
+		}
+	}
+	return gob.NewDecoder(bytes.NewBuffer(n)).Decode(t)
+}
+
 func (p TimeEntrySlice) Len() int {
 	return len(p)
 }
@@ -224,14 +674,33 @@ func (p TimeEntrySlice) Swap(i, j int) {
 
 type fsarchive struct {
 	rootpathstr    string
+	fs             archiveFS //where the files under rootpathstr are
 	entryfiles     *TimeEntrySlice
 	tempentryfiles TimeEntrySlice
+	fresh          TimeEntrySlice       //files newer than the entryfiles found by the running scan. protected by entrymu
+	freshview      TimeEntrySlice       //the entryfiles followed by the fresh files. built by getQueryFiles
+	scanfiles      map[scanKey][]string //the tempentryfiles paths by date and size. built by seenFile
+	scanpaths      map[string]bool      //the tempentryfiles paths. built by seenFile
+	firstdates     *firstDatePool       //reads the first dates of the files of the running scan
 	reqchan        chan string
-	scanning       bool
+	scanning       int32        //accessed atomically. use isScanning and setScanning
+	scanworkers    int          //max number of files a query scans concurrently
+	scanopenfiles  int          //max number of files a scan reads the first date of concurrently
+	watch          bool         //watch the filesystem for new files instead of rescanning
+	writable       bool         //files can be uploaded to the archive. see SetWritable
+	entrymu        sync.RWMutex //protects the entryfiles pointer, entrytag and entrymod
+	entrytag       string       //ETag of the entryfiles
+	entrymod       time.Time    //when the entryfiles last changed
 	scanwg         *sync.WaitGroup
 	scanch         chan struct{}
+	stopped        chan struct{} //closed once the serve goroutine has stopped. use request to send on reqchan
+	stoponce       *sync.Once    //sends the STOP of Close
 	timedelta      time.Duration
+	lastmu         sync.Mutex          //protects lastdates
+	lastdates      map[string]lastDate //the last record times that getLastDate read, by path
 	descriminator  string
+	patterns       []string //a file is part of the archive if its path matches any of these
+	dirlayouts     []string //time layouts of the year and month dirs. see SetDirLayouts
 	refreshmin     int
 	//this context will allow us to communicate with the continuous pull client goroutine
 	contctx *contCtx
@@ -245,13 +714,135 @@ type fsarchive struct {
 	api.DeleteNotAllowed
 }
 
-func (f *fsarchive) getContextChans() (chan contCmd, chan contCli) {
-	return f.contctx.reqch, f.contctx.repch
+//getEntryFiles returns the current snapshot of the archive files.
+//A snapshot is never modified after it's published by setEntryFiles,
+//so it can be used without any locking. An archive that was not created
+//by NewFsArchive and hasn't been scanned yet has no files, which the
+//queries answer with errempty.
+func (f *fsarchive) getEntryFiles() TimeEntrySlice {
+	f.entrymu.RLock()
+	defer f.entrymu.RUnlock()
+	if f.entryfiles == nil {
+		return nil
+	}
+	return *f.entryfiles
+}
+
+//addFresh makes a file found by a running scan visible to the queries before
+//the scan is over, if it is newer than all the entryfiles. Older files can't
+//be inserted without a copy of the entryfiles and wait for the end of the scan.
+func (f *fsarchive) addFresh(ef ArchEntryFile) {
+	f.entrymu.Lock()
+	defer f.entrymu.Unlock()
+	if f.entryfiles != nil && len(*f.entryfiles) > 0 && !ef.Sdate.After((*f.entryfiles)[len(*f.entryfiles)-1].Sdate) {
+		return
+	}
+	ind := sort.Search(len(f.fresh), func(i int) bool {
+		return f.fresh[i].Sdate.After(ef.Sdate)
+	})
+	//a new slice, since the previous one can be in use by getQueryFiles snapshots
+	fresh := make(TimeEntrySlice, 0, len(f.fresh)+1)
+	fresh = append(fresh, f.fresh[:ind]...)
+	fresh = append(fresh, ef)
+	f.fresh = append(fresh, f.fresh[ind:]...)
+	f.freshview = nil
+}
+
+//getQueryFiles is getEntryFiles followed by the files newer than them that
+//the running scan already found, so that queries see fresh data before a
+//long scan is over. Like getEntryFiles the snapshot is never modified.
+func (f *fsarchive) getQueryFiles() TimeEntrySlice {
+	f.entrymu.RLock()
+	fresh, view := len(f.fresh) > 0, f.freshview
+	f.entrymu.RUnlock()
+	if !fresh {
+		return f.getEntryFiles()
+	}
+	if view != nil {
+		return view
+	}
+	f.entrymu.Lock()
+	defer f.entrymu.Unlock()
+	if f.freshview == nil && len(f.fresh) > 0 {
+		var v TimeEntrySlice
+		if f.entryfiles != nil {
+			v = append(v, *f.entryfiles...)
+		}
+		f.freshview = append(v, f.fresh...)
+	}
+	if f.freshview == nil { //the scan was over before we got the lock
+		if f.entryfiles == nil {
+			return nil
+		}
+		return *f.entryfiles
+	}
+	return f.freshview
+}
+
+//setEntryFiles publishes a copy of the files found by the last scan.
+//the copy is needed because the scans keep appending to and sorting tempentryfiles.
+func (f *fsarchive) setEntryFiles(a TimeEntrySlice) {
+	cp := make(TimeEntrySlice, len(a))
+	copy(cp, a)
+	tag := entriesTag(cp)
+	f.entrymu.Lock()
+	old := f.entryfiles
+	f.entryfiles = &cp
+	f.fresh, f.freshview = nil, nil //the scan that found them is over
+	if tag != f.entrytag {
+		f.entrytag, f.entrymod = tag, time.Now()
+	}
+	f.entrymu.Unlock()
+	if resultcache != nil && tag != "" {
+		known := make(map[string]bool)
+		if old != nil {
+			for _, ef := range *old {
+				known[ef.Path] = true
+			}
+		}
+		added := make(map[string]bool)
+		for _, ef := range cp {
+			if !known[ef.Path] {
+				added[ef.Path] = true
+			}
+		}
+		resultcache.invalidate(f, cp, added)
+	}
+}
+
+//getEntriesTag returns the ETag of the current archive files and when they
+//last changed, for the replies that only change when the files do.
+//The tag is empty until the files are first set.
+func (f *fsarchive) getEntriesTag() (string, time.Time) {
+	f.entrymu.RLock()
+	defer f.entrymu.RUnlock()
+	return f.entrytag, f.entrymod
+}
+
+//entriesTag hashes everything about the files that the conf replies show.
+//It is a weak tag since the replies can be sent compressed or not.
+func entriesTag(a TimeEntrySlice) string {
+	h := fnv.New64a()
+	for _, ef := range a {
+		fmt.Fprintf(h, "%s %d %d %d\n", ef.Path, ef.Sdate.Unix(), ef.Sz, ef.indexPoints())
+	}
+	return fmt.Sprintf("W/\"%x\"", h.Sum64())
+}
+
+func (f *fsarchive) isScanning() bool {
+	return atomic.LoadInt32(&f.scanning) == 1
+}
+
+func (f *fsarchive) setScanning(a bool) {
+	var v int32
+	if a {
+		v = 1
+	}
+	atomic.StoreInt32(&f.scanning, v)
 }
 
 func (f *fsarchive) GetDateRangeString() string {
-	if len(*(f.entryfiles)) > 0 {
-		files := *(f.entryfiles)
+	if files := f.getEntryFiles(); len(files) > 0 {
 		dates := fmt.Sprintf("%s - %s\n", files[0].Sdate, files[len(files)-1].Sdate)
 		return dates
 	}
@@ -266,34 +857,64 @@ func (f *fsarchive) GetCollectorString() string {
 type contCli struct {
 	t1pull time.Time
 	t2pull time.Time
+	ack    time.Time     //the time of the last record the client got of its previous pull. zero if not sent
+	lag    time.Duration //the pulls end this long before the current time
+	begun  time.Time     //when the client registered, for the age of the session
 	ip     string
 	id     string //the associated current id with this client
 	err    error
-	cchan  chan bool //the chan to cancel the timeout goroutine
+	cchan  chan bool //the chan to cancel the timeout goroutine. buffered so cancelling never blocks
+}
+
+//cancelTimer stops the timeout goroutine of the client without blocking,
+//even if the timer already fired or was already cancelled.
+func (a *contCli) cancelTimer() {
+	if a.cchan == nil {
+		return
+	}
+	select {
+	case a.cchan <- true:
+	default:
+	}
 }
 
 type contCmd struct {
-	cmd int
-	cli contCli
+	cmd  int
+	cli  contCli
+	sess chan []ContSession //where CONT_LIST and CONT_REVOKE reply instead of repch
 }
 
 const (
 	CONT_ADD int = iota
 	CONT_GET
 	CONT_EXISTS
-	CONTCLISZ = 100
+	CONT_LIST   //list the sessions
+	CONT_REVOKE //remove the session of the id, or all the sessions of the ip
+	CONTCLISZ   = 100
 )
 
+//CONT_TIMEOUT is how long a continuous pulling id stays valid without being pulled
+const CONT_TIMEOUT = 30 * time.Minute
+
+//contCtx is driven by the event loop started by Serve, but its maps are
+//locked so that the Exists and Get helpers can also be called from other goroutines.
 type contCtx struct {
+	mu       sync.RWMutex          //protects contclis and contuuid
 	contclis map[string][]*contCli //one ip can have up to CONTCLISZ contexts associated at any point
 	contuuid map[string]*contCli
 	reqch    chan contCmd
 	repch    chan contCli
 	ug       *fastuuid.Generator
+	clients  prometheus.Gauge //number of registered clients
+	done     chan struct{}    //closed by Stop to end the event loop and the timers
+	loopwg   sync.WaitGroup
+	timerwg  sync.WaitGroup
+	savepath string //where the sessions are persisted. empty disables persistence
 }
 
-func newContCtx() *contCtx {
+func newContCtx(clients prometheus.Gauge) *contCtx {
 	return &contCtx{
+		clients:  clients,
 		contclis: make(map[string][]*contCli),
 		contuuid: make(map[string]*contCli),
 		reqch:    make(chan contCmd),
@@ -306,6 +927,8 @@ func (ctx *contCtx) Add(a *contCli) error {
 	if a.ip == "" && a.id == "" {
 		return errors.New("both arguments in Add empty")
 	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	if a.ip != "" {
 		contexts, ok := ctx.contclis[a.ip]
 		if ok {
@@ -319,12 +942,14 @@ func (ctx *contCtx) Add(a *contCli) error {
 	}
 	u := ctx.ug.Next()
 	uhex := hex.EncodeToString(u[:16])
-	a.t1pull = time.Now()
+	a.begun = time.Now()
+	a.t1pull = a.begun.Add(-a.lag)
 	a.id = uhex
-	a.cchan = make(chan bool)
+	a.cchan = make(chan bool, 1)
 	ctx.contclis[a.ip] = append(ctx.contclis[a.ip], a)
 	ctx.contuuid[a.id] = a
-	ctx.PrintClis()
+	ctx.clients.Set(float64(len(ctx.contuuid)))
+	ctx.printClis()
 	return nil
 }
 
@@ -336,19 +961,25 @@ func (ctx *contCtx) Del(a *contCli) error {
 	if a.ip == "" && a.id == "" {
 		return errors.New("both arguments in Del empty")
 	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	if a.ip != "" {
-		log.Printf("querying node :%+v by ip", a) //sanity check to ensure the ip is registered
+		debugf("querying node :%+v by ip", a) //sanity check to ensure the ip is registered
 		vals, ok = ctx.contclis[a.ip]
 		if !ok {
 			return errors.New("ip not registered")
 		}
 	} else if a.id != "" {
-		log.Printf("removing node :%+v by id", a)
+		debugf("removing node :%+v by id", a)
 		_, ok = ctx.contuuid[a.id]
 		if !ok {
 			return errors.New("id not registered")
 		}
 	}
+	//the client can be removed before its timer fires, which must not fire later
+	if c, ok := ctx.contuuid[a.id]; ok {
+		c.cancelTimer()
+	}
 	for i := range vals {
 		if vals[i].id == a.id {
 			ctx.contclis[a.ip] = append(vals[:i], vals[i+1:]...)
@@ -358,21 +989,35 @@ func (ctx *contCtx) Del(a *contCli) error {
 		delete(ctx.contclis, a.ip) //deregister this ip from the keys
 	}
 	delete(ctx.contuuid, a.id)
-	ctx.PrintClis()
+	ctx.clients.Set(float64(len(ctx.contuuid)))
+	ctx.printClis()
 	return nil
 }
 
 func (ctx *contCtx) ExistsId(a string) bool {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
 	_, ok := ctx.contuuid[a]
 	return ok
 }
 
 func (ctx *contCtx) ExistsIP(a string) bool {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
 	_, ok := ctx.contclis[a]
 	return ok
 }
 
+//getCli returns the client registered with the id, or nil
+func (ctx *contCtx) getCli(id string) *contCli {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.contuuid[id]
+}
+
 func (ctx *contCtx) GetIDsfromIP(a string) (ret []string) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
 	cclis, ok := ctx.contclis[a]
 	if ok {
 		for i := range cclis {
@@ -386,21 +1031,36 @@ func (ctx *contCtx) GetIDsfromIP(a string) (ret []string) {
 
 // UpdateCli is based on the id existing in the argument. so only use it if you have checked for existance via id
 func (ctx *contCtx) UpdateCli(a *contCli) {
-	log.Printf("----before update")
-	ctx.PrintClis()
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	debugf("----before update")
+	ctx.printClis()
 	val := ctx.contuuid[a.id] //on the subsequent calls we need to use val because a is mostly empty for now.
 	//val also contains the PREVIOUS id
 	if val.t2pull.IsZero() { //first pull after start
 		a.t1pull = val.t1pull
-		a.t2pull = time.Now()
+		a.t2pull = time.Now().Add(-a.lag)
 	} else { // we update both
 		a.t1pull = val.t2pull
-		a.t2pull = time.Now()
+		//the previous pull was cut short, so resume from the last record the client got.
+		//it is sent again, since the records of the same time can't be told apart.
+		if !a.ack.IsZero() && a.ack.Before(val.t2pull) {
+			a.t1pull = a.ack
+			if a.ack.Before(val.t1pull) {
+				a.t1pull = val.t1pull
+			}
+		}
+		a.t2pull = time.Now().Add(-a.lag)
 	}
+	//a larger lag than the previous pull's would go back in time
+	if a.t2pull.Before(a.t1pull) {
+		a.t2pull = a.t1pull
+	}
+	a.begun = val.begun
 	u := ctx.ug.Next()
 	uhex := hex.EncodeToString(u[:16])
 	a.id = uhex
-	a.cchan = make(chan bool)
+	a.cchan = make(chan bool, 1)
 	delete(ctx.contuuid, val.id) //remove previous id
 	for i := range ctx.contclis[val.ip] {
 		if ctx.contclis[val.ip][i].id == val.id {
@@ -408,80 +1068,149 @@ func (ctx *contCtx) UpdateCli(a *contCli) {
 		}
 	}
 	ctx.contuuid[a.id] = a // register new id
-	log.Printf("----after update")
-	ctx.PrintClis()
+	debugf("----after update")
+	ctx.printClis()
 }
 
 func (ctx *contCtx) PrintClis() {
-	log.Printf("PRINTING")
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	ctx.printClis()
+}
+
+//printClis must be called with mu held
+func (ctx *contCtx) printClis() {
+	debugf("PRINTING")
 	for k, v := range ctx.contclis {
-		log.Printf("by IP key:%v val:%v", k, v)
+		debugf("by IP key:%v val:%v", k, v)
 	}
 	for k, v := range ctx.contuuid {
-		log.Printf("by ID key:%v val:%v", k, v)
+		debugf("by ID key:%v val:%v", k, v)
 	}
 }
 
-func setTimer(a *contCli, expirech chan *contCli) {
-	timer := time.NewTimer(30 * time.Minute)
+func (ctx *contCtx) setTimer(a *contCli, expirech chan *contCli) {
+	ctx.setTimerDuration(a, expirech, CONT_TIMEOUT)
+}
+
+func (ctx *contCtx) setTimerDuration(a *contCli, expirech chan *contCli, d time.Duration) {
+	timer := time.NewTimer(d)
+	done := ctx.done
+	ctx.timerwg.Add(1)
 	go func() {
-		log.Printf("timer for context:%+v started", a)
+		defer ctx.timerwg.Done()
+		debugf("timer for context:%+v started", a)
 		select {
 		case <-timer.C:
-			expirech <- a
+			//the client can still be removed while the event loop is busy,
+			//so the cancel is waited for along with the loop.
+			select {
+			case expirech <- a:
+			case <-a.cchan:
+				debugf("timer for context:%+v canceled after firing", a)
+			case <-done: //the event loop is gone
+			}
 		case <-a.cchan:
 			timer.Stop()
-			log.Printf("timer for context:%+v canceled", a)
+			debugf("timer for context:%+v canceled", a)
+		case <-done:
+			timer.Stop()
 		}
 		return //this kills the goroutine
 	}()
 }
 
+//Stop ends the continuous pulling event loop started by Serve and
+//waits for it and all the client timers to exit.
+func (ctx *contCtx) Stop() {
+	if ctx.done == nil {
+		return
+	}
+	close(ctx.done)
+	ctx.loopwg.Wait()
+	ctx.timerwg.Wait()
+	ctx.done = nil
+}
+
 //serve just fires the goroutine that handles the continuous pulling
 func (ctx *contCtx) Serve() {
+	done := make(chan struct{})
+	ctx.done = done
+	ctx.loopwg.Add(1)
 	//this is the goroutine that is the main event loop for the continuous pulling engine
 	go func() {
+		defer ctx.loopwg.Done()
 		expirech := make(chan *contCli) //this is the aggregate channel that the timer goroutines will write their expiration
+		var savec <-chan time.Time
+		if ctx.savepath != "" {
+			if err := ctx.load(expirech); err != nil {
+				warnf("failed loading continuous pull sessions:%s", err)
+			}
+			saveticker := time.NewTicker(CONT_SAVE_INTERVAL)
+			defer saveticker.Stop()
+			savec = saveticker.C
+		}
 		for {
 			select {
+			case <-done:
+				infof("continuous pull event loop stopping")
+				if ctx.savepath != "" {
+					if err := ctx.save(); err != nil {
+						warnf("failed saving continuous pull sessions:%s", err)
+					}
+				}
+				return
+			case <-savec:
+				if err := ctx.save(); err != nil {
+					warnf("failed saving continuous pull sessions:%s", err)
+				}
 			case cmd := <-ctx.reqch:
-				log.Printf("i got cmd:%+v with arg:%+v", cmd.cmd, cmd.cli)
+				debugf("i got cmd:%+v with arg:%+v", cmd.cmd, cmd.cli)
 				switch cmd.cmd {
 				case CONT_ADD:
 					err := ctx.Add(&cmd.cli)
 					if err != nil {
-						log.Printf("error :%s with cli:%+v", err, cmd.cli)
+						warnf("error :%s with cli:%+v", err, cmd.cli)
 						ctx.repch <- contCli{err: err}
 					} else {
-						setTimer(&cmd.cli, expirech)
-						log.Printf("cont event loop firing new timer with id:%s", cmd.cli.id)
+						ctx.setTimer(&cmd.cli, expirech)
+						debugf("cont event loop firing new timer with id:%s", cmd.cli.id)
 						ctx.repch <- cmd.cli
 					}
 
 				case CONT_GET, CONT_EXISTS:
-					log.Printf("querying for id:%s", cmd.cli.id)
+					debugf("querying for id:%s", cmd.cli.id)
 					if ctx.ExistsId(cmd.cli.id) {
-						log.Printf("FOUND by id")
-						oval := ctx.contuuid[cmd.cli.id]
-						oval.cchan <- true
+						debugf("FOUND by id")
+						oval := ctx.getCli(cmd.cli.id)
+						oval.cancelTimer()
 						ctx.UpdateCli(&cmd.cli) // UpdateCli is based on the id existing in the argument. so only use it if you have checked for existance via id
-						setTimer(&cmd.cli, expirech)
+						ctx.setTimer(&cmd.cli, expirech)
 					} else if ctx.ExistsIP(cmd.cli.ip) {
 						cmd.cli.err = errors.New(fmt.Sprintf("ip has a handler registered but this id is NX. current IDs associated with your ip are %v", ctx.GetIDsfromIP(cmd.cli.ip)))
-						log.Printf("%s", cmd.cli.err)
+						infof("%s", cmd.cli.err)
 					} else {
 						cmd.cli.err = errors.New("non existant ID")
-						log.Printf("%s", cmd.cli.err)
+						infof("%s", cmd.cli.err)
 					}
 					ctx.repch <- cmd.cli
+				case CONT_LIST:
+					cmd.sess <- ctx.sessions()
+				case CONT_REVOKE:
+					cmd.sess <- ctx.revoke(cmd.cli.id, cmd.cli.ip)
 				}
 
 			case expcli := <-expirech:
-				log.Printf("timer for:%+v expired. removing", expcli)
-				err := ctx.Del(expcli)
-				if err != nil {
-					log.Printf("Del error :%s with cli:%+v", err, expcli)
-					ctx.repch <- contCli{err: err}
+				//the timer can fire as its client is removed or pulls, and
+				//then the client it carries isn't registered anymore.
+				if ctx.getCli(expcli.id) != expcli {
+					debugf("timer for:%+v expired after it was canceled. ignoring", expcli)
+					continue
+				}
+				debugf("timer for:%+v expired. removing", expcli)
+				//nobody waits on repch for an expiry, so the error is only logged
+				if err := ctx.Del(expcli); err != nil {
+					warnf("Del error :%s with cli:%+v", err, expcli)
 				}
 			}
 		}
@@ -524,19 +1253,78 @@ func (m *mrtarchive) GetScanWaitGroup() *sync.WaitGroup {
 }
 
 func (m *mrtarchive) Save(a string) error {
-	return m.tempentryfiles.ToGobFile(a)
+	return m.tempentryfiles.ToFile(a)
 }
 
 func (m *mrtarchive) Load(a string) error {
-	return m.tempentryfiles.FromGobFile(a)
+	return m.tempentryfiles.FromFile(a)
 }
 
 func (m *mrtarchive) GetReqChan() chan string {
 	return m.reqchan
 }
 
+//Close stops the scanning and continuous pulling goroutines started by Serve.
+//It returns once they have exited. Closing it again does nothing.
+func (m *mrtarchive) Close() {
+	m.stoponce.Do(func() {
+		m.request("STOP")
+	})
+	m.contctx.loopwg.Wait()
+}
+
+//request sends a command to the serve goroutine. It returns false without
+//sending it if the archive has been stopped.
+func (fsa *fsarchive) request(cmd string) bool {
+	select {
+	case fsa.reqchan <- cmd:
+		return true
+	case <-fsa.stopped:
+		return false
+	}
+}
+
+//requestDone sends a command to the serve goroutine and returns once it is
+//done with it. The goroutine handles one command at a time, so once it takes
+//the SYNC that follows cmd, cmd is done. It returns false if the archive
+//has been stopped.
+func (fsa *fsarchive) requestDone(cmd string) bool {
+	return fsa.request(cmd) && fsa.request("SYNC")
+}
+
+//contRequest sends a session command to the continuous pulling event loop
+//and returns the sessions it replies with. It returns false without sending
+//it if the archive has been stopped.
+func (fsa *fsarchive) contRequest(cmd contCmd) ([]ContSession, bool) {
+	cmd.sess = make(chan []ContSession, 1)
+	select {
+	case fsa.contctx.reqch <- cmd:
+	case <-fsa.stopped:
+		return nil, false
+	}
+	return <-cmd.sess, true
+}
+
+//contReply sends a CONT_ADD or CONT_GET command to the continuous pulling
+//event loop and returns the client it replies with. It returns false without
+//sending it if the archive has been stopped.
+func (fsa *fsarchive) contReply(cmd contCmd) (contCli, bool) {
+	select {
+	case fsa.contctx.reqch <- cmd:
+	case <-fsa.stopped:
+		return contCli{}, false
+	}
+	return <-fsa.contctx.repch, true
+}
+
+//SetContSavePath makes the continuous pulling sessions survive restarts
+//by saving them in a file. It must be called before Serve.
+func (m *mrtarchive) SetContSavePath(a string) {
+	m.contctx.savepath = a
+}
+
 func (m *mrtarchive) SetEntryFilesToTemp() {
-	m.entryfiles = &m.tempentryfiles
+	m.setEntryFiles(m.tempentryfiles)
 }
 
 type fsarconf struct {
@@ -557,27 +1345,121 @@ func NewFsarstat(a *fsarchive) *fsarstat {
 	return &fsarstat{fsarchive: a}
 }
 
+//fsarcount counts the messages a query would return without sending them
+type fsarcount struct {
+	*fsarchive
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewFsarcount(a *fsarchive) *fsarcount {
+	return &fsarcount{fsarchive: a}
+}
+
+//fsarfile sends the raw bytes of a single archive file
+type fsarfile struct {
+	*fsarchive
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewFsarfile(a *fsarchive) *fsarfile {
+	return &fsarfile{fsarchive: a}
+}
+
 func NewFsarconf(a *fsarchive) *fsarconf {
 	return &fsarconf{fsarchive: a}
 }
 
-//in order not to block in gets, we need to
-//fire a new goroutine to send the api.Reply on the channel
-//the reason is that we create the channel here and we must
-//return it to the responsewriter and any sends would block
-//without the receiver being ready.
-func (fsc *fsarconf) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+//FILE_CHUNKSZ is the size of the replies a file is sent in
+const FILE_CHUNKSZ = 64 * 1024
+
+//lookupFile returns the archive file with the name as listed by ?files.
+//Only the names of the entry files are accepted, so no other path can be opened.
+func (fsf *fsarfile) lookupFile(name string) (ArchEntryFile, bool) {
+	if name == "" || name != filepath.Base(name) {
+		return ArchEntryFile{}, false
+	}
+	for _, f := range fsf.getEntryFiles() {
+		if filepath.Base(f.Path) == name {
+			return f, true
+		}
+	}
+	return ArchEntryFile{}, false
+}
+
+func (fsf *fsarfile) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return fsf.GetContext(context.Background(), values)
+}
+
+//GetContext sends the file named by the name parameter as it is on disk.
+func (fsf *fsarfile) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
 	retc := make(chan api.Reply)
+	var (
+		file archiveFile
+		fi   os.FileInfo
+	)
+	ef, ok := fsf.lookupFile(values.Get("name"))
+	err := errnofile
+	if ok {
+		if file, err = fsf.fs.Open(ef.Path); err == nil {
+			if fi, err = file.Stat(); err != nil {
+				file.Close()
+			}
+		}
+	}
+	if err != nil {
+		if err != errnofile {
+			warnf("failed opening file:%s error:%s", ef.Path, err)
+		}
+		countRequestError(httpCode(errnofile))
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: errnofile}
+		}()
+		return api.HdrReply{Code: httpCode(errnofile)}, retc
+	}
 	go func() {
-		defer close(retc) //must close the chan to let the listener finish.
-		arfiles := fsc.fsarchive.entryfiles
-		if arfiles == nil {
-			log.Printf("nil arfile in fsarconf. ignoring request\n")
-			return
+		defer close(retc)
+		defer file.Close()
+		//a file that is still being written is only sent up to the Content-Length
+		r := io.LimitReader(file, fi.Size())
+		for {
+			buf := make([]byte, FILE_CHUNKSZ)
+			nb, err := r.Read(buf)
+			if nb > 0 {
+				select {
+				case retc <- api.Reply{Data: buf[:nb], Err: nil}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				warnf("error reading file:%s error:%s", ef.Path, err)
+				return
+			}
 		}
+	}()
+	return api.HdrReply{Code: 200, ContentType: "application/octet-stream", ContentLength: fi.Size()}, retc
+}
+
+//in order not to block in gets, we need to
+//fire a new goroutine to send the api.Reply on the channel
+//the reason is that we create the channel here and we must
+//return it to the responsewriter and any sends would block
+//without the receiver being ready.
+func (fsc *fsarconf) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	go func() {
+		defer close(retc) //must close the chan to let the listener finish.
+		arfiles := fsc.fsarchive.getEntryFiles()
 		if _, ok := values["range"]; ok {
-			if len(*arfiles) > 0 {
-				f := *arfiles
+			if len(arfiles) > 0 {
+				f := arfiles
 				dates := fmt.Sprintf("%s - %s\n", f[0].Sdate, f[len(f)-1].Sdate)
 				retc <- api.Reply{Data: []byte(dates), Err: nil}
 				return
@@ -586,75 +1468,628 @@ func (fsc *fsarconf) Get(values url.Values) (api.HdrReply, chan api.Reply) {
 			return
 		}
 		if _, ok := values["files"]; ok {
-			for _, f := range *arfiles {
+			for _, f := range arfiles {
 				retc <- api.Reply{Data: []byte(fmt.Sprintf("%s\n", filepath.Base(f.Path))), Err: nil}
 			}
 			return
 		}
+		if _, ok := values["stats"]; ok {
+			fstats := make([]FileIndexStats, len(arfiles))
+			for i, f := range arfiles {
+				fstats[i] = FileIndexStats{Name: filepath.Base(f.Path), Size: f.Sz, Points: f.indexPoints()}
+				fstats[i].Indexed = fstats[i].Points > 0
+			}
+			b, err := json.Marshal(fstats)
+			if err != nil {
+				retc <- api.Reply{Data: nil, Err: err}
+				return
+			}
+			retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+			return
+		}
+		if _, ok := values["summary"]; ok {
+			b, err := json.Marshal(summarize(arfiles))
+			if err != nil {
+				retc <- api.Reply{Data: nil, Err: err}
+				return
+			}
+			retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+			return
+		}
 		return
 	}()
-	return api.HdrReply{Code: 200}, retc
+	h := api.HdrReply{Code: 200}
+	_, stats := values["stats"]
+	_, summary := values["summary"]
+	if stats || summary {
+		h.ContentType = "application/json"
+	}
+	//the conf only changes when the files do, so pollers can ask if it did
+	h.ETag, h.LastModified = fsc.getEntriesTag()
+	return h, retc
+}
+
+//FileIndexStats tells if an archive file has offsets for the seek optimization
+//or needs to be run through indextool.
+type FileIndexStats struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Indexed bool   `json:"indexed"`
+	Points  int    `json:"points"` //number of offsets
+}
+
+//ArchiveSummary is how much data an archive holds. The dates are those of
+//the first and last file and are left out if the archive is empty.
+type ArchiveSummary struct {
+	FileCount   int        `json:"fileCount"`
+	TotalBytes  int64      `json:"totalBytes"`
+	FirstDate   *time.Time `json:"firstDate,omitempty"`
+	LastDate    *time.Time `json:"lastDate,omitempty"`
+	AvgFileSize int64      `json:"avgFileSize"`
+}
+
+func summarize(ef []ArchEntryFile) ArchiveSummary {
+	sum := ArchiveSummary{FileCount: len(ef)}
+	if len(ef) == 0 {
+		return sum
+	}
+	for k := range ef {
+		sum.TotalBytes += ef[k].Sz
+	}
+	first, last := ef[0].Sdate, ef[len(ef)-1].Sdate
+	sum.FirstDate, sum.LastDate = &first, &last
+	sum.AvgFileSize = sum.TotalBytes / int64(len(ef))
+	return sum
+}
+
+//dateError is a range that has no files in the archive. It tells the client
+//the range of the archive, and for a gap the range of the missing records,
+//so that it can adjust the request.
+type dateError struct {
+	err         error //errbefore, errafter or errgap
+	first, last time.Time
+	from, to    time.Time //the gap
 }
 
-func getTimerange(values url.Values, ar archive, h api.HdrReply) (api.HdrReply, chan api.Reply) {
+func (d dateError) Error() string {
+	if d.err == errgap {
+		return fmt.Sprintf("%s from %s to %s. the archive has files from %s to %s", d.err, timeToString(d.from), timeToString(d.to), timeToString(d.first), timeToString(d.last))
+	}
+	return fmt.Sprintf("%s. the archive has files from %s to %s", d.err, timeToString(d.first), timeToString(d.last))
+}
+
+//httpCode returns the HTTP status code for a request that failed with err.
+//A range outside of the archive is not satisfiable, while one in a gap of
+//it is just not found.
+func httpCode(err error) int {
+	if d, ok := err.(dateError); ok {
+		if d.err == errgap {
+			return 404
+		}
+		return 416
+	}
+	switch err {
+	case errdate, errnoar, errnofile:
+		return 404
+	case errempty, errbusy, errstopped:
+		return 503
+	case errrange, errlagged:
+		return 416
+	case errunauth:
+		return 401
+	}
+	return 400
+}
+
+//codedError carries the HTTP status code of an error to the JSON error replies
+type codedError struct {
+	error
+	code int
+}
+
+func (c codedError) StatusCode() int {
+	return c.code
+}
+
+//newCodedError classifies err with httpCode
+func newCodedError(err error) error {
+	return codedError{error: err, code: httpCode(err)}
+}
+
+//isNoData is true for the errors of a query whose range has no files yet
+func isNoData(err error) bool {
+	if ce, ok := err.(codedError); ok {
+		err = ce.error
+	}
+	if _, ok := err.(dateError); ok {
+		return true
+	}
+	return err == errdate || err == errempty
+}
+
+func getTimerange(ctx context.Context, values url.Values, ar archive, h api.HdrReply) (api.HdrReply, chan api.Reply) {
+	return getTimerangeUntil(ctx, values, ar, h, time.Time{})
+}
+
+//getTimerangeUntil is getTimerange that also drops the messages at or after
+//until if it is not zero. The end values are in whole seconds, so this is
+//how the first reply of a continuous pull ends exactly where the next pull starts.
+func getTimerangeUntil(ctx context.Context, values url.Values, ar archive, h api.HdrReply, until time.Time) (api.HdrReply, chan api.Reply) {
 	var (
-		grwg sync.WaitGroup
+		grwg     sync.WaitGroup
+		ranges   [][2]time.Time
+		err      error
+		acquired bool
+		brange   *[2]int64
+		loc      *time.Location
+		cq       *cacheQuery
+		lag      time.Duration
 	)
+	sinceerr := sinceValues(values)
 	retc := make(chan api.Reply)
 	timeAstrs, ok1 := values["start"]
 	timeBstrs, ok2 := values["end"]
-	if len(timeAstrs) != len(timeBstrs) || !ok1 || !ok2 {
-		grwg.Add(1)
-		go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errbadreq} }()
+	atstrs, okat := values["at"]
+	asofstrs, okasof := values["asof"]
+	validate := values.Get("validate") == "true"
+	if validate { //the errors are also JSON
+		h.ContentType = "application/json"
+	}
+	qp, qperr := newQueryParams(values)
+	if qp != nil {
+		qp.done = ctx.Done()
+		qp.until = until
+		setSpanTrailers(&h, qp)
+	}
+	if sinceerr != nil {
+		err = sinceerr
 		goto done
 	}
+	//either start and end pairs, at instants or a single asof
+	if okasof {
+		if ok1 || ok2 || okat || len(asofstrs) != 1 {
+			err = errbadreq
+			goto done
+		}
+	} else if okat && (ok1 || ok2) || !okat && (len(timeAstrs) != len(timeBstrs) || !ok1 || !ok2) {
+		err = errbadreq
+		goto done
+	}
+	if len(atstrs) > MAX_AT {
+		err = errmanyat
+		goto done
+	}
+	if len(timeAstrs) > maxranges {
+		err = fmt.Errorf("too many start and end pairs. at most %d ranges can be requested", maxranges)
+		goto done
+	}
+	if qperr != nil {
+		err = qperr
+		goto done
+	}
+	if loc, err = parseTZ(values.Get("tz")); err != nil {
+		goto done
+	}
+	if lag, err = lagValue(values, ar); err != nil {
+		goto done
+	}
+	if okat {
+		if ranges, err = atRanges(atstrs, loc); err != nil {
+			goto done
+		}
+	}
+	if okasof {
+		if ranges, err = asofRanges(ar, asofstrs[0], loc, qp); err != nil {
+			goto done
+		}
+		//the range is the whole file and nothing of the next one
+		qp.exact, qp.slop = true, -1
+	}
+	//all the ranges are validated before any query is fired,
+	//because the status code has to be known before the data is sent.
 	for i := 0; i < len(timeAstrs); i++ {
-		log.Printf("timeAstr:%s timeBstr:%s .Current server time:%v", timeAstrs[i], timeBstrs[i], time.Now())
-		timeA, errtime := time.Parse("20060102150405", timeAstrs[i])
-		timeB, errtime1 := time.Parse("20060102150405", timeBstrs[i])
-		log.Printf("1:%v %v", timeA, timeB)
-		if errtime != nil || errtime1 != nil {
-			log.Printf("date parse error A:%s B:%s", errtime, errtime1)
-			grwg.Add(1)
-			go func() {
-				defer grwg.Done()
-				retc <- api.Reply{Data: nil, Err: errors.New(fmt.Sprintf("%s .Current server time:%v", errbaddate, time.Now()))}
-			}()
+		debugf("timeAstr:%s timeBstr:%s .Current server time:%v", timeAstrs[i], timeBstrs[i], time.Now())
+		timeA, timeB, errtime := parseTimePair(timeAstrs[i], timeBstrs[i], loc)
+		if errtime != nil {
+			warnf("date parse error:%s", errtime)
+			err = errors.New(fmt.Sprintf("%s. %s .Current server time:%v", errtime, errbaddate, time.Now()))
 			goto done
-
 		}
-		if errtime != nil || timeB.Before(timeA) {
-			log.Printf("warning: TimeB before TimeA")
-			grwg.Add(1)
-			go func() {
-				defer grwg.Done()
-				retc <- api.Reply{Data: nil, Err: errors.New(fmt.Sprintf("%s .Current server time:%v", errbaddate, time.Now()))}
-			}()
-		} else if timeA.AddDate(0, 0, 1).Before(timeB) {
-			log.Printf("2:%v %v", timeA, timeB)
-			grwg.Add(1)
-			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errbigdt} }()
-		} else {
-			log.Printf("3:%v %v", timeA, timeB)
-			ar.Query(timeA, timeB, retc, &grwg) //this will fire a new goroutine
+		if timeB.Before(timeA) {
+			warnf("warning: TimeB before TimeA")
+			err = errors.New(fmt.Sprintf("%s .Current server time:%v", errbaddate, time.Now()))
+			goto done
 		}
+		if timeA.AddDate(0, 0, 1).Before(timeB) {
+			err = errbigdt
+			goto done
+		}
+		ranges = append(ranges, [2]time.Time{timeA, timeB})
+	}
+	//with a lag the ranges stop before the files that are still being written.
+	//the ranges that start after that are dropped.
+	if lag > 0 {
+		cutoff := time.Now().Add(-lag)
+		var lagged [][2]time.Time
+		for _, r := range ranges {
+			if !r[0].Before(cutoff) {
+				continue
+			}
+			if r[1].After(cutoff) {
+				r[1] = cutoff
+				//until also drops the messages past it in the slop, and skips
+				//the cache since the end of the range moves with the time.
+				if until.IsZero() || cutoff.Before(until) {
+					until = cutoff
+					qp.until = until
+				}
+			}
+			lagged = append(lagged, r)
+		}
+		if len(lagged) == 0 {
+			err = errlagged
+			goto done
+		}
+		ranges = lagged
 	}
+	//the request only fails if none of the ranges can be served.
+	//otherwise the queries report the ranges that are not in the archive.
+	for _, r := range ranges {
+		if _, _, _, err = ar.getFileIndexRange(r[0], r[1]); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		goto done
+	}
+	//a dry run stops here, after everything the real query would reject
+	if validate {
+		grwg.Add(1)
+		go func() {
+			defer grwg.Done()
+			retc <- validateRanges(ar, ranges)
+		}()
+		goto done
+	}
+	//a popular range can be sent from the cache without querying.
+	//the first reply of a continuous pull ends at a time that is not in the values,
+	//and a profile has to time the query.
+	if until.IsZero() && !qp.profiling() {
+		cq = resultcache.query(ar, values, ranges, qp)
+	}
+	if cq != nil {
+		if resultcache.send(cq, &h, qp, retc, &grwg) {
+			h.Cache = "HIT"
+			goto done
+		}
+		h.Cache = "MISS"
+	}
+	//rather than piling up, requests are rejected when too many are already querying.
+	if !acquireQuery() {
+		err = errbusy
+		h.RetryAfter = QUERY_RETRY_AFTER
+		goto done
+	}
+	acquired = true
+	if qp.bundle != "" {
+		fa, ok := ar.(*fsarchive)
+		if !ok {
+			err = errnobundle
+			goto done
+		}
+		gz := qp.bundle == "tar.gz"
+		h.ContentType, h.Filename = "application/x-tar", fa.bundleName(ranges, gz)
+		if gz {
+			h.ContentType = "application/gzip"
+		}
+		fa.sendBundle(ranges, gz, qp, retc, &grwg)
+		goto done
+	}
+	if qp.manifest {
+		fa, ok := ar.(*fsarchive)
+		if !ok {
+			err = errnomanifest
+			goto done
+		}
+		h.ContentType = "application/json"
+		fa.sendManifest(ranges, values, qp, retc, &grwg)
+		goto done
+	}
+	//raw MRT queries of whole files have a known size, so clients can show progress.
+	//they are sent as the files are, so that the body is always that size and
+	//interrupted downloads can be resumed.
+	if fa, ok := ar.(*fsarchive); ok {
+		h.ContentLength = fa.wholeFilesSize(ranges, qp)
+		if h.ContentLength > 0 {
+			h.AcceptRanges = true
+			if brange, err = parseByteRange(values.Get("rangeheader"), h.ContentLength); err != nil {
+				h.ContentRange = fmt.Sprintf("bytes */%d", h.ContentLength)
+				h.ContentLength = 0
+				goto done
+			}
+			if brange == nil {
+				brange = &[2]int64{0, h.ContentLength - 1}
+			} else {
+				h.Code = 206
+				h.ContentRange = fmt.Sprintf("bytes %d-%d/%d", brange[0], brange[1], h.ContentLength)
+				h.ContentLength = brange[1] - brange[0] + 1
+			}
+			fa.sendByteRange(ranges[0], brange[0], brange[1], qp, retc, &grwg)
+			goto done
+		}
+	}
+	if len(ranges) == 1 {
+		debugf("querying:%v %v", ranges[0][0], ranges[0][1])
+		ar.Query(ranges[0][0], ranges[0][1], qp, retc, &grwg) //this will fire a new goroutine
+		goto done
+	}
+	//several ranges are queried one after the other so that their replies
+	//don't interleave. in descending order the last range goes first.
+	grwg.Add(1)
+	go func(ranges [][2]time.Time) {
+		defer grwg.Done()
+		for k := range ranges {
+			r := ranges[k]
+			if qp.isDesc() {
+				r = ranges[len(ranges)-1-k]
+			}
+			debugf("querying:%v %v", r[0], r[1])
+			var rwg sync.WaitGroup
+			ar.Query(r[0], r[1], qp, retc, &rwg)
+			rwg.Wait()
+		}
+	}(ranges)
 	// the last goroutine that will wait for all we invoked and close the chan
 done:
+	if err != nil {
+		h.Code = httpCode(err)
+		countRequestError(h.Code)
+		grwg.Add(1)
+		go func(err error) {
+			defer grwg.Done()
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}(err)
+	}
 	go func(wg *sync.WaitGroup) {
 		wg.Wait()   //wait for all the goroutines to finish sending
 		close(retc) //close the chan so that range in responsewriter will finish
-		log.Printf("closing the chan\n")
+		if acquired {
+			releaseQuery()
+		}
+		debugf("closing the chan\n")
 	}(&grwg)
+	if cq != nil && h.Cache == "MISS" && err == nil {
+		return h, resultcache.tee(cq, qp, retc)
+	}
 	return h, retc
 
 }
 
+//sinceValues replaces the since parameter with the start and end values of
+//the range from it to now, in the tz of the query, like the continuous pulls
+//do for their end. The rest of the query, the cache included, sees a plain range.
+func sinceValues(values url.Values) error {
+	sincestrs, ok := values["since"]
+	if !ok {
+		return nil
+	}
+	for _, p := range []string{"start", "end", "at", "asof"} {
+		if _, ok := values[p]; ok {
+			return errbadreq
+		}
+	}
+	if len(sincestrs) != 1 {
+		return errbadreq
+	}
+	loc, err := parseTZ(values.Get("tz"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	start := now
+	if d, derr := time.ParseDuration(sincestrs[0]); derr == nil {
+		if d <= 0 {
+			return errsince
+		}
+		start = now.Add(-d)
+	} else if start, _, err = parseTimePair(sincestrs[0], sincestrs[0], loc); err != nil || start.After(now) {
+		return errsince
+	}
+	values["start"] = []string{timeToStringIn(start, loc)}
+	values["end"] = []string{timeToStringIn(now, loc)}
+	delete(values, "since")
+	return nil
+}
+
+//lagArchive is an archive whose files are written over a known interval
+type lagArchive interface {
+	dumpInterval() time.Duration
+}
+
+func (f *fsarchive) dumpInterval() time.Duration {
+	return f.timedelta
+}
+
+//lagValue returns the lag parameter, which is a duration like 15m or true for
+//the dump interval of the archive. It is 0 if it's not set.
+func lagValue(values url.Values, ar archive) (time.Duration, error) {
+	switch lstr := values.Get("lag"); lstr {
+	case "", "false":
+		return 0, nil
+	case "true":
+		la, ok := ar.(lagArchive)
+		if !ok {
+			return 0, errlag
+		}
+		return la.dumpInterval(), nil
+	default:
+		d, err := time.ParseDuration(lstr)
+		if err != nil || d < 0 {
+			return 0, errlag
+		}
+		return d, nil
+	}
+}
+
+//asofArchive is an archive that can find the RIB dump of an asof time
+type asofArchive interface {
+	asofFile(time.Time) (ArchEntryFile, [2]time.Time, error)
+}
+
+//asofRanges returns the range of the RIB file of the asof value, and sets
+//the file in qp so that only that file is sent.
+func asofRanges(ar archive, asof string, loc *time.Location, qp *queryParams) ([][2]time.Time, error) {
+	aa, ok := ar.(asofArchive)
+	if !ok {
+		return nil, errasof
+	}
+	t, _, err := parseTimePair(asof, asof, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%s. %s", err, errbaddate)
+	}
+	ef, r, err := aa.asofFile(t)
+	if err != nil {
+		return nil, err
+	}
+	qp.asof = &ef
+	return [][2]time.Time{r}, nil
+}
+
+//isRibArchive is true for the archives of RIB dumps instead of updates
+func (f *fsarchive) isRibArchive() bool {
+	return riborupdatestr(f.descriminator) == "ribs"
+}
+
+//asofFile returns the last file that started at or before t and its range
+//[start, end), where end is the start of the next file, or the timedelta after
+//its start for the last one. A t later than that has no RIB in the archive yet.
+func (f *fsarchive) asofFile(t time.Time) (ArchEntryFile, [2]time.Time, error) {
+	if !f.isRibArchive() {
+		return ArchEntryFile{}, [2]time.Time{}, errasof
+	}
+	ef := f.getQueryFiles()
+	if len(ef) == 0 {
+		return ArchEntryFile{}, [2]time.Time{}, errempty
+	}
+	k := sort.Search(len(ef), func(i int) bool {
+		return ef[i].Sdate.After(t)
+	}) - 1
+	if k < 0 {
+		return ArchEntryFile{}, [2]time.Time{}, errdate
+	}
+	end := ef[k].Sdate.Add(f.timedelta)
+	if k+1 < len(ef) {
+		end = ef[k+1].Sdate
+	} else if !t.Before(end) {
+		return ArchEntryFile{}, [2]time.Time{}, errdate
+	}
+	return ef[k], [2]time.Time{ef[k].Sdate, end}, nil
+}
+
+//atRanges returns the ranges of AT_WINDOW around the at values, in order.
+//Windows that overlap are joined so that no message is sent twice.
+func atRanges(atstrs []string, loc *time.Location) ([][2]time.Time, error) {
+	ats := make([]time.Time, len(atstrs))
+	for i, a := range atstrs {
+		t, _, err := parseTimePair(a, a, loc)
+		if err != nil {
+			return nil, fmt.Errorf("%s. %s", err, errbaddate)
+		}
+		ats[i] = t
+	}
+	sort.Slice(ats, func(i, j int) bool { return ats[i].Before(ats[j]) })
+	var ranges [][2]time.Time
+	for _, t := range ats {
+		r := [2]time.Time{t.Add(-AT_WINDOW), t.Add(AT_WINDOW)}
+		if n := len(ranges); n > 0 && !r[0].After(ranges[n-1][1]) {
+			ranges[n-1][1] = r[1]
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+//the accepted formats for the start and end values, in the order they are tried.
+var timeFormats = []struct {
+	name  string
+	parse func(string, *time.Location) (time.Time, error)
+}{
+	{"YYYYMMDDHHMMSS", func(a string, loc *time.Location) (time.Time, error) {
+		return time.ParseInLocation("20060102150405", a, loc)
+	}},
+	{"RFC3339", func(a string, loc *time.Location) (time.Time, error) {
+		return time.Parse(time.RFC3339, a)
+	}},
+	{"unix seconds", func(a string, loc *time.Location) (time.Time, error) {
+		secs, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}},
+}
+
+//parseTimePair parses a start and an end value. The format is picked by the
+//first one that parses the start value, and the end value must be in that
+//same format so that a request can't mix formats. Times without a zone are
+//in loc. The times returned are always in UTC.
+func parseTimePair(astr, bstr string, loc *time.Location) (ta, tb time.Time, err error) {
+	for _, tf := range timeFormats {
+		if ta, err = tf.parse(astr, loc); err != nil {
+			continue
+		}
+		if tb, err = tf.parse(bstr, loc); err != nil {
+			err = fmt.Errorf("end value:%s is not in the %s format of the start value", bstr, tf.name)
+		}
+		ta, tb = ta.UTC(), tb.UTC()
+		return
+	}
+	err = fmt.Errorf("start value:%s is not in a known format", astr)
+	return
+}
+
+//parseTZ parses the tz parameter, which is either an IANA time zone name
+//or a fixed offset from UTC like +02:00, -0700 or -7. Empty means UTC.
+func parseTZ(a string) (*time.Location, error) {
+	if a == "" {
+		return time.UTC, nil
+	}
+	if a[0] == '+' || a[0] == '-' {
+		hstr, mstr := a[1:], "0"
+		if i := strings.Index(hstr, ":"); i != -1 {
+			hstr, mstr = hstr[:i], hstr[i+1:]
+		} else if len(hstr) == 4 {
+			hstr, mstr = hstr[:2], hstr[2:]
+		}
+		h, herr := strconv.Atoi(hstr)
+		m, merr := strconv.Atoi(mstr)
+		if herr != nil || merr != nil || h > 14 || m > 59 {
+			return nil, fmt.Errorf("malformed tz parameter:%s", a)
+		}
+		offset := h*3600 + m*60
+		if a[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(a, offset), nil
+	}
+	loc, err := time.LoadLocation(a)
+	if err != nil {
+		return nil, fmt.Errorf("unknown tz parameter:%s", a)
+	}
+	return loc, nil
+}
+
 func timeToString(a time.Time) string {
-	return a.UTC().Format("20060102150405")
+	return timeToStringIn(a, time.UTC)
 }
 
-func handleParams(values url.Values, ar contarchive) (api.HdrReply, chan api.Reply) {
+//timeToStringIn formats a time as a YYYYMMDDHHMMSS value of the time zone loc
+func timeToStringIn(a time.Time, loc *time.Location) string {
+	return a.In(loc).Format("20060102150405")
+}
+
+func handleParams(ctx context.Context, values url.Values, ar contarchive) (api.HdrReply, chan api.Reply) {
 	var (
 		grwg sync.WaitGroup
 		defh api.HdrReply
@@ -665,55 +2100,153 @@ func handleParams(values url.Values, ar contarchive) (api.HdrReply, chan api.Rep
 	_, ok3 := values["end"]
 	ip, ok4 := values["remoteaddr"]
 	if !ok4 {
-		log.Printf("remoteaddr has not been plugged in the url.Values dictionary")
+		warnf("remoteaddr has not been plugged in the url.Values dictionary")
 		ip = []string{"IP error"}
 	}
 	if !ok1 {
-		return getTimerange(values, ar, defh)
+		return getTimerange(ctx, values, ar, defh)
 	}
 	retc := make(chan api.Reply)
-	creqch, crepch := ar.getContextChans()
 	//continuous has to be only by itself or with a start on a request
 	if ok3 || len(contid) > 1 {
+		defh.Code = httpCode(errbadreq)
 		grwg.Add(1)
 		go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errbadreq} }()
 		goto done
 	}
 	switch contid[0] {
 	case "begin":
-		log.Printf("register request handler for cli %s", ip[0])
+		debugf("register request handler for cli %s", ip[0])
 		arg := contCli{ip: ip[0]}
-		creqch <- contCmd{cmd: CONT_ADD, cli: arg}
-		rep := <-crepch
+		lag, err := lagValue(values, ar)
+		if err != nil {
+			defh.Code = httpCode(err)
+			grwg.Add(1)
+			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: err} }()
+			goto done
+		}
+		arg.lag = lag
+		rep, ok := ar.contReply(contCmd{cmd: CONT_ADD, cli: arg})
+		if !ok {
+			defh.Code = httpCode(errstopped)
+			grwg.Add(1)
+			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errstopped} }()
+			goto done
+		}
 		if rep.err == nil {
-			log.Printf("register api.Reply handler for cli %+v", rep)
+			debugf("register api.Reply handler for cli %+v", rep)
 			defh.Extra = rep.id
 			//handle the case where the user also has specified a start in here
 			if ok2 {
-				//we create a string of the current time.
-				values["end"] = []string{timeToString(time.Now())}
-				return getTimerange(values, ar, defh)
+				//we create a string of the time the client was registered at, in the
+				//zone of the start. a bad tz is reported by getTimerange. the first
+				//pull starts at that time, so the reply stops right before it.
+				end := timeToString(rep.t1pull)
+				if loc, err := parseTZ(values.Get("tz")); err == nil {
+					end = timeToStringIn(rep.t1pull, loc)
+				}
+				values["end"] = []string{end}
+				return getTimerangeUntil(ctx, values, ar, defh, rep.t1pull)
 			}
 		} else {
-			log.Printf("error :%s", rep.err)
+			warnf("error :%s", rep.err)
+			defh.Code = 400
 			grwg.Add(1)
 			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: rep.err} }()
 			goto done
 		}
 	default:
-		log.Printf("will query handler %s for cli %s", contid[0], ip[0])
+		debugf("will query handler %s for cli %s", contid[0], ip[0])
 		arg := contCli{ip: ip[0], id: contid[0]}
-		creqch <- contCmd{cmd: CONT_GET, cli: arg}
-		rep := <-crepch
+		if a := values.Get("ack"); a != "" {
+			ack, _, err := parseTimePair(a, a, time.UTC)
+			if err != nil {
+				defh.Code = httpCode(errbadack)
+				grwg.Add(1)
+				go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errbadack} }()
+				goto done
+			}
+			arg.ack = ack
+		}
+		lag, err := lagValue(values, ar)
+		if err != nil {
+			defh.Code = httpCode(err)
+			grwg.Add(1)
+			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: err} }()
+			goto done
+		}
+		arg.lag = lag
+		//the slot is taken before the pull so that a busy archive doesn't
+		//move the window of the client past messages it was never sent.
+		if !acquireQuery() {
+			defh.Code = httpCode(errbusy)
+			defh.RetryAfter = QUERY_RETRY_AFTER
+			grwg.Add(1)
+			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errbusy} }()
+			goto done
+		}
+		rep, ok := ar.contReply(contCmd{cmd: CONT_GET, cli: arg})
+		if !ok {
+			releaseQuery()
+			defh.Code = httpCode(errstopped)
+			grwg.Add(1)
+			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: errstopped} }()
+			goto done
+		}
+		if rep.err != nil || rep.t2pull.IsZero() {
+			releaseQuery()
+		}
 		if rep.err == nil {
-			log.Printf("sending next id for cli %+v", rep)
+			debugf("sending next id for cli %+v", rep)
 			defh.Extra = rep.id
 			if !rep.t2pull.IsZero() { //
-				ar.Query(rep.t1pull, rep.t2pull, retc, &grwg)
+				qp, qperr := newQueryParams(values)
+				if qperr != nil {
+					releaseQuery()
+					defh.Code = httpCode(qperr)
+					grwg.Add(1)
+					go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: qperr} }()
+					goto done
+				}
+				qp.done = ctx.Done()
+				//consecutive pulls share their bounds, so they are [t1pull, t2pull)
+				//with the sub-second precision of the records, and no slop around them.
+				//otherwise the records near a bound are sent twice, or not at all.
+				qp.exact, qp.slop = true, -1
+				setSpanTrailers(&defh, qp)
+				qc := make(chan api.Reply)
+				var qwg sync.WaitGroup
+				ar.Query(rep.t1pull, rep.t2pull, qp, qc, &qwg)
+				go func() {
+					qwg.Wait()
+					releaseQuery()
+					close(qc)
+				}()
+				//the code has to be known before the reply starts, so wait for its first message.
+				//a pull without new messages gets a 204, so the client knows to back off.
+				first, ok := <-qc
+				if !ok || isNoData(first.Err) {
+					debugf("no new messages for cli %s", ip[0])
+					defh.Code = 204
+					go func() {
+						for range qc {
+						}
+					}()
+					goto done
+				}
+				grwg.Add(1)
+				go func() {
+					defer grwg.Done()
+					retc <- first
+					for r := range qc {
+						retc <- r
+					}
+				}()
 				goto done
 			}
 		} else {
-			log.Printf("error :%s", rep.err)
+			warnf("error :%s", rep.err)
+			defh.Code = 404 //the id is not registered
 			grwg.Add(1)
 			go func() { defer grwg.Done(); retc <- api.Reply{Data: nil, Err: rep.err} }()
 			goto done
@@ -723,55 +2256,253 @@ done:
 	go func(wg *sync.WaitGroup) {
 		wg.Wait()   //wait for all the goroutines to finish sending
 		close(retc) //close the chan so that range in responsewriter will finish
-		log.Printf("closing the chan\n")
+		debugf("closing the chan\n")
 	}(&grwg)
 	return defh, retc
 
 }
 
 func (fsa *fsarchive) Get(values url.Values) (api.HdrReply, chan api.Reply) {
-	return handleParams(values, fsa)
+	return fsa.GetContext(context.Background(), values)
+}
+
+//GetContext stops querying the archive when ctx is done, like when the client disconnects.
+func (fsa *fsarchive) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	h, retc := handleParams(ctx, values, fsa)
+	if f, ok := lookupFormat(values.Get("format")); ok && h.ContentType == "" {
+		h.ContentType = f.contentType
+	}
+	return h, retc
 }
 
 func (pba *pbarchive) Get(values url.Values) (api.HdrReply, chan api.Reply) {
-	return handleParams(values, pba)
+	return pba.GetContext(context.Background(), values)
+}
+
+func (pba *pbarchive) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	return handleParams(ctx, values, pba)
 }
 
 func (jsa *jsonarchive) Get(values url.Values) (api.HdrReply, chan api.Reply) {
-	return handleParams(values, jsa)
+	return jsa.GetContext(context.Background(), values)
+}
+
+func (jsa *jsonarchive) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	return handleParams(ctx, values, jsa)
 }
 
 //func (fsa *mrtarchive) Get(values url.Values) (api.HdrReply, chan api.Reply) {
 //}
 
-func (fss *fsarstat) Get(values url.Values) (api.HdrReply, chan api.Reply) {
-	return getTimerange(values, fss, api.HdrReply{Code: 200})
+func (fss *fsarstat) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return fss.GetContext(context.Background(), values)
+}
+
+func (fss *fsarstat) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	return getTimerange(ctx, values, fss, api.HdrReply{Code: 200, ContentType: "application/json"})
+}
+
+func (fsc *fsarcount) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return fsc.GetContext(context.Background(), values)
+}
+
+func (fsc *fsarcount) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	return getTimerange(ctx, values, fsc, api.HdrReply{Code: 200, ContentType: "application/json"})
+}
+
+const (
+	COMP_NONE int = iota
+	COMP_BZIP2
+	COMP_GZIP
+	COMP_ZSTD
+)
+
+var (
+	bzip2magic    = []byte{'B', 'Z', 'h'}
+	bzip2blkmagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	gzipmagic     = []byte{0x1f, 0x8b}
+	zstdmagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	//suffixes of files that are still being written or downloaded
+	tempsuffixes = []string{".tmp", ".part"}
+)
+
+//isTempFile is true for files that are still being written. They are not
+//indexed until they are renamed to their final name.
+func isTempFile(pathname string) bool {
+	for _, suf := range tempsuffixes {
+		if strings.HasSuffix(pathname, suf) {
+			return true
+		}
+	}
+	return false
+}
+
+//compressionExt returns the extension that names the outer compression of
+//a file, ignoring temporary suffixes, so foo.bz2.tmp is .bz2 and foo.mrt.gz.bz2
+//is .bz2 (the gzip layer inside is found by GetScanner).
+func compressionExt(pathname string) string {
+	for isTempFile(pathname) {
+		pathname = strings.TrimSuffix(pathname, filepath.Ext(pathname))
+	}
+	return filepath.Ext(pathname)
+}
+
+//sniffCompression returns the compression format of the leading bytes of a
+//stream. hdr should hold at least 10 bytes to tell bzip2 apart from raw MRT.
+func sniffCompression(hdr []byte) int {
+	if bytes.HasPrefix(hdr, gzipmagic) {
+		return COMP_GZIP
+	}
+	if bytes.HasPrefix(hdr, zstdmagic) {
+		return COMP_ZSTD
+	}
+	//a raw MRT timestamp can start with "BZh" so only trust the bzip2 magic
+	//when the block header magic is also present.
+	if len(hdr) >= 10 && bytes.HasPrefix(hdr, bzip2magic) && hdr[3] >= '1' && hdr[3] <= '9' && bytes.Equal(hdr[4:10], bzip2blkmagic) {
+		return COMP_BZIP2
+	}
+	return COMP_NONE
+}
+
+//GetCompression returns the compression format of an MRT file.
+//the extension is trusted if the leading bytes of the file agree with it,
+//otherwise we fall back to detecting the format from the magic bytes alone.
+func GetCompression(file archiveFile) int {
+	hdr := make([]byte, 4)
+	//ReadAt does not move the file offset so callers can still Seek/Read normally
+	nb, _ := file.ReadAt(hdr, 0)
+	hdr = hdr[:nb]
+	isbz := bytes.HasPrefix(hdr, bzip2magic) && len(hdr) == 4 && hdr[3] >= '1' && hdr[3] <= '9'
+	isgz := bytes.HasPrefix(hdr, gzipmagic)
+	iszst := bytes.Equal(hdr, zstdmagic)
+	switch compressionExt(file.Name()) {
+	case ".bz2":
+		if isbz || !isgz {
+			return COMP_BZIP2
+		}
+	case ".gz":
+		if isgz || !isbz {
+			return COMP_GZIP
+		}
+	case ".zst":
+		if iszst || !isbz && !isgz {
+			return COMP_ZSTD
+		}
+	}
+	hdr = make([]byte, 10)
+	nb, _ = file.ReadAt(hdr, 0)
+	return sniffCompression(hdr[:nb])
+}
+
+//decompressInner unwraps a second compression layer of a decompressed stream,
+//for files compressed twice like foo.mrt.gz.bz2. Streams that don't start
+//with a known magic are returned as they are.
+func decompressInner(r io.Reader, fname string) io.Reader {
+	br := bufio.NewReader(r)
+	hdr, _ := br.Peek(10)
+	switch sniffCompression(hdr) {
+	case COMP_BZIP2:
+		infof("file:%s is compressed twice. unwrapping the inner bzip2 stream", fname)
+		return bzip2.NewReader(br)
+	case COMP_GZIP:
+		if gzreader, err := gzip.NewReader(br); err == nil {
+			infof("file:%s is compressed twice. unwrapping the inner gzip stream", fname)
+			return gzreader
+		}
+	case COMP_ZSTD:
+		if zreader, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1)); err == nil {
+			infof("file:%s is compressed twice. unwrapping the inner zstd stream", fname)
+			return zreader
+		}
+	}
+	return br
+}
+
+//GetScanner returns a scanner of the MRT records of a file, decompressing it,
+//and its inner stream if it is compressed twice, as GetCompression detects.
+func GetScanner(file archiveFile) (scanner *bufio.Scanner) {
+	fname := file.Name()
+	switch GetCompression(file) {
+	case COMP_BZIP2:
+		//log.Printf("bunzip2 file: %s. opening decompression stream", fname)
+		bzreader := bzip2.NewReader(file)
+		scanner = bufio.NewScanner(decompressInner(bzreader, fname))
+		scanner.Split(splitMrt)
+	case COMP_GZIP:
+		//log.Printf("gunzip file: %s. opening decompression stream", fname)
+		gzreader, err := gzip.NewReader(file)
+		if err != nil {
+			warnf("failed opening gzip stream on file:%s error:%s. opening normally", fname, err)
+			file.Seek(0, 0)
+			scanner = bufio.NewScanner(file)
+		} else {
+			scanner = bufio.NewScanner(decompressInner(gzreader, fname))
+		}
+		scanner.Split(splitMrt)
+	case COMP_ZSTD:
+		//a single decoder goroutine, so that nothing is left running
+		//when the scanner is dropped without closing the decoder.
+		zreader, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			warnf("failed opening zstd stream on file:%s error:%s. opening normally", fname, err)
+			file.Seek(0, 0)
+			scanner = bufio.NewScanner(file)
+		} else {
+			scanner = bufio.NewScanner(decompressInner(zreader, fname))
+		}
+		scanner.Split(splitMrt)
+	default:
+		//log.Printf("no extension on file: %s. opening normally", fname)
+		scanner = bufio.NewScanner(file)
+		scanner.Split(splitMrt)
+	}
+	SetScannerBuffer(scanner)
+	return
+}
+
+//DEFAULT_MAX_RECORD_SIZE is the largest MRT record the scanners accept unless
+//SetMaxRecordSize is called. The 64KB default of bufio.Scanner is too small
+//for large RIB records and jumbo updates.
+const DEFAULT_MAX_RECORD_SIZE = 16 * 1024 * 1024
+
+var maxrecordsize = DEFAULT_MAX_RECORD_SIZE
+
+//SetMaxRecordSize sets the largest MRT record the scanners accept.
+//Files with larger records are only read up to that record.
+func SetMaxRecordSize(a int) {
+	if a < bufio.MaxScanTokenSize {
+		a = bufio.MaxScanTokenSize
+	}
+	maxrecordsize = a
+}
+
+//SetScannerBuffer lets an MRT scanner grow its buffer up to the max record size.
+//It must be called before the first Scan.
+func SetScannerBuffer(scanner *bufio.Scanner) {
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxrecordsize)
 }
 
-func getScanner(file *os.File) (scanner *bufio.Scanner) {
-	fname := file.Name()
-	fext := filepath.Ext(fname)
-	if fext == ".bz2" {
-		//log.Printf("bunzip2 file: %s. opening decompression stream", fname)
-		bzreader := bzip2.NewReader(file)
-		scanner = bufio.NewScanner(bzreader)
-		scanner.Split(ppmrt.SplitMrt)
-	} else {
-		//log.Printf("no extension on file: %s. opening normally", fname)
-		scanner = bufio.NewScanner(file)
-		scanner.Split(ppmrt.SplitMrt)
+//scanError describes a scanner that stopped before the end of a file,
+//so that the client knows its reply is incomplete.
+func scanError(fname string, err error) error {
+	if err == bufio.ErrTooLong {
+		return fmt.Errorf("file %s has an MRT record larger than %d bytes. the rest of the file was skipped", fname, maxrecordsize)
 	}
-	return
+	return fmt.Errorf("error reading file %s:%s. the rest of the file was skipped", fname, err)
 }
 
-func getFirstDate(fname string) (t time.Time, err error) {
-	file, err := os.Open(fname)
+//FIRSTDATE_MAXSKIP is how many undecodable leading records getFirstDate
+//skips before rejecting a file.
+const FIRSTDATE_MAXSKIP = 4
+
+func getFirstDate(fs archiveFS, fname string) (t time.Time, err error) {
+	file, err := fs.Open(fname)
 	if err != nil {
-		log.Println("getFirstDate failed opening file: ", fname, " ", err)
+		warnf("getFirstDate failed opening file:%s error:%s", fname, err)
 		return
 	}
 	defer file.Close()
-	scanner := getScanner(file)
+	scanner := GetScanner(file)
 	scanner.Scan()
 	err = scanner.Err()
 	if err != nil {
@@ -789,7 +2520,7 @@ func getFirstDate(fname string) (t time.Time, err error) {
 			hdrbuf := ppmrt.NewMrtHdrBuf(hdbuf)
 			_, err = hdrbuf.Parse()
 			if err != nil {
-				log.Printf("getFirstDate error in creating MRT header:%s", err)
+				warnf("getFirstDate error in creating MRT header:%s", err)
 				return
 			}
 			hdr := hdrbuf.GetHeader()
@@ -797,64 +2528,173 @@ func getFirstDate(fname string) (t time.Time, err error) {
 			//log.Printf("getFirstDate got header with time:%v", t)
 			return
 		}
-		log.Printf("getFirstDate scanner error:%s", err)
+		warnf("getFirstDate scanner error:%s", err)
 		return
 	}
-	data := scanner.Bytes()
-	if len(data) < ppmrt.MRT_HEADER_LEN {
-		log.Printf("getFirstDate on %s MRT scanner returned less bytes (%d) than the minimum header", fname, len(data))
-		return time.Now(), errors.New(fmt.Sprintf("too few bytes read from mrtfile:%s", fname))
-	}
-
-	hdrbuf := ppmrt.NewMrtHdrBuf(data)
-	_, err = hdrbuf.Parse()
-	if err != nil {
-		log.Printf("getFirstDate error in creating MRT header:%s", err)
-		return
+	//skip a bounded number of leading tokens that are not MRT records,
+	//like a stray partial record or a status message.
+	for skipped := 0; ; skipped++ {
+		data := scanner.Bytes()
+		if len(data) < ppmrt.MRT_HEADER_LEN {
+			err = fmt.Errorf("too few bytes read from mrtfile:%s", fname)
+		} else {
+			hdrbuf := ppmrt.NewMrtHdrBuf(data)
+			if _, err = hdrbuf.Parse(); err == nil {
+				hdr := hdrbuf.GetHeader()
+				t = time.Unix(int64(hdr.Timestamp), 0)
+				if skipped > 0 {
+					infof("getFirstDate skipped %d undecodable leading records in %s", skipped, fname)
+				}
+				return
+			}
+		}
+		if skipped >= FIRSTDATE_MAXSKIP {
+			warnf("getFirstDate on %s failed to decode the first %d records. last error:%s", fname, skipped+1, err)
+			return
+		}
+		if !scanner.Scan() {
+			if err = scanner.Err(); err == nil {
+				err = fmt.Errorf("no MRT records found in mrtfile:%s", fname)
+			}
+			warnf("getFirstDate scanner error:%s", err)
+			return
+		}
 	}
-	hdr := hdrbuf.GetHeader()
-	t = time.Unix(int64(hdr.Timestamp), 0)
-	//log.Printf("getFirstDate got header with time:%v", t)
-	return
 }
 
-func (ma *fsarchive) getFileIndexRange(ta, tb time.Time) (int, int, int64, error) {
-	ef := *ma.entryfiles
+//getFileIndexRange returns the snapshot of the archive files and the
+//range [i,j) of the files that contain messages between ta and tb.
+func (ma *fsarchive) getFileIndexRange(ta, tb time.Time) (TimeEntrySlice, int, int, error) {
+	ef := ma.getQueryFiles()
 	if len(ef) == 0 {
-		return 0, 0, 0, errempty
+		return nil, 0, 0, errempty
 	}
-	if tb.Before(ef[0].Sdate) || ta.After(ef[len(ef)-1].Sdate.Add(ma.timedelta)) {
-		return 0, 0, 0, errdate
+	first, last := ef[0].Sdate, ef[len(ef)-1].Sdate.Add(ma.timedelta)
+	if tb.Before(first) {
+		return nil, 0, 0, dateError{err: errbefore, first: first, last: last}
 	}
+	if ta.After(last) {
+		return nil, 0, 0, dateError{err: errafter, first: first, last: last}
+	}
+	//the messages at ta are in the last file that started before it, since a file
+	//lasts until the next one starts. this doesn't depend on the timedelta
+	//matching the actual cadence of the files, which would miss messages
+	//when the files are longer than it and open extra files when shorter.
 	i := sort.Search(len(ef), func(i int) bool {
-		return ef[i].Sdate.After(ta.Add(-ma.timedelta - time.Second))
+		return ef[i].Sdate.After(ta.Add(-time.Second))
 	})
+	if i > 0 {
+		i--
+	}
 	j := sort.Search(len(ef), func(i int) bool {
 		return ef[i].Sdate.After(tb)
 	})
-
-	//This code finds the index of the offset where the request is starting.
-	// offsets[k] < ta < offsets[k+1]
-	var k int64 = 0
-	if ef[i].Offsets != nil && ef[i].Offsets[0].Time.Before(ta) {
-		for ind := 0; ind < len(ef[i].Offsets)-1 && k == 0; ind++ {
-			if ef[i].Offsets[ind].Time.Before(ta.Add(time.Second)) && ef[i].Offsets[ind+1].Time.After(ta) {
-				k = ef[i].Offsets[ind].Pos
-				log.Printf("Seeking to offset %d:%d\n", ind, k)
+	//a range within a file that another file follows is in a gap if it is
+	//after the last record of the file. the last indexed offset saves
+	//reading the file when there are records after the start of the range.
+	if j == i+1 && j < len(ef) && ef[i].Sdate.Before(ta) {
+		if n := ef[i].indexPoints(); n == 0 || ef[i].Offsets[n-1].Time.Before(ta.Add(-time.Second)) {
+			if ld, err := ma.getLastDate(ef[i]); err == nil && ld.Before(ta.Add(-time.Second)) {
+				return nil, 0, 0, dateError{err: errgap, first: first, last: last, from: ld, to: ef[j].Sdate}
 			}
 		}
-	} else {
-		log.Printf("=====NO SEEKING======\n")
 	}
+	debugf("indexes [i:%d j:%d]", i, j)
+	return ef, i, j, nil
+}
+
+//lastDate is the time of the last record of a file when it had a size
+type lastDate struct {
+	sz int64
+	t  time.Time
+}
+
+//getLastDate returns the time of the last record of ef, scanning it from its
+//last indexed offset. Files only grow, so the time is kept until the size
+//of the file changes.
+func (ma *fsarchive) getLastDate(ef ArchEntryFile) (time.Time, error) {
+	ma.lastmu.Lock()
+	ld, ok := ma.lastdates[ef.Path]
+	ma.lastmu.Unlock()
+	if ok && ld.sz == ef.Sz {
+		return ld.t, nil
+	}
+	file, err := ma.fs.Open(ef.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	seekToOffset(file, ef, ef.Sdate.Add(100*365*24*time.Hour))
+	scanner := GetScanner(file)
+	var t time.Time
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		if len(data) < ppmrt.MRT_HEADER_LEN {
+			continue
+		}
+		hdrbuf := ppmrt.NewMrtHdrBuf(data)
+		if _, err := hdrbuf.Parse(); err != nil {
+			continue
+		}
+		t = time.Unix(int64(hdrbuf.GetHeader().Timestamp), 0)
+	}
+	if err = scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	if t.IsZero() {
+		return t, fmt.Errorf("no MRT records found in mrtfile:%s", ef.Path)
+	}
+	ma.lastmu.Lock()
+	if ma.lastdates == nil {
+		ma.lastdates = make(map[string]lastDate)
+	}
+	ma.lastdates[ef.Path] = lastDate{sz: ef.Sz, t: t}
+	ma.lastmu.Unlock()
+	return t, nil
+}
+
+//getOffset returns the position of the greatest indexed offset whose time is
+//not after t, or 0 if the file has no such offset.
+//The offsets point right after the sampled message, so every message before
+//the returned position has a time that is not after t.
+func (a ArchEntryFile) getOffset(t time.Time) int64 {
+	offs := a.Offsets
+	//indextool leaves zero valued offsets at the tail of the slice
+	//when it sampled less messages than it had slots for.
+	n := sort.Search(len(offs), func(i int) bool {
+		return offs[i].Time.IsZero()
+	})
+	k := sort.Search(n, func(i int) bool {
+		return offs[i].Time.After(t)
+	})
+	if k == 0 {
+		return 0
+	}
+	return offs[k-1].Pos
+}
 
-	if ma.debug {
-		log.Printf("indexes [i:%d j:%d]", i, j)
+//seekToOffset positions the file at the indexed offset closest to ta.
+//Compressed files can't be seeked into, so they are always scanned from the start.
+func seekToOffset(file archiveFile, ef ArchEntryFile, ta time.Time) {
+	if len(ef.Offsets) == 0 || GetCompression(file) != COMP_NONE {
+		return
+	}
+	//messages in the second before ta are still part of the reply
+	if off := ef.getOffset(ta.Add(-time.Second)); off > 0 {
+		debugf("Seeking to offset %d in file %s\n", off, ef.Path)
+		file.Seek(off, 0)
 	}
-	return i, j, k, nil
 }
 
 type transformer func([]byte) ([]byte, error)
 
+//msgReply is a reply of the scanner of a file. The message might have been
+//transformed already, so ts has the timestamp of its MRT header.
+type msgReply struct {
+	api.Reply
+	ts uint32
+}
+
 func newIdentityTransformer() transformer {
 	return func(a []byte) ([]byte, error) {
 		return a, nil
@@ -890,7 +2730,7 @@ func newJsonTransformer() transformer {
 		mrth := ppmrt.NewMrtHdrBuf(a)
 		bgp4h, err := mrth.Parse()
 		if err != nil {
-			log.Printf("Failed parsing MRT header:%s", err)
+			debugf("Failed parsing MRT header:%s", err)
 		}
 		//check if it is a rib
 		isrib, _ := ppmrt.IsRib(a)
@@ -899,17 +2739,17 @@ func newJsonTransformer() transformer {
 		}
 		bgph, err := bgp4h.Parse()
 		if err != nil {
-			log.Printf("Failed parsing BG4MP header:%s", err)
+			debugf("Failed parsing BG4MP header:%s", err)
 			return nil, err
 		}
 		bgpup, err := bgph.Parse()
 		if err != nil {
-			log.Printf("Failed parsing BGP header:%s", err)
+			debugf("Failed parsing BGP header:%s", err)
 			return nil, err
 		}
 		_, err = bgpup.Parse()
 		if err != nil {
-			log.Printf("Failed parsing BGP update:%s", err)
+			debugf("Failed parsing BGP update:%s", err)
 			return nil, err
 		}
 		mbs := &ppmrt.MrtBufferStack{mrth, bgp4h, bgph, bgpup}
@@ -918,247 +2758,1146 @@ func newJsonTransformer() transformer {
 		return []byte(mbsj), nil
 	}
 }
-func transformAndSendBytes(ar *fsarchive, ta, tb time.Time, rc chan<- api.Reply, trans transformer) {
-	i, j, offPos, err := ar.getFileIndexRange(ta, tb)
 
-	if err != nil {
-		rc <- api.Reply{nil, err}
+//BgpJsonLine is the JSON object sent for every message when format=json is requested.
+//AS path sequences are flattened and each AS_SET is a nested array.
+type BgpJsonLine struct {
+	Timestamp int64
+	PeerAS    uint32
+	PeerIP    string
+	Type      string
+	Withdrawn []string      `json:",omitempty"`
+	Announced []string      `json:",omitempty"`
+	ASPath    []interface{} `json:",omitempty"`
+}
+
+func bgpTypeString(up *bgp4mpMsg) string {
+	if up.statechange {
+		return "STATE_CHANGE"
+	}
+	switch up.msgtype {
+	case BGP_OPEN:
+		return "OPEN"
+	case BGP_UPDATE:
+		return "UPDATE"
+	case BGP_NOTIFICATION:
+		return "NOTIFICATION"
+	case BGP_KEEPALIVE:
+		return "KEEPALIVE"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", up.msgtype)
+}
+
+func prefixStrings(a []*net.IPNet) (ret []string) {
+	for _, p := range a {
+		ret = append(ret, p.String())
+	}
+	return
+}
+
+//newJsonLineTransformer decodes BGP4MP messages into a BgpJsonLine
+//followed by a newline. With hdrsonly only the header fields are set.
+func newJsonLineTransformer(hdrsonly bool) transformer {
+	return func(a []byte) ([]byte, error) {
+		var (
+			up  *bgp4mpMsg
+			err error
+		)
+		if hdrsonly {
+			up, _, err = decodeBGP4MPHeader(a)
+		} else {
+			up, err = decodeBGP4MP(a)
+		}
+		if err != nil {
+			return nil, err
+		}
+		jl := BgpJsonLine{
+			Timestamp: int64(up.timestamp),
+			PeerAS:    up.peerAS,
+			PeerIP:    up.peerIP.String(),
+			Type:      bgpTypeString(up),
+			Withdrawn: prefixStrings(up.withdrawn),
+			Announced: prefixStrings(up.announced),
+		}
+		for _, seg := range up.aspath {
+			if seg.set {
+				jl.ASPath = append(jl.ASPath, seg.asns)
+				continue
+			}
+			for _, asn := range seg.asns {
+				jl.ASPath = append(jl.ASPath, asn)
+			}
+		}
+		jlb, err := json.Marshal(jl)
+		if err != nil {
+			return nil, err
+		}
+		return append(jlb, '\n'), nil
+	}
+}
+
+//newHeaderTransformer cuts the MRT records down to their MRT, BGP4MP and BGP
+//headers, and fixes the MRT length so that they can still be parsed. State
+//changes are all header and are kept whole. Records that are not BGP4MP,
+//like RIBs, are left with just the MRT header.
+func newHeaderTransformer() transformer {
+	return func(a []byte) ([]byte, error) {
+		n := ppmrt.MRT_HEADER_LEN
+		up, _, err := decodeBGP4MPHeader(a)
+		if err == nil {
+			n = up.hdrlen
+		} else if err != errnotbgp4mp {
+			return nil, err
+		}
+		cp := make([]byte, n)
+		copy(cp, a)
+		binary.BigEndian.PutUint32(cp[8:12], uint32(n-ppmrt.MRT_HEADER_LEN))
+		return cp, nil
+	}
+}
+
+//newNormalizeTransformer re-encodes the BGP4MP records to BGP4MP_ET if et is set,
+//and the BGP4MP_ET records to BGP4MP otherwise. Records that gain the extended
+//timestamp get 0 microseconds, and the ones that lose it lose that precision.
+//Anything else is sent as it is.
+func newNormalizeTransformer(et bool) transformer {
+	return func(a []byte) ([]byte, error) {
+		typ, _, err := mrtType(a)
+		if err != nil {
+			return nil, err
+		}
+		hl := ppmrt.MRT_HEADER_LEN
+		var cp []byte
+		switch {
+		case et && typ == MRT_BGP4MP:
+			cp = make([]byte, len(a)+4)
+			copy(cp, a[:hl])
+			copy(cp[hl+4:], a[hl:])
+			binary.BigEndian.PutUint16(cp[4:6], MRT_BGP4MP_ET)
+		case !et && typ == MRT_BGP4MP_ET:
+			if len(a) < hl+4 {
+				return nil, errshortmsg
+			}
+			cp = make([]byte, len(a)-4)
+			copy(cp, a[:hl])
+			copy(cp[hl:], a[hl+4:])
+			binary.BigEndian.PutUint16(cp[4:6], MRT_BGP4MP)
+		default:
+			return a, nil
+		}
+		binary.BigEndian.PutUint32(cp[8:12], uint32(len(cp)-hl))
+		return cp, nil
+	}
+}
+
+//newQueryTransformer returns the transformer of the output format of the
+//raw MRT queries
+func newQueryTransformer(qp *queryParams) transformer {
+	if qp == nil {
+		return newIdentityTransformer()
+	}
+	f, ok := lookupFormat(qp.format)
+	if !ok { //newQueryParams already checked it
+		return newIdentityTransformer()
+	}
+	return f.newTransformer(qp)
+}
+
+//newRawTransformer is the transformer of the mrt format, that sends the
+//records as they are unless they are normalized or cut to their headers.
+func newRawTransformer(qp *queryParams) transformer {
+	hdrsonly := qp != nil && qp.hdrsonly
+	if qp != nil && qp.normalize != "" {
+		norm := newNormalizeTransformer(qp.normalize == "et")
+		if !hdrsonly {
+			return norm
+		}
+		hdr := newHeaderTransformer()
+		return func(a []byte) ([]byte, error) {
+			a, err := norm(a)
+			if err != nil {
+				return nil, err
+			}
+			return hdr(a)
+		}
+	}
+	if hdrsonly {
+		return newHeaderTransformer()
+	}
+	return newIdentityTransformer()
+}
+
+//scanFile sends a reply for every message of the file between ta and tb
+//that matches the query on out. In descending order the replies of the file
+//are buffered and sent reversed after it has been scanned.
+//It gives up as soon as quit is closed and returns the number of bytes scanned.
+func scanFile(ar *fsarchive, ef ArchEntryFile, ta, tb time.Time, qp *queryParams, trans transformer, out chan<- msgReply, quit <-chan struct{}) (scanned int64) {
+	desc := qp != nil && qp.desc
+	var (
+		buffered      []msgReply
+		prof          [PROF_PHASES]time.Duration
+		records, sent int64
+	)
+	send := func(r msgReply) bool {
+		if desc {
+			buffered = append(buffered, r)
+			return true
+		}
+		if r.Err == nil {
+			records++
+			sent += int64(len(r.Data))
+		}
+		sendt := qp.profNow()
+		select {
+		case out <- r:
+		case <-quit:
+			return false
+		}
+		if qp.profiling() {
+			prof[PROF_SEND] += time.Since(sendt)
+		}
+		return true
+	}
+	if !qp.mayHavePeers(ef) {
+		debugf("skipping:%s that has none of the requested peers", ef.Path)
 		return
 	}
-	ef := *ar.entryfiles
+	debugf("opening:%s", ef.Path)
+	opent := qp.profNow()
+	file, ferr := ar.fs.Open(ef.Path)
+	if ferr != nil {
+		warnf("failed opening file:%s error:%s", ef.Path, ferr)
+		return
+	}
+	defer file.Close()
+	seekToOffset(file, ef, qp.fileStart(ta, tb))
+	scanner := GetScanner(file)
+	startt := time.Now()
+	if qp.profiling() {
+		prof[PROF_OPEN] = startt.Sub(opent)
+		defer func() {
+			qp.profFile(ef.Path, prof, records, sent)
+		}()
+	}
+	scant := qp.profNow()
+	for scanner.Scan() {
+		if qp.profiling() {
+			prof[PROF_SCAN] += time.Since(scant)
+		}
+		//a filtering query might not send anything for a while, so check here too
+		if qp.cancelled() {
+			return
+		}
+		data := scanner.Bytes()
+		scanned += int64(len(data))
+		//the last token of a truncated file can be shorter than a header
+		if len(data) < ppmrt.MRT_HEADER_LEN {
+			debugf("skipping a truncated record of %d bytes in file:%s", len(data), ef.Path)
+			scant = qp.profNow()
+			continue
+		}
+		decodet := qp.profNow()
+
+		hdrbuf := ppmrt.NewMrtHdrBuf(data)
+		_, err := hdrbuf.Parse()
+		if err != nil {
+			debugf("error in creating MRT header:%s", err)
+			if qp.profiling() {
+				prof[PROF_DECODE] += time.Since(decodet)
+			}
+			if !send(msgReply{Reply: api.Reply{Data: nil, Err: err}}) {
+				return
+			}
+			scant = qp.profNow()
+			continue
+		}
+		msgtime := mrtTime(data)
+		if qp.inRange(msgtime, ta, tb) && qp.match(data) &&
+			qp.firstSeen(data, msgtime, ef.Sdate, ef.Sdate.Add(ar.timedelta)) {
+			//documenation was saying that the Bytes() returnned from a scanner
+			//can be overwritten by subsequent calls to Scan().
+			//if we don't copy the bytes here, we have an awful race.
+			ts := binary.BigEndian.Uint32(data)
+			if trans != nil {
+				data, err = trans(data)
+			}
+			cp := make([]byte, len(data))
+			copy(cp, data)
+			if qp.profiling() {
+				prof[PROF_DECODE] += time.Since(decodet)
+			}
+			if !send(msgReply{Reply: api.Reply{Data: cp, Err: err}, ts: ts}) {
+				return
+			}
+		} else if qp.profiling() {
+			prof[PROF_DECODE] += time.Since(decodet)
+		}
+		scant = qp.profNow()
+	}
+	if qp.profiling() {
+		prof[PROF_SCAN] += time.Since(scant)
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		//the client has to know that the reply is incomplete
+		warnf("file scanner error:%s\n", err)
+		if !send(msgReply{Reply: api.Reply{Data: nil, Err: scanError(ef.Path, err)}}) {
+			return
+		}
+	}
+	debugf("finished parsing file %s size %d in %s\n", ef.Path, ef.Sz, time.Since(startt))
+	desc = false //from now on send for real
+	for b := len(buffered) - 1; b >= 0; b-- {
+		if !send(buffered[b]) {
+			return
+		}
+	}
+	return
+}
+
+//wholeFiles returns the files of a range if they all start and end within it,
+//so that a raw query of the range sends them whole. A file lasts until the next
+//one starts, and the last one a timedelta. The file before the range that
+//getFileIndexRange returns for the messages at its start is left out if it
+//ends at or before the range.
+func (ar *fsarchive) wholeFiles(r [2]time.Time, qp *queryParams) (TimeEntrySlice, bool) {
+	ef, i, j, err := ar.getFileIndexRange(r[0], r[1])
+	if err != nil {
+		return nil, false
+	}
+	if qp.asof != nil {
+		return TimeEntrySlice{*qp.asof}, true
+	}
+	end := func(k int) time.Time {
+		if k+1 < len(ef) {
+			return ef[k+1].Sdate
+		}
+		return ef[k].Sdate.Add(ar.timedelta)
+	}
+	if i < j && ef[i].Sdate.Before(r[0]) && !end(i).After(r[0]) {
+		i++
+	}
+	//the messages up to a second after the end are part of the range
+	slop := time.Second
+	if qp.exact {
+		slop = 0
+	}
+	if i >= j || ef[i].Sdate.Before(r[0]) || end(j-1).After(r[1].Add(slop)) {
+		return nil, false
+	}
+	return ef[i:j], true
+}
+
+//wholeFilesSize returns the number of bytes a raw MRT query of the ranges will send,
+//or 0 if it can't be known in advance. That is only the case for a single range
+//whose files are uncompressed, entirely within the range and sent unfiltered in
+//their order. Then the reply is the files as they are, so nothing else, like the
+//error of a record that can't be parsed, can be sent.
+func (ar *fsarchive) wholeFilesSize(ranges [][2]time.Time, qp *queryParams) (sz int64) {
+	if qp == nil || len(ranges) != 1 || qp.filtering() || qp.limit != 0 || qp.format != "" || qp.hdrsonly || qp.normalize != "" || qp.dedup != nil || qp.profiling() {
+		return 0
+	}
+	if qp.isDesc() || qp.isSorted() || qp.getSlop() > time.Second || !qp.until.IsZero() {
+		return 0
+	}
+	files, ok := ar.wholeFiles(ranges[0], qp)
+	if !ok {
+		return 0
+	}
+	for _, ef := range files {
+		file, err := ar.fs.Open(ef.Path)
+		if err != nil {
+			return 0
+		}
+		comp := GetCompression(file)
+		file.Close()
+		if comp != COMP_NONE { //Sz is the compressed size
+			return 0
+		}
+		sz += ef.Sz
+	}
+	return sz
+}
+
+//QueryValidation is the reply to validate=true. It describes the files a
+//query would scan without running it.
+type QueryValidation struct {
+	Valid          bool   `json:"valid"`
+	Files          int    `json:"files"`
+	FirstDate      string `json:"firstDate,omitempty"`
+	LastDate       string `json:"lastDate,omitempty"`
+	EstimatedBytes int64  `json:"estimatedBytes"` //size of the files on disk
+}
+
+//validateRanges returns the QueryValidation of the ranges of a request
+//that getTimerange already accepted.
+func validateRanges(ar archive, ranges [][2]time.Time) api.Reply {
+	var (
+		qv          = QueryValidation{Valid: true}
+		first, last time.Time
+	)
+	for _, r := range ranges {
+		ef, i, j, err := ar.getFileIndexRange(r[0], r[1])
+		if err != nil || i >= j {
+			continue
+		}
+		qv.Files += j - i
+		for k := i; k < j; k++ {
+			qv.EstimatedBytes += ef[k].Sz
+		}
+		if first.IsZero() || ef[i].Sdate.Before(first) {
+			first = ef[i].Sdate
+		}
+		if ef[j-1].Sdate.After(last) {
+			last = ef[j-1].Sdate
+		}
+	}
+	if !first.IsZero() {
+		qv.FirstDate = first.UTC().Format(time.RFC3339)
+		qv.LastDate = last.UTC().Format(time.RFC3339)
+	}
+	b, err := json.Marshal(qv)
+	if err != nil {
+		return api.Reply{Data: nil, Err: err}
+	}
+	return api.Reply{Data: append(b, '\n'), Err: nil}
+}
+
+//parseByteRange parses a Range header with a single range of bytes. It returns
+//nil for an empty header and for the ones we don't support, like multiple
+//ranges, so that the whole reply is sent instead.
+func parseByteRange(hdr string, size int64) (*[2]int64, error) {
+	if !strings.HasPrefix(hdr, "bytes=") || strings.Contains(hdr, ",") {
+		return nil, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(hdr, "bytes="))
+	ind := strings.Index(spec, "-")
+	if ind == -1 {
+		return nil, errrange
+	}
+	var (
+		start, end int64
+		err        error
+	)
+	if ind == 0 { //the last bytes
+		n, err := strconv.ParseInt(spec[1:], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errrange
+		}
+		if n > size {
+			n = size
+		}
+		return &[2]int64{size - n, size - 1}, nil
+	}
+	if start, err = strconv.ParseInt(spec[:ind], 10, 64); err != nil || start >= size {
+		return nil, errrange
+	}
+	end = size - 1
+	if spec[ind+1:] != "" {
+		if end, err = strconv.ParseInt(spec[ind+1:], 10, 64); err != nil || end < start {
+			return nil, errrange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return &[2]int64{start, end}, nil
+}
+
+//sendByteRange sends the bytes start to end, inclusive, of the files of the range
+//one after the other. That is only the reply of the query when wholeFilesSize is
+//not zero, because then the files are sent as they are.
+func (ar *fsarchive) sendByteRange(r [2]time.Time, start, end int64, qp *queryParams, rc chan api.Reply, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ef, ok := ar.wholeFiles(r, qp)
+		if !ok { //the files changed since wholeFilesSize
+			warnf("the files of the range %v %v are no longer whole", r[0], r[1])
+			return
+		}
+		var off int64 //where file k starts in the reply
+		for k := 0; k < len(ef) && off <= end; k++ {
+			fstart, fend := off, off+ef[k].Sz-1
+			off += ef[k].Sz
+			if fend < start {
+				continue
+			}
+			from, to := int64(0), fend-fstart
+			if start > fstart {
+				from = start - fstart
+			}
+			if end < fend {
+				to = end - fstart
+			}
+			if !sendFileBytes(ar.fs, ef[k].Path, from, to-from+1, qp, rc) {
+				return
+			}
+		}
+	}()
+}
+
+//sendFileBytes sends n bytes of a file from offset from. It returns false
+//if the client went away or the file could not be read.
+func sendFileBytes(fs archiveFS, fname string, from, n int64, qp *queryParams, rc chan api.Reply) bool {
+	file, err := fs.Open(fname)
+	if err != nil {
+		warnf("failed opening file:%s error:%s", fname, err)
+		return false
+	}
+	defer file.Close()
+	if _, err = file.Seek(from, 0); err != nil {
+		warnf("failed seeking file:%s error:%s", fname, err)
+		return false
+	}
+	return sendReader(io.LimitReader(file, n), fname, qp, rc)
+}
+
+//sendReader sends what is read from r in FILE_CHUNKSZ replies. It returns false
+//if the client went away or r could not be read.
+func sendReader(r io.Reader, fname string, qp *queryParams, rc chan api.Reply) bool {
+	for {
+		buf := make([]byte, FILE_CHUNKSZ)
+		nb, err := r.Read(buf)
+		if nb > 0 {
+			select {
+			case rc <- api.Reply{Data: buf[:nb], Err: nil}:
+			case <-qp.doneChan():
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			warnf("error reading file:%s error:%s", fname, err)
+			return false
+		}
+	}
+}
+
+//FILE_REPLY_BUFSZ is how many replies a file scanner can get ahead of the
+//file that is currently being sent to the client.
+const FILE_REPLY_BUFSZ = 1024
+
+//DEFAULT_REPLY_BATCH is how many bytes of messages are concatenated into a
+//single reply unless SetReplyBatch is called.
+const DEFAULT_REPLY_BATCH = 64 * 1024
+
+var replybatch = DEFAULT_REPLY_BATCH
+
+//SetReplyBatch sets how many bytes of messages the queries that are written
+//straight to the client concatenate into a single reply, so that dense files
+//don't cost a channel send per message. 0 sends every message on its own.
+func SetReplyBatch(a int) {
+	if a < 0 {
+		a = 0
+	}
+	replybatch = a
+}
+
+//transformAndSendBytes scans up to scanworkers files concurrently. Each file gets
+//its own reply channel and the channels are drained in file order, so the replies
+//are still sent in chronological (or reverse chronological) order.
+//With sorted=true the files are merged by mergeFiles instead.
+//The messages are transformed by the scanners of the files, which carry their raw
+//timestamps along so that the span of the messages sent can still be read.
+//If batchsz is more than 0 the messages are concatenated into replies of at least
+//batchsz bytes, that are also flushed at the end of every file and before errors.
+//Callers that look at every message on its own must pass 0.
+//It returns the number of files of the range that are scanned.
+func transformAndSendBytes(ar *fsarchive, ta, tb time.Time, qp *queryParams, rc chan<- api.Reply, trans transformer, batchsz int) (files int) {
+	getijt := qp.profNow()
+	ef, i, j, err := ar.getFileIndexRange(qp.fileRange(ta, tb))
+	if err == nil && qp != nil && qp.asof != nil {
+		//the files of the range also have the RIBs before and after it
+		ef, i, j = TimeEntrySlice{*qp.asof}, 0, 1
+	}
+	qp.profAdd(PROF_GETIJ, getijt)
 
-	for k := i; k < j; k++ {
-		if ar.debug {
-			log.Printf("opening:%s", ef[k].Path)
+	if err != nil {
+		rc <- api.Reply{Data: nil, Err: newCodedError(err)}
+		return
+	}
+	if qp.emptyRange(ta, tb) {
+		debugf("exact range from %s to %s is empty. not opening any files", ta, tb)
+		j = i
+	}
+	for _, f := range ef[i:j] {
+		if qp.mayHavePeers(f) {
+			files++
+		}
+	}
+	var scanned, records, sentbytes int64
+	defer func(startt time.Time) {
+		ar.observeQuery(startt, atomic.LoadInt64(&scanned))
+		ar.logAccess(qp, ta, tb, records, sentbytes, startt)
+	}(time.Now())
+	desc := qp != nil && qp.desc
+	quit := make(chan struct{}) //closed when we stop sending to tell the scanners to give up
+	defer close(quit)
+	var outs []chan msgReply
+	if qp.isSorted() {
+		//a single stream, merged across the files
+		outs = []chan msgReply{make(chan msgReply, FILE_REPLY_BUFSZ)}
+		go func() {
+			defer close(outs[0])
+			atomic.AddInt64(&scanned, mergeFiles(ar, ef[i:j], ta, tb, qp, trans, outs[0], quit))
+		}()
+	} else {
+		outs = make([]chan msgReply, j-i)
+		for n := range outs {
+			outs[n] = make(chan msgReply, FILE_REPLY_BUFSZ)
+		}
+		go func() {
+			sem := make(chan struct{}, ar.getScanWorkers())
+			for n := range outs {
+				k := i + n
+				if desc {
+					k = j - 1 - n
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-quit:
+					return
+				}
+				go func(n, k int) {
+					defer func() { <-sem }()
+					defer close(outs[n])
+					atomic.AddInt64(&scanned, scanFile(ar, ef[k], ta, tb, qp, trans, outs[n], quit))
+				}(n, k)
+			}
+		}()
+	}
+	send := func(r api.Reply, n int64) bool {
+		sendt := qp.profNow()
+		select {
+		case rc <- r:
+		case <-qp.doneChan(): //the client went away
+			return false
 		}
-		file, ferr := os.Open(ef[k].Path)
-		if ferr != nil {
-			log.Println("failed opening file: ", ef[k].Path, " ", ferr)
-			continue
+		qp.profAdd(PROF_SEND, sendt)
+		if r.Err == nil {
+			records += n
+			sentbytes += int64(len(r.Data))
 		}
-		scanner := getScanner(file)
-		startt := time.Now()
-		// On the first file scanned, jump to the offset position
-		if k == i {
-			file.Seek(offPos, 0)
+		return true
+	}
+	var (
+		batch     []byte
+		batchrecs int64
+	)
+	flush := func() bool {
+		if batchrecs == 0 {
+			return true
 		}
-		for scanner.Scan() {
-			data := scanner.Bytes()
-
-			hdrbuf := ppmrt.NewMrtHdrBuf(data)
-			_, err := hdrbuf.Parse()
-			if err != nil {
-				log.Printf("error in creating MRT header:%s", err)
-				rc <- api.Reply{Data: nil, Err: err}
-				continue
+		//the consumer keeps the bytes of the reply, so the next batch gets a new buffer
+		r, n := api.Reply{Data: batch}, batchrecs
+		batch, batchrecs = make([]byte, 0, batchsz), 0
+		return send(r, n)
+	}
+	if batchsz > 0 {
+		batch = make([]byte, 0, batchsz)
+	}
+	for _, out := range outs {
+		for mr := range out {
+			r := mr.Reply
+			if r.Err == nil {
+				//stop once the limit of messages has been reached
+				if !qp.take() {
+					flush()
+					return
+				}
+				qp.sentAt(mr.ts)
 			}
-			hdr := hdrbuf.GetHeader()
-			msgtime := time.Unix(int64(hdr.Timestamp), 0)
-			if msgtime.After(ta.Add(-time.Second)) && msgtime.Before(tb.Add(time.Second)) {
-				//documenation was saying that the Bytes() returnned from a scanner
-				//can be overwritten by subsequent calls to Scan().
-				//if we don't copy the bytes here, we have an awful race.
-				if trans != nil {
-					data, err = trans(data)
+			if r.Err == nil && batchsz > 0 {
+				batch = append(batch, r.Data...)
+				batchrecs++
+				if len(batch) >= batchsz && !flush() {
+					return
 				}
-				cp := make([]byte, len(data))
-				copy(cp, data)
-				rc <- api.Reply{Data: cp, Err: err}
+				continue
+			}
+			//errors are sent after the messages that came before them
+			if !flush() || !send(r, 1) {
+				return
 			}
 		}
-		if err := scanner.Err(); err != nil && err != io.EOF {
-			log.Printf("file scanner error:%s\n", err)
+		//don't hold a filtering query's messages back longer than a file
+		if !flush() {
+			return
 		}
-		log.Printf("finished parsing file %s size %d in %s\n", ef[k].Path, ef[k].Sz, time.Since(startt))
-		file.Close()
 	}
-
+	return
 }
 
-func (ma *fsarchive) Query(ta, tb time.Time, retc chan api.Reply, wg *sync.WaitGroup) {
-	log.Printf("mrt query from %s to %s\n", ta, tb)
+func (ma *fsarchive) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("mrt query from %s to %s\n", ta, tb)
 	//Always add to the waitgroup before calling the go statement.
 	wg.Add(1)
 	go func(rc chan<- api.Reply) {
 		defer wg.Done()
-		it := newIdentityTransformer()
-		transformAndSendBytes(ma, ta, tb, rc, it)
+		transformAndSendBytes(ma, ta, tb, qp, rc, newQueryTransformer(qp), replybatch)
 		return
 	}(retc)
 }
 
-func (pba *pbarchive) Query(ta, tb time.Time, retc chan api.Reply, wg *sync.WaitGroup) {
-	log.Printf("protobuf query from %s to %s\n", ta, tb)
+func (pba *pbarchive) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("protobuf query from %s to %s\n", ta, tb)
 	//Always add to the waitgroup before calling the go statement.
 	wg.Add(1)
 	go func(rc chan<- api.Reply) {
 		defer wg.Done()
 		pt := newProtobufTransformer()
-		transformAndSendBytes(pba.fsarchive, ta, tb, rc, pt)
+		transformAndSendBytes(pba.fsarchive, ta, tb, qp, rc, pt, replybatch)
 		return
 	}(retc)
 }
 
-func (jsa *jsonarchive) Query(ta, tb time.Time, retc chan api.Reply, wg *sync.WaitGroup) {
-	log.Printf("json query from %s to %s\n", ta, tb)
+func (jsa *jsonarchive) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("json query from %s to %s\n", ta, tb)
 	//Always add to the waitgroup before calling the go statement.
 	wg.Add(1)
 	go func(rc chan<- api.Reply) {
 		defer wg.Done()
 		jt := newJsonTransformer()
-		transformAndSendBytes(jsa.fsarchive, ta, tb, rc, jt)
+		transformAndSendBytes(jsa.fsarchive, ta, tb, qp, rc, jt, replybatch)
 		return
 	}(retc)
 }
 
-func (fss *fsarstat) Query(ta, tb time.Time, retc chan api.Reply, wg *sync.WaitGroup) {
-	log.Printf("stat query from %s to %s\n", ta, tb)
+//msgCounts are the counters of a stats bucket
+type msgCounts struct {
+	withdrawn, nlri, reach, unreach, ribprefixes, ribentries int
+}
+
+func (a *msgCounts) add(b msgCounts) {
+	a.withdrawn += b.withdrawn
+	a.nlri += b.nlri
+	a.reach += b.reach
+	a.unreach += b.unreach
+	a.ribprefixes += b.ribprefixes
+	a.ribentries += b.ribentries
+}
+
+//appendBucket appends the counters of one Delta_sec bucket to the stats
+func (st *BgpStats) appendBucket(total int, c msgCounts, anomalous bool) {
+	if anomalous {
+		st.Anomalies = append(st.Anomalies, len(st.TotalPerDelta))
+	}
+	st.TotalPerDelta = append(st.TotalPerDelta, total)
+	st.Withdrawn = append(st.Withdrawn, c.withdrawn)
+	st.NLRI = append(st.NLRI, c.nlri)
+	st.MPReach = append(st.MPReach, c.reach)
+	st.MPUnreach = append(st.MPUnreach, c.unreach)
+	st.RibPrefixes = append(st.RibPrefixes, c.ribprefixes)
+	st.RibEntries = append(st.RibEntries, c.ribentries)
+}
+
+//the arrays of BgpStats that statsStream spools, in the order they are sent
+var statsSpoolNames = []string{"Withdrawn", "NLRI", "MPReach", "MPUnreach", "RibPrefixes", "RibEntries", "Anomalies"}
+
+//statsStream sends the stats of stream=true as they are counted, so that wide
+//ranges don't hold all the buckets in memory. The reply is the same BgpStats
+//as without stream. TotalPerDelta is sent as it is counted, while the other
+//arrays are spooled to a temporary file each and sent after it. TotalMsgs and
+//the errors of the files that couldn't be read are only known at the end:
+//{"StartTime":..,"EndTime":..,"Delta_sec":..,"TotalPerDelta":[..],"Withdrawn":[..],..,"TotalMsgs":..}
+type statsStream struct {
+	rc     chan<- api.Reply
+	buf    bytes.Buffer
+	spools []*statsSpool
+	n      int   //buckets written
+	sent   int64 //bytes sent
+}
+
+//statsSpool is an array of a statsStream, written to an unlinked temporary file
+type statsSpool struct {
+	f *os.File
+	w *bufio.Writer
+	n int //values written
+}
+
+func (sp *statsSpool) add(v int) {
+	if sp.n > 0 {
+		sp.w.WriteByte(',')
+	}
+	sp.w.WriteString(strconv.Itoa(v))
+	sp.n++
+}
+
+//newStatsStream returns an error if the spools can't be created
+func newStatsStream(rc chan<- api.Reply, ta, tb time.Time, deltasec int) (*statsStream, error) {
+	ss := &statsStream{rc: rc}
+	for range statsSpoolNames {
+		f, err := ioutil.TempFile("", "bgparchive-stats-")
+		if err != nil {
+			ss.discard()
+			return nil, err
+		}
+		//the file goes away once it is closed
+		os.Remove(f.Name())
+		ss.spools = append(ss.spools, &statsSpool{f: f, w: bufio.NewWriter(f)})
+	}
+	st, _ := json.Marshal(fmt.Sprintf("%s", ta))
+	et, _ := json.Marshal(fmt.Sprintf("%s", tb))
+	fmt.Fprintf(&ss.buf, `{"StartTime":%s,"EndTime":%s,"Delta_sec":%d,"TotalPerDelta":`, st, et, deltasec)
+	return ss, nil
+}
+
+func (ss *statsStream) appendBucket(total int, c msgCounts, anomalous bool) {
+	if ss.n == 0 {
+		ss.buf.WriteByte('[')
+	} else {
+		ss.buf.WriteByte(',')
+	}
+	ss.buf.WriteString(strconv.Itoa(total))
+	for k, v := range []int{c.withdrawn, c.nlri, c.reach, c.unreach, c.ribprefixes, c.ribentries} {
+		ss.spools[k].add(v)
+	}
+	if anomalous {
+		ss.spools[len(ss.spools)-1].add(ss.n)
+	}
+	ss.n++
+	if ss.buf.Len() >= FILE_CHUNKSZ {
+		ss.flush()
+	}
+}
+
+func (ss *statsStream) flush() {
+	if ss.buf.Len() == 0 {
+		return
+	}
+	cp := make([]byte, ss.buf.Len())
+	copy(cp, ss.buf.Bytes())
+	ss.buf.Reset()
+	ss.sent += int64(len(cp))
+	ss.rc <- api.Reply{Data: cp, Err: nil}
+}
+
+//closeArray ends an array like json.Marshal does a slice, which is null if empty
+func (ss *statsStream) closeArray(n int) {
+	if n == 0 {
+		ss.buf.WriteString("null")
+	} else {
+		ss.buf.WriteByte(']')
+	}
+}
+
+//close sends the spooled arrays, the errors and TotalMsgs, which end the JSON
+//object. If a spool can't be read the object can't be completed, so the error
+//is sent instead.
+func (ss *statsStream) close(totalmsgs int64, errs []error) error {
+	defer ss.discard()
+	ss.closeArray(ss.n)
+	for k, sp := range ss.spools {
+		name := statsSpoolNames[k]
+		if name == "Anomalies" && sp.n == 0 { //omitempty
+			continue
+		}
+		fmt.Fprintf(&ss.buf, `,"%s":`, name)
+		if sp.n > 0 {
+			ss.buf.WriteByte('[')
+			if err := sp.w.Flush(); err != nil {
+				return err
+			}
+			if _, err := sp.f.Seek(0, 0); err != nil {
+				return err
+			}
+			for {
+				_, err := io.CopyN(&ss.buf, sp.f, FILE_CHUNKSZ)
+				ss.flush()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		ss.closeArray(sp.n)
+	}
+	if len(errs) > 0 {
+		strs := make([]string, len(errs))
+		for k, err := range errs {
+			strs[k] = err.Error()
+		}
+		b, _ := json.Marshal(strs)
+		fmt.Fprintf(&ss.buf, `,"Errors":%s`, b)
+	}
+	fmt.Fprintf(&ss.buf, `,"TotalMsgs":%d}`, totalmsgs)
+	ss.flush()
+	return nil
+}
+
+//discard removes the spools. It can be called more than once.
+func (ss *statsStream) discard() {
+	for _, sp := range ss.spools {
+		sp.f.Close()
+	}
+	ss.spools = nil
+}
+
+//updateCounts parses a BGP4MP update with protoparse and counts its routes.
+//The reach and unreach counters count the MP attributes, while the routes
+//they carry, of any family, are added to the nlri and withdrawn counters.
+func updateCounts(data []byte) (c msgCounts, err error) {
+	hdrbuf := ppmrt.NewMrtHdrBuf(data)
+	bgp4hbuf, err := hdrbuf.Parse()
+	if err != nil {
+		return c, fmt.Errorf("error in creating MRT header:%s", err)
+	}
+	bgphdrbuf, err := bgp4hbuf.Parse()
+	if err != nil {
+		return c, fmt.Errorf("error in creating BGP4MP header:%s", err)
+	}
+	bgpupbuf, err := bgphdrbuf.Parse()
+	if err != nil {
+		return c, fmt.Errorf("error in parsing BGP header:%s", err)
+	}
+	bgpupbuf.Parse()
+	//if err != nil {
+	//log.Printf("error in parsing BGP update:%s", err)
+	//continue
+	//}
+
+	up := bgpupbuf.(pp.BGPUpdater).GetUpdate()
+	if up.WithdrawnRoutes != nil {
+		c.withdrawn += len(up.WithdrawnRoutes.Prefixes)
+	}
+	if up.AdvertizedRoutes != nil {
+		c.nlri += len(up.AdvertizedRoutes.Prefixes)
+	}
+	if up.Attrs != nil {
+		for _, att := range up.Attrs.Types {
+			if att == pb.BGPUpdate_Attributes_MP_REACH_NLRI {
+				c.reach += 1
+			} else if att == pb.BGPUpdate_Attributes_MP_UNREACH_NLRI {
+				c.unreach += 1
+			}
+		}
+	}
+	if c.reach > 0 || c.unreach > 0 {
+		//protoparse doesn't give us the MP routes, so walk the message ourselves
+		up, err := decodeBGP4MP(data)
+		if err != nil {
+			return c, fmt.Errorf("error in decoding MP routes:%s", err)
+		}
+		c.nlri += up.mpreach
+		c.withdrawn += up.mpunreach
+	}
+	return
+}
+
+func (fss *fsarstat) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("stat query from %s to %s\n", ta, tb)
 	//Always add to the waitgroup before calling the go statement.
 	wg.Add(1)
 	go func(rc chan<- api.Reply) {
 		st := &BgpStats{}
 		var (
-			lastTime     time.Time
-			totreach     int
-			totunreach   int
-			totnlri      int
-			totwithdrawn int
-			totdelta     int
+			lastTime time.Time
+			tot      msgCounts
+			totdelta int
 		)
 		defer wg.Done()
+		bucketdur := time.Duration(qp.bucketSecs()) * time.Second
 		ma := fss.fsarchive
-		i, j, offPos, err := ma.getFileIndexRange(ta, tb)
+		ef, i, j, err := ma.getFileIndexRange(qp.fileRange(ta, tb))
 
 		if err != nil {
-			rc <- api.Reply{nil, err}
+			rc <- api.Reply{Data: nil, Err: newCodedError(err)}
 			return
 		}
-		ef := *ma.entryfiles
+		if qp.emptyRange(ta, tb) {
+			debugf("exact range from %s to %s is empty. not opening any files", ta, tb)
+			j = i
+		}
+		var scanned, sent int64
+		defer func(startt time.Time) {
+			ma.observeQuery(startt, scanned)
+			ma.logAccess(qp, ta, tb, st.TotalMsgs, sent, startt)
+		}(time.Now())
+		addBucket := st.appendBucket
+		var (
+			ss   *statsStream
+			errs []error //scan errors of a stream, sent in the stats so that they stay valid JSON
+		)
+		if qp != nil && qp.stream {
+			var err error
+			if ss, err = newStatsStream(rc, ta, tb, qp.bucketSecs()); err != nil {
+				warnf("can't stream the stats:%s. sending them whole", err)
+			} else {
+				defer ss.discard()
+				addBucket = ss.appendBucket
+			}
+		}
+		var ad *anomalyDetector
+		if qp != nil && qp.anomalyk > 0 {
+			ad = newAnomalyDetector(qp.anomalyk)
+		}
+		emit := func(total int, c msgCounts) {
+			addBucket(total, c, ad.check(total))
+		}
+		var lastprefix string //of the last TABLE_DUMP record, to count every prefix once
 		for k := i; k < j; k++ {
-			if fss.debug {
-				log.Printf("opening:%s", ef[k].Path)
+			if qp.cancelled() {
+				debugf("stat query from %s to %s cancelled", ta, tb)
+				return
 			}
-			file, ferr := os.Open(ef[k].Path)
+			debugf("opening:%s", ef[k].Path)
+			file, ferr := ma.fs.Open(ef[k].Path)
 			if ferr != nil {
-				log.Println("failed opening file: ", ef[k].Path, " ", ferr)
+				warnf("failed opening file:%s error:%s", ef[k].Path, ferr)
 				continue
 			}
-			scanner := getScanner(file)
+			seekToOffset(file, ef[k], qp.fileStart(ta, tb))
+			scanner := GetScanner(file)
 			startt := time.Now()
 			if k == i { //only on the first file to be examined
-				lastTime = ta //set it to the beginning of interval
-				file.Seek(offPos, 0)
+				lastTime = qp.fileStart(ta, tb) //set it to the beginning of interval, widened by the slop
 			}
-			for scanner.Scan() {
+			for scanner.Scan() && !qp.cancelled() {
 				data := scanner.Bytes()
+				scanned += int64(len(data))
 
-				hdrbuf := ppmrt.NewMrtHdrBuf(data)
-				bgp4hbuf, err := hdrbuf.Parse()
+				var mc msgCounts
+				typ, _, err := mrtType(data)
 				if err != nil {
-					log.Printf("error in creating MRT header:%s", err)
+					debugf("error in creating MRT header:%s", err)
 					continue
 				}
-				hdr := hdrbuf.GetHeader()
-				msgtime := time.Unix(int64(hdr.Timestamp), 0)
-				bgphdrbuf, err := bgp4hbuf.Parse()
-				if err != nil {
-					log.Printf("error in creating BGP4MP header:%s", err)
+				//same filters as the updates, so stats can be per prefix, AS or peer
+				if !qp.match(data) {
 					continue
 				}
-				bgpupbuf, err := bgphdrbuf.Parse()
-				if err != nil {
-					log.Printf("error in parsing BGP header:%s", err)
+				msgtime := time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+				//RIB records are not BGP4MP messages, so they can't go through protoparse
+				if typ == MRT_TABLE_DUMP_V2 {
+					ents, err := ribEntryCount(data)
+					if err == errnotrib { //peer index table
+						continue
+					} else if err != nil {
+						debugf("error in parsing RIB record:%s", err)
+						continue
+					}
+					mc.ribprefixes, mc.ribentries = 1, ents
+				} else if typ == MRT_TABLE_DUMP {
+					ent, err := decodeTableDump(data)
+					if err != nil {
+						debugf("error in parsing RIB record:%s", err)
+						continue
+					}
+					mc.ribentries = 1
+					if p := ent.prefix.String(); p != lastprefix {
+						mc.ribprefixes, lastprefix = 1, p
+					}
+				} else if mc, err = updateCounts(data); err != nil {
+					debugf("%s", err)
 					continue
 				}
-				bgpupbuf.Parse()
-				//if err != nil {
-				//log.Printf("error in parsing BGP update:%s", err)
-				//continue
-				//}
-
-				up := bgpupbuf.(pp.BGPUpdater).GetUpdate()
-				if msgtime.After(ta.Add(-time.Second)) && msgtime.Before(tb.Add(time.Second)) {
+				if qp.inRange(msgtime, ta, tb) {
 					st.TotalMsgs += 1
-					secsfromlast := int(msgtime.Sub(lastTime).Seconds())
-					if secsfromlast < 0 {
-						log.Printf("Warning! secs from last msg less than 0:%d", secsfromlast)
-					} else if secsfromlast == 0 {
+					//lastTime is the start of the current bucket
+					bucketsfromlast := int(msgtime.Sub(lastTime) / bucketdur)
+					if msgtime.Before(lastTime) {
+						debugf("Warning! msg at %s before the start of the current bucket %s", msgtime, lastTime)
+					} else if bucketsfromlast == 0 {
 						totdelta += 1
-						if up.WithdrawnRoutes != nil {
-							totwithdrawn += len(up.WithdrawnRoutes.Prefixes)
-						}
-						if up.AdvertizedRoutes != nil {
-							totnlri += len(up.AdvertizedRoutes.Prefixes)
-						}
-						if up.Attrs != nil {
-							for _, att := range up.Attrs.Types {
-								if att == pb.BGPUpdate_Attributes_MP_REACH_NLRI {
-									totreach += 1
-								} else if att == pb.BGPUpdate_Attributes_MP_UNREACH_NLRI {
-									totunreach += 1
-								}
-							}
-						}
-					} else if secsfromlast > 0 {
+						tot.add(mc)
+					} else if bucketsfromlast > 0 {
 						// flush the previous
-						st.Withdrawn = append(st.Withdrawn, totwithdrawn)
-						st.NLRI = append(st.NLRI, totnlri)
-						st.MPReach = append(st.MPReach, totreach)
-						st.MPUnreach = append(st.MPUnreach, totunreach)
-						st.TotalPerDelta = append(st.TotalPerDelta, totdelta)
+						emit(totdelta, tot)
 						//reset
-						totwithdrawn, totnlri, totreach, totunreach, totdelta = 0, 0, 0, 0, 0
-						if secsfromlast > 1 {
-							for sec := 1; sec < secsfromlast; sec++ {
+						tot, totdelta = msgCounts{}, 0
+						if bucketsfromlast > 1 {
+							for b := 1; b < bucketsfromlast; b++ {
 								//log.Printf("inserting one dummy")
-								st.Withdrawn = append(st.Withdrawn, 0)
-								st.NLRI = append(st.NLRI, 0)
-								st.MPReach = append(st.MPReach, 0)
-								st.MPUnreach = append(st.MPUnreach, 0)
-								st.TotalPerDelta = append(st.TotalPerDelta, 0)
+								emit(0, msgCounts{})
 							}
 						}
 						totdelta += 1
-						if up.WithdrawnRoutes != nil {
-							totwithdrawn += len(up.WithdrawnRoutes.Prefixes)
-						}
-						if up.AdvertizedRoutes != nil {
-							totnlri += len(up.AdvertizedRoutes.Prefixes)
-						}
-
-						if up.Attrs != nil {
-							for _, att := range up.Attrs.Types {
-								//log.Println("attribute: ", att)
-								if att == pb.BGPUpdate_Attributes_MP_REACH_NLRI {
-									totreach += 1
-								} else if att == pb.BGPUpdate_Attributes_MP_UNREACH_NLRI {
-									totunreach += 1
-								}
-							}
-						}
-						lastTime = msgtime
+						tot.add(mc)
+						lastTime = lastTime.Add(time.Duration(bucketsfromlast) * bucketdur)
 					}
 				}
 			}
 			if err := scanner.Err(); err != nil && err != io.EOF {
-				log.Printf("file scanner error:%s\n", err)
+				warnf("file scanner error:%s\n", err)
+				if ss != nil {
+					errs = append(errs, scanError(ef[k].Path, err))
+				} else {
+					rc <- api.Reply{Data: nil, Err: scanError(ef[k].Path, err)}
+				}
 			}
-			log.Printf("finished parsing file %s size %d in %s\n", ef[k].Path, ef[k].Sz, time.Since(startt))
+			debugf("finished parsing file %s size %d in %s\n", ef[k].Path, ef[k].Sz, time.Since(startt))
 			file.Close()
 		}
+		//the last bucket is only flushed by a later message, so flush it here
+		if totdelta > 0 {
+			emit(totdelta, tot)
+		}
+		if ss != nil {
+			if err := ss.close(st.TotalMsgs, errs); err != nil {
+				warnf("error in sending the spooled stats:%s", err)
+				rc <- api.Reply{Data: nil, Err: err}
+			}
+			sent = ss.sent
+			return
+		}
 		st.StartTime = fmt.Sprintf("%s", ta)
 		st.EndTime = fmt.Sprintf("%s", tb)
-		st.Delta_sec = 1
+		st.Delta_sec = qp.bucketSecs()
 		//statstr := fmt.Sprintf("%+v\n", st)
 		b, err := json.Marshal(st)
 		if err != nil {
-			log.Printf("error in json marshal:%s", err)
+			warnf("error in json marshal:%s", err)
 		}
+		sent = int64(len(b))
 		rc <- api.Reply{Data: b, Err: nil}
 		return
 	}(retc)
 }
 
+type MsgCount struct {
+	StartTime string
+	EndTime   string
+	Count     int64 //number of MRT messages
+	Bytes     int64 //size of the MRT messages
+	Files     int   //number of archive files that will be scanned
+}
+
+//Query runs the same scan as the mrt query on a private channel
+//so that the count matches exactly what would have been sent.
+func (fsc *fsarcount) Query(ta, tb time.Time, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) {
+	debugf("count query from %s to %s\n", ta, tb)
+	//Always add to the waitgroup before calling the go statement.
+	wg.Add(1)
+	go func(rc chan<- api.Reply) {
+		defer wg.Done()
+		mc := &MsgCount{StartTime: fmt.Sprintf("%s", ta), EndTime: fmt.Sprintf("%s", tb)}
+		cntc := make(chan api.Reply)
+		go func() {
+			defer close(cntc)
+			mc.Files = transformAndSendBytes(fsc.fsarchive, ta, tb, qp, cntc, nil, 0)
+		}()
+		for r := range cntc {
+			if r.Err != nil { //errors are still sent to the client
+				rc <- r
+				continue
+			}
+			mc.Count++
+			mc.Bytes += int64(len(r.Data))
+		}
+		if qp.cancelled() {
+			return
+		}
+		b, err := json.Marshal(mc)
+		if err != nil {
+			warnf("error in json marshal:%s", err)
+		}
+		rc <- api.Reply{Data: append(b, '\n'), Err: nil}
+		return
+	}(retc)
+}
+
 func (fsa *mrtarchive) revisit(pathname string, f os.FileInfo, err error) error {
 	if f == nil {
 		return errors.New("fileinfo is nil")
@@ -1170,22 +3909,16 @@ func (fsa *mrtarchive) revisit(pathname string, f os.FileInfo, err error) error
 		return derr
 	}
 	if f.Mode().IsDir() {
-		if fsa.debug {
-			log.Printf("reexamining dir:%s last archived date is:%v\n", fname, ld)
-		}
-		ok, yr, mon := isYearMonthDir(path.Base(pathname))
+		debugf("reexamining dir:%s last archived date is:%v", fname, ld)
+		ok, yr, mon := yearMonthDir(pathname, fsa.dirlayouts)
 		if ok {
-			log.Printf("%s is a year month dir with yr:%v month:%v", fname, yr, mon)
+			debugf("%s is a year month dir with yr:%v month:%v", fname, yr, mon)
 			if yr < ld.Year() {
-				if fsa.debug {
-					log.Printf("year is less than:%v", ld.Year())
-				}
+				debugf("year is less than:%v", ld.Year())
 				return filepath.SkipDir
 			}
-			if mon < int(ld.Month()) && yr <= ld.Year() {
-				if fsa.debug {
-					log.Printf("month is less than:%v", int(ld.Month()))
-				}
+			if mon != 0 && mon < int(ld.Month()) && yr <= ld.Year() {
+				debugf("month is less than:%v", int(ld.Month()))
 				return filepath.SkipDir
 			}
 			//if here we are in the correct dir as our last scanned year.month
@@ -1195,26 +3928,29 @@ func (fsa *mrtarchive) revisit(pathname string, f os.FileInfo, err error) error
 	if err != nil {
 		return err
 	}
-	if strings.LastIndex(pathname, fsa.descriminator) == -1 {
-		if fsa.debug {
-			log.Printf("visit: descriminator:%s not found in path:%s . ignoring\n", fsa.descriminator, pathname)
-		}
+	if !fsa.matchesPattern(pathname) {
+		debugf("visit: patterns:%v not found in path:%s . ignoring", fsa.patterns, pathname)
+		return nil
+	}
+	if isTempFile(pathname) {
+		debugf("visit: ignoring file:%s that is still being written", pathname)
 		return nil
 	}
 	if f.Mode().IsRegular() {
-		time, errtime := getFirstDate(pathname)
-		if errtime != nil {
-			if fsa.debug {
-				log.Print("getFirstDate failed on file: ", fname, " that should be in fooHHMM format with error: ", errtime)
+		sz := f.Size()
+		fsa.firstdates.firstDate(pathname, fsa.fs, func(time time.Time, errtime error) {
+			if errtime != nil {
+				debugf("getFirstDate failed on file:%s that should be in fooHHMM format with error:%s", fname, errtime)
+				return
 			}
-			return nil
-		}
-		if time.After(ld) { // only add files that are later than current lastdate.
-			log.Printf("adding file:%s with date:%v to the archive\n", pathname, time)
-			fsa.tempentryfiles = append(fsa.tempentryfiles, ArchEntryFile{Path: pathname, Sdate: time, Sz: f.Size()})
-		} else {
-			//log.Printf("on: %s time:%v not later than last archived time:%v", fname, time, ld)
-		}
+			if time.After(ld) && !fsa.seenFile(pathname, time, sz) { // only add files that are later than current lastdate.
+				infof("adding file:%s with date:%v to the archive\n", pathname, time)
+				fsa.tempentryfiles = append(fsa.tempentryfiles, ArchEntryFile{Path: pathname, Sdate: time, Sz: sz})
+				fsa.addFresh(fsa.tempentryfiles[len(fsa.tempentryfiles)-1])
+			} else {
+				//log.Printf("on: %s time:%v not later than last archived time:%v", fname, time, ld)
+			}
+		})
 	}
 	return nil
 }
@@ -1222,25 +3958,82 @@ func (fsa *mrtarchive) revisit(pathname string, f os.FileInfo, err error) error
 func (fsa *mrtarchive) visit(pathname string, f os.FileInfo, err error) error {
 	fname := f.Name()
 	//log.Print("examining mrt: ", fname)
-	if strings.LastIndex(pathname, fsa.descriminator) == -1 {
-		if fsa.debug {
-			log.Printf("visit: descriminator:%s not found in path:%s . ignoring\n", fsa.descriminator, pathname)
-		}
+	if !fsa.matchesPattern(pathname) {
+		debugf("visit: patterns:%v not found in path:%s . ignoring", fsa.patterns, pathname)
+		return nil
+	}
+	if isTempFile(pathname) {
+		debugf("visit: ignoring file:%s that is still being written", pathname)
 		return nil
 	}
 	if f.Mode().IsRegular() {
-		time, errtime := getFirstDate(pathname)
-		if errtime != nil {
-			if fsa.debug {
-				log.Print("time.Parse() failed on file: ", fname, " that should be in fooHHMM format with error: ", errtime)
+		sz := f.Size()
+		fsa.firstdates.firstDate(pathname, fsa.fs, func(time time.Time, errtime error) {
+			if errtime != nil {
+				debugf("time.Parse() failed on file:%s that should be in fooHHMM format with error:%s", fname, errtime)
+				return
 			}
-			return nil
-		}
-		fsa.tempentryfiles = append(fsa.tempentryfiles, ArchEntryFile{Path: pathname, Sdate: time, Sz: f.Size()})
+			if fsa.seenFile(pathname, time, sz) {
+				return
+			}
+			fsa.tempentryfiles = append(fsa.tempentryfiles, ArchEntryFile{Path: pathname, Sdate: time, Sz: sz})
+			fsa.addFresh(fsa.tempentryfiles[len(fsa.tempentryfiles)-1])
+		})
 	}
 	return nil
 }
 
+//scanKey is what two paths of the same physical file surely have in common
+type scanKey struct {
+	sdate int64
+	sz    int64
+}
+
+//seenFile returns true if pathname is already in tempentryfiles, or it is the same
+//physical file as one of them. Hard links and paths through symlinked dirs would
+//otherwise add the same data twice. The paths are looked up on their own, since
+//a file that grew since it was added has another size. Only the other paths with
+//the same first date and size are compared, so distinct files with the same
+//content are all kept. Paths that aren't seen are remembered, so they must be
+//added by the caller.
+func (fsa *fsarchive) seenFile(pathname string, sdate time.Time, sz int64) bool {
+	if fsa.scanfiles == nil {
+		fsa.scanfiles = make(map[scanKey][]string)
+		fsa.scanpaths = make(map[string]bool, len(fsa.tempentryfiles))
+		for _, ef := range fsa.tempentryfiles {
+			k := scanKey{ef.Sdate.Unix(), ef.Sz}
+			fsa.scanfiles[k] = append(fsa.scanfiles[k], ef.Path)
+			fsa.scanpaths[ef.Path] = true
+		}
+	}
+	if fsa.scanpaths[pathname] {
+		return true
+	}
+	k := scanKey{sdate.Unix(), sz}
+	for _, p := range fsa.scanfiles[k] {
+		if fsa.sameFile(p, pathname) {
+			debugf("file:%s is the same file as:%s . ignoring", pathname, p)
+			return true
+		}
+	}
+	fsa.scanfiles[k] = append(fsa.scanfiles[k], pathname)
+	fsa.scanpaths[pathname] = true
+	return false
+}
+
+//sameFile is never true for objects, which can't be linked
+func (fsa *fsarchive) sameFile(a, b string) bool {
+	fa, err := fsa.fs.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := fsa.fs.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
 func NewMRTArchive(path, descr, colname string, ref int, savepath string, debug bool) *mrtarchive {
 	return &mrtarchive{fsarchive: NewFsArchive(path, descr, colname, ref, savepath, debug)}
 }
@@ -1248,174 +4041,342 @@ func NewMRTArchive(path, descr, colname string, ref int, savepath string, debug
 func NewFsArchive(path, descr, colname string, ref int, savepath string, debug bool) *fsarchive {
 	return &fsarchive{
 		rootpathstr:    path,
+		fs:             newArchiveFS(path),
 		entryfiles:     &TimeEntrySlice{},
 		tempentryfiles: TimeEntrySlice{},
 		reqchan:        make(chan string),
-		scanning:       false,
+		stopped:        make(chan struct{}),
+		stoponce:       &sync.Once{},
 		scanwg:         &sync.WaitGroup{},
 		scanch:         make(chan struct{}),
 		timedelta:      15 * time.Minute,
 		descriminator:  descr,
+		patterns:       []string{descr},
+		dirlayouts:     []string{DEFAULT_DIR_LAYOUT},
 		refreshmin:     ref,
-		contctx:        newContCtx(),
+		contctx:        newContCtx(contClients.WithLabelValues(colname, descr)),
 		collectorstr:   colname,
 		savepath:       savepath,
 		debug:          debug,
+		scanopenfiles:  DEFAULT_SCAN_OPEN_FILES,
+	}
+}
+
+//SetPatterns replaces the descriminator as the way to tell which files
+//under the root path belong to the archive. Patterns containing any of *?[
+//are globs matched against the file name, the rest are matched anywhere in
+//the path like the descriminator.
+func (fsar *fsarchive) SetPatterns(a []string) {
+	if len(a) > 0 {
+		fsar.patterns = a
+	}
+}
+
+func (fsar *fsarchive) matchesPattern(pathname string) bool {
+	for _, p := range fsar.patterns {
+		if strings.ContainsAny(p, "*?[") {
+			if ok, _ := filepath.Match(p, filepath.Base(pathname)); ok {
+				return true
+			}
+		} else if strings.LastIndex(pathname, p) != -1 {
+			return true
+		}
 	}
+	return false
+}
+
+//SetWatch makes Serve watch the filesystem for new files after the
+//first scan instead of rescanning every refresh period.
+//Serve falls back to rescanning if the filesystem can't be watched.
+func (fsar *fsarchive) SetWatch(a bool) {
+	fsar.watch = a
+}
+
+//SetWritable lets files be uploaded to the archive by its ingest resource.
+//Archives are read only by default, and only local ones can be written to.
+func (fsar *fsarchive) SetWritable(a bool) {
+	fsar.writable = a
 }
 
 func (fsar *fsarchive) SetTimeDelta(a time.Duration) {
 	fsar.timedelta = a
 }
 
+//SetScanWorkers sets how many files a single query can scan concurrently.
+//Values less than 1 default to the number of CPUs.
+func (fsar *fsarchive) SetScanWorkers(a int) {
+	fsar.scanworkers = a
+}
+
+//SetScanOpenFiles sets how many files a scan of the archive opens at the same
+//time to read their first dates. Large trees are indexed faster with more,
+//as long as the process stays under its limit of open files.
+func (fsar *fsarchive) SetScanOpenFiles(a int) {
+	fsar.scanopenfiles = a
+}
+
+func (fsar *fsarchive) getScanWorkers() int {
+	if fsar.scanworkers < 1 {
+		return runtime.NumCPU()
+	}
+	return fsar.scanworkers
+}
+
 func (fsar *fsarchive) lastDate() (time.Time, error) {
-	if len(*fsar.entryfiles) == 0 {
+	ef := fsar.getEntryFiles()
+	if len(ef) == 0 {
 		return time.Now(), errempty
 	}
-	return (*fsar.entryfiles)[len(*fsar.entryfiles)-1].Sdate, nil
+	return ef[len(ef)-1].Sdate, nil
 }
 
-//trying to see if a dir name is in YYYY.MM form
-//returns true, year, month if it is, or false, 0, 0 if not.
-//input fname should be a Base dir. meaning it would be good to
-//get it from a path.Base() function
-func isYearMonthDir(fname string) (res bool, yr int, mon int) {
-	var err error
-	res = false
-	yr = 0
-	mon = 0
-	isdot := func(r rune) bool {
-		if r == '.' {
-			return true
-		}
-		return false
-	}
-	ind := strings.IndexFunc(fname, isdot)
-	//not found or in the form foo.
-	if ind == -1 || ind == len(fname) {
-		return
-	}
-	//not YYYY or MM
-	if len(fname[:ind]) != 4 || len(fname[ind+1:]) != 2 {
-		return
-	}
-	yr, err = strconv.Atoi(fname[:ind])
-	if err != nil {
-		return
-	}
-	mon, err = strconv.Atoi(fname[ind+1:])
-	if err != nil {
-		return
+//DEFAULT_DIR_LAYOUT is the year and month dirs of RouteViews and RIS, like 2013.01
+const DEFAULT_DIR_LAYOUT = "2006.01"
+
+//SetDirLayouts sets the time layouts of the year and month dirs of the archive,
+//that let the rescans skip the months before the last file. A layout with a /
+//is matched against as many of the last elements of the path, like 2006/01 for
+//a month dir inside a year dir, and a layout without a month like 2006 skips
+//whole years. Dirs that match none of them are always walked.
+func (fsar *fsarchive) SetDirLayouts(a []string) {
+	if len(a) > 0 {
+		fsar.dirlayouts = a
 	}
-	if mon < 1 || mon > 12 {
-		return
+}
+
+//yearMonthDir returns true and the year and month of a dir whose path ends
+//in one of the layouts. The month is 0 for layouts with just the year.
+func yearMonthDir(pathname string, layouts []string) (res bool, yr int, mon int) {
+	elems := strings.Split(filepath.ToSlash(pathname), "/")
+	for _, l := range layouts {
+		n := strings.Count(l, "/") + 1
+		if n > len(elems) {
+			continue
+		}
+		t, err := time.Parse(l, strings.Join(elems[len(elems)-n:], "/"))
+		if err != nil {
+			continue
+		}
+		if strings.Contains(l, "01") || strings.Contains(l, "Jan") {
+			return true, t.Year(), int(t.Month())
+		}
+		return true, t.Year(), 0
 	}
-	//the values were found to be valid
-	res = true
 	return
 }
 
 func (fsa *fsarchive) printEntries() {
-	log.Printf("dumping entries")
-	for _, ef := range *fsa.entryfiles {
+	debugf("dumping entries")
+	for _, ef := range fsa.getEntryFiles() {
 		fmt.Printf("%s %s\n", ef.Path, ef.Sdate)
 	}
 }
 
 func (fsa *mrtarchive) rescan() {
-	fsa.scanning = true
-	filepath.Walk(fsa.rootpathstr, fsa.revisit)
+	startt := time.Now()
+	fsa.setScanning(true)
+	fsa.firstdates = newFirstDatePool(fsa.fs, fsa.scanopenfiles)
+	if err := fsa.fs.Walk(fsa.rootpathstr, fsa.revisit); err != nil {
+		warnf("fsarchive:%s rescan error:%s", fsa.descriminator, err)
+	}
+	fsa.firstdates.wait()
+	fsa.firstdates = nil
+	fsa.scanfiles, fsa.scanpaths = nil, nil
+	sort.Sort(fsa.tempentryfiles)
+	fsa.observeScan(startt)
+}
+
+//fullRescan walks the whole archive like scan, but keeps the files already
+//in it and only reads the ones it doesn't know yet. Unlike rescan it doesn't
+//skip the months before the last date, so it picks up backfilled files.
+func (fsa *mrtarchive) fullRescan() {
+	startt := time.Now()
+	fsa.setScanning(true)
+	known := make(map[string]bool, len(fsa.tempentryfiles))
+	for _, ef := range fsa.tempentryfiles {
+		known[ef.Path] = true
+	}
+	before := len(fsa.tempentryfiles)
+	fsa.firstdates = newFirstDatePool(fsa.fs, fsa.scanopenfiles)
+	err := fsa.fs.Walk(fsa.rootpathstr, func(pathname string, f os.FileInfo, err error) error {
+		if err != nil || known[pathname] {
+			return nil
+		}
+		return fsa.visit(pathname, f, err)
+	})
+	if err != nil {
+		warnf("fsarchive:%s full rescan error:%s", fsa.descriminator, err)
+	}
+	fsa.firstdates.wait()
+	fsa.firstdates = nil
+	fsa.scanfiles, fsa.scanpaths = nil, nil
 	sort.Sort(fsa.tempentryfiles)
+	infof("fsarchive:%s full rescan found %d new files", fsa.descriminator, len(fsa.tempentryfiles)-before)
+	fsa.observeScan(startt)
 }
 
 func (fsa *mrtarchive) scan() {
 	//clear the temp slice
 	//fsa.scanwg.Add(1)
+	startt := time.Now()
 	fsa.tempentryfiles = []ArchEntryFile{}
-	fsa.scanning = true
+	fsa.setScanning(true)
 	//fmt.Printf("the type is:%+v\n", reflect.TypeOf(fsa))
-	filepath.Walk(fsa.rootpathstr, fsa.visit)
+	fsa.firstdates = newFirstDatePool(fsa.fs, fsa.scanopenfiles)
+	if err := fsa.fs.Walk(fsa.rootpathstr, fsa.visit); err != nil {
+		warnf("fsarchive:%s scan error:%s", fsa.descriminator, err)
+	}
+	fsa.firstdates.wait()
+	fsa.firstdates = nil
+	fsa.scanfiles, fsa.scanpaths = nil, nil
 	sort.Sort(fsa.tempentryfiles)
+	fsa.observeScan(startt)
 	//allow the serve goroutine to unblock in case of STOP.
 	//signal the serve goroutine on scandone channel
 	//fsa.scanch <- struct{}{}
 }
 
 func (fsa *mrtarchive) Serve(wg, allscanwg *sync.WaitGroup) (reqchan chan<- string) {
-	if fsa.reqchan == nil { // we have closed the channel and now called again
-		fsa.reqchan = make(chan string)
+	select {
+	case <-fsa.stopped: // we have been stopped and now called again
+		fsa.stopped, fsa.stoponce = make(chan struct{}), &sync.Once{}
+	default:
 	}
 	tick := time.NewTicker(time.Minute * time.Duration(fsa.refreshmin))
-	log.Printf("rescanning every :%v", time.Minute*time.Duration(fsa.refreshmin))
+	infof("rescanning every :%v", time.Minute*time.Duration(fsa.refreshmin))
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		var (
+			watcher  *fsnotify.Watcher
+			watchevc chan fsnotify.Event //stays nil unless we are watching
+			watcherc chan error
+			pending  = make(map[string]bool)
+		)
+		startWatch := func() {
+			if !fsa.watch || watcher != nil {
+				return
+			}
+			w, err := fsa.newWatcher()
+			if err != nil {
+				warnf("fsarchive:%s can't watch the filesystem:%s. rescanning every :%v", fsa.descriminator, err, time.Minute*time.Duration(fsa.refreshmin))
+				return
+			}
+			infof("fsarchive:%s watching %s for new files", fsa.descriminator, fsa.rootpathstr)
+			tick.Stop()
+			watcher, watchevc, watcherc = w, w.Events, w.Errors
+		}
 		for {
 			select {
-			case req := <-fsa.reqchan:
+			case ev := <-watchevc:
+				fsa.handleWatchEvent(watcher, ev, pending)
+			case err := <-watcherc:
+				warnf("fsarchive:%s watcher error:%s", fsa.descriminator, err)
+			case req, ok := <-fsa.reqchan:
+				if !ok { //a closed request channel stops the archive
+					req = "STOP"
+				}
 				switch req {
 				case "SCAN":
-					if fsa.scanning {
-						log.Print("fsarchive: already scanning. ignoring command")
+					if fsa.isScanning() {
+						infof("fsarchive: already scanning. ignoring command")
 					} else { //fire an async goroutine to scan the files and wait for SCANDONE
-						log.Printf("fsarchive:%s scanning.", fsa.descriminator)
+						infof("fsarchive:%s scanning.", fsa.descriminator)
 						allscanwg.Add(1)
 						fsa.scanwg.Add(1)
 						fsa.scan()
-						fsa.scanning = false
-						fsa.entryfiles = &fsa.tempentryfiles
+						fsa.setScanning(false)
+						fsa.setEntryFiles(fsa.tempentryfiles)
 						fsa.scanwg.Done()
 						allscanwg.Done()
+						startWatch()
 					}
 				case "RESCAN":
-					if fsa.scanning {
-						log.Print("fsarchive: already scanning. ignoring command")
+					if fsa.isScanning() {
+						infof("fsarchive: already scanning. ignoring command")
 					} else { //fire an async goroutine to scan the files and wait for SCANDONE
-						log.Printf("fsarchive:%s rescanning.", fsa.descriminator)
+						infof("fsarchive:%s rescanning.", fsa.descriminator)
 						fsa.rescan()
-						fsa.scanning = false
-						fsa.entryfiles = &fsa.tempentryfiles
-						errg := fsa.tempentryfiles.ToGobFile(fmt.Sprintf("%s/%s", fsa.savepath, fsa.descriminator))
+						fsa.setScanning(false)
+						fsa.setEntryFiles(fsa.tempentryfiles)
+						errg := fsa.tempentryfiles.ToFile(fmt.Sprintf("%s/%s-%s", fsa.savepath, fsa.descriminator, fsa.collectorstr))
+						if errg != nil {
+							warnf("%s", errg)
+						} else {
+							infof("succesfully rewrote serialized file for archive:%s", fsa.descriminator)
+						}
+						//like the periodic rescan, this catches up an archive loaded from its index file
+						startWatch()
+					}
+				case "FULLRESCAN":
+					if fsa.isScanning() {
+						infof("fsarchive: already scanning. ignoring command")
+					} else {
+						infof("fsarchive:%s rescanning all the months.", fsa.descriminator)
+						fsa.fullRescan()
+						fsa.setScanning(false)
+						fsa.setEntryFiles(fsa.tempentryfiles)
+						errg := fsa.tempentryfiles.ToFile(fmt.Sprintf("%s/%s-%s", fsa.savepath, fsa.descriminator, fsa.collectorstr))
 						if errg != nil {
-							log.Println(errg)
+							warnf("%s", errg)
 						} else {
-							log.Printf("succesfully rewrote serialized file for archive:%s", fsa.descriminator)
+							infof("succesfully rewrote serialized file for archive:%s", fsa.descriminator)
 						}
 					}
+				case "SYNC":
+					//nothing to do. since the commands are handled one at a time,
+					//the sender knows that the commands it sent before are done.
 				case "DUMPENTRIES":
-					if fsa.scanning {
-						log.Printf("fsar: warning. scanning in progress", fsa.descriminator)
+					if fsa.isScanning() {
+						warnf("fsar:%s warning. scanning in progress", fsa.descriminator)
 					}
 					fsa.printEntries()
 				case "STOP":
-					log.Printf("fsar:%s stopping", fsa.descriminator)
+					infof("fsar:%s stopping", fsa.descriminator)
 					fsa.scanwg.Wait()
 					tick.Stop()
-					fsa.reqchan = nil //no more stuff from this channel
+					if watcher != nil {
+						watcher.Close()
+					}
+					fsa.contctx.Stop()
+					close(fsa.stopped) //no more stuff from this channel
 					return
+				default:
+					//ADD <path> adds a single file, like the uploads of the ingest resource
+					if pathname := strings.TrimPrefix(req, "ADD "); pathname != req {
+						f, err := fsa.fs.Stat(pathname)
+						if err == nil {
+							err = fsa.addFile(pathname, f)
+						}
+						if err != nil {
+							warnf("fsarchive:%s failed adding file:%s error:%s", fsa.descriminator, pathname, err)
+						}
+					}
 				}
 			case <-tick.C:
-				log.Printf("rescanning")
-				if fsa.scanning {
-					log.Print("fsarchive: already scanning. ignoring command")
+				debugf("rescanning")
+				if fsa.isScanning() {
+					infof("fsarchive: already scanning. ignoring command")
 				} else { //fire an async goroutine to scan the files and wait for SCANDONE
-					log.Printf("fsarchive:%s rescanning.", fsa.descriminator)
+					infof("fsarchive:%s rescanning.", fsa.descriminator)
 					fsa.rescan()
-					fsa.scanning = false
-					fsa.entryfiles = &fsa.tempentryfiles
+					fsa.setScanning(false)
+					fsa.setEntryFiles(fsa.tempentryfiles)
 					//rewrite the file
-					errg := fsa.tempentryfiles.ToGobFile(fmt.Sprintf("%s/%s-%s", fsa.savepath, fsa.descriminator, fsa.collectorstr))
+					errg := fsa.tempentryfiles.ToFile(fmt.Sprintf("%s/%s-%s", fsa.savepath, fsa.descriminator, fsa.collectorstr))
 					if errg != nil {
-						log.Println(errg)
+						warnf("%s", errg)
 					} else {
-						log.Printf("succesfully rewrote serialized file for archive:%s", fsa.descriminator)
+						infof("succesfully rewrote serialized file for archive:%s", fsa.descriminator)
 					}
+					//an archive loaded from its index file starts watching after catching up
+					startWatch()
 				}
 			}
 		}
 	}()
 	//firing continuous cli pull context server
-	log.Printf("firing continuous pull server")
+	infof("firing continuous pull server")
 	fsa.contctx.Serve()
 	return fsa.reqchan
 }
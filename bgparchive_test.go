@@ -0,0 +1,2658 @@
+package bgparchive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	ppmrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//three files of 15 minutes with an update every minute
+var quarterFiles = []testFile{
+	{start: 0, n: 15, step: time.Minute},
+	{start: 15 * time.Minute, n: 15, step: time.Minute},
+	{start: 30 * time.Minute, n: 15, step: time.Minute},
+}
+
+func TestWholeFilesContentLength(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	file1, err := ioutil.ReadFile(ef[1].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file2, err := ioutil.ReadFile(ef[2].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		a, b   time.Duration
+		length int64
+		body   []byte
+	}{
+		{"aligned file", 15 * time.Minute, 30*time.Minute - time.Second, int64(len(file1)), file1},
+		{"aligned files", 15 * time.Minute, 45*time.Minute - time.Second, int64(len(file1) + len(file2)), append(append([]byte(nil), file1...), file2...)},
+		{"starts in a file", 10 * time.Minute, 30*time.Minute - time.Second, 0, nil},
+		{"ends in a file", 15 * time.Minute, 25 * time.Minute, 0, nil},
+		{"takes a second of the next file", 15 * time.Minute, 30 * time.Minute, 0, nil},
+	}
+	for _, tt := range tests {
+		h, body, errs := testQuery(ar, testRange(tt.a, tt.b))
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tt.name, h.Code, errs)
+			continue
+		}
+		if h.ContentLength != tt.length {
+			t.Errorf("%s: got Content-Length %d, want %d", tt.name, h.ContentLength, tt.length)
+		}
+		if tt.length > 0 && !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: the body is not the files of the range", tt.name)
+		}
+		if tt.length > 0 && !h.AcceptRanges {
+			t.Errorf("%s: a reply with a Content-Length should accept ranges", tt.name)
+		}
+	}
+}
+
+func TestWholeFilesNotWithFilters(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	values := testRange(15*time.Minute, 30*time.Minute-time.Second)
+	values.Set("peeras", "3356")
+	if h, _, _ := testQuery(ar, values); h.ContentLength != 0 {
+		t.Errorf("a filtered query got Content-Length %d", h.ContentLength)
+	}
+}
+
+func TestByteRanges(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	var files []byte
+	for _, k := range []int{1, 2} {
+		b, err := ioutil.ReadFile(ef[k].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b...)
+	}
+	size := int64(len(files))
+	tests := []struct {
+		hdr        string
+		code       int
+		from, to   int64
+		contentrng string
+	}{
+		{"bytes=100-", 206, 100, size - 1, fmt.Sprintf("bytes 100-%d/%d", size-1, size)},
+		{fmt.Sprintf("bytes=%d-", size-10), 206, size - 10, size - 1, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size)},
+		{"bytes=10-1200", 206, 10, 1200, fmt.Sprintf("bytes 10-1200/%d", size)},
+		{"bytes=-50", 206, size - 50, size - 1, fmt.Sprintf("bytes %d-%d/%d", size-50, size-1, size)},
+		{fmt.Sprintf("bytes=%d-", size), 416, 0, 0, fmt.Sprintf("bytes */%d", size)},
+	}
+	for _, tt := range tests {
+		values := testRange(15*time.Minute, 45*time.Minute-time.Second)
+		values.Set("rangeheader", tt.hdr)
+		h, body, errs := testQuery(ar, values)
+		if h.Code != tt.code {
+			t.Errorf("%s: got code %d, want %d", tt.hdr, h.Code, tt.code)
+			continue
+		}
+		if h.ContentRange != tt.contentrng {
+			t.Errorf("%s: got Content-Range %q, want %q", tt.hdr, h.ContentRange, tt.contentrng)
+		}
+		if tt.code != 206 {
+			continue
+		}
+		if len(errs) != 0 {
+			t.Errorf("%s: got errors %v", tt.hdr, errs)
+		}
+		if h.ContentLength != tt.to-tt.from+1 || !bytes.Equal(body, files[tt.from:tt.to+1]) {
+			t.Errorf("%s: got %d bytes with Content-Length %d, want bytes %d to %d", tt.hdr, len(body), h.ContentLength, tt.from, tt.to)
+		}
+	}
+}
+
+func TestRangesOutsideTheArchive(t *testing.T) {
+	//a two hour file with an update every 10 minutes, like a RIB dump that is
+	//longer than the timedelta, and another file after it
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 12, step: 10 * time.Minute},
+		{start: 2 * time.Hour, n: 15, step: time.Minute},
+	})
+	tests := []struct {
+		name string
+		a, b time.Duration
+		code int
+		err  string
+		recs int
+	}{
+		{"before the start", -2 * time.Hour, -time.Hour, 416, "before the first file", 0},
+		{"after the end", 3 * time.Hour, 4 * time.Hour, 416, "after the last file", 0},
+		{"in a gap", 112 * time.Minute, 118 * time.Minute, 404, "in a gap between the files of the archive from 20130101015000 to 20130101020000", 0},
+		{"in the file past the timedelta", 30*time.Minute - time.Second, 40 * time.Minute, 200, "", 2},
+		{"across the files", 110 * time.Minute, 2*time.Hour + 30*time.Second, 200, "", 2},
+	}
+	for _, tt := range tests {
+		h, body, errs := testQuery(ar, testRange(tt.a, tt.b))
+		if h.Code != tt.code {
+			t.Errorf("%s: got code %d, want %d", tt.name, h.Code, tt.code)
+			continue
+		}
+		if tt.err != "" {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) || !strings.Contains(errs[0].Error(), "the archive has files from 20130101000000") {
+				t.Errorf("%s: got errors %v, want one about %q", tt.name, errs, tt.err)
+			}
+			continue
+		}
+		if n := len(splitRecords(t, body)); n != tt.recs {
+			t.Errorf("%s: got %d records, want %d", tt.name, n, tt.recs)
+		}
+	}
+}
+
+func TestSpanOfTransformedMessages(t *testing.T) {
+	//the messages lose their timestamps, so the span must come from the scanners
+	if _, ok := lookupFormat("testblank"); !ok {
+		if err := RegisterFormat("testblank", "text/plain", true, func([]byte) ([]byte, error) {
+			return []byte("x\n"), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ar := newTestArchive(t, quarterFiles)
+	tests := []struct {
+		name        string
+		params      map[string]string
+		first, last time.Duration
+		recs        int
+	}{
+		{"raw", nil, 16 * time.Minute, 44 * time.Minute, 29},
+		{"transformed", map[string]string{"format": "testblank"}, 16 * time.Minute, 44 * time.Minute, 29},
+		{"sorted", map[string]string{"format": "testblank", "sorted": "true"}, 16 * time.Minute, 44 * time.Minute, 29},
+		{"desc", map[string]string{"format": "testblank", "desc": "true"}, 16 * time.Minute, 44 * time.Minute, 29},
+		{"limit", map[string]string{"format": "testblank", "limit": "3"}, 16 * time.Minute, 18 * time.Minute, 3},
+	}
+	for _, tt := range tests {
+		//not aligned to the files, so that raw messages aren't sent as whole files
+		values := testRange(16*time.Minute, 45*time.Minute)
+		values.Set("exact", "true")
+		for k, v := range tt.params {
+			values.Set(k, v)
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tt.name, h.Code, errs)
+			continue
+		}
+		if tt.params["format"] != "" {
+			if n := bytes.Count(body, []byte("x\n")); n != tt.recs || len(body) != 2*n {
+				t.Errorf("%s: got %d transformed messages in %d bytes, want %d", tt.name, n, len(body), tt.recs)
+			}
+		}
+		tv := h.TrailerValues()
+		want := map[string]string{
+			DATA_FIRST_TRAILER: testEpoch.Add(tt.first).Format(time.RFC3339),
+			DATA_LAST_TRAILER:  testEpoch.Add(tt.last).Format(time.RFC3339),
+		}
+		for k, v := range want {
+			if tv[k] != v {
+				t.Errorf("%s: got trailer %s %q, want %q", tt.name, k, tv[k], v)
+			}
+		}
+	}
+}
+
+func TestSeenFile(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	dir := filepath.Dir(ef[0].Path)
+	link := filepath.Join(dir, "updates.20130101.0001")
+	if err := os.Link(ef[0].Path, link); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(ef[1].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := filepath.Join(dir, "updates.20130101.0016")
+	if err := ioutil.WriteFile(cp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		path  string
+		sdate time.Time
+		sz    int64
+		seen  bool
+	}{
+		{"same path", ef[0].Path, ef[0].Sdate, ef[0].Sz, true},
+		{"same path after it grew", ef[2].Path, ef[2].Sdate, ef[2].Sz + 100, true},
+		{"hard link", link, ef[0].Sdate, ef[0].Sz, true},
+		{"copy", cp, ef[1].Sdate, ef[1].Sz, false},
+		{"copy again", cp, ef[1].Sdate, ef[1].Sz, true},
+	}
+	ar.tempentryfiles = ef
+	for _, tt := range tests {
+		if seen := ar.seenFile(tt.path, tt.sdate, tt.sz); seen != tt.seen {
+			t.Errorf("%s: got seen %v, want %v", tt.name, seen, tt.seen)
+		}
+	}
+}
+
+func TestScanSymlink(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	link := filepath.Join(filepath.Dir(ef[0].Path), "updates.20130101.0001")
+	if err := os.Symlink(ef[0].Path, link); err != nil {
+		t.Fatal(err)
+	}
+	scanned := scanTestArchive(ar.rootpathstr).getEntryFiles()
+	if len(scanned) != len(ef) {
+		t.Fatalf("got %d files, want %d: %v", len(scanned), len(ef), scanned)
+	}
+	var n int
+	for _, f := range scanned {
+		if f.Sdate.Equal(ef[0].Sdate) {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("the file and its symlink are %d entries, want 1", n)
+	}
+}
+
+func TestFullRescanBackfill(t *testing.T) {
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 15, step: time.Minute},
+		{start: 32 * 24 * time.Hour, n: 15, step: time.Minute},
+	})
+	//a file backfilled in the month before the last date
+	backfill := testFile{start: time.Hour, n: 15, step: time.Minute}
+	var data []byte
+	for _, rec := range backfill.records() {
+		data = append(data, rec...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ar.rootpathstr, "2013.01", backfill.name()), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		scan  func()
+		files int
+	}{
+		{"rescan", ar.rescan, 2},
+		{"full rescan", ar.fullRescan, 3},
+		{"full rescan again", ar.fullRescan, 3},
+	} {
+		tc.scan()
+		ar.setScanning(false)
+		ar.setEntryFiles(ar.tempentryfiles)
+		if n := len(ar.getEntryFiles()); n != tc.files {
+			t.Errorf("%s: got %d files, want %d", tc.name, n, tc.files)
+		}
+	}
+	h, body, errs := testQuery(ar, testRange(backfill.start, backfill.start+15*time.Minute-time.Second))
+	if h.Code != 200 || len(errs) != 0 || !bytes.Equal(body, data) {
+		t.Errorf("the backfilled range got code %d, errors %v and %d bytes, want %d", h.Code, errs, len(body), len(data))
+	}
+}
+
+//slowWalkFS stops the walks before the file named stop until release is closed
+type slowWalkFS struct {
+	archiveFS
+	stop    string
+	release chan struct{}
+}
+
+func (sfs *slowWalkFS) Walk(root string, fn filepath.WalkFunc) error {
+	return sfs.archiveFS.Walk(root, func(pathname string, fi os.FileInfo, err error) error {
+		if filepath.Base(pathname) == sfs.stop {
+			<-sfs.release
+		}
+		return fn(pathname, fi, err)
+	})
+}
+
+func TestQueryDuringScan(t *testing.T) {
+	last := testFile{start: 45 * time.Minute, n: 15, step: time.Minute}
+	dir, _ := writeTestFiles(t, append(quarterFiles, last))
+	defer os.RemoveAll(dir)
+	ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+	sfs := &slowWalkFS{archiveFS: ar.fs, stop: last.name(), release: make(chan struct{})}
+	ar.fs = sfs
+	scanned := make(chan struct{})
+	go func() {
+		ar.scan()
+		close(scanned)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ar.getQueryFiles()) < len(quarterFiles) {
+		if time.Now().After(deadline) {
+			close(sfs.release)
+			t.Fatalf("the queries see %d files of the running scan", len(ar.getQueryFiles()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//the files found so far are queried before the scan is over
+	h, body, errs := testQuery(ar, testRange(16*time.Minute, 29*time.Minute))
+	if h.Code != 200 || len(errs) != 0 || len(body) == 0 {
+		t.Errorf("during the scan got code %d, errors %v and %d bytes", h.Code, errs, len(body))
+	}
+	if n := len(ar.getEntryFiles()); n != 0 {
+		t.Errorf("the scan published %d files before it was over", n)
+	}
+	close(sfs.release)
+	<-scanned
+	ar.setScanning(false)
+	ar.setEntryFiles(ar.tempentryfiles)
+	if qf, ef := ar.getQueryFiles(), ar.getEntryFiles(); len(qf) != 4 || len(ef) != 4 {
+		t.Errorf("after the scan the queries see %d files of the %d", len(qf), len(ef))
+	}
+	//a file older than the archive files waits for the end of the scan
+	ar.addFresh(ArchEntryFile{Path: filepath.Join(dir, "2013.01", "updates.20130101.0020"), Sdate: testEpoch.Add(20 * time.Minute)})
+	if n := len(ar.getQueryFiles()); n != 4 {
+		t.Errorf("an older file found by a scan made the queries see %d files", n)
+	}
+}
+
+func TestServeLoadedIndex(t *testing.T) {
+	dir, _ := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(dir)
+	saved := scanTestArchive(dir)
+	index := filepath.Join(t.TempDir(), "updates-testcol")
+	if err := saved.Save(index); err != nil {
+		t.Fatal(err)
+	}
+	//a file added after the index was saved
+	added := testFile{start: 45 * time.Minute, n: 15, step: time.Minute}
+	var data []byte
+	for _, rec := range added.records() {
+		data = append(data, rec...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "2013.01", added.name()), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+	if err := ar.Load(index); err != nil {
+		t.Fatal(err)
+	}
+	ar.SetEntryFilesToTemp()
+	//the saved files are served before any scan
+	h, body, errs := testQuery(ar, testRange(0, 45*time.Minute-time.Second))
+	if h.Code != 200 || len(errs) != 0 || len(splitRecords(t, body)) != 45 {
+		t.Fatalf("the saved files got code %d, errors %v and %d bytes", h.Code, errs, len(body))
+	}
+	//and the rescan in the background picks up the rest
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg) <- "RESCAN"
+	defer wg.Wait()
+	defer ar.Close()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if h, body, _ = testQuery(ar, testRange(added.start, added.start+15*time.Minute-time.Second)); h.Code == 200 && bytes.Equal(body, data) {
+			break
+		}
+	}
+	if h.Code != 200 || !bytes.Equal(body, data) {
+		t.Errorf("the added file got code %d and %d bytes, want %d", h.Code, len(body), len(data))
+	}
+}
+
+func TestFileIndexRangeCadence(t *testing.T) {
+	//files of a record a minute for an hour, shorter than the 15 minute timedelta
+	for _, cadence := range []time.Duration{5 * time.Minute, 10 * time.Minute} {
+		var files []testFile
+		for start := time.Duration(0); start < time.Hour; start += cadence {
+			files = append(files, testFile{start: start, n: int(cadence / time.Minute), step: time.Minute})
+		}
+		//the last file is taken to last the timedelta
+		ar := newTestArchive(t, append(files, testFile{start: time.Hour, n: 1}))
+		for a := time.Duration(0); a < time.Hour-3*time.Minute; a += time.Minute {
+			_, i, j, err := ar.getFileIndexRange(testEpoch.Add(a), testEpoch.Add(a+3*time.Minute))
+			if err != nil {
+				t.Fatalf("%s files from %s: %s", cadence, a, err)
+			}
+			//the file with the records a second before a, and nothing before it
+			if first := int((a - time.Second) / cadence); i != first {
+				t.Errorf("%s files from %s: got the first file %d, want %d", cadence, a, i, first)
+			}
+			_, body, errs := testQuery(ar, testRange(a, a+3*time.Minute))
+			if n := len(splitRecords(t, body)); n != 4 || len(errs) != 0 || j <= i {
+				t.Errorf("%s files from %s: got %d messages of the files [%d:%d] and errors %v, want 4", cadence, a, n, i, j, errs)
+			}
+		}
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	if !ar.request("SYNC") {
+		t.Fatal("a running archive doesn't take requests")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ar.Close()
+		ar.Close()
+		if ar.request("SYNC") {
+			t.Error("a stopped archive took a request")
+		}
+		h, retc := NewArchiveAdmin(MrtArchives{ar}, "secret").Post(url.Values{"cmd": {"RESCAN"}, "authorization": {"Bearer secret"}, "remoteaddr": {"127.0.0.1"}})
+		var errs []error
+		for r := range retc {
+			errs = append(errs, r.Err)
+		}
+		if h.Code != 200 || len(errs) != 1 || errs[0] != errstopped {
+			t.Errorf("an admin request to a stopped archive got code %d and errors %v", h.Code, errs)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the archive blocked")
+	}
+	wg.Wait()
+}
+
+func TestServeStopGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ar := newTestArchive(t, quarterFiles)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	//a client, and the timer of its expiry
+	if h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}}); h.Code != 200 || h.Extra == "" {
+		t.Fatalf("got code %d id %q and errors %v", h.Code, h.Extra, errs)
+	}
+	ar.Close()
+	wg.Wait()
+	scanwg.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines are left after the archive is stopped", n-before)
+	}
+}
+
+func TestContinuousStopped(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}})
+	if h.Code != 200 || h.Extra == "" {
+		t.Fatalf("got code %d id %q and errors %v", h.Code, h.Extra, errs)
+	}
+	id := h.Extra
+	ar.Close()
+	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, values := range []url.Values{{"continuous": {"begin"}}, {"continuous": {id}}} {
+			h, _, errs := testQuery(ar, values)
+			if h.Code != 503 || len(errs) != 1 || errs[0] != errstopped {
+				t.Errorf("%v: got code %d and errors %v, want %s", values, h.Code, errs, errstopped)
+			}
+		}
+		if n := len(querysem); n != 0 {
+			t.Errorf("%d query slots are taken after the pulls", n)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a continuous request to a stopped archive blocked")
+	}
+}
+
+func TestStatsStreamLikeBuffered(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	st := NewFsarstat(ar.fsarchive)
+	tests := []struct {
+		name   string
+		a, b   time.Duration
+		params map[string]string
+	}{
+		{"minutes", 0, 45 * time.Minute, map[string]string{"bucket": "60"}},
+		{"default buckets", 10 * time.Minute, 40 * time.Minute, nil},
+		{"anomalies", 0, 45 * time.Minute, map[string]string{"bucket": "60", "anomaly": "1"}},
+		{"no messages", 0, 45 * time.Minute, map[string]string{"peeras": "64512"}},
+	}
+	for _, tt := range tests {
+		var replies [2]BgpStats
+		for k, stream := range []string{"false", "true"} {
+			values := testRange(tt.a, tt.b)
+			values.Set("stream", stream)
+			for p, v := range tt.params {
+				values.Set(p, v)
+			}
+			h, body, errs := testQuery(st, values)
+			if h.Code != 200 || len(errs) != 0 {
+				t.Fatalf("%s stream=%s: got code %d and errors %v", tt.name, stream, h.Code, errs)
+			}
+			if err := json.Unmarshal(body, &replies[k]); err != nil {
+				t.Fatalf("%s stream=%s: %s in %s", tt.name, stream, err, body)
+			}
+		}
+		if !reflect.DeepEqual(replies[0], replies[1]) {
+			t.Errorf("%s: the streamed stats\n%+v\nare not the buffered ones\n%+v", tt.name, replies[1], replies[0])
+		}
+		if tt.params["peeras"] == "" && replies[0].TotalMsgs == 0 {
+			t.Errorf("%s: no messages were counted", tt.name)
+		}
+	}
+}
+
+func TestStatsStreamErrors(t *testing.T) {
+	dir, paths := writeTestFiles(t, quarterFiles[:1])
+	defer os.RemoveAll(dir)
+	writeTruncatedGzip(t, filepath.Join(filepath.Dir(paths[0]), quarterFiles[1].name()), quarterFiles[1].records())
+	st := NewFsarstat(scanTestArchive(dir).fsarchive)
+	values := testRange(0, 30*time.Minute)
+	values.Set("stream", "true")
+	h, body, errs := testQuery(st, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	var stats BgpStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("%s in %s", err, body)
+	}
+	if len(stats.Errors) != 1 || !strings.Contains(stats.Errors[0], "updates.20130101.0015") {
+		t.Errorf("got errors %v, want the one of the second file", stats.Errors)
+	}
+	if stats.TotalMsgs != 30 {
+		t.Errorf("got %d messages, want the 30 before the error", stats.TotalMsgs)
+	}
+}
+
+func TestContinuousBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Minute)
+	writeLiveFile(t, dir, now.Add(-10*time.Minute), minutes(now, -10, -5))
+	ar := scanTestArchive(dir)
+	ar.contctx.Serve()
+	defer ar.contctx.Stop()
+	h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}})
+	if h.Code != 200 || h.Extra == "" || len(errs) != 0 {
+		t.Fatalf("got code %d id %q and errors %v", h.Code, h.Extra, errs)
+	}
+	id := h.Extra
+	for _, tc := range []struct {
+		name  string
+		taken int //slots taken during the pull
+		busy  bool
+	}{
+		{"all the slots taken", cap(querysem), true},
+		{"one slot free", cap(querysem) - 1, false},
+		{"no slots taken", 0, false},
+	} {
+		for k := 0; k < tc.taken; k++ {
+			if !acquireQuery() {
+				t.Fatal("no query slot")
+			}
+		}
+		h, _, errs := testQuery(ar, url.Values{"continuous": {id}})
+		if busy := h.Code == 503; busy != tc.busy || busy && h.RetryAfter == 0 {
+			t.Errorf("%s: got code %d retry after %d and errors %v", tc.name, h.Code, h.RetryAfter, errs)
+		}
+		//a busy pull keeps the id, so the client can retry it
+		if !tc.busy {
+			if h.Extra == "" {
+				t.Errorf("%s: got code %d and no next id", tc.name, h.Code)
+			}
+			id = h.Extra
+		}
+		if n := len(querysem); n != tc.taken {
+			t.Errorf("%s: %d slots are taken after the pull, want %d", tc.name, n, tc.taken)
+		}
+		for k := 0; k < tc.taken; k++ {
+			releaseQuery()
+		}
+	}
+}
+
+func TestAsofSendsOneRib(t *testing.T) {
+	rib := func(d time.Duration) []byte {
+		return mrtRecord(testTs(d), MRT_TABLE_DUMP_V2, 2, []byte{0, 0, 0, 1, 24, 8, 8, 8, 0, 0})
+	}
+	//the first dump has a record dated after the second one started
+	dumps := [][][]byte{
+		{rib(0), rib(time.Minute), rib(2*time.Hour + 30*time.Second)},
+		{rib(2 * time.Hour), rib(2*time.Hour + time.Minute)},
+		{rib(4 * time.Hour)},
+	}
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mdir := filepath.Join(dir, testEpoch.Format("2006.01"))
+	if err := os.MkdirAll(mdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for k, recs := range dumps {
+		name := "ribs." + testEpoch.Add(time.Duration(2*k)*time.Hour).Format("20060102.1504")
+		if err := ioutil.WriteFile(filepath.Join(mdir, name), bytes.Join(recs, nil), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ar := NewMRTArchive(dir, "ribs", "testcol", 120, dir, false)
+	ar.scan()
+	ar.setScanning(false)
+	ar.setEntryFiles(ar.tempentryfiles)
+	for _, tc := range []struct {
+		asof time.Duration
+		code int
+		want [][]byte
+	}{
+		{0, 200, dumps[0]},
+		{time.Hour, 200, dumps[0]},
+		{2 * time.Hour, 200, dumps[1]},
+		{2*time.Hour + 30*time.Minute, 200, dumps[1]},
+		{4*time.Hour + 30*time.Second, 200, dumps[2]},
+		{-time.Hour, 404, nil},
+	} {
+		values := url.Values{"asof": {testEpoch.Add(tc.asof).Format("20060102150405")}}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != tc.code {
+			t.Errorf("asof %s: got code %d and errors %v, want %d", tc.asof, h.Code, errs, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if got := splitRecords(t, body); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("asof %s: got %d records, want the %d of its dump", tc.asof, len(got), len(tc.want))
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := TimeEntrySlice{
+		{Path: "/a/2013.01/updates.20130101.0000", Sdate: testEpoch, Sz: 100},
+		{Path: "/a/2013.01/updates.20130101.0015", Sdate: testEpoch.Add(15 * time.Minute), Sz: 200},
+	}
+	fname := filepath.Join(dir, "index")
+	for _, tc := range []struct {
+		name    string
+		corrupt func([]byte) []byte
+		err     string
+	}{
+		{"round trip", func(b []byte) []byte { return b }, ""},
+		{"flipped byte", func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b }, "checksum"},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }, "checksum"},
+		{"header only", func(b []byte) []byte { return b[:len(INDEX_MAGIC)+2] }, "truncated"},
+		{"newer version", func(b []byte) []byte { b[len(INDEX_MAGIC)+3] = byte(INDEX_VERSION + 1); return b }, "version"},
+	} {
+		if err := want.ToFile(fname); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, tc.corrupt(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var got TimeEntrySlice
+		err = got.FromFile(fname)
+		if tc.err == "" {
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: got %v and error %v", tc.name, got, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, want one about the %s", tc.name, err, tc.err)
+		}
+	}
+	//concurrent writers don't share a temporary file and leave none behind
+	var wg sync.WaitGroup
+	for k := 0; k < 8; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := want.ToFile(fname); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	var got TimeEntrySlice
+	if err := got.FromFile(fname); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("after concurrent writes: got %v and error %v", got, err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		t.Errorf("got the files %v, want only the index", names)
+	}
+}
+
+func TestParseTimePair(t *testing.T) {
+	plus2 := time.FixedZone("+02:00", 2*3600)
+	for _, tc := range []struct {
+		a, b   string
+		loc    *time.Location
+		ta, tb time.Time
+		err    bool
+	}{
+		{"20130101000000", "20130101001500", time.UTC, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		{"20130101020000", "20130101021500", plus2, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		{"2013-01-01T00:00:00Z", "2013-01-01T00:15:00Z", time.UTC, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		//an RFC3339 value has its own zone
+		{"2013-01-01T02:00:00+02:00", "2013-01-01T00:15:00Z", time.UTC, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		{"2013-01-01T00:00:00.25Z", "2013-01-01T00:00:01Z", time.UTC, testEpoch.Add(250 * time.Millisecond), testEpoch.Add(time.Second), false},
+		{"1356998400", "1356999300", time.UTC, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		{"1356998400", "1356999300", plus2, testEpoch, testEpoch.Add(15 * time.Minute), false},
+		//the formats can't be mixed
+		{"2013-01-01T00:00:00Z", "1356999300", time.UTC, time.Time{}, time.Time{}, true},
+		{"yesterday", "today", time.UTC, time.Time{}, time.Time{}, true},
+		{"", "", time.UTC, time.Time{}, time.Time{}, true},
+	} {
+		ta, tb, err := parseTimePair(tc.a, tc.b, tc.loc)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s %s: got %s %s, want an error", tc.a, tc.b, ta, tb)
+			}
+			continue
+		}
+		if err != nil || !ta.Equal(tc.ta) || !tb.Equal(tc.tb) || ta.Location() != time.UTC {
+			t.Errorf("%s %s: got %s %s and error %v, want %s %s", tc.a, tc.b, ta, tb, err, tc.ta, tc.tb)
+		}
+	}
+}
+
+func TestIndexFileVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := TimeEntrySlice{{Path: "/a/2013.01/updates.20130101.0000", Sdate: testEpoch, Sz: 100}}
+	fname := filepath.Join(dir, "index")
+	var gobbed bytes.Buffer
+	if err := gob.NewEncoder(&gobbed).Encode(&want); err != nil {
+		t.Fatal(err)
+	}
+	header := func(ver uint32) []byte {
+		b := append([]byte(INDEX_MAGIC), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(INDEX_MAGIC):], ver)
+		return b
+	}
+	for _, tc := range []struct {
+		name  string
+		write func() error
+		ok    bool
+	}{
+		{"current", func() error { return want.ToFile(fname) }, true},
+		{"legacy gob", func() error { return want.ToGobFile(fname) }, true},
+		{"version 1 without a checksum", func() error {
+			return ioutil.WriteFile(fname, append(header(1), gobbed.Bytes()...), 0600)
+		}, true},
+		{"version 0 with a header", func() error {
+			return ioutil.WriteFile(fname, append(header(0), gobbed.Bytes()...), 0600)
+		}, false},
+		{"a newer version", func() error {
+			return ioutil.WriteFile(fname, append(header(INDEX_VERSION+1), gobbed.Bytes()...), 0600)
+		}, false},
+	} {
+		if err := tc.write(); err != nil {
+			t.Fatal(err)
+		}
+		var got TimeEntrySlice
+		err := got.FromFile(fname)
+		if tc.ok && (err != nil || !reflect.DeepEqual(got, want)) {
+			t.Errorf("%s: got %v and error %v", tc.name, got, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%s: got %v, want an error", tc.name, got)
+		}
+	}
+}
+
+//TestEntryFilesSwap is meant for -race. The files of the archive are swapped
+//and its scanning flag flipped while queries and readers run.
+func TestEntryFilesSwap(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	all := ar.getEntryFiles()
+	sets := []TimeEntrySlice{all, all[:1]}
+	readers := []struct {
+		name string
+		read func() error
+	}{
+		{"entry files", func() error {
+			if n := len(ar.getEntryFiles()); n != len(sets[0]) && n != len(sets[1]) {
+				return fmt.Errorf("got %d files", n)
+			}
+			return nil
+		}},
+		{"scanning", func() error { ar.isScanning(); return nil }},
+		{"query", func() error {
+			h, _, errs := testQuery(ar, testRange(time.Minute, 10*time.Minute))
+			if h.Code != 200 || len(errs) != 0 {
+				return fmt.Errorf("got code %d and errors %v", h.Code, errs)
+			}
+			return nil
+		}},
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(name string, read func() error) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := read(); err != nil {
+					t.Errorf("%s: %s", name, err)
+					return
+				}
+			}
+		}(r.name, r.read)
+	}
+	for k := 0; k < 200; k++ {
+		ar.setScanning(k%2 == 0)
+		ar.setEntryFiles(sets[k%2])
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStatsBuckets(t *testing.T) {
+	st := NewFsarstat(newTestArchive(t, quarterFiles).fsarchive)
+	for _, tc := range []struct {
+		a, b   time.Duration
+		bucket string
+		want   []int
+	}{
+		{0, 2 * time.Minute, "60", []int{1, 1, 1}},
+		{2 * time.Minute, 13 * time.Minute, "300", []int{5, 5, 2}},
+		{0, 30 * time.Minute, "600", []int{10, 10, 10, 1}},
+		//the last bucket is in another file than the ones before it
+		{10 * time.Minute, 15 * time.Minute, "240", []int{4, 2}},
+		{44 * time.Minute, 45 * time.Minute, "60", []int{1}},
+	} {
+		values := testRange(tc.a, tc.b)
+		values.Set("bucket", tc.bucket)
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s-%s: got code %d and errors %v", tc.a, tc.b, h.Code, errs)
+		}
+		var stats BgpStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("%s in %s", err, body)
+		}
+		if !reflect.DeepEqual(stats.TotalPerDelta, tc.want) {
+			t.Errorf("%s-%s by %ss: got %v, want %v", tc.a, tc.b, tc.bucket, stats.TotalPerDelta, tc.want)
+		}
+		sum := 0
+		for _, n := range stats.TotalPerDelta {
+			sum += n
+		}
+		if int64(sum) != stats.TotalMsgs {
+			t.Errorf("%s-%s: the buckets have %d messages of %d", tc.a, tc.b, sum, stats.TotalMsgs)
+		}
+	}
+}
+
+func TestFileByName(t *testing.T) {
+	dir, paths := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(dir)
+	//a file in the archive dir that is not an entry file
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ff := NewFsarfile(scanTestArchive(dir).fsarchive)
+	for _, tc := range []struct {
+		name string
+		code int
+		path string //of the file that is sent
+	}{
+		{quarterFiles[0].name(), 200, paths[0]},
+		{quarterFiles[2].name(), 200, paths[2]},
+		{"updates.20130101.0100", 404, ""},
+		{"secret", 404, ""},
+		{"../secret", 404, ""},
+		{"2013.01/" + quarterFiles[0].name(), 404, ""},
+		{"", 404, ""},
+	} {
+		h, body, errs := testQuery(ff, url.Values{"name": {tc.name}})
+		if h.Code != tc.code {
+			t.Errorf("%q: got code %d and errors %v, want %d", tc.name, h.Code, errs, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		want, err := ioutil.ReadFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, want) || h.ContentLength != int64(len(want)) {
+			t.Errorf("%q: got %d bytes with a Content-Length of %d, want the %d of the file", tc.name, len(body), h.ContentLength, len(want))
+		}
+	}
+}
+
+func TestScanErrorsSent(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+	}{
+		{"raw", url.Values{}},
+		{"sorted", url.Values{"sorted": {"true"}}},
+		{"descending", url.Values{"order": {"desc"}}},
+	} {
+		dir, paths := writeTestFiles(t, quarterFiles[:1])
+		writeTruncatedGzip(t, filepath.Join(filepath.Dir(paths[0]), quarterFiles[1].name()), quarterFiles[1].records())
+		ar := scanTestArchive(dir)
+		values := testRange(time.Minute, 29*time.Minute)
+		for k, v := range tc.params {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		os.RemoveAll(dir)
+		if h.Code != 200 {
+			t.Fatalf("%s: got code %d", tc.name, h.Code)
+		}
+		//the messages of the file before the error are still sent
+		if n := len(splitRecords(t, body)); n != 29 {
+			t.Errorf("%s: got %d messages, want 29", tc.name, n)
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), quarterFiles[1].name()) {
+			t.Errorf("%s: got errors %v, want the one of the truncated file", tc.name, errs)
+		}
+	}
+}
+
+//TestContCtxConcurrent is meant for -race. The helpers that read the client
+//maps are called while clients are added, updated and deleted.
+func TestContCtxConcurrent(t *testing.T) {
+	ctx := newTestArchive(t, quarterFiles[:1]).contctx
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	workers := []struct {
+		name string
+		run  func(ip string) error
+	}{
+		{"add, update and delete", func(ip string) error {
+			cli := &contCli{ip: ip}
+			if err := ctx.Add(cli); err != nil {
+				return err
+			}
+			next := &contCli{ip: ip, id: cli.id}
+			ctx.UpdateCli(next)
+			if !ctx.ExistsId(next.id) || ctx.ExistsId(cli.id) {
+				return fmt.Errorf("the id %s was not replaced by %s", cli.id, next.id)
+			}
+			return ctx.Del(next)
+		}},
+		{"lookups", func(ip string) error {
+			for _, id := range ctx.GetIDsfromIP(ip) {
+				if c := ctx.getCli(id); c != nil && c.ip != ip {
+					return fmt.Errorf("the id %s of %s is registered to %s", id, ip, c.ip)
+				}
+			}
+			ctx.ExistsIP(ip)
+			ctx.PrintClis()
+			return nil
+		}},
+	}
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		for _, ip := range ips {
+			wg.Add(1)
+			go func(name, ip string, run func(string) error) {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					if err := run(ip); err != nil {
+						t.Errorf("%s %s: %s", name, ip, err)
+						return
+					}
+				}
+			}(w.name, ip, w.run)
+		}
+	}
+	wg.Wait()
+	for _, ip := range ips {
+		if ctx.ExistsIP(ip) {
+			t.Errorf("%s still has the clients %v", ip, ctx.GetIDsfromIP(ip))
+		}
+	}
+}
+
+func TestReplyBatches(t *testing.T) {
+	dir, paths := writeTestFiles(t, quarterFiles[:1])
+	defer os.RemoveAll(dir)
+	writeTruncatedGzip(t, filepath.Join(filepath.Dir(paths[0]), quarterFiles[1].name()), quarterFiles[1].records())
+	ar := scanTestArchive(dir)
+	var want []byte
+	for _, tc := range []struct {
+		batchsz int
+		replies int //with data
+	}{
+		{0, 29},
+		{1, 29},
+		{3 * len(quarterFiles[0].records()[0]), 10},
+		//the messages of a file are not held back for the next one
+		{1 << 20, 2},
+	} {
+		qp, err := newQueryParams(url.Values{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc := make(chan api.Reply)
+		go func() {
+			defer close(rc)
+			transformAndSendBytes(ar.fsarchive, testEpoch.Add(time.Minute), testEpoch.Add(29*time.Minute), qp, rc, newQueryTransformer(qp), tc.batchsz)
+		}()
+		var (
+			body    []byte
+			replies int
+			errat   = -1
+		)
+		for r := range rc {
+			if r.Err != nil {
+				errat = replies
+				continue
+			}
+			if errat != -1 {
+				t.Errorf("batch %d: a reply after the error", tc.batchsz)
+			}
+			body = append(body, r.Data...)
+			replies++
+		}
+		if want == nil {
+			want = body
+		}
+		if !bytes.Equal(body, want) || len(splitRecords(t, body)) != 29 {
+			t.Errorf("batch %d: got %d bytes, want the %d of the 29 messages", tc.batchsz, len(body), len(want))
+		}
+		if replies != tc.replies {
+			t.Errorf("batch %d: got %d replies, want %d", tc.batchsz, replies, tc.replies)
+		}
+		//the error of the second file comes after its messages
+		if errat != replies {
+			t.Errorf("batch %d: got the error after %d of %d replies", tc.batchsz, errat, replies)
+		}
+	}
+}
+
+func TestNoEntryFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fa   *fsarchive
+	}{
+		{"not created by NewFsArchive", &fsarchive{}},
+		{"not scanned", NewMRTArchive(os.TempDir(), "updates", "testcol", 5, os.TempDir(), false).fsarchive},
+	} {
+		if files := tc.fa.getEntryFiles(); len(files) != 0 {
+			t.Errorf("%s: got %d files", tc.name, len(files))
+		}
+		if _, _, _, err := tc.fa.getFileIndexRange(testEpoch, testEpoch.Add(time.Hour)); err != errempty {
+			t.Errorf("%s: got the error %v, want %v", tc.name, err, errempty)
+		}
+		for _, res := range []api.Resource{&mrtarchive{fsarchive: tc.fa}, NewFsarstat(tc.fa)} {
+			h, _, errs := testQuery(res, testRange(0, time.Hour))
+			if h.Code != httpCode(errempty) || len(errs) != 1 {
+				t.Errorf("%s %T: got code %d and errors %v, want %d", tc.name, res, h.Code, errs, httpCode(errempty))
+			}
+		}
+	}
+}
+
+func TestContTimerCancel(t *testing.T) {
+	ctx := newTestArchive(t, quarterFiles[:1]).contctx
+	for _, tc := range []struct {
+		name    string
+		del     bool //the client is deleted before its timer fires
+		fired   bool //the client is deleted after its timer fires, while the expiry isn't taken
+		cancels int  //extra cancels of the timer
+		expires bool
+	}{
+		{"deleted", true, false, 0, false},
+		{"deleted and cancelled again", true, false, 2, false},
+		{"deleted after firing", true, true, 0, false},
+		{"not deleted", false, false, 0, true},
+	} {
+		expirech := make(chan *contCli)
+		cli := &contCli{ip: "192.0.2.1"}
+		if err := ctx.Add(cli); err != nil {
+			t.Fatal(err)
+		}
+		ctx.setTimerDuration(cli, expirech, 20*time.Millisecond)
+		if tc.fired {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if tc.del {
+			if err := ctx.Del(cli); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for k := 0; k < tc.cancels; k++ {
+			cli.cancelTimer() //must not block
+		}
+		select {
+		case got := <-expirech:
+			if !tc.expires || got != cli {
+				t.Errorf("%s: the timer of %s fired", tc.name, got.id)
+			}
+			ctx.Del(cli)
+		case <-time.After(200 * time.Millisecond):
+			if tc.expires {
+				t.Errorf("%s: the timer didn't fire", tc.name)
+			}
+		}
+		//the timer goroutine is gone either way
+		waited := make(chan struct{})
+		go func() { ctx.timerwg.Wait(); close(waited) }()
+		select {
+		case <-waited:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the timer goroutine is still running", tc.name)
+		}
+	}
+}
+
+func TestTruncatedLastRecord(t *testing.T) {
+	recs := quarterFiles[0].records()
+	for _, tail := range []int{1, 5, ppmrt.MRT_HEADER_LEN - 1} {
+		//the file ends in the middle of the header of its last record
+		last := recs[len(recs)-1]
+		ar := newTestArchive(t, []testFile{{start: 0, recs: append(recs[:len(recs)-1:len(recs)-1], last[:tail])}})
+		h, body, errs := testQuery(ar, testRange(time.Minute, 14*time.Minute))
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%d bytes: got code %d and errors %v", tail, h.Code, errs)
+		}
+		//the last full record is at 13m
+		if n := len(splitRecords(t, body)); n != 13 {
+			t.Errorf("%d bytes: got %d messages, want 13", tail, n)
+		}
+		h, body, errs = testQuery(NewFsarstat(ar.fsarchive), testRange(0, 15*time.Minute))
+		var stats BgpStats
+		if h.Code != 200 || len(errs) != 0 || json.Unmarshal(body, &stats) != nil || stats.TotalMsgs != 14 {
+			t.Errorf("%d bytes: got code %d errors %v and the stats %s, want 14 messages", tail, h.Code, errs, body)
+		}
+	}
+}
+
+func TestUntilSubSecond(t *testing.T) {
+	sec := testTs(time.Minute)
+	recs := [][]byte{bgp4mpETUpdate(sec, 200000), bgp4mpETUpdate(sec, 500000), bgp4mpETUpdate(sec, 800000)}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}})
+	until := testEpoch.Add(time.Minute + 500*time.Millisecond)
+	//the first reply of a continuous pull ends right before until, and the next pull starts at it
+	h, first, errs := func() (api.HdrReply, []byte, []error) {
+		h, retc := getTimerangeUntil(context.Background(), testRange(0, 2*time.Minute), ar, api.HdrReply{Code: 200}, until)
+		var body []byte
+		var errs []error
+		for r := range retc {
+			if r.Err != nil {
+				errs = append(errs, r.Err)
+			}
+			body = append(body, r.Data...)
+		}
+		return h, body, errs
+	}()
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	qp, err := newQueryParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qp.exact, qp.slop = true, -1
+	rc := make(chan api.Reply)
+	var wg sync.WaitGroup
+	ar.Query(until, testEpoch.Add(2*time.Minute), qp, rc, &wg)
+	go func() { wg.Wait(); close(rc) }()
+	var next []byte
+	for r := range rc {
+		next = append(next, r.Data...)
+	}
+	for _, tc := range []struct {
+		name string
+		body []byte
+		want [][]byte
+	}{
+		{"first reply", first, recs[:1]},
+		{"next pull", next, recs[1:]},
+	} {
+		if got := splitRecords(t, tc.body); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %d records, want %d", tc.name, len(got), len(tc.want))
+		}
+	}
+}
+
+func TestSinceValues(t *testing.T) {
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		values url.Values
+		err    error //nil if the since is accepted
+		start  time.Duration
+	}{
+		{url.Values{"since": {"1h"}}, nil, time.Hour},
+		{url.Values{"since": {"90s"}}, nil, 90 * time.Second},
+		{url.Values{"since": {now.Add(-2 * time.Hour).Format(time.RFC3339)}}, nil, 2 * time.Hour},
+		{url.Values{"since": {now.Add(-3 * time.Hour).Format("20060102150405")}}, nil, 3 * time.Hour},
+		{url.Values{"since": {now.Add(-time.Hour).Add(-2 * time.Hour).Format("20060102150405")}, "tz": {"-02:00"}}, nil, time.Hour},
+		{url.Values{"since": {"0s"}}, errsince, 0},
+		{url.Values{"since": {"-1h"}}, errsince, 0},
+		{url.Values{"since": {now.Add(time.Hour).Format(time.RFC3339)}}, errsince, 0},
+		{url.Values{"since": {"yesterday"}}, errsince, 0},
+		{url.Values{"since": {"1h", "2h"}}, errbadreq, 0},
+		{url.Values{"since": {"1h"}, "start": {"20130101000000"}}, errbadreq, 0},
+		{url.Values{"since": {"1h"}, "asof": {"20130101000000"}}, errbadreq, 0},
+		{url.Values{}, nil, -1}, //left alone
+	} {
+		in := url.Values{}
+		for k, v := range tc.values {
+			in[k] = v
+		}
+		err := sinceValues(tc.values)
+		if err != tc.err {
+			t.Errorf("%v: got the error %v, want %v", in, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tc.start < 0 {
+			if len(tc.values) != 0 {
+				t.Errorf("%v: got the values %v", in, tc.values)
+			}
+			continue
+		}
+		loc, _ := parseTZ(tc.values.Get("tz"))
+		ta, tb, err := parseTimePair(tc.values.Get("start"), tc.values.Get("end"), loc)
+		if err != nil || tc.values.Get("since") != "" {
+			t.Errorf("%v: got the values %v and error %v", in, tc.values, err)
+			continue
+		}
+		//the values are in whole seconds
+		if d := tb.Sub(ta) - tc.start; d < -2*time.Second || d > 2*time.Second || tb.Sub(now) > 2*time.Second || now.Sub(tb) > 2*time.Second {
+			t.Errorf("%v: got the range %s to %s, want %s to now", in, ta, tb, tc.start)
+		}
+	}
+}
+
+func TestYearMonthDir(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		layouts []string
+		ok      bool
+		yr, mon int
+	}{
+		{"/data/rrc00/2013.01", []string{DEFAULT_DIR_LAYOUT}, true, 2013, 1},
+		{"/data/route-views2/bgpdata/2013.12", []string{DEFAULT_DIR_LAYOUT}, true, 2013, 12},
+		{"/data/rrc00/2013.13", []string{DEFAULT_DIR_LAYOUT}, false, 0, 0},
+		{"/data/rrc00/2013.1", []string{DEFAULT_DIR_LAYOUT}, false, 0, 0},
+		{"/data/rrc00/updates", []string{DEFAULT_DIR_LAYOUT}, false, 0, 0},
+		{"/data/rrc00/2013/01", []string{DEFAULT_DIR_LAYOUT}, false, 0, 0},
+		{"/data/rrc00/2013/01", []string{"2006/01"}, true, 2013, 1},
+		{"/data/rrc00/2013", []string{"2006/01", "2006"}, true, 2013, 0},
+		{"/data/rrc00/2013-02", []string{DEFAULT_DIR_LAYOUT, "2006-01"}, true, 2013, 2},
+		{"2013/01", []string{"data/2006/01"}, false, 0, 0},
+	} {
+		ok, yr, mon := yearMonthDir(tc.path, tc.layouts)
+		if ok != tc.ok || yr != tc.yr || mon != tc.mon {
+			t.Errorf("%s with %v: got %v %d %d, want %v %d %d", tc.path, tc.layouts, ok, yr, mon, tc.ok, tc.yr, tc.mon)
+		}
+	}
+}
+
+func TestRevisitSkipsMonths(t *testing.T) {
+	//the last file of the archive is in 2013.01
+	ar := newTestArchive(t, quarterFiles)
+	root, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, tc := range []struct {
+		dir     string
+		layouts []string
+		skip    bool
+	}{
+		{"2012.12", []string{DEFAULT_DIR_LAYOUT}, true},
+		{"2013.01", []string{DEFAULT_DIR_LAYOUT}, false},
+		{"2013.02", []string{DEFAULT_DIR_LAYOUT}, false},
+		{"2012/12", []string{DEFAULT_DIR_LAYOUT}, false},
+		{"2012/12", []string{"2006/01", "2006"}, true},
+		{"2012", []string{"2006/01", "2006"}, true},
+		{"2013", []string{"2006/01", "2006"}, false},
+		{"2013/01", []string{"2006/01", "2006"}, false},
+	} {
+		p := filepath.Join(root, tc.dir)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ar.SetDirLayouts(tc.layouts)
+		err = ar.revisit(p, fi, nil)
+		if skip := err == filepath.SkipDir; skip != tc.skip || (err != nil && !skip) {
+			t.Errorf("%s with %v: got %v, want skip %v", tc.dir, tc.layouts, err, tc.skip)
+		}
+	}
+}
+
+func TestMaxRanges(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	defer SetMaxRanges(DEFAULT_MAX_RANGES)
+	for _, tc := range []struct {
+		max, ranges int
+		code        int
+	}{
+		{0, 1, 200},
+		{0, DEFAULT_MAX_RANGES, 200},
+		{0, DEFAULT_MAX_RANGES + 1, 400},
+		{0, 1000, 400},
+		{2, 2, 200},
+		{2, 3, 400},
+	} {
+		SetMaxRanges(tc.max)
+		cfs := &countingFS{archiveFS: ar.fs}
+		ar.fs = cfs
+		values := url.Values{}
+		for k := 0; k < tc.ranges; k++ {
+			values.Add("start", testEpoch.Add(time.Duration(k%45)*time.Minute).Format("20060102150405"))
+			values.Add("end", testEpoch.Add(time.Duration(k%45+1)*time.Minute).Format("20060102150405"))
+		}
+		h, _, _ := testQuery(ar, values)
+		ar.fs = cfs.archiveFS
+		if h.Code != tc.code {
+			t.Errorf("%d ranges with a max of %d: got code %d, want %d", tc.ranges, tc.max, h.Code, tc.code)
+		}
+		if scanned := cfs.max > 0; scanned != (tc.code == 200) {
+			t.Errorf("%d ranges with a max of %d: got files scanned %v", tc.ranges, tc.max, scanned)
+		}
+	}
+}
+
+func TestContinuousAck(t *testing.T) {
+	ctx := newTestArchive(t, quarterFiles[:1]).contctx
+	t1 := time.Now().Add(-10 * time.Minute)
+	t2 := t1.Add(5 * time.Minute)
+	for _, tc := range []struct {
+		name string
+		ack  time.Time
+		want time.Time //the start of the next pull
+	}{
+		{"no ack", time.Time{}, t2},
+		{"cut short", t1.Add(2 * time.Minute), t1.Add(2 * time.Minute)},
+		{"last record", t2.Add(-time.Microsecond), t2.Add(-time.Microsecond)},
+		{"first record", t1, t1},
+		{"before the pull", t1.Add(-time.Minute), t1},
+		{"end of the pull", t2, t2},
+		{"after the pull", t2.Add(time.Minute), t2},
+	} {
+		cli := &contCli{ip: "192.0.2.1"}
+		if err := ctx.Add(cli); err != nil {
+			t.Fatal(err)
+		}
+		cli.t1pull, cli.t2pull = t1, t2
+		next := &contCli{ip: cli.ip, id: cli.id, ack: tc.ack}
+		ctx.UpdateCli(next)
+		if !next.t1pull.Equal(tc.want) || next.t2pull.Before(next.t1pull) {
+			t.Errorf("%s: the next pull is from %s to %s, want from %s", tc.name, next.t1pull, next.t2pull, tc.want)
+		}
+		if ctx.getCli(next.id) != next || ctx.ExistsId(cli.id) {
+			t.Errorf("%s: the client is not under its new id", tc.name)
+		}
+		ctx.Del(next)
+	}
+}
+
+func TestContinuousBadAck(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles[:1])
+	ar.contctx.Serve()
+	defer ar.contctx.Stop()
+	h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}})
+	if h.Code != 200 || h.Extra == "" || len(errs) != 0 {
+		t.Fatalf("got code %d id %q and errors %v", h.Code, h.Extra, errs)
+	}
+	id := h.Extra
+	//a bad ack keeps the id, so the client can retry it
+	for _, ack := range []string{"yesterday", "2013-01-01T00:00:00", "1h"} {
+		h, _, errs := testQuery(ar, url.Values{"continuous": {id}, "ack": {ack}})
+		if h.Code != 400 || len(errs) != 1 || errs[0] != errbadack {
+			t.Errorf("%s: got code %d and errors %v", ack, h.Code, errs)
+		}
+	}
+}
+
+func TestLagValue(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles[:1])
+	for _, tc := range []struct {
+		lag  string
+		ar   archive
+		want time.Duration
+		err  error
+	}{
+		{"", ar, 0, nil},
+		{"false", ar, 0, nil},
+		{"true", ar, 15 * time.Minute, nil},
+		{"true", nil, 0, errlag},
+		{"5m", ar, 5 * time.Minute, nil},
+		{"0s", ar, 0, nil},
+		{"-5m", ar, 0, errlag},
+		{"5", ar, 0, errlag},
+		{"yes", ar, 0, errlag},
+	} {
+		d, err := lagValue(url.Values{"lag": {tc.lag}}, tc.ar)
+		if d != tc.want || err != tc.err {
+			t.Errorf("%q: got %s and the error %v, want %s and %v", tc.lag, d, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestLagRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Minute)
+	writeLiveFile(t, dir, now.Add(-30*time.Minute), minutes(now, -30, -15))
+	writeLiveFile(t, dir, now.Add(-15*time.Minute), minutes(now, -15, 0))
+	ar := scanTestArchive(dir)
+	for _, tc := range []struct {
+		lag  string
+		code int
+		recs int
+	}{
+		{"", 200, 30},
+		{"10m", 200, 21},
+		{"true", 200, 16},
+		{"40m", 416, 0},
+		{"-1m", 400, 0},
+	} {
+		values := url.Values{
+			"start": {now.Add(-30 * time.Minute).Format("20060102150405")},
+			"end":   {now.Format("20060102150405")},
+		}
+		if tc.lag != "" {
+			values.Set("lag", tc.lag)
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != tc.code {
+			t.Errorf("lag %q: got code %d and errors %v, want %d", tc.lag, h.Code, errs, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if n := len(splitRecords(t, body)); n != tc.recs || len(errs) != 0 {
+			t.Errorf("lag %q: got %d records and errors %v, want %d", tc.lag, n, errs, tc.recs)
+		}
+	}
+}
+
+func TestContinuousLag(t *testing.T) {
+	ctx := newTestArchive(t, quarterFiles[:1]).contctx
+	cli := &contCli{ip: "192.0.2.1", lag: 10 * time.Minute}
+	if err := ctx.Add(cli); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ctx.Del(cli) }()
+	for _, tc := range []struct {
+		lag time.Duration
+		end time.Duration //before now
+	}{
+		{10 * time.Minute, 10 * time.Minute},
+		{5 * time.Minute, 5 * time.Minute},
+		//a larger lag doesn't go back in time
+		{20 * time.Minute, 5 * time.Minute},
+		{0, 0},
+	} {
+		id := cli.id
+		cli = &contCli{ip: cli.ip, id: id, lag: tc.lag}
+		now := time.Now()
+		ctx.UpdateCli(cli)
+		if d := now.Sub(cli.t2pull) - tc.end; d < -time.Second || d > time.Second || cli.t2pull.Before(cli.t1pull) {
+			t.Errorf("lag %s: the pull is from %s to %s, want to %s before %s", tc.lag, cli.t1pull, cli.t2pull, tc.end, now)
+		}
+	}
+}
+
+func TestQueryOffsets(t *testing.T) {
+	//a file of 15 minutes with an update every 10 seconds and a file after it
+	tf := testFile{start: 0, n: 90, step: 10 * time.Second}
+	ar := newTestArchive(t, []testFile{tf, {start: 15 * time.Minute, n: 15, step: time.Minute}})
+	ef := ar.getEntryFiles()
+	//index every 25th message like indextool, pointing right after it
+	var (
+		offs []EntryOffset
+		pos  int64
+	)
+	for k, rec := range tf.records() {
+		pos += int64(len(rec))
+		if k%25 == 0 {
+			offs = append(offs, EntryOffset{Time: mrtTime(rec), Pos: pos})
+		}
+	}
+	//and leave zero valued slots at the tail
+	offs = append(offs, make([]EntryOffset, 3)...)
+	indexed := append(TimeEntrySlice(nil), ef...)
+	indexed[0].Offsets = offs
+	for _, r := range [][2]time.Duration{{0, 15 * time.Minute}, {7 * time.Minute, 8 * time.Minute}, {5*time.Minute + 5*time.Second, 11 * time.Minute}, {14 * time.Minute, 25 * time.Minute}} {
+		var counts [2]int
+		for k, files := range []TimeEntrySlice{ef, indexed} {
+			ar.setEntryFiles(files)
+			h, body, errs := testQuery(ar, testRange(r[0], r[1]))
+			if h.Code != 200 || len(errs) != 0 {
+				t.Fatalf("%v: got code %d and errors %v", r, h.Code, errs)
+			}
+			counts[k] = len(splitRecords(t, body))
+		}
+		if counts[0] == 0 || counts[0] != counts[1] {
+			t.Errorf("%v: got %d messages without the index and %d with it", r, counts[0], counts[1])
+		}
+	}
+}
+
+func TestJsonLines(t *testing.T) {
+	set := bgpAttr(0x40, ATTR_AS_PATH, []byte{AS_SEQUENCE, 1, 0, 0, 0x0d, 0x1c, AS_SET, 2, 0, 0, 0xfc, 0x00, 0, 0, 0xfc, 0x01})
+	recs := [][]byte{
+		bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24", "8.8.4.0/24"}, nil),
+		bgp4mpUpdate(testTs(time.Minute), 174, "192.0.2.2", nil, nil, []string{"1.1.1.0/24"}),
+		mrtRecord(testTs(2*time.Minute), MRT_BGP4MP, BGP4MP_MESSAGE_AS4, bgp4mpBody(3356, "192.0.2.1", BGP_UPDATE, bgpUpdate(nil, []string{"10.0.0.0/8"}, nil, set))),
+		bgp4mpStateChange(testTs(3*time.Minute), 3356, "192.0.2.1", 6, 1),
+	}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}})
+	values := testRange(0, 4*time.Minute)
+	values.Set("format", "json")
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	if h.ContentType != "application/x-ndjson" {
+		t.Errorf("got the Content-Type %q", h.ContentType)
+	}
+	want := []string{
+		`{"Timestamp":1356998400,"PeerAS":3356,"PeerIP":"192.0.2.1","Type":"UPDATE","Announced":["8.8.8.0/24","8.8.4.0/24"],"ASPath":[3356,15169]}`,
+		`{"Timestamp":1356998460,"PeerAS":174,"PeerIP":"192.0.2.2","Type":"UPDATE","Withdrawn":["1.1.1.0/24"]}`,
+		`{"Timestamp":1356998520,"PeerAS":3356,"PeerIP":"192.0.2.1","Type":"UPDATE","Announced":["10.0.0.0/8"],"ASPath":[3356,[64512,64513]]}`,
+		`{"Timestamp":1356998580,"PeerAS":3356,"PeerIP":"192.0.2.1","Type":"STATE_CHANGE"}`,
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), body)
+	}
+	for k, line := range lines {
+		var jl BgpJsonLine
+		if err := json.Unmarshal([]byte(line), &jl); err != nil {
+			t.Errorf("line %d: %s", k, err)
+		}
+		if line != want[k] {
+			t.Errorf("line %d: got %s, want %s", k, line, want[k])
+		}
+	}
+}
+
+func TestHeadersOnly(t *testing.T) {
+	recs := [][]byte{
+		bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24", "8.8.4.0/24"}, nil),
+		bgp4mpStateChange(testTs(time.Minute), 3356, "192.0.2.1", 6, 1),
+		ribRecord(testTs(2*time.Minute), TDV2_RIB_IPV4_UNICAST, "10.0.0.0/8", 3),
+	}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}})
+	values := testRange(0, 3*time.Minute)
+	values.Set("headersonly", "true")
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	got := splitRecords(t, body)
+	//the MRT header, the BGP4MP header of an AS4 peer and the BGP header,
+	//the whole state change and the MRT header of the RIB
+	wantlens := []int{12 + 20 + 19, len(recs[1]), 12}
+	if len(got) != len(recs) {
+		t.Fatalf("got %d messages, want %d", len(got), len(recs))
+	}
+	for k := range got {
+		if len(got[k]) != wantlens[k] || !bytes.Equal(got[k][:8], recs[k][:8]) || !bytes.Equal(got[k][12:], recs[k][12:len(got[k])]) {
+			t.Errorf("message %d: got % x, want the first %d bytes of % x", k, got[k], wantlens[k], recs[k])
+		}
+	}
+	if got[0][len(got[0])-1] != BGP_UPDATE {
+		t.Errorf("the BGP header ends with the type %d, want %d", got[0][len(got[0])-1], BGP_UPDATE)
+	}
+	//json is only of BGP4MP messages
+	values = testRange(0, time.Minute)
+	values.Set("headersonly", "true")
+	values.Set("format", "json")
+	if _, body, errs = testQuery(ar, values); len(errs) != 0 {
+		t.Fatalf("json: %v", errs)
+	}
+	want := `{"Timestamp":1356998400,"PeerAS":3356,"PeerIP":"192.0.2.1","Type":"UPDATE"}
+{"Timestamp":1356998460,"PeerAS":3356,"PeerIP":"192.0.2.1","Type":"STATE_CHANGE"}
+`
+	if string(body) != want {
+		t.Errorf("json: got\n%swant\n%s", body, want)
+	}
+	values.Set("headersonly", "yes")
+	if h, _, _ = testQuery(ar, values); h.Code != 400 {
+		t.Errorf("a malformed headersonly got code %d", h.Code)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	plain := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356}, []string{"8.8.8.0/24"}, nil)
+	et := bgp4mpETUpdate(testTs(time.Minute), 250000)
+	state := bgp4mpStateChange(testTs(2*time.Minute), 3356, "192.0.2.1", 6, 1)
+	ar := newTestArchive(t, []testFile{{start: 0, recs: [][]byte{plain, et, state}}})
+	//the body of every record without the microseconds of the extended timestamp
+	bodyOf := func(rec []byte) []byte {
+		if binary.BigEndian.Uint16(rec[4:6]) == MRT_BGP4MP_ET {
+			return rec[16:]
+		}
+		return rec[12:]
+	}
+	for _, tc := range []struct {
+		normalize string
+		typ       uint16
+		usecs     []uint32
+	}{
+		{"et", MRT_BGP4MP_ET, []uint32{0, 250000, 0}},
+		{"plain", MRT_BGP4MP, nil},
+	} {
+		values := testRange(0, 2*time.Minute)
+		values.Set("normalize", tc.normalize)
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.normalize, h.Code, errs)
+		}
+		got := splitRecords(t, body)
+		if len(got) != 3 {
+			t.Fatalf("%s: got %d messages, want 3", tc.normalize, len(got))
+		}
+		for k, rec := range got {
+			orig := [][]byte{plain, et, state}[k]
+			if typ := binary.BigEndian.Uint16(rec[4:6]); typ != tc.typ || !bytes.Equal(rec[:4], orig[:4]) || !bytes.Equal(rec[6:8], orig[6:8]) {
+				t.Errorf("%s: message %d got the header % x, want the type %d", tc.normalize, k, rec[:12], tc.typ)
+			}
+			if !bytes.Equal(bodyOf(rec), bodyOf(orig)) {
+				t.Errorf("%s: message %d got the body % x, want % x", tc.normalize, k, bodyOf(rec), bodyOf(orig))
+			}
+			if tc.usecs != nil && binary.BigEndian.Uint32(rec[12:16]) != tc.usecs[k] {
+				t.Errorf("%s: message %d got %d microseconds, want %d", tc.normalize, k, binary.BigEndian.Uint32(rec[12:16]), tc.usecs[k])
+			}
+		}
+	}
+	for _, bad := range []url.Values{{"normalize": {"v2"}}, {"normalize": {"et"}, "format": {"json"}}} {
+		values := testRange(0, 2*time.Minute)
+		for k, v := range bad {
+			values[k] = v
+		}
+		if h, _, _ := testQuery(ar, values); h.Code != 400 {
+			t.Errorf("%v got code %d", bad, h.Code)
+		}
+	}
+}
+
+func TestHttpCodes(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{errbadreq, 400},
+		{errbaddate, 400},
+		{errbigdt, 400},
+		{errdate, 404},
+		{errnoar, 404},
+		{errnofile, 404},
+		{dateError{err: errbefore}, 416},
+		{dateError{err: errafter}, 416},
+		{errrange, 416},
+		{errempty, 503},
+		{errbusy, 503},
+		{errstopped, 503},
+	} {
+		if got := httpCode(tc.err); got != tc.code {
+			t.Errorf("%s: got code %d, want %d", tc.err, got, tc.code)
+		}
+	}
+	//and the codes of the replies of the requests that fail that way
+	ar := newTestArchive(t, quarterFiles)
+	empty := &mrtarchive{fsarchive: NewMRTArchive(os.TempDir(), "updates", "testcol", 5, os.TempDir(), false).fsarchive}
+	for _, tc := range []struct {
+		name   string
+		res    api.Resource
+		values url.Values
+		code   int
+	}{
+		{"malformed", ar, url.Values{"start": {"yesterday"}, "end": {"today"}}, 400},
+		{"no end", ar, url.Values{"start": {"20130101000000"}}, 400},
+		{"start after end", ar, testRange(time.Hour, 0), 400},
+		{"too long", ar, testRange(0, 25*time.Hour), 400},
+		{"before the archive", ar, testRange(-2*time.Hour, -time.Hour), 416},
+		{"after the archive", ar, testRange(2*time.Hour, 3*time.Hour), 416},
+		{"empty archive", empty, testRange(0, time.Hour), 503},
+		{"in the archive", ar, testRange(0, time.Hour), 200},
+	} {
+		h, _, errs := testQuery(tc.res, tc.values)
+		if h.Code != tc.code {
+			t.Errorf("%s: got code %d and errors %v, want %d", tc.name, h.Code, errs, tc.code)
+		}
+		if (tc.code != 200) != (len(errs) == 1) {
+			t.Errorf("%s: got errors %v", tc.name, errs)
+		}
+	}
+}
+
+func TestDescOrder(t *testing.T) {
+	//two files with a few updates in each second
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 300, step: 300 * time.Millisecond},
+		{start: 90 * time.Second, n: 300, step: 300 * time.Millisecond},
+	})
+	values := testRange(10*time.Second, 150*time.Second)
+	_, asc, errs := testQuery(ar, values)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	values.Set("order", "desc")
+	h, desc, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	ascrecs, descrecs := splitRecords(t, asc), splitRecords(t, desc)
+	if len(descrecs) == 0 || len(descrecs) != len(ascrecs) {
+		t.Fatalf("got %d messages in desc order and %d in asc order", len(descrecs), len(ascrecs))
+	}
+	for k := 1; k < len(descrecs); k++ {
+		if mrtTime(descrecs[k]).After(mrtTime(descrecs[k-1])) {
+			t.Fatalf("message %d at %s is after the one before it at %s", k, mrtTime(descrecs[k]), mrtTime(descrecs[k-1]))
+		}
+	}
+	//the per-file window still applies
+	first, last := mrtTime(descrecs[len(descrecs)-1]), mrtTime(descrecs[0])
+	if first.Before(testEpoch.Add(9*time.Second)) || last.After(testEpoch.Add(151*time.Second)) {
+		t.Errorf("got messages from %s to %s", first, last)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 500, step: time.Second},
+		{start: 10 * time.Minute, n: 500, step: time.Second},
+	})
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		want   int
+	}{
+		{"one file", url.Values{"limit": {"10"}}, 10},
+		{"desc", url.Values{"limit": {"10"}, "order": {"desc"}}, 10},
+		{"more than the range", url.Values{"limit": {"10000"}}, 1000},
+	} {
+		values := testRange(0, 20*time.Minute)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		if n := len(splitRecords(t, body)); n != tc.want {
+			t.Errorf("%s: got %d messages, want %d", tc.name, n, tc.want)
+		}
+	}
+	for _, bad := range []string{"0", "-1", "ten"} {
+		values := testRange(0, 20*time.Minute)
+		values.Set("limit", bad)
+		if h, _, _ := testQuery(ar, values); h.Code != 400 {
+			t.Errorf("the limit %q got code %d", bad, h.Code)
+		}
+	}
+}
+
+func TestCountLikeQuery(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	//the same files as RIBs, for asof
+	ribs := newTestArchive(t, quarterFiles)
+	ribs.descriminator = "ribs"
+	for _, tc := range []struct {
+		values url.Values
+		files  int
+	}{
+		{testRange(0, 45*time.Minute), 3},
+		{testRange(7*time.Minute+30*time.Second, 33*time.Minute), 3},
+		{testRange(15*time.Minute, 30*time.Minute-time.Second), 2},
+		{url.Values{"start": {"20130101001000"}, "end": {"20130101002000"}, "peeras": {"174"}}, 2},
+		{url.Values{"start": {"20130101001000"}, "end": {"20130101004000"}, "limit": {"7"}}, 3},
+		//a single file as of a time, and no file for an empty exact range
+		{url.Values{"asof": {"20130101002000"}}, 1},
+		{url.Values{"start": {"20130101001000"}, "end": {"20130101001000"}, "exact": {"true"}}, 0},
+	} {
+		ar := ar
+		if tc.values.Get("asof") != "" {
+			ar = ribs
+		}
+		h, body, errs := testQuery(ar, tc.values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%v: got code %d and errors %v", tc.values, h.Code, errs)
+		}
+		h, cbody, errs := testQuery(NewFsarcount(ar.fsarchive), tc.values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%v: the count got code %d and errors %v", tc.values, h.Code, errs)
+		}
+		var mc MsgCount
+		if err := json.Unmarshal(cbody, &mc); err != nil {
+			t.Fatalf("%v: %s in %s", tc.values, err, cbody)
+		}
+		if n := len(splitRecords(t, body)); mc.Count != int64(n) || mc.Bytes != int64(len(body)) {
+			t.Errorf("%v: counted %d messages of %d bytes, the query sent %d of %d", tc.values, mc.Count, mc.Bytes, n, len(body))
+		}
+		if mc.Files != tc.files {
+			t.Errorf("%v: counted %d files, want %d", tc.values, mc.Files, tc.files)
+		}
+	}
+}
+
+//denseFiles are eight files of 15 minutes with an update every 300ms
+var denseFiles = func() (ret []testFile) {
+	for k := 0; k < 8; k++ {
+		ret = append(ret, testFile{start: time.Duration(k) * 15 * time.Minute, n: 3000, step: 300 * time.Millisecond})
+	}
+	return
+}()
+
+func BenchmarkScanWorkers(b *testing.B) {
+	ar := newTestArchive(b, denseFiles)
+	//a filter, so that the files are scanned instead of sent whole
+	values := testRange(0, 2*time.Hour-time.Second)
+	values.Set("peeras", "3356")
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"sequential", 1},
+		{"parallel", runtime.NumCPU()},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ar.SetScanWorkers(bc.workers)
+			for n := 0; n < b.N; n++ {
+				_, body, errs := testQuery(ar, values)
+				if len(errs) != 0 {
+					b.Fatal(errs)
+				}
+				b.SetBytes(int64(len(body)))
+			}
+		})
+	}
+}
+
+func TestJsonErrorReply(t *testing.T) {
+	st := NewFsarstat(newTestArchive(t, quarterFiles).fsarchive)
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		code   int
+	}{
+		{"malformed", url.Values{"start": {"yesterday"}, "end": {"today"}}, 400},
+		{"reversed", testRange(20*time.Minute, 10*time.Minute), 400},
+		{"before the archive", testRange(-2*time.Hour, -time.Hour), 416},
+	} {
+		h, _, errs := testQuery(st, tc.values)
+		if h.Code != tc.code || !strings.Contains(h.ContentType, "json") {
+			t.Errorf("%s: got code %d with the content type %q, want %d and JSON", tc.name, h.Code, h.ContentType, tc.code)
+		}
+		if len(errs) != 1 {
+			t.Errorf("%s: got the errors %v, want one", tc.name, errs)
+			continue
+		}
+		//the code of the JSON error object written by the api
+		sc, ok := errs[0].(api.StatusCoder)
+		if !ok || sc.StatusCode() != tc.code {
+			t.Errorf("%s: the error %v doesn't have the status code %d", tc.name, errs[0], tc.code)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	dir, paths := writeTestFiles(t, []testFile{
+		{start: 0, n: 3, step: time.Minute},
+		{start: 15 * time.Minute, n: 3, step: time.Minute},
+		{start: 30 * time.Minute, n: 3, step: time.Minute},
+		{start: 45 * time.Minute, n: 3, step: time.Minute},
+	})
+	defer os.RemoveAll(dir)
+	//the files of another naming scheme, and one that matches no pattern
+	for i, name := range map[int]string{1: "rib.20130101.0015.mrt", 2: "route-views.20130101.0030.dump"} {
+		np := filepath.Join(filepath.Dir(paths[i]), name)
+		if err := os.Rename(paths[i], np); err != nil {
+			t.Fatal(err)
+		}
+		paths[i] = np
+	}
+	for _, tc := range []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"descriminator", nil, []string{paths[0], paths[3]}},
+		{"glob", []string{"*.mrt"}, []string{paths[1]}},
+		{"both", []string{"updates", "*.mrt"}, []string{paths[0], paths[1], paths[3]}},
+		{"none", []string{"ribs", "*.gz"}, nil},
+	} {
+		ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+		ar.SetPatterns(tc.patterns)
+		ar.scan()
+		var got []string
+		for _, ef := range ar.tempentryfiles {
+			got = append(got, ef.Path)
+		}
+		//the walk order is by name
+		sort.Strings(got)
+		sort.Strings(tc.want)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got the files %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFirstDateLeadingJunk(t *testing.T) {
+	//a record of an unknown type, that can't be decoded
+	junk := mrtRecord(testTs(time.Hour), 99, 0, []byte("status: dumping"))
+	valid := bgp4mpUpdate(testTs(time.Minute), 3356, "192.0.2.1", nil, []string{"10.0.0.0/8"}, nil)
+	junks := func(n int) (recs [][]byte) {
+		for i := 0; i < n; i++ {
+			recs = append(recs, junk)
+		}
+		return
+	}
+	for _, tc := range []struct {
+		name string
+		recs [][]byte
+		ok   bool
+	}{
+		{"valid", [][]byte{valid}, true},
+		{"junk first", [][]byte{junk, valid}, true},
+		{"most junk", append(junks(FIRSTDATE_MAXSKIP), valid), true},
+		{"too much junk", append(junks(FIRSTDATE_MAXSKIP+1), valid), false},
+		{"only junk", [][]byte{junk}, false},
+	} {
+		dir, paths := writeTestFiles(t, []testFile{{start: 0, recs: tc.recs}})
+		sdate, err := getFirstDate(localFS{}, paths[0])
+		os.RemoveAll(dir)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got the error %v", tc.name, err)
+		} else if tc.ok && !sdate.Equal(testEpoch.Add(time.Minute)) {
+			t.Errorf("%s: got the date %s, want %s", tc.name, sdate, testEpoch.Add(time.Minute))
+		}
+	}
+}
+
+func TestStatsFilters(t *testing.T) {
+	//announcements of two prefixes from two origins, and withdrawals
+	type update struct {
+		origin   uint32
+		prefix   string
+		withdraw bool
+	}
+	var (
+		ups  []update
+		recs [][]byte
+	)
+	for i := 0; i < 60; i++ {
+		up := update{origin: 13335, prefix: "1.1.1.0/24"}
+		if i%3 == 0 {
+			up.origin = 15169
+		}
+		if i%2 == 0 {
+			up.prefix = "8.8.8.0/24"
+		}
+		ts := testTs(time.Duration(i) * 10 * time.Second)
+		if i%5 == 4 {
+			up.withdraw = true
+			recs = append(recs, bgp4mpUpdate(ts, 3356, "192.0.2.1", nil, nil, []string{up.prefix}))
+		} else {
+			recs = append(recs, bgp4mpUpdate(ts, 3356, "192.0.2.1", []uint32{3356, up.origin}, []string{up.prefix}, nil))
+		}
+		ups = append(ups, up)
+	}
+	st := NewFsarstat(newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 15 * time.Minute, n: 1}}).fsarchive)
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		match  func(update) bool
+	}{
+		{"no filter", nil, func(update) bool { return true }},
+		{"prefix", url.Values{"prefix": {"8.8.8.0/24"}}, func(u update) bool { return u.prefix == "8.8.8.0/24" }},
+		{"covering prefix", url.Values{"prefix": {"1.0.0.0/8"}}, func(u update) bool { return u.prefix == "1.1.1.0/24" }},
+		//withdrawals have no AS path
+		{"origin", url.Values{"aspath": {"origin:15169"}}, func(u update) bool { return !u.withdraw && u.origin == 15169 }},
+		{"origin and prefix", url.Values{"aspath": {"origin:13335"}, "prefix": {"8.8.8.0/24"}}, func(u update) bool {
+			return !u.withdraw && u.origin == 13335 && u.prefix == "8.8.8.0/24"
+		}},
+		{"nothing", url.Values{"prefix": {"9.9.9.0/24"}}, func(update) bool { return false }},
+	} {
+		var msgs, nlri, withdrawn int
+		for _, u := range ups {
+			if !tc.match(u) {
+				continue
+			}
+			msgs++
+			if u.withdraw {
+				withdrawn++
+			} else {
+				nlri++
+			}
+		}
+		values := testRange(0, 10*time.Minute)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+			continue
+		}
+		var stats BgpStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("%s: %s in %s", tc.name, err, body)
+		}
+		sum := func(a []int) (n int) {
+			for _, v := range a {
+				n += v
+			}
+			return
+		}
+		if stats.TotalMsgs != int64(msgs) || sum(stats.TotalPerDelta) != msgs || sum(stats.NLRI) != nlri || sum(stats.Withdrawn) != withdrawn {
+			t.Errorf("%s: got %d messages, %d prefixes and %d withdrawn, want %d, %d and %d", tc.name, stats.TotalMsgs, sum(stats.NLRI), sum(stats.Withdrawn), msgs, nlri, withdrawn)
+		}
+	}
+}
+
+func TestArchiveList(t *testing.T) {
+	h := new(HelpMsg)
+	h.AddArchive(NewFsarconf(newTestArchive(t, quarterFiles).fsarchive))
+	other := newTestArchive(t, []testFile{{start: 24 * time.Hour, n: 1}, {start: 24*time.Hour + 15*time.Minute, n: 1}})
+	other.collectorstr = "othercol"
+	h.AddArchive(NewFsarconf(other.fsarchive))
+	empty := NewMRTArchive(os.TempDir(), "ribs", "emptycol", 5, os.TempDir(), false)
+	h.AddArchive(NewFsarconf(empty.fsarchive))
+	hdr, body, errs := testQuery(NewArchiveList(h), url.Values{})
+	if hdr.Code != 200 || len(errs) != 0 || hdr.ContentType != "application/json" {
+		t.Fatalf("got code %d, errors %v and the content type %q", hdr.Code, errs, hdr.ContentType)
+	}
+	var infos []ArchiveInfo
+	if err := json.Unmarshal(body, &infos); err != nil {
+		t.Fatalf("%s in %s", err, body)
+	}
+	want := []ArchiveInfo{
+		{"testcol", "updates", "2013-01-01T00:00:00Z", "2013-01-01T00:30:00Z", 3},
+		{"othercol", "updates", "2013-01-02T00:00:00Z", "2013-01-02T00:15:00Z", 2},
+		{"emptycol", "ribs", "", "", 0},
+	}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("got the archives\n%+v\nwant\n%+v", infos, want)
+	}
+}
+
+func TestArchiveNotFound(t *testing.T) {
+	h := new(HelpMsg)
+	h.AddArchive(NewFsarconf(newTestArchive(t, quarterFiles).fsarchive))
+	ribs := NewMRTArchive(os.TempDir(), "table", "othercol", 5, os.TempDir(), false)
+	h.AddArchive(NewFsarconf(ribs.fsarchive))
+	hdr, body, errs := testQuery(NewArchiveNotFound(h), url.Values{})
+	if hdr.Code != 404 || len(errs) != 1 || errs[0] != errnoar {
+		t.Fatalf("got code %d and errors %v, want 404 and %v", hdr.Code, errs, errnoar)
+	}
+	for _, want := range []string{"updates  archive: testcol\n", "ribs     archive: othercol\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("the collector %q is not listed in:\n%s", want, body)
+		}
+	}
+}
+
+func TestGetContextCancel(t *testing.T) {
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 900, step: time.Second},
+		{start: 15 * time.Minute, n: 900, step: time.Second},
+		{start: 30 * time.Minute, n: 900, step: time.Second},
+	})
+	before := runtime.NumGoroutine()
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+	}{
+		{"raw", url.Values{}},
+		{"filtering", url.Values{"peeras": {"3356"}}},
+		{"sorted", url.Values{"sorted": {"true"}}},
+		{"stats", url.Values{"bucket": {"60"}}},
+	} {
+		values := testRange(0, 45*time.Minute-time.Second)
+		values.Set("remoteaddr", "127.0.0.1")
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		var res api.ContextGetter = ar
+		if tc.name == "stats" {
+			res = NewFsarstat(ar.fsarchive)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		h, retc := res.GetContext(ctx, values)
+		if h.Code != 200 {
+			t.Fatalf("%s: got code %d", tc.name, h.Code)
+		}
+		//the client reads a reply and goes away without reading the rest
+		<-retc
+		cancel()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			t.Errorf("%s: %d goroutines are left after the cancel", tc.name, n-before)
+		}
+	}
+}
+
+func TestZstdFiles(t *testing.T) {
+	dir, paths := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(dir)
+	zdir, zpaths := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(zdir)
+	for _, p := range zpaths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(data)
+		zw.Close()
+		if err := ioutil.WriteFile(p+".zst", buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(p)
+	}
+	plain, compressed := scanTestArchive(dir), scanTestArchive(zdir)
+	if len(compressed.tempentryfiles) != len(paths) {
+		t.Fatalf("got %d zstd files in the archive, want %d", len(compressed.tempentryfiles), len(paths))
+	}
+	for _, r := range [][2]time.Duration{{0, 45 * time.Minute}, {10 * time.Minute, 20 * time.Minute}, {40 * time.Minute, 45 * time.Minute}} {
+		values := testRange(r[0], r[1])
+		h, want, errs := testQuery(plain, values)
+		if h.Code != 200 || len(errs) != 0 || len(want) == 0 {
+			t.Fatalf("%s-%s: got code %d and errors %v from the uncompressed files", r[0], r[1], h.Code, errs)
+		}
+		h, got, errs := testQuery(compressed, testRange(r[0], r[1]))
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s-%s: got code %d and errors %v from the zstd files", r[0], r[1], h.Code, errs)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s-%s: got %d bytes from the zstd files, want %d", r[0], r[1], len(got), len(want))
+		}
+	}
+}
+
+func TestLargeRecord(t *testing.T) {
+	//about 84KB of RIB entries, more than the 64KB tokens of a bufio.Scanner
+	large := ribRecord(testTs(time.Minute), TDV2_RIB_IPV4_UNICAST, "10.0.0.0/8", 7000)
+	if len(large) <= bufio.MaxScanTokenSize {
+		t.Fatalf("the record is only %d bytes", len(large))
+	}
+	recs := (testFile{start: 0, n: 5, step: time.Minute}).records()
+	recs = append(recs[:2], append([][]byte{large}, recs[2:]...)...)
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 15 * time.Minute, n: 1}})
+	h, body, errs := testQuery(ar, testRange(0, 10*time.Minute))
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	got := splitRecords(t, body)
+	if len(got) != len(recs) || !bytes.Equal(got[2], large) {
+		t.Errorf("got %d records, want the %d of the file with the large one", len(got), len(recs))
+	}
+}
+
+func TestCompressionExt(t *testing.T) {
+	for _, tc := range []struct {
+		name, ext string
+		temp      bool
+	}{
+		{"updates.20130101.0000.bz2", ".bz2", false},
+		{"updates.20130101.0000.bz2.tmp", ".bz2", true},
+		{"updates.20130101.0000.gz.part", ".gz", true},
+		{"updates.20130101.0000.mrt.gz.bz2", ".bz2", false},
+		{"updates.20130101.0000.zst.part.tmp", ".zst", true},
+		{"updates.mrt", ".mrt", false},
+		{"updates.tmp", "", true},
+	} {
+		if ext := compressionExt(tc.name); ext != tc.ext {
+			t.Errorf("%s: got the extension %q, want %q", tc.name, ext, tc.ext)
+		}
+		if temp := isTempFile(tc.name); temp != tc.temp {
+			t.Errorf("%s: got temporary %v, want %v", tc.name, temp, tc.temp)
+		}
+	}
+}
+
+func TestOddExtensions(t *testing.T) {
+	recs := quarterFiles[0].records()
+	var raw []byte
+	for _, rec := range recs {
+		raw = append(raw, rec...)
+	}
+	gz := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		comp int
+	}{
+		//the extension is trusted, and GetScanner falls back to reading it normally
+		{"plain.gz", raw, COMP_GZIP},
+		{"gzip.bz2", gz(raw), COMP_GZIP},
+		{"gzip.mrt.gz.bz2", gz(raw), COMP_GZIP},
+		{"twice.gz.gz", gz(gz(raw)), COMP_GZIP},
+		{"gzip.bz2.tmp", gz(raw), COMP_GZIP},
+		{"gzip", gz(raw), COMP_GZIP},
+	} {
+		p := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(p, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := localFS{}.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if comp := GetCompression(f); comp != tc.comp {
+			t.Errorf("%s: got the compression %d, want %d", tc.name, comp, tc.comp)
+		}
+		var got []byte
+		scanner := GetScanner(f)
+		for scanner.Scan() {
+			got = append(got, scanner.Bytes()...)
+		}
+		f.Close()
+		if scanner.Err() != nil || !bytes.Equal(got, raw) {
+			t.Errorf("%s: got %d bytes and the error %v, want the %d of the records", tc.name, len(got), scanner.Err(), len(raw))
+		}
+	}
+	//the files that are still being written are not indexed
+	mdir := filepath.Join(dir, "2013.01")
+	os.MkdirAll(mdir, 0755)
+	for _, name := range []string{"updates.20130101.0000.bz2.tmp", "updates.20130101.0015.part", "updates.20130101.0030.gz"} {
+		if err := ioutil.WriteFile(filepath.Join(mdir, name), gz(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ar := scanTestArchive(mdir)
+	if len(ar.tempentryfiles) != 1 || filepath.Base(ar.tempentryfiles[0].Path) != "updates.20130101.0030.gz" {
+		t.Errorf("got the files %v, want only the one that is not temporary", ar.tempentryfiles)
+	}
+}
+
+func TestContinuousNoData(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ar.contctx.Serve()
+	defer ar.contctx.Stop()
+	h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}})
+	if h.Code != 200 || len(errs) != 0 || h.Extra == "" {
+		t.Fatalf("beginning got code %d, errors %v and the id %q", h.Code, errs, h.Extra)
+	}
+	//the archive has nothing after the begin, however many times the client pulls
+	for id, k := h.Extra, 0; k < 3; k++ {
+		h, body, errs := testQuery(ar, url.Values{"continuous": {id}})
+		if h.Code != 204 || len(body) != 0 || len(errs) != 0 {
+			t.Fatalf("pull %d: got code %d, %d bytes and errors %v, want an empty 204", k, h.Code, len(body), errs)
+		}
+		if h.Extra == "" || h.Extra == id || !ar.contctx.ExistsId(h.Extra) {
+			t.Fatalf("pull %d: got the next id %q after %q", k, h.Extra, id)
+		}
+		id = h.Extra
+	}
+}
+
+func TestStatsMinutesLikeSeconds(t *testing.T) {
+	//bursts of announcements and withdrawals at uneven seconds
+	var recs [][]byte
+	for s := 0; s < 600; s += 1 + s%7 {
+		for k := 0; k <= s%4; k++ {
+			if k%2 == 0 {
+				recs = append(recs, bgp4mpUpdate(testTs(time.Duration(s)*time.Second), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24", "8.8.4.0/24"}, nil))
+			} else {
+				recs = append(recs, bgp4mpUpdate(testTs(time.Duration(s)*time.Second), 3356, "192.0.2.1", nil, nil, []string{"1.1.1.0/24"}))
+			}
+		}
+	}
+	st := NewFsarstat(newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 15 * time.Minute, n: 1}}).fsarchive)
+	var stats [2]BgpStats
+	for k, bucket := range []string{"1", "60"} {
+		values := testRange(0, 10*time.Minute-time.Second)
+		values.Set("bucket", bucket)
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("bucket=%s: got code %d and errors %v", bucket, h.Code, errs)
+		}
+		if err := json.Unmarshal(body, &stats[k]); err != nil {
+			t.Fatalf("bucket=%s: %s in %s", bucket, err, body)
+		}
+	}
+	secs, mins := stats[0], stats[1]
+	if secs.Delta_sec != 1 || mins.Delta_sec != 60 || len(mins.TotalPerDelta) != 10 {
+		t.Fatalf("got %d buckets of %ds", len(mins.TotalPerDelta), mins.Delta_sec)
+	}
+	if secs.TotalMsgs != int64(len(recs)) || mins.TotalMsgs != secs.TotalMsgs {
+		t.Errorf("got %d messages by second and %d by minute, want %d", secs.TotalMsgs, mins.TotalMsgs, len(recs))
+	}
+	for _, row := range []struct {
+		name       string
+		secs, mins []int
+	}{
+		{"TotalPerDelta", secs.TotalPerDelta, mins.TotalPerDelta},
+		{"NLRI", secs.NLRI, mins.NLRI},
+		{"Withdrawn", secs.Withdrawn, mins.Withdrawn},
+	} {
+		for m := range row.mins {
+			sum := 0
+			for s := m * 60; s < (m+1)*60 && s < len(row.secs); s++ {
+				sum += row.secs[s]
+			}
+			if sum != row.mins[m] {
+				t.Errorf("%s: minute %d has %d, and its seconds %d", row.name, m, row.mins[m], sum)
+			}
+		}
+	}
+}
+
+func TestConfIndexStats(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	ef[0].Offsets = []EntryOffset{{Time: testEpoch.Add(5 * time.Minute), Pos: 100}, {Time: testEpoch.Add(10 * time.Minute), Pos: 200}}
+	//indextool leaves the slots it couldn't fill zero
+	ef[2].Offsets = []EntryOffset{{Time: testEpoch.Add(35 * time.Minute), Pos: 300}, {}}
+	ar.setEntryFiles(ef)
+	h, body, errs := testQuery(NewFsarconf(ar.fsarchive), url.Values{"stats": {""}})
+	if h.Code != 200 || len(errs) != 0 || h.ContentType != "application/json" {
+		t.Fatalf("got code %d, errors %v and the content type %q", h.Code, errs, h.ContentType)
+	}
+	var stats []FileIndexStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("%s in %s", err, body)
+	}
+	want := []FileIndexStats{
+		{filepath.Base(ef[0].Path), ef[0].Sz, true, 2},
+		{filepath.Base(ef[1].Path), ef[1].Sz, false, 0},
+		{filepath.Base(ef[2].Path), ef[2].Sz, true, 1},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got the stats\n%+v\nwant\n%+v", stats, want)
+	}
+}
+
+func TestConfSummary(t *testing.T) {
+	ar := NewMRTArchive(os.TempDir(), "updates", "testcol", 5, os.TempDir(), false)
+	conf := NewFsarconf(ar.fsarchive)
+	for _, tc := range []struct {
+		name string
+		ef   TimeEntrySlice
+		want string
+	}{
+		{"empty", nil, `{"fileCount":0,"totalBytes":0,"avgFileSize":0}`},
+		{"files", TimeEntrySlice{
+			{Path: "a", Sdate: testEpoch, Sz: 1000},
+			{Path: "b", Sdate: testEpoch.Add(15 * time.Minute), Sz: 3000},
+			{Path: "c", Sdate: testEpoch.Add(30 * time.Minute), Sz: 2001},
+		}, `{"fileCount":3,"totalBytes":6001,"firstDate":"2013-01-01T00:00:00Z","lastDate":"2013-01-01T00:30:00Z","avgFileSize":2000}`},
+	} {
+		ar.setEntryFiles(tc.ef)
+		h, body, errs := testQuery(conf, url.Values{"summary": {""}})
+		if h.Code != 200 || len(errs) != 0 || h.ContentType != "application/json" {
+			t.Fatalf("%s: got code %d, errors %v and the content type %q", tc.name, h.Code, errs, h.ContentType)
+		}
+		if got := strings.TrimSpace(string(body)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfETag(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	conf := NewFsarconf(ar.fsarchive)
+	first, _, _ := testQuery(conf, url.Values{})
+	if first.ETag == "" || first.LastModified.IsZero() {
+		t.Fatalf("got the ETag %q last modified at %s", first.ETag, first.LastModified)
+	}
+	//setting the same files again keeps the tag and the time
+	ar.setEntryFiles(ar.getEntryFiles())
+	if h, _, _ := testQuery(conf, url.Values{}); h.ETag != first.ETag || !h.LastModified.Equal(first.LastModified) {
+		t.Errorf("the unchanged files got the ETag %q at %s, want %q at %s", h.ETag, h.LastModified, first.ETag, first.LastModified)
+	}
+	ef := ar.getEntryFiles()
+	ar.setEntryFiles(ef[:2])
+	if h, _, _ := testQuery(conf, url.Values{}); h.ETag == first.ETag {
+		t.Errorf("the changed files kept the ETag %q", h.ETag)
+	}
+	//the help shows the ranges of the archives too
+	help := new(HelpMsg)
+	help.AddArchive(conf)
+	h1, _, _ := testQuery(help, url.Values{})
+	ar.setEntryFiles(ef)
+	if h2, _, _ := testQuery(help, url.Values{}); h1.ETag == "" || h2.ETag == h1.ETag {
+		t.Errorf("the help got the ETags %q and %q after the files changed", h1.ETag, h2.ETag)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	values := testRange(10*time.Minute, 20*time.Minute)
+	values.Set("validate", "true")
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 || h.ContentType != "application/json" {
+		t.Fatalf("got code %d, errors %v and the content type %q", h.Code, errs, h.ContentType)
+	}
+	var qv QueryValidation
+	if err := json.Unmarshal(body, &qv); err != nil {
+		t.Fatalf("%s in %s", err, body)
+	}
+	want := QueryValidation{true, 2, "2013-01-01T00:00:00Z", "2013-01-01T00:15:00Z", ef[0].Sz + ef[1].Sz}
+	if qv != want {
+		t.Errorf("got %+v, want %+v", qv, want)
+	}
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+	}{
+		{"malformed", url.Values{"start": {"yesterday"}, "end": {"20130101002000"}}},
+		{"reversed", testRange(20*time.Minute, 10*time.Minute)},
+		{"too long", testRange(0, 25*time.Hour)},
+		{"no end", url.Values{"start": {"20130101001000"}}},
+		{"before the archive", testRange(-2*time.Hour, -time.Hour)},
+		{"after the archive", testRange(2*time.Hour, 3*time.Hour)},
+		{"bad prefix", url.Values{"start": {"20130101001000"}, "end": {"20130101002000"}, "prefix": {"10.0.0.0/33"}}},
+		{"bad tz", url.Values{"start": {"20130101001000"}, "end": {"20130101002000"}, "tz": {"Mars/Olympus"}}},
+	} {
+		//the code of the query that would be run
+		h, _, _ := testQuery(ar, tc.values)
+		want := h.Code
+		tc.values.Set("validate", "true")
+		h, body, errs := testQuery(ar, tc.values)
+		if want == 200 || h.Code != want || len(errs) != 1 || len(body) != 0 {
+			t.Errorf("%s: got code %d, errors %v and %q, want the code %d of the query", tc.name, h.Code, errs, body, want)
+		}
+	}
+}
+
+func BenchmarkReplyBatch(b *testing.B) {
+	ar := newTestArchive(b, denseFiles)
+	defer SetReplyBatch(DEFAULT_REPLY_BATCH)
+	//a filter, so that the messages are sent one by one instead of the whole files
+	values := testRange(0, 2*time.Hour-time.Second)
+	values.Set("peeras", "3356")
+	for _, bc := range []struct {
+		name    string
+		batchsz int
+	}{
+		{"unbatched", 0},
+		{"4KB", 4 * 1024},
+		{"64KB", 64 * 1024},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			SetReplyBatch(bc.batchsz)
+			for n := 0; n < b.N; n++ {
+				_, body, errs := testQuery(ar, values)
+				if len(errs) != 0 {
+					b.Fatal(errs)
+				}
+				b.SetBytes(int64(len(body)))
+			}
+		})
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	st := NewFsarstat(ar.fsarchive)
+	//testEpoch is 17:00 of the day before in Denver
+	denver, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[api.Resource][]byte)
+	for _, res := range []api.Resource{ar, st} {
+		h, body, errs := testQuery(res, testRange(10*time.Minute, 20*time.Minute))
+		if h.Code != 200 || len(errs) != 0 || len(body) == 0 {
+			t.Fatalf("utc: got code %d, errors %v and %d bytes", h.Code, errs, len(body))
+		}
+		want[res] = body
+	}
+	for _, tc := range []struct {
+		tz  string
+		loc *time.Location
+	}{
+		{"America/Denver", denver},
+		{"-07:00", time.FixedZone("", -7*3600)},
+		{"-0700", time.FixedZone("", -7*3600)},
+		{"+5", time.FixedZone("", 5*3600)},
+		{"+05:30", time.FixedZone("", 5*3600+30*60)},
+	} {
+		values := url.Values{
+			"start": {testEpoch.Add(10 * time.Minute).In(tc.loc).Format("20060102150405")},
+			"end":   {testEpoch.Add(20 * time.Minute).In(tc.loc).Format("20060102150405")},
+			"tz":    {tc.tz},
+		}
+		for _, res := range []api.Resource{ar, st} {
+			h, body, errs := testQuery(res, values)
+			if h.Code != 200 || len(errs) != 0 || !bytes.Equal(body, want[res]) {
+				t.Errorf("%s: got code %d, errors %v and %d bytes, want the %d of the UTC range", tc.tz, h.Code, errs, len(body), len(want[res]))
+			}
+		}
+	}
+	for _, bad := range []string{"Mars/Olympus", "+15", "-07:60", "+x"} {
+		if _, err := parseTZ(bad); err == nil {
+			t.Errorf("the tz %s is accepted", bad)
+		}
+	}
+}
+
+func TestAtInstants(t *testing.T) {
+	//a message every 10 seconds
+	files := []testFile{
+		{start: 0, n: 90, step: 10 * time.Second},
+		{start: 15 * time.Minute, n: 90, step: 10 * time.Second},
+		{start: 30 * time.Minute, n: 90, step: 10 * time.Second},
+	}
+	ar := newTestArchive(t, files)
+	at := func(d time.Duration) string {
+		return testEpoch.Add(d).Format("20060102150405")
+	}
+	for _, tc := range []struct {
+		name string
+		ats  []time.Duration
+		msgs int
+	}{
+		//the messages from 30 seconds before to 30 seconds after each one
+		{"three instants", []time.Duration{40 * time.Minute, 5 * time.Minute, 20 * time.Minute}, 3 * 7},
+		//windows that overlap are sent once
+		{"overlapping", []time.Duration{10 * time.Minute, 10*time.Minute + 20*time.Second}, 9},
+	} {
+		values := url.Values{}
+		for _, d := range tc.ats {
+			values.Add("at", at(d))
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		recs := splitRecords(t, body)
+		if len(recs) != tc.msgs {
+			t.Errorf("%s: got %d messages, want %d", tc.name, len(recs), tc.msgs)
+		}
+		var last uint32
+		for _, rec := range recs {
+			ts := binary.BigEndian.Uint32(rec)
+			near := false
+			for _, d := range tc.ats {
+				if diff := int64(ts) - int64(testTs(d)); diff >= -30 && diff <= 30 {
+					near = true
+				}
+			}
+			if !near || ts <= last {
+				t.Errorf("%s: got a message at %d after %d", tc.name, ts, last)
+			}
+			last = ts
+		}
+	}
+	toomany := url.Values{}
+	for k := 0; k <= MAX_AT; k++ {
+		toomany.Add("at", at(time.Duration(k)*time.Minute))
+	}
+	for _, bad := range []url.Values{
+		toomany,
+		{"at": {at(5 * time.Minute)}, "start": {at(0)}, "end": {at(time.Minute)}},
+		{"at": {"yesterday"}},
+	} {
+		if h, _, _ := testQuery(ar, bad); h.Code != 400 {
+			t.Errorf("%d at values and the start %v got code %d", len(bad["at"]), bad["start"], h.Code)
+		}
+	}
+}
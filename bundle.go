@@ -0,0 +1,126 @@
+package bgparchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errbundle   = errors.New("bundle only serves whole files. it can't be used with filters, limit, order, sorted, dedup, headersonly, normalize or format=json")
+	errnobundle = errors.New("bundles are only served by the raw MRT archives")
+	errgone     = errors.New("the client went away")
+)
+
+//replyWriter sends what is written to it as replies, for the bundles
+type replyWriter struct {
+	rc   chan<- api.Reply
+	done <-chan struct{}
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	//the consumer keeps the bytes of the reply
+	cp := make([]byte, len(p))
+	copy(cp, p)
+	select {
+	case w.rc <- api.Reply{Data: cp, Err: nil}:
+		return len(p), nil
+	case <-w.done:
+		return 0, errgone
+	}
+}
+
+//bundleName is the file name a bundle of the ranges is downloaded as
+func (ar *fsarchive) bundleName(ranges [][2]time.Time, gz bool) string {
+	name := fmt.Sprintf("%s-%s-%s.tar", ar.collectorstr, strings.Replace(ar.descriminator, "/", "_", -1), timeToString(ranges[0][0]))
+	if gz {
+		name += ".gz"
+	}
+	return name
+}
+
+//sendBundle sends the files of the ranges as they are in a tar archive, gzip
+//compressed if gz is set. Every file is sent once even if it is in more than
+//one range. The sizes in the tar headers are the indexed ones, so a file that
+//is still growing is cut where the index ends. If a file can't be read the
+//tar is cut short and an error is sent, so the client sees it is truncated.
+func (ar *fsarchive) sendBundle(ranges [][2]time.Time, gz bool, qp *queryParams, rc chan api.Reply, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bw := bufio.NewWriterSize(&replyWriter{rc: rc, done: qp.doneChan()}, FILE_CHUNKSZ)
+		var (
+			w   io.Writer = bw
+			gzw *gzip.Writer
+		)
+		if gz {
+			gzw = gzip.NewWriter(bw)
+			w = gzw
+		}
+		tw := tar.NewWriter(w)
+		seen := make(map[string]bool)
+		for _, r := range ranges {
+			ef, i, j, err := ar.getFileIndexRange(r[0], r[1])
+			if err != nil {
+				warnf("bundle range from %s to %s:%s", r[0], r[1], err)
+				continue
+			}
+			//the file before the range, that getFileIndexRange returns for the
+			//messages at its start, has none of them if the next one starts by then
+			if i+1 < j && !ef[i+1].Sdate.After(r[0]) {
+				i++
+			}
+			for k := i; k < j; k++ {
+				if seen[ef[k].Path] {
+					continue
+				}
+				seen[ef[k].Path] = true
+				if err := ar.addToBundle(tw, ef[k]); err != nil {
+					warnf("bundle of archive:%s error:%s", ar.descriminator, err)
+					if err != errgone && bw.Flush() == nil {
+						rc <- api.Reply{Data: nil, Err: err}
+					}
+					return
+				}
+			}
+		}
+		tw.Close()
+		if gzw != nil {
+			gzw.Close()
+		}
+		bw.Flush()
+	}()
+}
+
+func (ar *fsarchive) addToBundle(tw *tar.Writer, ef ArchEntryFile) error {
+	file, err := ar.fs.Open(ef.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	modtime := ef.Sdate
+	if fi, err := file.Stat(); err == nil {
+		modtime = fi.ModTime()
+	}
+	hdr := &tar.Header{
+		Name:    filepath.Base(ef.Path),
+		Mode:    0644,
+		Size:    ef.Sz,
+		ModTime: modtime,
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(tw, file, ef.Sz); err != nil {
+		return fmt.Errorf("failed reading file:%s error:%s", ef.Path, err)
+	}
+	return nil
+}
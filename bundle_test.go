@@ -0,0 +1,118 @@
+package bgparchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//untar returns the contents of the files of a tar archive by name, in the order they are in it
+func untar(t *testing.T, r io.Reader) ([]string, map[string][]byte) {
+	var names []string
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		files[hdr.Name] = data
+	}
+}
+
+func TestBundle(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		files  []int //of the archive
+	}{
+		{"tar", url.Values{"bundle": {"tar"}}, []int{1}},
+		{"tar.gz", url.Values{"bundle": {"tar.gz"}}, []int{1}},
+		//the files with messages in the range, even if they are partly in it
+		{"partial files", url.Values{"bundle": {"tar"}, "start": {"20130101001000"}, "end": {"20130101003500"}}, []int{0, 1, 2}},
+		//a file is sent once even if two ranges have it
+		{"ranges", url.Values{"bundle": {"tar"}, "start": {"20130101000100", "20130101000500"}, "end": {"20130101000200", "20130101000600"}}, []int{0}},
+	} {
+		values := testRange(20*time.Minute, 30*time.Minute-time.Second)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		want := ar.bundleName([][2]time.Time{{testEpoch.Add(20 * time.Minute)}}, tc.name == "tar.gz")
+		if _, ok := tc.values["start"]; ok {
+			want = ""
+		}
+		if want != "" && h.Filename != want {
+			t.Errorf("%s: got the file name %q, want %q", tc.name, h.Filename, want)
+		}
+		var r io.Reader = bytes.NewReader(body)
+		if tc.name == "tar.gz" {
+			gzr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			if h.ContentType != "application/gzip" {
+				t.Errorf("%s: got the content type %q", tc.name, h.ContentType)
+			}
+			r = gzr
+		} else if h.ContentType != "application/x-tar" {
+			t.Errorf("%s: got the content type %q", tc.name, h.ContentType)
+		}
+		names, files := untar(t, r)
+		if len(names) != len(tc.files) {
+			t.Fatalf("%s: got the files %v, want %d", tc.name, names, len(tc.files))
+		}
+		for k, n := range tc.files {
+			data, err := ioutil.ReadFile(ef[n].Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := filepath.Base(ef[n].Path); names[k] != name || !bytes.Equal(files[name], data) {
+				t.Errorf("%s: got the file %s of %d bytes, want %s of %d", tc.name, names[k], len(files[names[k]]), name, len(data))
+			}
+		}
+	}
+	for _, bad := range []url.Values{{"bundle": {"zip"}}, {"bundle": {"tar"}, "peeras": {"3356"}}, {"bundle": {"tar"}, "format": {"json"}}} {
+		values := testRange(15*time.Minute, 30*time.Minute-time.Second)
+		for k, v := range bad {
+			values[k] = v
+		}
+		if h, _, _ := testQuery(ar, values); h.Code != 400 {
+			t.Errorf("%v got code %d", bad, h.Code)
+		}
+	}
+}
+
+func TestBundleFileBefore(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	//a range from the start of a file doesn't have the one before it
+	values := testRange(15*time.Minute, 30*time.Minute-time.Second)
+	values.Set("bundle", "tar")
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	names, _ := untar(t, bytes.NewReader(body))
+	if want := filepath.Base(ar.getEntryFiles()[1].Path); len(names) != 1 || names[0] != want {
+		t.Errorf("got the files %v, want %s", names, want)
+	}
+}
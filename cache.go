@@ -0,0 +1,274 @@
+package bgparchive
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//resultCache keeps the replies of recent queries in files of a directory, so
+//that popular ranges are sent as they are instead of scanning the archive
+//files again. When the files take more than maxbytes the least recently used
+//ones are removed. The entries of an archive whose range has new files are
+//removed when the archive files are set.
+type resultCache struct {
+	dir      string
+	maxbytes int64
+	mu       sync.Mutex //protects everything below
+	size     int64
+	lru      *list.List //of *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key         string
+	ar          *fsarchive
+	ranges      [][2]time.Time //the ranges the archive files were looked up with
+	path        string
+	size        int64
+	first, last time.Time //the span of the messages, for the trailers
+	spanok      bool
+}
+
+//cacheQuery is a query that can be answered from the cache, or added to it
+type cacheQuery struct {
+	key    string
+	ar     *fsarchive
+	ranges [][2]time.Time
+	tag    string //the entries tag when the query started
+}
+
+//resultcache is nil unless SetResultCache enabled it
+var resultcache *resultCache
+
+//the values of a request that don't change the messages of the reply
+var cacheIgnoredValues = map[string]bool{
+	"remoteaddr":    true,
+	"authorization": true,
+	"rangeheader":   true,
+	"compress":      true,
+}
+
+//SetResultCache keeps the replies of up to maxbytes of recent queries in dir.
+//The files left in it by a previous run are removed. An empty dir disables
+//the cache. It should be called before the archives are served.
+func SetResultCache(dir string, maxbytes int64) error {
+	if dir == "" || maxbytes <= 0 {
+		resultcache = nil
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, pat := range []string{"*.cache", "*.tmp"} {
+		old, _ := filepath.Glob(filepath.Join(dir, pat))
+		for _, f := range old {
+			os.Remove(f)
+		}
+	}
+	resultcache = &resultCache{
+		dir:      dir,
+		maxbytes: maxbytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	return nil
+}
+
+//query returns the cache query of a request for the ranges, or nil if the
+//reply can't be cached. Only the raw MRT, protobuf and JSON queries are cached,
+//and not the ones that reach the newest archive file since it can still grow.
+//Bundles and manifests have their own content types, so they aren't cached either.
+func (rc *resultCache) query(ar archive, values url.Values, ranges [][2]time.Time, qp *queryParams) *cacheQuery {
+	if rc == nil || qp == nil || qp.bundle != "" || qp.manifest || values.Get("rangeheader") != "" {
+		return nil
+	}
+	var fa *fsarchive
+	switch a := ar.(type) {
+	case *fsarchive:
+		fa = a
+	case *pbarchive:
+		fa = a.fsarchive
+	case *jsonarchive:
+		fa = a.fsarchive
+	default:
+		return nil
+	}
+	ef := fa.getEntryFiles()
+	if len(ef) == 0 {
+		return nil
+	}
+	cq := &cacheQuery{ar: fa}
+	for _, r := range ranges {
+		ta, tb := qp.fileRange(r[0], r[1])
+		if !tb.Before(ef[len(ef)-1].Sdate) {
+			return nil
+		}
+		cq.ranges = append(cq.ranges, [2]time.Time{ta, tb})
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if !cacheIgnoredValues[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	fmt.Fprintf(h, "%T\n%s\n%s\n", ar, fa.collectorstr, fa.descriminator)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%q\n", k, values[k]) //the order of repeated values matters
+	}
+	cq.key = hex.EncodeToString(h.Sum(nil))
+	cq.tag, _ = fa.getEntriesTag()
+	return cq
+}
+
+//send sends the cached reply of the query and returns true, or returns false
+//if it is not in the cache.
+func (rc *resultCache) send(cq *cacheQuery, h *api.HdrReply, qp *queryParams, retc chan api.Reply, wg *sync.WaitGroup) bool {
+	rc.mu.Lock()
+	el, ok := rc.entries[cq.key]
+	if !ok {
+		rc.mu.Unlock()
+		return false
+	}
+	rc.lru.MoveToFront(el)
+	ent := *el.Value.(*cacheEntry)
+	//opened while locked so that it can't be evicted in between
+	file, err := os.Open(ent.path)
+	rc.mu.Unlock()
+	if err != nil {
+		warnf("failed opening cached reply:%s error:%s", ent.path, err)
+		return false
+	}
+	h.TrailerValues = func() map[string]string {
+		if !ent.spanok {
+			return nil
+		}
+		return map[string]string{
+			DATA_FIRST_TRAILER: ent.first.Format(time.RFC3339),
+			DATA_LAST_TRAILER:  ent.last.Format(time.RFC3339),
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer file.Close()
+		sendReader(file, ent.path, qp, retc)
+	}()
+	return true
+}
+
+//tee returns a channel with the replies of in, that are also written to a file
+//that is added to the cache if the query finishes without errors.
+func (rc *resultCache) tee(cq *cacheQuery, qp *queryParams, in chan api.Reply) chan api.Reply {
+	tmp, err := ioutil.TempFile(rc.dir, "result-*.tmp")
+	if err != nil {
+		warnf("failed creating result cache file:%s", err)
+		return in
+	}
+	out := make(chan api.Reply)
+	go func() {
+		defer close(out)
+		var n int64
+		ok := true
+		for r := range in {
+			if ok {
+				if r.Err != nil {
+					ok = false
+				} else if n += int64(len(r.Data)); n > rc.maxbytes {
+					ok = false
+				} else if _, err := tmp.Write(r.Data); err != nil {
+					warnf("failed writing result cache file:%s", err)
+					ok = false
+				}
+			}
+			out <- r
+		}
+		if err := tmp.Close(); err != nil || !ok || qp.cancelled() {
+			os.Remove(tmp.Name())
+			return
+		}
+		rc.add(cq, tmp.Name(), n, qp)
+	}()
+	return out
+}
+
+func (rc *resultCache) add(cq *cacheQuery, tmpname string, size int64, qp *queryParams) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	//the archive changed while the query ran, so the reply could be missing files
+	if tag, _ := cq.ar.getEntriesTag(); tag != cq.tag {
+		os.Remove(tmpname)
+		return
+	}
+	ent := &cacheEntry{key: cq.key, ar: cq.ar, ranges: cq.ranges, path: filepath.Join(rc.dir, cq.key+".cache"), size: size}
+	ent.first, ent.last, ent.spanok = qp.sentSpan()
+	if el, ok := rc.entries[cq.key]; ok {
+		rc.remove(el)
+	}
+	if err := os.Rename(tmpname, ent.path); err != nil {
+		warnf("failed adding result cache file:%s", err)
+		os.Remove(tmpname)
+		return
+	}
+	rc.entries[cq.key] = rc.lru.PushFront(ent)
+	rc.size += size
+	for rc.size > rc.maxbytes {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+//remove must be called with mu held
+func (rc *resultCache) remove(el *list.Element) {
+	ent := el.Value.(*cacheEntry)
+	rc.lru.Remove(el)
+	delete(rc.entries, ent.key)
+	rc.size -= ent.size
+	os.Remove(ent.path)
+}
+
+//invalidate removes the entries of the archive that the added files could
+//have messages for. A file has messages until the next file of the archive
+//starts, and the last one until who knows when.
+func (rc *resultCache) invalidate(ar *fsarchive, files TimeEntrySlice, added map[string]bool) {
+	if rc == nil || len(added) == 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for el := rc.lru.Front(); el != nil; {
+		next := el.Next()
+		ent := el.Value.(*cacheEntry)
+		if ent.ar == ar && overlapsFiles(ent.ranges, files, added) {
+			rc.remove(el)
+		}
+		el = next
+	}
+}
+
+func overlapsFiles(ranges [][2]time.Time, files TimeEntrySlice, added map[string]bool) bool {
+	for k, ef := range files {
+		if !added[ef.Path] {
+			continue
+		}
+		for _, r := range ranges {
+			if ef.Sdate.After(r[1]) {
+				continue
+			}
+			if k == len(files)-1 || files[k+1].Sdate.After(r[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
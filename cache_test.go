@@ -0,0 +1,88 @@
+package bgparchive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	if err := SetResultCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { resultcache = nil }()
+	ar := newTestArchive(t, quarterFiles)
+	query := func(name string, a, b time.Duration, values url.Values, cache string) []byte {
+		q := testRange(a, b)
+		for k, v := range values {
+			q[k] = v
+		}
+		h, body, errs := testQuery(ar, q)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", name, h.Code, errs)
+		}
+		if h.Cache != cache {
+			t.Errorf("%s: got cache %q, want %q", name, h.Cache, cache)
+		}
+		return body
+	}
+	query("early", time.Minute, 10*time.Minute, nil, "MISS")
+	first := query("first", 16*time.Minute, 29*time.Minute, nil, "MISS")
+	if again := query("again", 16*time.Minute, 29*time.Minute, nil, "HIT"); len(first) == 0 || !bytes.Equal(again, first) {
+		t.Errorf("the cached reply has %d bytes, want %d", len(again), len(first))
+	}
+	//the values that don't change the messages are the same query
+	query("other client", 16*time.Minute, 29*time.Minute, url.Values{"remoteaddr": {"192.0.2.1"}}, "HIT")
+	query("filtered", 16*time.Minute, 29*time.Minute, url.Values{"peeras": {"3356"}}, "MISS")
+	//the newest file can still grow
+	query("newest file", 31*time.Minute, 40*time.Minute, nil, "")
+
+	//a file added in the range removes the cached replies that it has messages for
+	added := testFile{start: 20 * time.Minute, n: 5, step: time.Minute}
+	var data []byte
+	for _, rec := range added.records() {
+		data = append(data, rec...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ar.rootpathstr, "2013.01", added.name()), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ar.fullRescan()
+	ar.setScanning(false)
+	ar.setEntryFiles(ar.tempentryfiles)
+	if rescanned := query("rescanned", 16*time.Minute, 29*time.Minute, nil, "MISS"); bytes.Equal(rescanned, first) {
+		t.Error("the rescanned range got the reply from before the added file")
+	}
+	query("rescanned again", 16*time.Minute, 29*time.Minute, nil, "HIT")
+	query("early after rescan", time.Minute, 10*time.Minute, nil, "HIT")
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	_, body, _ := testQuery(ar, testRange(time.Minute, 10*time.Minute))
+	//room for one reply
+	if err := SetResultCache(t.TempDir(), int64(len(body)+len(body)/2)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { resultcache = nil }()
+	for _, tc := range []struct {
+		a, b  time.Duration
+		cache string
+	}{
+		{time.Minute, 10 * time.Minute, "MISS"},
+		{time.Minute, 10 * time.Minute, "HIT"},
+		{16 * time.Minute, 25 * time.Minute, "MISS"},
+		{16 * time.Minute, 25 * time.Minute, "HIT"},
+		//evicted by the last one
+		{time.Minute, 10 * time.Minute, "MISS"},
+	} {
+		if h, _, _ := testQuery(ar, testRange(tc.a, tc.b)); h.Cache != tc.cache {
+			t.Errorf("from %s to %s: got cache %q, want %q", tc.a, tc.b, h.Cache, tc.cache)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(resultcache.dir, "*.cache")); len(files) != 1 {
+		t.Errorf("got the cache files %v, want 1", files)
+	}
+}
@@ -9,9 +9,12 @@ import (
 	api "github.com/CSUNetSec/bgparchive/api"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -21,8 +24,22 @@ var (
 	flag_basepath        string
 	flag_savepath        string
 	flag_debug           bool
+	flag_loglevel        string
 	flag_conffile        string
 	flag_port            int
+	flag_scanworkers     int
+	flag_scanopenfiles   int
+	flag_cachedir        string
+	flag_cachemb         int
+	flag_watch           bool
+	flag_maxqueries      int
+	flag_maxranges       int
+	flag_maxrecordsize   int
+	flag_savesessions    bool
+	flag_accesslog       string
+	flag_replybatch      int
+	flag_admintoken      string
+	flag_ingesttoken     string
 )
 
 type descpath struct {
@@ -31,6 +48,9 @@ type descpath struct {
 	Delta_minutes int
 	Basepath      string
 	Collector     string
+	Patterns      []string //optional. file name globs or path substrings used instead of Desc to select files
+	Dir_layouts   []string //optional. time layouts of the year and month dirs, like 2006/01. the default is 2006.01
+	Writable      bool     //optional. files can be uploaded to the archive with ingest-token
 }
 
 type descpaths []descpath
@@ -64,8 +84,22 @@ func init() {
 	flag.Var(&flag_descpaths, "descriminator-paths", "comma seperated list of fsbasepath:descriminator:urlpath:delta_minutes:collectorname quints")
 	flag.StringVar(&flag_savepath, "savepath", ".", "directory to save the binary archive index files")
 	flag.StringVar(&flag_conffile, "conf", "", "configuration file")
-	flag.BoolVar(&flag_debug, "debug", false, "turn on debugging")
+	flag.BoolVar(&flag_debug, "debug", false, "turn on debugging. same as log-level debug")
+	flag.StringVar(&flag_loglevel, "log-level", "info", "least severe level of the lines that are logged. debug, info or warn")
 	flag.IntVar(&flag_port, "port", 80, "default port for the HTTP server to bind to")
+	flag.BoolVar(&flag_watch, "watch", false, "watch the archive directories for new files instead of rescanning every refresh-minutes")
+	flag.IntVar(&flag_maxqueries, "max-queries", ba.DEFAULT_MAX_QUERIES, "max number of requests querying the archives at the same time. more are rejected with a 503")
+	flag.IntVar(&flag_maxranges, "max-ranges", ba.DEFAULT_MAX_RANGES, "max number of start and end pairs in a request. more are rejected with a 400")
+	flag.IntVar(&flag_maxrecordsize, "max-record-size", ba.DEFAULT_MAX_RECORD_SIZE, "largest MRT record in bytes that is read from the archive files")
+	flag.BoolVar(&flag_savesessions, "save-sessions", false, "save the continuous pulling sessions in savepath so that they survive restarts")
+	flag.StringVar(&flag_accesslog, "access-log", "", "file to append a JSON line to for every query. - is the standard output")
+	flag.StringVar(&flag_admintoken, "admin-token", "", "secret token of the /archive/admin endpoints that trigger scans and list or revoke the continuous pulling sessions. the endpoints are disabled without it")
+	flag.StringVar(&flag_ingesttoken, "ingest-token", "", "secret token of the ingest endpoints of the writable archives of the conf file. the endpoints are disabled without it")
+	flag.IntVar(&flag_replybatch, "reply-batch", ba.DEFAULT_REPLY_BATCH, "bytes of messages sent to a client in one go. 0 sends every message on its own")
+	flag.IntVar(&flag_scanworkers, "scan-workers", runtime.NumCPU(), "max number of archive files a single query scans concurrently")
+	flag.StringVar(&flag_cachedir, "cache-dir", "", "directory to keep the replies of recent queries in, to send them again without scanning the archive. empty disables the cache")
+	flag.IntVar(&flag_cachemb, "cache-size", 1024, "max megabytes of replies kept in cache-dir")
+	flag.IntVar(&flag_scanopenfiles, "scan-open-files", ba.DEFAULT_SCAN_OPEN_FILES, "max number of files a scan of an archive opens at the same time to read their dates")
 }
 
 func main() {
@@ -87,14 +121,51 @@ func main() {
 		log.Fatal("not descriminators and paths specified")
 	}
 
+	if flag_debug {
+		flag_loglevel = "debug"
+	}
+	if err := ba.SetLogLevel(flag_loglevel); err != nil {
+		log.Fatal(err)
+	}
+	ba.SetMaxQueries(flag_maxqueries)
+	ba.SetMaxRanges(flag_maxranges)
+	ba.SetMaxRecordSize(flag_maxrecordsize)
+	ba.SetReplyBatch(flag_replybatch)
+	if err := ba.SetResultCache(flag_cachedir, int64(flag_cachemb)*1024*1024); err != nil {
+		log.Fatal(err)
+	}
+	switch flag_accesslog {
+	case "":
+	case "-":
+		ba.SetAccessLog(os.Stdout)
+	default:
+		alfile, err := os.OpenFile(flag_accesslog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer alfile.Close()
+		ba.SetAccessLog(alfile)
+	}
 	api := api.NewAPI()
 	servewg := &sync.WaitGroup{}
 	allscanwg := &sync.WaitGroup{}
 	hmsg := new(ba.HelpMsg)
+	var reqcs []chan<- string
 	for i, v := range flag_descpaths {
 		ars = append(ars, ba.NewMRTArchive(v.Basepath, v.Desc, v.Collector, flag_refresh_minutes, flag_savepath, flag_debug))
 		ars[i].SetTimeDelta(time.Duration(v.Delta_minutes) * time.Minute)
+		ars[i].SetScanWorkers(flag_scanworkers)
+		ars[i].SetScanOpenFiles(flag_scanopenfiles)
+		ars[i].SetPatterns(v.Patterns)
+		ars[i].SetDirLayouts(v.Dir_layouts)
+		ars[i].SetWatch(flag_watch)
+		ars[i].SetWritable(v.Writable)
+		if flag_savesessions {
+			ars[i].SetContSavePath(fmt.Sprintf("%s/%s-%s.sessions", flag_savepath, v.Desc, v.Collector))
+		}
 		statar := ba.NewFsarstat(ars[i].GetFsArchive())
+		countar := ba.NewFsarcount(ars[i].GetFsArchive())
+		filear := ba.NewFsarfile(ars[i].GetFsArchive())
 		fsc := ba.NewFsarconf(ars[i].GetFsArchive())
 		pbar := ba.NewPbArchive(ars[i].GetFsArchive())
 		jsar := ba.NewJsonArchive(ars[i].GetFsArchive())
@@ -103,7 +174,15 @@ func main() {
 		api.AddResource(jsar, fmt.Sprintf("/archive/json/%s%s", v.Collector, v.Path))
 		api.AddResource(fsc, fmt.Sprintf("/archive/mrt/%s%s/conf", v.Collector, v.Path))
 		api.AddResource(statar, fmt.Sprintf("/archive/mrt/%s%s/stats", v.Collector, v.Path))
+		api.AddResource(countar, fmt.Sprintf("/archive/mrt/%s%s/count", v.Collector, v.Path))
+		api.AddResource(filear, fmt.Sprintf("/archive/mrt/%s%s/file", v.Collector, v.Path))
+		api.AddResource(ba.NewFsarpeers(ars[i].GetFsArchive()), fmt.Sprintf("/archive/mrt/%s%s/peers", v.Collector, v.Path))
+		if flag_ingesttoken != "" && v.Writable {
+			api.AddResource(ba.NewArchiveIngest(ars[i].GetFsArchive(), flag_ingesttoken), fmt.Sprintf("/archive/mrt/%s%s/ingest", v.Collector, v.Path))
+		}
+		api.AddHandler(ba.NewWsArchive(ars[i].GetFsArchive()), fmt.Sprintf("/archive/mrt/%s%s/ws", v.Collector, v.Path))
 		mrtreqc := ars[i].Serve(servewg, allscanwg)
+		reqcs = append(reqcs, mrtreqc)
 		errg := ars[i].Load(fmt.Sprintf("%s/%s-%s", flag_savepath, v.Desc, v.Collector))
 		if errg != nil {
 			log.Printf("failed to find serialized file. Scanning")
@@ -119,17 +198,41 @@ func main() {
 		} else {
 			//log.Printf("Found serialized file for archive:%s. entryfiles:%s", v, ars[i].entryfiles)
 			log.Printf("Found serialized file for archive:%v.", v)
+			//serve the saved files right away, and pick up the files
+			//added since they were saved in the background.
 			ars[i].SetEntryFilesToTemp()
+			mrtreqc <- "RESCAN"
 		}
 		hmsg.AddArchive(fsc)
 	}
 	allscanwg.Wait()
 	//the global help message
 	api.AddResource(hmsg, "/archive/help")
+	api.AddResource(ba.NewArchiveList(hmsg), "/archive/list")
+	api.AddResource(ba.NewAllArchive(ars), "/archive/all")
+	if flag_admintoken != "" {
+		admin := ba.NewArchiveAdmin(ars, flag_admintoken)
+		api.AddResource(admin, "/archive/admin")
+		api.AddResource(ba.NewArchiveSessions(admin), "/archive/admin/sessions")
+	}
+	//everything else under /archive/ is a collector or path that doesn't exist
+	api.AddResource(ba.NewArchiveNotFound(hmsg), "/archive/")
+	api.AddHandler(ba.MetricsHandler(), "/archive/metrics")
+	//the periodic rescans skip the months before the last file. a SIGHUP
+	//rescans everything to pick up the files backfilled in older months.
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			log.Print("got SIGHUP. rescanning all the archives")
+			for _, c := range reqcs {
+				c <- "FULLRESCAN"
+			}
+		}
+	}()
 	api.Start(flag_port)
 	for _, v := range ars {
-		rc := v.GetReqChan()
-		close(rc)
+		v.Close()
 	}
 	servewg.Wait()
 	log.Print("all fsarchives stopped. exiting")
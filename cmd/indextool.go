@@ -6,7 +6,6 @@ package main
 
 import (
 	"bufio"
-	"compress/bzip2"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -28,31 +27,23 @@ var (
 	print_tes     bool
 	sample_rate   float64
 	new_dir       string
+	new_basepath  string
+	index_every   int
+	points_per_mb float64
+	no_peers      bool
 )
 
-func GetScanner(file *os.File) (scanner *bufio.Scanner) {
-	fname := file.Name()
-	fext := filepath.Ext(fname)
-	if fext == ".bz2" {
-		//log.Printf("bunzip2 file: %s. opening decompression stream", fname)
-		bzreader := bzip2.NewReader(file)
-		scanner = bufio.NewScanner(bzreader)
-		scanner.Split(pbmrt.SplitMrt)
-	} else {
-		//log.Printf("no extension on file: %s. opening normally", fname)
-		scanner = bufio.NewScanner(file)
-		scanner.Split(pbmrt.SplitMrt)
-	}
-	return
-}
-
 func init() {
 	flag.StringVar(&output_suffix, "outsuffix", "", "suffix of the generated index file")
 	flag.StringVar(&output_suffix, "o", "", "")
 	flag.Float64Var(&sample_rate, "rate", DEFAULT_RATE, "sample rate used")
 	flag.Float64Var(&sample_rate, "r", DEFAULT_RATE, "")
+	flag.IntVar(&index_every, "every", 0, "place an index point every this many messages instead of sampling by byte position with rate")
+	flag.Float64Var(&points_per_mb, "per-mb", 0, "index points per megabyte of the file, instead of a fixed number of points given by rate")
+	flag.BoolVar(&no_peers, "nopeers", false, "don't index the BGP4MP peers of every file, that let peer queries skip the files without their peers")
 	flag.BoolVar(&print_tes, "print", false, "Do not create the index file, print the TES file to standard output instead")
 	flag.BoolVar(&print_tes, "p", false, "")
+	flag.StringVar(&new_basepath, "bp", "", "rewrite the dir of every file referenced in the index to this existing directory, keeping the file names")
 	flag.StringVar(&new_dir, "dir", "", "rewrit dir of the files referenced in the index. Must be the same across all entries. format is s:olddir:newdir")
 }
 
@@ -77,6 +68,19 @@ func main() {
 			}
 			fmt.Printf("\n")
 		}
+	} else if new_basepath != "" {
+		if fi, err := os.Stat(new_basepath); err != nil || !fi.IsDir() {
+			fmt.Printf("error: new basepath %s is not an existing directory\n", new_basepath)
+			return
+		}
+		for _, ifile := range args {
+			output_name, err := rewriteBasepath(ifile, new_basepath)
+			if err != nil {
+				fmt.Printf("error:%s", err)
+				return
+			}
+			fmt.Printf("rewrote the basepath to %s in file %s\n", new_basepath, output_name)
+		}
 	} else if new_dir != "" {
 		fmt.Printf("detecting base path in existing indexfiles\n")
 		if sf = strings.FieldsFunc(new_dir, ff); new_dir[0] != 's' && len(sf) != 3 {
@@ -108,7 +112,7 @@ func rewriteDir(ifile, from, to string) error {
 		detectedDir, output_name string
 	)
 	entries := bgp.TimeEntrySlice{}
-	err := (&entries).FromGobFile(ifile)
+	err := (&entries).FromFile(ifile)
 	if err != nil {
 		return fmt.Errorf("Error opening index file: %s\n", ifile)
 	}
@@ -131,7 +135,7 @@ func rewriteDir(ifile, from, to string) error {
 	for i, ef := range entries {
 		entries[i].Path = to + filepath.Base(ef.Path)
 	}
-	err = entries.ToGobFile(output_name)
+	err = entries.ToFile(output_name)
 	if err != nil {
 		fmt.Printf("Error regobing TES: %s\n", output_name)
 	}
@@ -139,9 +143,47 @@ func rewriteDir(ifile, from, to string) error {
 	return nil
 }
 
+//rewriteBasepath moves every entry of the index file to basepath, keeping
+//the file names, and writes the result next to the index file. Entries whose
+//rewritten file can't be read are kept but reported. A basepath that goes up
+//with .. and entries without a file name to keep, whose rewritten path would
+//be out of basepath, are rejected.
+func rewriteBasepath(ifile, basepath string) (string, error) {
+	for _, elem := range strings.Split(filepath.ToSlash(basepath), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("new basepath %s goes up with ..\n", basepath)
+		}
+	}
+	entries := bgp.TimeEntrySlice{}
+	if err := (&entries).FromFile(ifile); err != nil {
+		return "", fmt.Errorf("Error opening index file: %s\n", ifile)
+	}
+	output_name := ifile + ".newdir"
+	if output_suffix != "" {
+		output_name = ifile + "." + output_suffix
+	}
+	for i, ef := range entries {
+		//the base of a path that ends in .. or is the root is not a file name
+		name := filepath.Base(ef.Path)
+		if name == "." || name == ".." || filepath.IsAbs(name) {
+			return "", fmt.Errorf("entry path %s has no file name to move to the new basepath\n", ef.Path)
+		}
+		entries[i].Path = filepath.Join(basepath, name)
+		if file, err := os.Open(entries[i].Path); err != nil {
+			fmt.Printf("warning: rewritten file %s is not readable:%s\n", entries[i].Path, err)
+		} else {
+			file.Close()
+		}
+	}
+	if err := entries.ToFile(output_name); err != nil {
+		return "", fmt.Errorf("Error regobing TES: %s\n", output_name)
+	}
+	return output_name, nil
+}
+
 func printTes(tesName string) error {
 	entries := bgp.TimeEntrySlice{}
-	err := (&entries).FromGobFile(tesName)
+	err := (&entries).FromFile(tesName)
 	if err != nil {
 		return err
 	}
@@ -154,7 +196,7 @@ func printTes(tesName string) error {
 func createIndexedTESFile(tesName string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	entries := bgp.TimeEntrySlice{}
-	err := (&entries).FromGobFile(tesName)
+	err := (&entries).FromFile(tesName)
 	if err != nil {
 		fmt.Printf("Error opening indexfile: %s\n", tesName)
 		return
@@ -170,7 +212,25 @@ func createIndexedTESFile(tesName string, wg *sync.WaitGroup) {
 			fmt.Printf("Error opening ArchEntryFile: %s\n", entries[enct].Path)
 			return
 		}
-		m := Generate_Index(GetScanner(entryfile), entries[enct].Sz, sample_rate, getTimestampFromMRT)
+		var (
+			m    []*ItemOffset
+			each func([]byte)
+		)
+		peers := bgp.NewPeerSet()
+		if !no_peers {
+			each = peers.Add
+		}
+		if index_every > 0 {
+			m = Generate_Count_Index(bgp.GetScanner(entryfile), index_every, getTimestampFromMRT, each)
+		} else if points_per_mb > 0 {
+			points := int(float64(entries[enct].Sz) / (1024 * 1024) * points_per_mb)
+			m = Generate_Points_Index(bgp.GetScanner(entryfile), entries[enct].Sz, points, getTimestampFromMRT, each)
+		} else {
+			m = Generate_Index(bgp.GetScanner(entryfile), entries[enct].Sz, sample_rate, getTimestampFromMRT, each)
+		}
+		if !no_peers {
+			entries[enct].Peers, entries[enct].PeersIndexed = peers.Peers(), true
+		}
 		entries[enct].Offsets = make([]bgp.EntryOffset, len(m))
 		for ct, offset := range m {
 			if offset != nil {
@@ -182,7 +242,7 @@ func createIndexedTESFile(tesName string, wg *sync.WaitGroup) {
 		}
 		entryfile.Close()
 	}
-	err = entries.ToGobFile(output_name)
+	err = entries.ToFile(output_name)
 	if err != nil {
 		fmt.Printf("Error regobing TES: %s\n", tesName)
 	}
@@ -208,20 +268,35 @@ func NewItemOffset(val interface{}, pos int64) *ItemOffset {
 
 // Generates indexes based on the file size and sample rate
 // The scanner must be initialized and Split to parse messages
-// before given to this function
-func Generate_Index(scanner *bufio.Scanner, fsize int64, sample_rate float64, translate func([]byte) (interface{}, error)) []*ItemOffset {
+// before given to this function. If each is not nil it is
+// called on every message
+func Generate_Index(scanner *bufio.Scanner, fsize int64, sample_rate float64, translate func([]byte) (interface{}, error), each func([]byte)) []*ItemOffset {
 
 	if sample_rate < 0.0 || sample_rate > 1.0 {
 		sample_rate = DEFAULT_RATE
 	}
 
-	indices := make([]*ItemOffset, int(1/sample_rate))
-	sample_dist := sample_rate * float64(fsize)
+	return Generate_Points_Index(scanner, fsize, int(1/sample_rate), translate, each)
+}
+
+// Generates up to points indexes evenly spread over the file size.
+// At least one index point is generated
+func Generate_Points_Index(scanner *bufio.Scanner, fsize int64, points int, translate func([]byte) (interface{}, error), each func([]byte)) []*ItemOffset {
+
+	if points < 1 {
+		points = 1
+	}
+
+	indices := make([]*ItemOffset, points)
+	sample_dist := float64(fsize) / float64(points)
 	index_ct := 0
 	var actual_pos int64 = 0
 	for scanner.Scan() {
 		data := scanner.Bytes()
 		actual_pos += int64(len(data))
+		if each != nil {
+			each(data)
+		}
 		if float64(actual_pos) > float64(index_ct)*sample_dist && index_ct < len(indices) {
 			td, err := translate(data)
 			if err == nil {
@@ -231,6 +306,33 @@ func Generate_Index(scanner *bufio.Scanner, fsize int64, sample_rate float64, tr
 		}
 	}
 
+	return indices[:index_ct]
+}
+
+// Generates indexes every "every" messages, so that bursts of large
+// records don't leave long stretches of time without an index point.
+// The offsets are the same as the ones of Generate_Index
+func Generate_Count_Index(scanner *bufio.Scanner, every int, translate func([]byte) (interface{}, error), each func([]byte)) []*ItemOffset {
+	var (
+		indices    []*ItemOffset
+		actual_pos int64 = 0
+		msg_ct     int   = 0
+	)
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		actual_pos += int64(len(data))
+		if each != nil {
+			each(data)
+		}
+		if msg_ct%every == 0 {
+			td, err := translate(data)
+			if err == nil {
+				indices = append(indices, NewItemOffset(td, actual_pos))
+			}
+		}
+		msg_ct++
+	}
+
 	return indices
 }
 
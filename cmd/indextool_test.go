@@ -0,0 +1,267 @@
+package main
+
+//cmd holds the mains of two tools, so these tests are run with the
+//files of indextool only:
+//go test indextool.go indextool_test.go
+
+import (
+	"bytes"
+	"encoding/binary"
+	bgp "github.com/CSUNetSec/bgparchive"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//mrtRecord returns a BGP4MP record at the second of testEpoch with a body of
+//n bytes. indextool only looks at the headers.
+func mrtRecord(sec int, n int) []byte {
+	rec := make([]byte, 12+n)
+	binary.BigEndian.PutUint32(rec, uint32(testEpoch.Unix())+uint32(sec))
+	binary.BigEndian.PutUint16(rec[4:], 16)
+	binary.BigEndian.PutUint16(rec[6:], 4)
+	binary.BigEndian.PutUint32(rec[8:], uint32(n))
+	return rec
+}
+
+//writeTes writes the files in dir and an index file of them, and returns its path
+func writeTes(t *testing.T, dir, name string, files map[string][][]byte) string {
+	var entries bgp.TimeEntrySlice
+	for fname, recs := range files {
+		var data []byte
+		for _, rec := range recs {
+			data = append(data, rec...)
+		}
+		p := filepath.Join(dir, fname)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, bgp.ArchEntryFile{Path: p, Sdate: time.Unix(int64(binary.BigEndian.Uint32(recs[0])), 0), Sz: int64(len(data))})
+	}
+	tes := filepath.Join(dir, name)
+	if err := entries.ToFile(tes); err != nil {
+		t.Fatal(err)
+	}
+	return tes
+}
+
+//readTes returns the entries of an index file
+func readTes(t *testing.T, fname string) bgp.TimeEntrySlice {
+	entries := bgp.TimeEntrySlice{}
+	if err := (&entries).FromFile(fname); err != nil {
+		t.Fatalf("%s: %s", fname, err)
+	}
+	return entries
+}
+
+//recordsOf returns n records one every step seconds of the size
+func recordsOf(n, step, size int) (recs [][]byte) {
+	for k := 0; k < n; k++ {
+		recs = append(recs, mrtRecord(k*step, size))
+	}
+	return
+}
+
+func TestRewriteBasepath(t *testing.T) {
+	olddir, newdir := t.TempDir(), t.TempDir()
+	tes := writeTes(t, olddir, "updates-col", map[string][][]byte{
+		"updates.20130101.0000": recordsOf(3, 60, 100),
+		"updates.20130101.0015": recordsOf(3, 60, 100),
+	})
+	//only one of the files is moved, the other is reported but kept
+	if err := os.Rename(filepath.Join(olddir, "updates.20130101.0000"), filepath.Join(newdir, "updates.20130101.0000")); err != nil {
+		t.Fatal(err)
+	}
+	out, err := rewriteBasepath(tes, newdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := readTes(t, tes), readTes(t, out)
+	if len(after) != len(before) {
+		t.Fatalf("got %d entries, want %d", len(after), len(before))
+	}
+	for i := range after {
+		if want := filepath.Join(newdir, filepath.Base(before[i].Path)); after[i].Path != want {
+			t.Errorf("got the path %s, want %s", after[i].Path, want)
+		}
+		if !after[i].Sdate.Equal(before[i].Sdate) || after[i].Sz != before[i].Sz {
+			t.Errorf("%s: the entry changed from %v to %v", after[i].Path, before[i], after[i])
+		}
+	}
+}
+
+func TestRewriteBasepathRejects(t *testing.T) {
+	dir := t.TempDir()
+	tes := writeTes(t, dir, "updates-col", map[string][][]byte{"updates.20130101.0000": recordsOf(3, 60, 100)})
+	for _, bp := range []string{"../elsewhere", dir + "/../elsewhere", "a/../../b"} {
+		if _, err := rewriteBasepath(tes, bp); err == nil {
+			t.Errorf("the basepath %s is accepted", bp)
+		}
+	}
+	//entries whose rewritten path would be the basepath itself or its parent
+	for _, p := range []string{"/", dir + "/..", "."} {
+		bad := filepath.Join(dir, "bad-col")
+		entries := bgp.TimeEntrySlice{{Path: p, Sdate: testEpoch, Sz: 1}}
+		if err := entries.ToFile(bad); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rewriteBasepath(bad, dir); err == nil {
+			t.Errorf("the entry path %s is accepted", p)
+		}
+	}
+}
+
+func TestIndexConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string) { output_suffix = s }(output_suffix)
+	output_suffix = "idx"
+	var tess []string
+	for _, name := range []string{"updates-col1", "updates-col2"} {
+		sub := filepath.Join(dir, name+".files")
+		os.Mkdir(sub, 0755)
+		tess = append(tess, writeTes(t, sub, name, map[string][][]byte{
+			"updates.20130101.0000": recordsOf(900, 1, 100),
+			"updates.20130101.0015": recordsOf(900, 1, 100),
+		}))
+	}
+	var wg sync.WaitGroup
+	for _, tes := range tess {
+		wg.Add(1)
+		go createIndexedTESFile(tes, &wg)
+	}
+	wg.Wait()
+	for _, tes := range tess {
+		entries := readTes(t, tes+".idx")
+		for _, ef := range entries {
+			if len(ef.Offsets) == 0 {
+				t.Errorf("%s: the file %s has no index points", tes, ef.Path)
+			}
+		}
+	}
+}
+
+//maxGap returns the longest time without an index point up to the end
+func maxGap(points []*ItemOffset, end time.Time) (gap time.Duration) {
+	for k := range points {
+		next := end
+		if k+1 < len(points) {
+			next = points[k+1].Value.(time.Time)
+		}
+		if d := next.Sub(points[k].Value.(time.Time)); d > gap {
+			gap = d
+		}
+	}
+	return
+}
+
+func TestCountIndexEvenness(t *testing.T) {
+	//a burst of large records in the first 100 seconds, then small ones
+	var recs [][]byte
+	for k := 0; k < 1000; k++ {
+		size := 100
+		if k < 100 {
+			size = 10000
+		}
+		recs = append(recs, mrtRecord(k, size))
+	}
+	dir := t.TempDir()
+	tes := writeTes(t, dir, "updates-col", map[string][][]byte{"updates.20130101.0000": recs})
+	ef := readTes(t, tes)[0]
+	index := func(count bool) []*ItemOffset {
+		f, err := os.Open(ef.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if count {
+			return Generate_Count_Index(bgp.GetScanner(f), 100, getTimestampFromMRT, nil)
+		}
+		return Generate_Index(bgp.GetScanner(f), ef.Sz, 0.1, getTimestampFromMRT, nil)
+	}
+	bytesidx, countidx := index(false), index(true)
+	if len(bytesidx) != 10 || len(countidx) != 10 {
+		t.Fatalf("got %d points by bytes and %d by count, want 10 of each", len(bytesidx), len(countidx))
+	}
+	end := testEpoch.Add(999 * time.Second)
+	bytegap, countgap := maxGap(bytesidx, end), maxGap(countidx, end)
+	if countgap != 100*time.Second || bytegap <= countgap {
+		t.Errorf("got the longest gap %s by bytes and %s by count, want 100s by count and more by bytes", bytegap, countgap)
+	}
+	//the offsets are the same as the ones by bytes, right after the record
+	for _, p := range countidx {
+		sec := int(p.Value.(time.Time).Sub(testEpoch) / time.Second)
+		want := int64(sec+1) * 10012
+		if sec >= 100 {
+			want = 100*10012 + int64(sec+1-100)*112
+		}
+		if p.Off != want {
+			t.Errorf("the point at %ds has the offset %d, want %d", sec, p.Off, want)
+		}
+	}
+}
+
+func TestPointsPerMB(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string, p float64) { output_suffix, points_per_mb = s, p }(output_suffix, points_per_mb)
+	output_suffix, points_per_mb = "idx", 4
+	//1MB and 8MB of 10KB records
+	tes := writeTes(t, dir, "updates-col", map[string][][]byte{
+		"updates.20130101.0000": recordsOf(105, 1, 10000-12),
+		"updates.20130101.0015": recordsOf(840, 1, 10000-12),
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	createIndexedTESFile(tes, &wg)
+	points := make(map[string]int)
+	for _, ef := range readTes(t, tes+".idx") {
+		points[filepath.Base(ef.Path)] = len(ef.Offsets)
+	}
+	small, large := points["updates.20130101.0000"], points["updates.20130101.0015"]
+	if small != 4 || large != 32 {
+		t.Errorf("got %d points in the 1MB file and %d in the 8MB one, want 4 and 32", small, large)
+	}
+}
+
+//peerRecord returns a BGP4MP keepalive of the peer at the second of testEpoch
+func peerRecord(sec int, as uint32, ip string) []byte {
+	body := make([]byte, 20, 39)
+	binary.BigEndian.PutUint32(body, as)
+	binary.BigEndian.PutUint16(body[10:], 1) //IPv4
+	copy(body[12:], net.ParseIP(ip).To4())
+	body = append(body, bytes.Repeat([]byte{0xff}, 16)...)
+	body = append(body, 0, 19, 4)
+	rec := mrtRecord(sec, len(body))
+	copy(rec[12:], body)
+	return rec
+}
+
+func TestIndexPeers(t *testing.T) {
+	defer func(s string, np bool) { output_suffix, no_peers = s, np }(output_suffix, no_peers)
+	output_suffix = "idx"
+	for _, np := range []bool{false, true} {
+		no_peers = np
+		dir := t.TempDir()
+		tes := writeTes(t, dir, "updates-col", map[string][][]byte{
+			"updates.20130101.0000": {peerRecord(0, 3356, "192.0.2.1"), peerRecord(1, 174, "192.0.2.2"), peerRecord(2, 3356, "192.0.2.1")},
+		})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		createIndexedTESFile(tes, &wg)
+		ef := readTes(t, tes+".idx")[0]
+		if np {
+			if ef.PeersIndexed || len(ef.Peers) != 0 {
+				t.Errorf("nopeers: got the peers %v indexed:%v", ef.Peers, ef.PeersIndexed)
+			}
+			continue
+		}
+		if !ef.PeersIndexed || len(ef.Peers) != 2 || ef.Peers[0].AS != 174 || !ef.Peers[1].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("got the peers %v indexed:%v, want 192.0.2.2 AS174 and 192.0.2.1 AS3356", ef.Peers, ef.PeersIndexed)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+//CONT_SAVE_INTERVAL is how often the continuous pulling sessions are saved
+//when persistence is enabled. They are also saved when the event loop stops.
+const CONT_SAVE_INTERVAL = time.Minute
+
+//contSession is the part of a contCli that is saved to disk
+type contSession struct {
+	Id     string
+	Ip     string
+	T1pull time.Time
+	T2pull time.Time
+	Begun  time.Time
+}
+
+//ContSession is a continuous pulling session as the admin endpoint lists it.
+//T2pull is zero until the first pull.
+type ContSession struct {
+	Collector     string    `json:"collector"`
+	Descriminator string    `json:"descriminator"`
+	Id            string    `json:"id"`
+	Ip            string    `json:"ip"`
+	T1pull        time.Time `json:"t1pull"`
+	T2pull        time.Time `json:"t2pull"`
+	AgeSec        float64   `json:"ageSec"` //since the session was begun
+}
+
+//lastPull is when the client last registered or pulled. Its timer expires
+//CONT_TIMEOUT after that.
+func (c *contCli) lastPull() time.Time {
+	if c.t2pull.IsZero() {
+		return c.t1pull
+	}
+	return c.t2pull
+}
+
+//save writes the registered sessions to the savepath of the context.
+func (ctx *contCtx) save() error {
+	ctx.mu.RLock()
+	sessions := make([]contSession, 0, len(ctx.contuuid))
+	for _, c := range ctx.contuuid {
+		sessions = append(sessions, contSession{Id: c.id, Ip: c.ip, T1pull: c.t1pull, T2pull: c.t2pull, Begun: c.begun})
+	}
+	ctx.mu.RUnlock()
+	m := new(bytes.Buffer)
+	if err := gob.NewEncoder(m).Encode(sessions); err != nil {
+		return err
+	}
+	//write and rename so that a crash never leaves a truncated file behind
+	tmp := ctx.savepath + ".tmp"
+	if err := ioutil.WriteFile(tmp, m.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ctx.savepath)
+}
+
+//load registers the sessions saved in the savepath of the context and
+//arms their timers with the time they had left. Sessions that expired
+//while the server was down are dropped.
+func (ctx *contCtx) load(expirech chan *contCli) error {
+	n, err := ioutil.ReadFile(ctx.savepath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var sessions []contSession
+	if err = gob.NewDecoder(bytes.NewBuffer(n)).Decode(&sessions); err != nil {
+		return err
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	for _, s := range sessions {
+		c := &contCli{id: s.Id, ip: s.Ip, t1pull: s.T1pull, t2pull: s.T2pull, begun: s.Begun, cchan: make(chan bool, 1)}
+		if c.begun.IsZero() { //saved before the sessions knew when they were begun
+			c.begun = c.t1pull
+		}
+		left := CONT_TIMEOUT - time.Since(c.lastPull())
+		if left <= 0 {
+			infof("dropping expired continuous pull session:%s", s.Id)
+			continue
+		}
+		if len(ctx.contclis[c.ip]) >= CONTCLISZ {
+			continue
+		}
+		ctx.contclis[c.ip] = append(ctx.contclis[c.ip], c)
+		ctx.contuuid[c.id] = c
+		ctx.setTimerDuration(c, expirech, left)
+	}
+	ctx.clients.Set(float64(len(ctx.contuuid)))
+	infof("loaded %d continuous pull sessions from %s", len(ctx.contuuid), ctx.savepath)
+	return nil
+}
+
+func (c *contCli) session() ContSession {
+	return ContSession{Id: c.id, Ip: c.ip, T1pull: c.t1pull, T2pull: c.t2pull, AgeSec: time.Since(c.begun).Seconds()}
+}
+
+//sessions lists the registered sessions ordered by ip and age
+func (ctx *contCtx) sessions() []ContSession {
+	ctx.mu.RLock()
+	ret := make([]ContSession, 0, len(ctx.contuuid))
+	for _, c := range ctx.contuuid {
+		ret = append(ret, c.session())
+	}
+	ctx.mu.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Ip != ret[j].Ip {
+			return ret[i].Ip < ret[j].Ip
+		}
+		return ret[i].AgeSec > ret[j].AgeSec
+	})
+	return ret
+}
+
+//revoke removes the session of the id, or all the sessions of the ip if the
+//id is empty, and returns them. If both are set the id has to be of the ip.
+//The next pull of a revoked session gets a 404 like an expired one.
+func (ctx *contCtx) revoke(id, ip string) []ContSession {
+	var clis []*contCli
+	if id != "" {
+		if c := ctx.getCli(id); c != nil && (ip == "" || c.ip == ip) {
+			clis = append(clis, c)
+		}
+	} else {
+		for _, cid := range ctx.GetIDsfromIP(ip) {
+			clis = append(clis, ctx.getCli(cid))
+		}
+	}
+	ret := make([]ContSession, 0, len(clis))
+	for _, c := range clis {
+		s := c.session()
+		if err := ctx.Del(&contCli{ip: c.ip, id: c.id}); err != nil {
+			warnf("failed revoking continuous pull session:%s error:%s", c.id, err)
+			continue
+		}
+		infof("revoked continuous pull session:%s of ip:%s", c.id, c.ip)
+		ret = append(ret, s)
+	}
+	return ret
+}
@@ -0,0 +1,53 @@
+package bgparchive
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContSessionsSaved(t *testing.T) {
+	savepath := filepath.Join(t.TempDir(), "sessions")
+	ar := newTestArchive(t, quarterFiles[:1])
+	ar.SetContSavePath(savepath)
+	//a session that expires while the server is down
+	expired := &contCli{ip: "192.0.2.2"}
+	if err := ar.contctx.Add(expired); err != nil {
+		t.Fatal(err)
+	}
+	expired.t1pull = time.Now().Add(-CONT_TIMEOUT - time.Minute)
+	ar.contctx.Serve()
+	h, _, errs := testQuery(ar, url.Values{"continuous": {"begin"}, "remoteaddr": {"192.0.2.1"}})
+	if h.Code != 200 || len(errs) != 0 || h.Extra == "" {
+		t.Fatalf("beginning got code %d, errors %v and the id %q", h.Code, errs, h.Extra)
+	}
+	id := h.Extra
+	begun := ar.contctx.getCli(id).begun
+	//the sessions are saved when the event loop stops
+	ar.contctx.Stop()
+
+	restarted := newTestArchive(t, quarterFiles[:1])
+	restarted.SetContSavePath(savepath)
+	restarted.contctx.Serve()
+	defer restarted.contctx.Stop()
+	//the sessions are loaded by the event loop, all at once
+	cli := restarted.contctx.getCli(id)
+	for deadline := time.Now().Add(5 * time.Second); cli == nil && time.Now().Before(deadline); cli = restarted.contctx.getCli(id) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cli == nil || cli.ip != "192.0.2.1" || !cli.begun.Equal(begun) {
+		t.Fatalf("got the session %+v for the saved id %s", cli, id)
+	}
+	if restarted.contctx.ExistsId(expired.id) {
+		t.Error("the expired session was loaded")
+	}
+	//the saved id can be pulled with, and it gets a new one
+	h, _, errs = testQuery(restarted, url.Values{"continuous": {id}, "remoteaddr": {"192.0.2.1"}})
+	if h.Code == 404 || h.Extra == "" || h.Extra == id {
+		t.Errorf("pulling with the saved id got code %d, errors %v and the next id %q", h.Code, errs, h.Extra)
+	}
+	if h, _, _ = testQuery(restarted, url.Values{"continuous": {id}, "remoteaddr": {"192.0.2.1"}}); h.Code != 404 {
+		t.Errorf("pulling with the used id got code %d, want 404", h.Code)
+	}
+}
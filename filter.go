@@ -0,0 +1,582 @@
+package bgparchive
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//queryParams holds the optional parameters of a request that
+//control which MRT records are sent back to the client and how.
+//It is shared by all the Query goroutines of a request.
+type queryParams struct {
+	prefixes  []*net.IPNet
+	aspaths   []asPathFilter
+	peers     []net.IP        //peer=. BGP4MP peer addresses
+	peerases  []uint32        //peeras=. BGP4MP peer ASNs
+	mrttypes  []mrtTypeFilter //mrttype=. MRT record types and subtypes
+	format    string          //format=. the output format the messages are sent in. empty is mrt
+	hdrsonly  bool            //headersonly=true. send the headers of the messages without their bodies
+	normalize string          //normalize=. et or plain. the MRT type the BGP4MP records are re-encoded to
+	bundle    string          //bundle=. tar or tar.gz. send the files as they are in a tar archive
+	manifest  bool            //manifest=true. send a description of the reply instead of it
+	prof      *queryProfile   //profile=true. time the phases of the query and send them last
+	desc      bool            //order=desc. most recent messages first
+	limit     int64           //max number of messages to send. 0 means no limit
+	sent      int64           //messages sent so far, accessed atomically
+	dedup     *seenSet        //dedup=true. drop repeated records at the file seams
+	bucket    int             //bucket=. seconds per column of the stats. 0 means 1
+	exact     bool            //exact=true. [start, end) without the one second slop
+	slop      time.Duration   //slop=. replaces the one second around the range. -1 means not set
+	sorted    bool            //sorted=true. merge the files by timestamp
+	stream    bool            //stream=true. send the stats buckets as they are counted
+	anomalyk  float64         //anomaly=. standard deviations that flag a stats bucket. 0 means off
+	remote    string          //address of the client, for the access log
+	span      *dataSpan       //timestamps of the messages sent, for the X-Data trailers
+	until     time.Time       //set by continuous pulls. the messages at or after it are left to the next pull
+	asof      *ArchEntryFile  //asof=. the RIB file that is sent whole instead of the files of the range
+	done      <-chan struct{} //closed when the client goes away and the query should stop
+}
+
+//DEDUP_WINDOW is how close to the start or the end of an archive file
+//a record has to be to be checked for duplicates.
+const DEDUP_WINDOW = 5 * time.Second
+
+//seenSet remembers the records sent near the file seams of a query.
+//the files of a query are scanned concurrently so it is locked.
+type seenSet struct {
+	mu   sync.Mutex
+	seen map[uint64]struct{}
+}
+
+//firstSeen returns true if the record has not been seen before in
+//this query. Only records within DEDUP_WINDOW of the start or end of
+//the file are remembered, since duplicates only show up where the files
+//overlap. This keeps the memory bounded on large ranges.
+func (qp *queryParams) firstSeen(data []byte, msgtime, fstart, fend time.Time) bool {
+	if qp == nil || qp.dedup == nil {
+		return true
+	}
+	if msgtime.Sub(fstart) > DEDUP_WINDOW && fend.Sub(msgtime) > DEDUP_WINDOW {
+		return true
+	}
+	//the MRT header timestamp is part of the data so it's part of the identity
+	h := fnv.New64a()
+	h.Write(data)
+	id := h.Sum64()
+	qp.dedup.mu.Lock()
+	defer qp.dedup.mu.Unlock()
+	if _, ok := qp.dedup.seen[id]; ok {
+		return false
+	}
+	qp.dedup.seen[id] = struct{}{}
+	return true
+}
+
+//asPathFilter matches updates with an ASN either as the origin
+//or anywhere in the AS path.
+type asPathFilter struct {
+	asn    uint32
+	origin bool
+}
+
+func (a asPathFilter) match(up *bgp4mpMsg) bool {
+	if !a.origin {
+		return up.contains(a.asn)
+	}
+	for _, o := range up.origin() {
+		if o == a.asn {
+			return true
+		}
+	}
+	return false
+}
+
+//mrtTypeFilter matches records of an MRT type and, unless subtypes
+//is empty, of one of the subtypes.
+type mrtTypeFilter struct {
+	typ      uint16
+	subtypes []uint16
+}
+
+func (m mrtTypeFilter) match(typ, subtyp uint16) bool {
+	if typ != m.typ {
+		return false
+	}
+	if len(m.subtypes) == 0 {
+		return true
+	}
+	for _, s := range m.subtypes {
+		if s == subtyp {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	bgp4mpMessageSubtypes = []uint16{BGP4MP_MESSAGE, BGP4MP_MESSAGE_AS4, BGP4MP_MESSAGE_LOCAL, BGP4MP_MESSAGE_AS4_LOCAL,
+		BGP4MP_MESSAGE_ADDPATH, BGP4MP_MESSAGE_AS4_ADDPATH, BGP4MP_MESSAGE_LOCAL_ADDPATH, BGP4MP_MESSAGE_AS4_LOCAL_ADDPATH}
+	bgp4mpStateChangeSubtypes = []uint16{BGP4MP_STATE_CHANGE, BGP4MP_STATE_CHANGE_AS4}
+)
+
+//parseMrtTypeFilter parses the friendly names update, statechange and rib,
+//or a numeric type with an optional subtype like 16:5.
+func parseMrtTypeFilter(a string) ([]mrtTypeFilter, error) {
+	switch a {
+	case "update":
+		return []mrtTypeFilter{{MRT_BGP4MP, bgp4mpMessageSubtypes}, {MRT_BGP4MP_ET, bgp4mpMessageSubtypes}}, nil
+	case "statechange":
+		return []mrtTypeFilter{{MRT_BGP4MP, bgp4mpStateChangeSubtypes}, {MRT_BGP4MP_ET, bgp4mpStateChangeSubtypes}}, nil
+	case "rib": //with the peer index table, that is needed to make sense of the RIB entries
+		return []mrtTypeFilter{{typ: MRT_TABLE_DUMP_V2}, {typ: MRT_TABLE_DUMP}}, nil
+	}
+	ret := mrtTypeFilter{}
+	tstr := a
+	if ind := strings.Index(a, ":"); ind != -1 {
+		subtyp, err := strconv.ParseUint(a[ind+1:], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("malformed mrttype parameter:%s", a)
+		}
+		ret.subtypes = []uint16{uint16(subtyp)}
+		tstr = a[:ind]
+	}
+	typ, err := strconv.ParseUint(tstr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed mrttype parameter:%s. should be update, statechange, rib or type[:subtype]", a)
+	}
+	ret.typ = uint16(typ)
+	return []mrtTypeFilter{ret}, nil
+}
+
+//parseASPathFilter parses values in the form [origin:|contains:]ASN.
+//without a qualifier the ASN can be anywhere in the path.
+func parseASPathFilter(a string) (asPathFilter, error) {
+	ret := asPathFilter{}
+	asnstr := a
+	if ind := strings.Index(a, ":"); ind != -1 {
+		switch a[:ind] {
+		case "origin":
+			ret.origin = true
+		case "contains":
+		default:
+			return ret, fmt.Errorf("unknown aspath qualifier:%s. should be origin or contains", a[:ind])
+		}
+		asnstr = a[ind+1:]
+	}
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asnstr), "AS"), 10, 32)
+	if err != nil {
+		return ret, fmt.Errorf("malformed aspath parameter:%s", a)
+	}
+	ret.asn = uint32(asn)
+	return ret, nil
+}
+
+//newQueryParams parses the filtering parameters out of the request values.
+//A nil *queryParams is valid and matches everything.
+func newQueryParams(values url.Values) (*queryParams, error) {
+	qp := &queryParams{remote: values.Get("remoteaddr"), span: &dataSpan{}, slop: -1}
+	if _, ok := lookupFormat(values.Get("format")); !ok {
+		return nil, fmt.Errorf("unknown format:%s. should be one of %s", values.Get("format"), formatNames())
+	}
+	if f := values.Get("format"); f != "mrt" {
+		qp.format = f
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		qp.desc = true
+	default:
+		return nil, fmt.Errorf("unknown order:%s. should be asc or desc", values.Get("order"))
+	}
+	if lstr := values.Get("limit"); lstr != "" {
+		limit, err := strconv.ParseInt(lstr, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("malformed limit parameter:%s. should be a positive integer", lstr)
+		}
+		qp.limit = limit
+	}
+	for _, pstr := range values["prefix"] {
+		_, pnet, err := net.ParseCIDR(pstr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed prefix parameter:%s", pstr)
+		}
+		qp.prefixes = append(qp.prefixes, pnet)
+	}
+	for _, astr := range values["aspath"] {
+		apf, err := parseASPathFilter(astr)
+		if err != nil {
+			return nil, err
+		}
+		qp.aspaths = append(qp.aspaths, apf)
+	}
+	if bstr := values.Get("bucket"); bstr != "" {
+		bucket, err := strconv.Atoi(bstr)
+		if err != nil || bucket <= 0 {
+			return nil, fmt.Errorf("malformed bucket parameter:%s. should be a positive number of seconds", bstr)
+		}
+		qp.bucket = bucket
+	}
+	if astr := values.Get("anomaly"); astr != "" {
+		k, err := strconv.ParseFloat(astr, 64)
+		if err != nil || k <= 0 || math.IsInf(k, 0) || math.IsNaN(k) {
+			return nil, fmt.Errorf("malformed anomaly parameter:%s. should be a positive number of standard deviations", astr)
+		}
+		qp.anomalyk = k
+	}
+	switch values.Get("exact") {
+	case "", "false":
+	case "true":
+		qp.exact = true
+	default:
+		return nil, fmt.Errorf("malformed exact parameter:%s. should be true or false", values.Get("exact"))
+	}
+	if sstr := values.Get("slop"); sstr != "" {
+		secs, err := strconv.Atoi(sstr)
+		if err != nil || secs < 0 || time.Duration(secs)*time.Second > MAX_SLOP {
+			return nil, fmt.Errorf("malformed slop parameter:%s. should be from 0 to %d seconds", sstr, int(MAX_SLOP/time.Second))
+		}
+		if qp.exact {
+			return nil, fmt.Errorf("slop can't be used with exact=true")
+		}
+		qp.slop = time.Duration(secs) * time.Second
+	}
+	switch values.Get("headersonly") {
+	case "", "false":
+	case "true":
+		qp.hdrsonly = true
+	default:
+		return nil, fmt.Errorf("malformed headersonly parameter:%s. should be true or false", values.Get("headersonly"))
+	}
+	switch values.Get("normalize") {
+	case "":
+	case "et", "plain":
+		if qp.format != "" {
+			return nil, fmt.Errorf("normalize only applies to the mrt format")
+		}
+		qp.normalize = values.Get("normalize")
+	default:
+		return nil, fmt.Errorf("unknown normalize:%s. should be et or plain", values.Get("normalize"))
+	}
+	switch values.Get("sorted") {
+	case "", "false":
+	case "true":
+		qp.sorted = true
+	default:
+		return nil, fmt.Errorf("malformed sorted parameter:%s. should be true or false", values.Get("sorted"))
+	}
+	switch values.Get("stream") {
+	case "", "false":
+	case "true":
+		qp.stream = true
+	default:
+		return nil, fmt.Errorf("malformed stream parameter:%s. should be true or false", values.Get("stream"))
+	}
+	switch values.Get("dedup") {
+	case "", "false":
+	case "true":
+		qp.dedup = &seenSet{seen: make(map[uint64]struct{})}
+	default:
+		return nil, fmt.Errorf("malformed dedup parameter:%s. should be true or false", values.Get("dedup"))
+	}
+	for _, mstr := range values["mrttype"] {
+		mtf, err := parseMrtTypeFilter(mstr)
+		if err != nil {
+			return nil, err
+		}
+		qp.mrttypes = append(qp.mrttypes, mtf...)
+	}
+	for _, pstr := range values["peer"] {
+		ip := net.ParseIP(pstr)
+		if ip == nil {
+			return nil, fmt.Errorf("malformed peer parameter:%s", pstr)
+		}
+		qp.peers = append(qp.peers, ip)
+	}
+	for _, astr := range values["peeras"] {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(astr), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed peeras parameter:%s", astr)
+		}
+		qp.peerases = append(qp.peerases, uint32(asn))
+	}
+	switch values.Get("bundle") {
+	case "":
+	case "tar", "tar.gz":
+		if qp.filtering() || qp.limit != 0 || qp.desc || qp.sorted || qp.dedup != nil || qp.format != "" || qp.hdrsonly || qp.normalize != "" {
+			return nil, errbundle
+		}
+		qp.bundle = values.Get("bundle")
+	default:
+		return nil, fmt.Errorf("unknown bundle:%s. should be tar or tar.gz", values.Get("bundle"))
+	}
+	switch values.Get("manifest") {
+	case "", "false":
+	case "true":
+		if qp.bundle != "" {
+			return nil, errmanifest
+		}
+		qp.manifest = true
+	default:
+		return nil, fmt.Errorf("malformed manifest parameter:%s. should be true or false", values.Get("manifest"))
+	}
+	switch values.Get("profile") {
+	case "", "false":
+	case "true":
+		if qp.bundle != "" || qp.manifest {
+			return nil, errprofile
+		}
+		qp.prof = newQueryProfile()
+	default:
+		return nil, fmt.Errorf("malformed profile parameter:%s. should be true or false", values.Get("profile"))
+	}
+	return qp, nil
+}
+
+//take accounts for one more message to be sent and returns false
+//if that would exceed the limit of the request.
+func (qp *queryParams) take() bool {
+	if qp == nil || qp.limit == 0 {
+		return true
+	}
+	return atomic.AddInt64(&qp.sent, 1) <= qp.limit
+}
+
+//dataSpan is the earliest and latest timestamps of the messages sent by a request.
+//the ranges of a request are queried concurrently so it is locked.
+type dataSpan struct {
+	mu          sync.Mutex
+	set         bool
+	first, last uint32
+}
+
+//sentAt accounts for a message with the timestamp ts that is being sent
+func (qp *queryParams) sentAt(ts uint32) {
+	if qp == nil || qp.span == nil {
+		return
+	}
+	qp.span.mu.Lock()
+	defer qp.span.mu.Unlock()
+	if !qp.span.set || ts < qp.span.first {
+		qp.span.first = ts
+	}
+	if !qp.span.set || ts > qp.span.last {
+		qp.span.last = ts
+	}
+	qp.span.set = true
+}
+
+//sentSpan returns the earliest and latest timestamps of the messages
+//sent so far. ok is false if none were sent.
+func (qp *queryParams) sentSpan() (first, last time.Time, ok bool) {
+	if qp == nil || qp.span == nil {
+		return
+	}
+	qp.span.mu.Lock()
+	defer qp.span.mu.Unlock()
+	if !qp.span.set {
+		return
+	}
+	return time.Unix(int64(qp.span.first), 0).UTC(), time.Unix(int64(qp.span.last), 0).UTC(), true
+}
+
+//doneChan returns the channel that is closed when the request is cancelled.
+//A nil channel is returned for requests that can't be cancelled, so
+//that selecting on it blocks forever.
+func (qp *queryParams) doneChan() <-chan struct{} {
+	if qp == nil {
+		return nil
+	}
+	return qp.done
+}
+
+//cancelled returns true if the request has been cancelled
+func (qp *queryParams) cancelled() bool {
+	select {
+	case <-qp.doneChan():
+		return true
+	default:
+		return false
+	}
+}
+
+//MAX_SLOP is the largest slop a query can ask for
+const MAX_SLOP = 15 * time.Minute
+
+//getSlop returns how far around the range messages are included
+func (qp *queryParams) getSlop() time.Duration {
+	if qp == nil || qp.slop < 0 {
+		return time.Second
+	}
+	return qp.slop
+}
+
+//inRange returns true if a message at msgtime belongs to the range [ta, tb].
+//By default one extra second on each side is included.
+func (qp *queryParams) inRange(msgtime, ta, tb time.Time) bool {
+	if qp != nil && !qp.until.IsZero() && !msgtime.Before(qp.until) {
+		return false
+	}
+	//every record of an asof RIB is sent, even the ones dated after the next dump
+	if qp != nil && qp.asof != nil {
+		return true
+	}
+	if qp != nil && qp.exact {
+		return !msgtime.Before(ta) && msgtime.Before(tb)
+	}
+	slop := qp.getSlop()
+	return msgtime.After(ta.Add(-slop)) && msgtime.Before(tb.Add(slop))
+}
+
+//fileRange returns the range to look up the files of a query of [ta, tb] with.
+//getFileIndexRange and seekToOffset already account for the default second
+//around the range, so it is only wider with a larger slop.
+func (qp *queryParams) fileRange(ta, tb time.Time) (time.Time, time.Time) {
+	slop := qp.getSlop()
+	if qp == nil || qp.exact || slop <= time.Second {
+		return ta, tb
+	}
+	return ta.Add(time.Second - slop), tb.Add(slop - time.Second)
+}
+
+//fileStart returns the time to seek the files of a query of [ta, tb] to
+func (qp *queryParams) fileStart(ta, tb time.Time) time.Time {
+	start, _ := qp.fileRange(ta, tb)
+	return start
+}
+
+//emptyRange is true if no message can be in the range [ta, tb], so the
+//files don't have to be opened. Only an exact range can be empty, since
+//the default one second on each side makes start==end a two second range.
+func (qp *queryParams) emptyRange(ta, tb time.Time) bool {
+	return qp != nil && qp.exact && !ta.Before(tb)
+}
+
+//bucketSecs returns the seconds per column of the stats
+func (qp *queryParams) bucketSecs() int {
+	if qp == nil || qp.bucket == 0 {
+		return 1
+	}
+	return qp.bucket
+}
+
+func (qp *queryParams) isDesc() bool {
+	return qp != nil && qp.desc
+}
+
+func (qp *queryParams) isSorted() bool {
+	return qp != nil && qp.sorted
+}
+
+func (qp *queryParams) filtering() bool {
+	return qp != nil && (len(qp.mrttypes) > 0 || qp.filteringMessages())
+}
+
+//filteringMessages is true if the filters need to decode BGP4MP messages
+func (qp *queryParams) filteringMessages() bool {
+	return len(qp.prefixes) > 0 || len(qp.aspaths) > 0 || qp.filteringPeers()
+}
+
+func (qp *queryParams) filteringPeers() bool {
+	return len(qp.peers) > 0 || len(qp.peerases) > 0
+}
+
+//match returns true if the MRT record in data should be sent to the client.
+//records that are not BGP4MP messages never match an active filter.
+//Values of the same parameter are ORed, different parameters are ANDed.
+func (qp *queryParams) match(data []byte) bool {
+	if !qp.filtering() {
+		return true
+	}
+	if !qp.matchMrtTypes(data) {
+		return false
+	}
+	if !qp.filteringMessages() {
+		return true
+	}
+	up, err := decodeBGP4MP(data)
+	if err != nil {
+		return false
+	}
+	return qp.matchPeers(up) && qp.matchPrefixes(up) && qp.matchASPaths(up)
+}
+
+func (qp *queryParams) matchMrtTypes(data []byte) bool {
+	if len(qp.mrttypes) == 0 {
+		return true
+	}
+	typ, subtyp, err := mrtType(data)
+	if err != nil {
+		return false
+	}
+	for _, m := range qp.mrttypes {
+		if m.match(typ, subtyp) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchPeers is true if the message is from any of the requested peer
+//addresses or peer ASNs.
+func (qp *queryParams) matchPeers(up *bgp4mpMsg) bool {
+	if !qp.filteringPeers() {
+		return true
+	}
+	for _, ip := range qp.peers {
+		if ip.Equal(up.peerIP) {
+			return true
+		}
+	}
+	for _, asn := range qp.peerases {
+		if asn == up.peerAS {
+			return true
+		}
+	}
+	return false
+}
+
+func (qp *queryParams) matchASPaths(up *bgp4mpMsg) bool {
+	if len(qp.aspaths) == 0 {
+		return true
+	}
+	for _, apf := range qp.aspaths {
+		if apf.match(up) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchPrefixes is true if any prefix of the update is within or contains
+//any of the requested prefixes.
+func (qp *queryParams) matchPrefixes(up *bgp4mpMsg) bool {
+	if len(qp.prefixes) == 0 {
+		return true
+	}
+	for _, p := range up.prefixes() {
+		for _, q := range qp.prefixes {
+			if prefixWithin(p, q) || prefixWithin(q, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//prefixWithin returns true if a is equal to or more specific than b.
+func prefixWithin(a, b *net.IPNet) bool {
+	aones, abits := a.Mask.Size()
+	bones, bbits := b.Mask.Size()
+	if abits != bbits || aones < bones {
+		return false
+	}
+	return b.Contains(a.IP)
+}
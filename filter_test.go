@@ -0,0 +1,382 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixFilter(t *testing.T) {
+	ann := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24", "10.0.0.0/8"}, nil)
+	wdr := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", nil, nil, []string{"1.1.1.0/24"})
+	mp := mrtRecord(testTs(0), MRT_BGP4MP, BGP4MP_MESSAGE_AS4, bgp4mpBody(3356, "192.0.2.1", BGP_UPDATE,
+		bgpUpdate([]uint32{3356}, nil, nil, mpReach(AFI_IP6, SAFI_UNICAST, encodePrefixes([]string{"2001:db8::/32"})))))
+	state := bgp4mpStateChange(testTs(0), 3356, "192.0.2.1", 6, 1)
+	for _, tc := range []struct {
+		name     string
+		prefixes []string
+		rec      []byte
+		want     bool
+	}{
+		{"no filter", nil, state, true},
+		{"equal", []string{"8.8.8.0/24"}, ann, true},
+		{"less specific", []string{"8.0.0.0/8"}, ann, true},
+		{"more specific", []string{"10.1.0.0/16"}, ann, true},
+		{"other", []string{"9.9.9.0/24"}, ann, false},
+		{"any of them", []string{"9.9.9.0/24", "8.8.8.8/32"}, ann, true},
+		{"withdrawn", []string{"1.1.1.0/24"}, wdr, true},
+		{"not withdrawn", []string{"8.8.8.0/24"}, wdr, false},
+		{"mp reach", []string{"2001:db8::/32"}, mp, true},
+		{"other family", []string{"8.8.8.0/24"}, mp, false},
+		{"v4 mapped", []string{"::ffff:8.8.8.0/120"}, ann, false},
+		{"state change", []string{"8.8.8.0/24"}, state, false},
+	} {
+		qp, err := newQueryParams(url.Values{"prefix": tc.prefixes})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := qp.match(tc.rec); got != tc.want {
+			t.Errorf("%s: prefixes %v got %v, want %v", tc.name, tc.prefixes, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"8.8.8.0", "8.8.8.0/33", "example.com/24", ""} {
+		if _, err := newQueryParams(url.Values{"prefix": {bad}}); err == nil {
+			t.Errorf("the prefix %q is accepted", bad)
+		}
+	}
+}
+
+func TestMrtTypeFilter(t *testing.T) {
+	upd := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356}, []string{"8.8.8.0/24"}, nil)
+	state := bgp4mpStateChange(testTs(0), 3356, "192.0.2.1", 6, 1)
+	ribv2 := mrtRecord(testTs(0), MRT_TABLE_DUMP_V2, 2, []byte{0, 0, 0, 1, 24, 8, 8, 8, 0, 0})
+	ribv1 := mrtRecord(testTs(0), MRT_TABLE_DUMP, 1, make([]byte, 20))
+	recs := [][]byte{upd, state, ribv2, ribv1}
+	for _, tc := range []struct {
+		values url.Values
+		want   []bool //for each of recs
+	}{
+		{url.Values{}, []bool{true, true, true, true}},
+		{url.Values{"mrttype": {"update"}}, []bool{true, false, false, false}},
+		{url.Values{"mrttype": {"statechange"}}, []bool{false, true, false, false}},
+		{url.Values{"mrttype": {"rib"}}, []bool{false, false, true, true}},
+		{url.Values{"mrttype": {"16"}}, []bool{true, true, false, false}},
+		{url.Values{"mrttype": {"16:5"}}, []bool{false, true, false, false}},
+		{url.Values{"mrttype": {"13:2", "statechange"}}, []bool{false, true, true, false}},
+		//a state change has no prefixes
+		{url.Values{"mrttype": {"16"}, "prefix": {"8.8.8.0/24"}}, []bool{true, false, false, false}},
+		{url.Values{"mrttype": {"statechange"}, "peer": {"192.0.2.1"}}, []bool{false, true, false, false}},
+	} {
+		qp, err := newQueryParams(tc.values)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.values, err)
+		}
+		for k, rec := range recs {
+			if got := qp.match(rec); got != tc.want[k] {
+				t.Errorf("%v: record %d got %v, want %v", tc.values, k, got, tc.want[k])
+			}
+		}
+	}
+	for _, bad := range []string{"updates", "16:", ":5", "65536", "-1"} {
+		if _, err := newQueryParams(url.Values{"mrttype": {bad}}); err == nil {
+			t.Errorf("the mrttype %q is accepted", bad)
+		}
+	}
+}
+
+func TestExactRange(t *testing.T) {
+	ta, tb := testEpoch.Add(time.Minute), testEpoch.Add(2*time.Minute)
+	for _, tc := range []struct {
+		values url.Values
+		at     time.Duration //since ta
+		want   bool
+	}{
+		{url.Values{}, -time.Second, false},
+		{url.Values{}, -time.Second + time.Millisecond, true},
+		{url.Values{}, 0, true},
+		{url.Values{}, time.Minute, true},
+		{url.Values{}, time.Minute + time.Second - time.Millisecond, true},
+		{url.Values{}, time.Minute + time.Second, false},
+		{url.Values{"exact": {"true"}}, -time.Millisecond, false},
+		{url.Values{"exact": {"true"}}, 0, true},
+		{url.Values{"exact": {"true"}}, time.Minute - time.Millisecond, true},
+		{url.Values{"exact": {"true"}}, time.Minute, false},
+		{url.Values{"exact": {"false"}}, time.Minute, true},
+		{url.Values{"slop": {"0"}}, 0, false},
+		{url.Values{"slop": {"0"}}, time.Millisecond, true},
+		{url.Values{"slop": {"0"}}, time.Minute, false},
+		{url.Values{"slop": {"30"}}, -29 * time.Second, true},
+		{url.Values{"slop": {"30"}}, time.Minute + 30*time.Second, false},
+	} {
+		qp, err := newQueryParams(tc.values)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.values, err)
+		}
+		if got := qp.inRange(ta.Add(tc.at), ta, tb); got != tc.want {
+			t.Errorf("%v: a message at %s got %v, want %v", tc.values, tc.at, got, tc.want)
+		}
+	}
+	for _, bad := range []url.Values{{"exact": {"yes"}}, {"exact": {"true"}, "slop": {"5"}}, {"slop": {"-1"}}, {"slop": {"901"}}} {
+		if _, err := newQueryParams(bad); err == nil {
+			t.Errorf("%v is accepted", bad)
+		}
+	}
+	//the queries of consecutive exact ranges send every message once
+	ar := newTestArchive(t, quarterFiles)
+	var got int
+	for a := time.Duration(0); a < 45*time.Minute; a += 7 * time.Minute {
+		values := testRange(a, a+7*time.Minute)
+		values.Set("exact", "true")
+		_, body, errs := testQuery(ar, values)
+		if len(errs) != 0 {
+			t.Fatalf("%s: %v", a, errs)
+		}
+		got += len(splitRecords(t, body))
+	}
+	if got != 45 {
+		t.Errorf("got %d messages in consecutive exact ranges, want 45", got)
+	}
+}
+
+func TestSlopQuery(t *testing.T) {
+	//a message every 10 seconds
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 90, step: 10 * time.Second},
+		{start: 15 * time.Minute, n: 90, step: 10 * time.Second},
+		{start: 30 * time.Minute, n: 90, step: 10 * time.Second},
+	})
+	for _, tc := range []struct {
+		values url.Values
+		msgs   int
+	}{
+		//the messages at the start and end are only included with some slop
+		{url.Values{"slop": {"0"}}, 5},
+		{url.Values{}, 7},
+		{url.Values{"slop": {"1"}}, 7},
+		{url.Values{"exact": {"true"}}, 6},
+		{url.Values{"slop": {"30"}}, 11},
+		//wider than the files of the range
+		{url.Values{"slop": {"600"}}, 125},
+	} {
+		values := testRange(20*time.Minute, 21*time.Minute)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%v: got code %d and errors %v", tc.values, h.Code, errs)
+		}
+		if n := len(splitRecords(t, body)); n != tc.msgs {
+			t.Errorf("%v: got %d messages, want %d", tc.values, n, tc.msgs)
+		}
+	}
+	for _, bad := range []url.Values{{"slop": {"901"}}, {"slop": {"x"}}, {"slop": {"5"}, "exact": {"true"}}} {
+		values := testRange(20*time.Minute, 21*time.Minute)
+		for k, v := range bad {
+			values[k] = v
+		}
+		if h, _, _ := testQuery(ar, values); h.Code != 400 {
+			t.Errorf("%v got code %d", bad, h.Code)
+		}
+	}
+}
+
+func TestEmptyExactRange(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ar.collectorstr = "emptyrange"
+	scanned := func() float64 {
+		return scrapeMetric(t, `bgparchive_scanned_bytes_total{collector="emptyrange",descriminator="updates"}`)
+	}
+	for _, tc := range []struct {
+		name    string
+		res     api.Resource
+		a, b    time.Duration
+		exact   string
+		msgs    int
+		scanned bool
+	}{
+		//start==end is the second around it without exact
+		{"zero width", ar, 10 * time.Minute, 10 * time.Minute, "false", 1, true},
+		{"zero width exact", ar, 10 * time.Minute, 10 * time.Minute, "true", 0, false},
+		{"zero width exact stats", NewFsarstat(ar.fsarchive), 10 * time.Minute, 10 * time.Minute, "true", -1, false}, //json
+		{"one second exact", ar, 10 * time.Minute, 10*time.Minute + time.Second, "true", 1, true},
+	} {
+		before := scanned()
+		values := testRange(tc.a, tc.b)
+		values.Set("exact", tc.exact)
+		h, body, errs := testQuery(tc.res, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+			continue
+		}
+		if tc.msgs >= 0 {
+			if n := len(splitRecords(t, body)); n != tc.msgs {
+				t.Errorf("%s: got %d messages, want %d", tc.name, n, tc.msgs)
+			}
+		}
+		if got := scanned() > before; got != tc.scanned {
+			t.Errorf("%s: got files scanned %v, want %v", tc.name, got, tc.scanned)
+		}
+	}
+}
+
+func TestASPathFilter(t *testing.T) {
+	//3356 15169 {64512 64513}
+	set := bgpAttr(0x40, ATTR_AS_PATH, []byte{AS_SEQUENCE, 2, 0, 0, 0x0d, 0x1c, 0, 0, 0x3b, 0x41, AS_SET, 2, 0, 0, 0xfc, 0x00, 0, 0, 0xfc, 0x01})
+	seq := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 174, 15169}, []string{"8.8.8.0/24"}, nil)
+	withset := mrtRecord(testTs(0), MRT_BGP4MP, BGP4MP_MESSAGE_AS4, bgp4mpBody(3356, "192.0.2.1", BGP_UPDATE, bgpUpdate(nil, []string{"8.8.8.0/24"}, nil, set)))
+	//a 2 byte AS session with the path 3356 174 15169
+	body2 := []byte{0x0d, 0x1c, 0xfd, 0xe8, 0, 0, 0, AFI_IP, 192, 0, 2, 1, 10, 0, 0, 1}
+	msg2 := bgpUpdate(nil, []string{"8.8.8.0/24"}, nil, bgpAttr(0x40, ATTR_AS_PATH, []byte{AS_SEQUENCE, 3, 0x0d, 0x1c, 0, 0xae, 0x3b, 0x41}))
+	hdr2 := append(bytes.Repeat([]byte{0xff}, BGP_MARKER_LEN), 0, byte(BGP_HEADER_LEN+len(msg2)), BGP_UPDATE)
+	as2 := mrtRecord(testTs(0), MRT_BGP4MP, BGP4MP_MESSAGE, append(append(body2, hdr2...), msg2...))
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		rec    []byte
+		want   bool
+	}{
+		{"origin", url.Values{"aspath": {"origin:15169"}}, seq, true},
+		{"origin not transit", url.Values{"aspath": {"origin:174"}}, seq, false},
+		{"origin not peer", url.Values{"aspath": {"origin:3356"}}, seq, false},
+		{"transit", url.Values{"aspath": {"174"}}, seq, true},
+		{"contains", url.Values{"aspath": {"contains:AS3356"}}, seq, true},
+		{"contains origin", url.Values{"aspath": {"contains:15169"}}, seq, true},
+		{"not in the path", url.Values{"aspath": {"7018"}}, seq, false},
+		{"any of them", url.Values{"aspath": {"origin:174", "7018", "15169"}}, seq, true},
+		{"origin in the set", url.Values{"aspath": {"origin:64513"}}, withset, true},
+		{"origin before the set", url.Values{"aspath": {"origin:15169"}}, withset, false},
+		{"transit before the set", url.Values{"aspath": {"15169"}}, withset, true},
+		{"2 byte origin", url.Values{"aspath": {"origin:15169"}}, as2, true},
+		{"2 byte transit", url.Values{"aspath": {"174"}}, as2, true},
+		{"2 byte not in the path", url.Values{"aspath": {"origin:174"}}, as2, false},
+		{"and prefix", url.Values{"aspath": {"origin:15169"}, "prefix": {"8.8.0.0/16"}}, seq, true},
+		{"and other prefix", url.Values{"aspath": {"origin:15169"}, "prefix": {"9.9.9.0/24"}}, seq, false},
+	} {
+		qp, err := newQueryParams(tc.values)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := qp.match(tc.rec); got != tc.want {
+			t.Errorf("%s: %v got %v, want %v", tc.name, tc.values, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"transit:174", "origin:", "AS", "4294967296", "origin:as-15169"} {
+		if _, err := newQueryParams(url.Values{"aspath": {bad}}); err == nil {
+			t.Errorf("the aspath %q is accepted", bad)
+		}
+	}
+}
+
+//bgp4mpUpdate6 returns a BGP4MP_MESSAGE_AS4 update record from an IPv6 peer
+func bgp4mpUpdate6(ts uint32, peeras uint32, peer string, nlri []string) []byte {
+	body := bgp4mpBody(peeras, "192.0.2.1", BGP_UPDATE, bgpUpdate([]uint32{peeras}, nlri, nil))
+	binary.BigEndian.PutUint16(body[10:], AFI_IP6)
+	addrs := append(append([]byte(nil), net.ParseIP(peer).To16()...), net.ParseIP("2001:db8::ffff").To16()...)
+	return mrtRecord(ts, MRT_BGP4MP, BGP4MP_MESSAGE_AS4, append(append(body[:12:12], addrs...), body[20:]...))
+}
+
+func TestPeerFilter(t *testing.T) {
+	var recs [][]byte
+	peers := []struct {
+		ip string
+		as uint32
+	}{{"192.0.2.1", 3356}, {"192.0.2.2", 174}, {"2001:db8::1", 6939}, {"192.0.2.3", 3356}}
+	for i := 0; i < 40; i++ {
+		p := peers[i%len(peers)]
+		if strings.Contains(p.ip, ":") {
+			recs = append(recs, bgp4mpUpdate6(testTs(time.Duration(i)*time.Second), p.as, p.ip, []string{"8.8.8.0/24"}))
+		} else {
+			recs = append(recs, bgp4mpUpdate(testTs(time.Duration(i)*time.Second), p.as, p.ip, nil, []string{"8.8.8.0/24"}, nil))
+		}
+	}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}, {start: 15 * time.Minute, n: 1}})
+	//want returns the records of the peers with the indexes
+	want := func(idx ...int) (b []byte) {
+		for i, rec := range recs {
+			for _, j := range idx {
+				if i%len(peers) == j {
+					b = append(b, rec...)
+				}
+			}
+		}
+		return
+	}
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		want   []byte
+	}{
+		{"no filter", nil, want(0, 1, 2, 3)},
+		{"ipv4 peer", url.Values{"peer": {"192.0.2.2"}}, want(1)},
+		{"ipv6 peer", url.Values{"peer": {"2001:db8::1"}}, want(2)},
+		{"two peers", url.Values{"peer": {"192.0.2.1", "2001:db8::1"}}, want(0, 2)},
+		{"peer asn", url.Values{"peeras": {"3356"}}, want(0, 3)},
+		{"peer asn prefix", url.Values{"peeras": {"AS174"}}, want(1)},
+		{"peer or asn", url.Values{"peer": {"192.0.2.2"}, "peeras": {"6939"}}, want(1, 2)},
+		{"other peer", url.Values{"peer": {"192.0.2.9"}}, nil},
+	} {
+		values := testRange(0, time.Minute)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+			continue
+		}
+		if !bytes.Equal(body, tc.want) {
+			t.Errorf("%s: got %d records, want %d", tc.name, len(splitRecords(t, body)), len(splitRecords(t, tc.want)))
+		}
+	}
+	for _, bad := range []url.Values{{"peer": {"192.0.2"}}, {"peeras": {"AS"}}, {"peeras": {"4294967296"}}} {
+		if _, err := newQueryParams(bad); err == nil {
+			t.Errorf("the parameters %v are accepted", bad)
+		}
+	}
+}
+
+func TestDedupSeam(t *testing.T) {
+	seam := bgp4mpUpdate(testTs(15*time.Minute), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil)
+	//another record of the same second that is not a duplicate
+	other := bgp4mpUpdate(testTs(15*time.Minute), 174, "192.0.2.2", []uint32{174, 15169}, []string{"8.8.8.0/24"}, nil)
+	first := append((testFile{start: 0, n: 15, step: time.Minute}).records(), seam)
+	second := append([][]byte{seam, other}, (testFile{start: 16 * time.Minute, n: 14, step: time.Minute}).records()...)
+	ar := newTestArchive(t, []testFile{{start: 0, recs: first}, {start: 15 * time.Minute, recs: second}})
+	count := func(body []byte, rec []byte) (n int) {
+		for _, r := range splitRecords(t, body) {
+			if bytes.Equal(r, rec) {
+				n++
+			}
+		}
+		return
+	}
+	for _, tc := range []struct {
+		dedup string
+		n     int
+	}{
+		{"false", 2},
+		{"true", 1},
+	} {
+		values := testRange(0, 30*time.Minute-time.Second)
+		values.Set("dedup", tc.dedup)
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("dedup=%s: got code %d and errors %v", tc.dedup, h.Code, errs)
+		}
+		if n := count(body, seam); n != tc.n {
+			t.Errorf("dedup=%s: got the record at the seam %d times, want %d", tc.dedup, n, tc.n)
+		}
+		if n := count(body, other); n != 1 {
+			t.Errorf("dedup=%s: got the other record of the second %d times", tc.dedup, n)
+		}
+		if n := len(splitRecords(t, body)); n != 30+tc.n {
+			t.Errorf("dedup=%s: got %d records, want %d", tc.dedup, n, 30+tc.n)
+		}
+	}
+}
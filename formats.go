@@ -0,0 +1,87 @@
+package bgparchive
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//outputFormat is a format the messages of the raw MRT queries can be sent
+//in with format=<name>
+type outputFormat struct {
+	newTransformer func(*queryParams) transformer
+	contentType    string //empty is the default of the api
+	text           bool   //sent as text messages on the websocket
+}
+
+var (
+	formatsmu sync.RWMutex
+	formats   = map[string]*outputFormat{
+		"mrt":  {newTransformer: newRawTransformer},
+		"json": {newTransformer: newJsonLineFormat, contentType: "application/x-ndjson", text: true},
+	}
+)
+
+//RegisterFormat adds an output format that is selected with format=name.
+//Every raw MRT record that is sent goes through fn, after the record is cut
+//to its headers if headersonly=true is also requested. A record that fn
+//returns an error for is not sent and the error is reported to the client.
+//Text formats are sent as text messages on the websocket. It should be
+//called before the archives are served.
+func RegisterFormat(name, contentType string, text bool, fn func([]byte) ([]byte, error)) error {
+	if name == "" || fn == nil {
+		return errors.New("a format needs a name and a transformer")
+	}
+	formatsmu.Lock()
+	defer formatsmu.Unlock()
+	if _, ok := formats[name]; ok {
+		return fmt.Errorf("format:%s is already registered", name)
+	}
+	formats[name] = &outputFormat{
+		newTransformer: func(qp *queryParams) transformer {
+			if qp.hdrsonly {
+				hdr := newHeaderTransformer()
+				return func(a []byte) ([]byte, error) {
+					a, err := hdr(a)
+					if err != nil {
+						return nil, err
+					}
+					return fn(a)
+				}
+			}
+			return fn
+		},
+		contentType: contentType,
+		text:        text,
+	}
+	return nil
+}
+
+//lookupFormat returns the output format of a format value. Empty is mrt.
+func lookupFormat(name string) (*outputFormat, bool) {
+	if name == "" {
+		name = "mrt"
+	}
+	formatsmu.RLock()
+	defer formatsmu.RUnlock()
+	f, ok := formats[name]
+	return f, ok
+}
+
+//formatNames lists the registered formats for the errors
+func formatNames() string {
+	formatsmu.RLock()
+	defer formatsmu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newJsonLineFormat(qp *queryParams) transformer {
+	return newJsonLineTransformer(qp.hdrsonly)
+}
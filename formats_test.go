@@ -0,0 +1,102 @@
+package bgparchive
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errtestformat = errors.New("test format error")
+
+//registerTestFormats registers the formats of the tests once, so that
+//they survive -count
+func registerTestFormats(t *testing.T) {
+	for name, fn := range map[string]func([]byte) ([]byte, error){
+		"testlen": func(a []byte) ([]byte, error) {
+			return []byte(fmt.Sprintf("%d\n", len(a))), nil
+		},
+		"testfail": func(a []byte) ([]byte, error) {
+			return nil, errtestformat
+		},
+	} {
+		if _, ok := lookupFormat(name); ok {
+			continue
+		}
+		if err := RegisterFormat(name, "text/plain", true, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	registerTestFormats(t)
+	fn := func(a []byte) ([]byte, error) { return a, nil }
+	for _, tc := range []struct {
+		name string
+		fn   func([]byte) ([]byte, error)
+		ok   bool
+	}{
+		{"", fn, false},
+		{"nofn", nil, false},
+		{"mrt", fn, false},
+		{"json", fn, false},
+		{"testlen", fn, false},
+	} {
+		if err := RegisterFormat(tc.name, "", false, tc.fn); (err == nil) != tc.ok {
+			t.Errorf("%q: got the error %v", tc.name, err)
+		}
+	}
+	if f, ok := lookupFormat(""); !ok || f != formats["mrt"] {
+		t.Errorf("the empty format is not mrt")
+	}
+}
+
+func TestRegisteredFormatQuery(t *testing.T) {
+	registerTestFormats(t)
+	ar := newTestArchive(t, quarterFiles)
+	rec := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil)
+	hdr, err := newHeaderTransformer()(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		format, headersonly string
+		code                int
+		ctype               string
+		body                string
+		errs                int
+	}{
+		{"testlen", "", 200, "text/plain", fmt.Sprintf("%d\n%d\n%d\n", len(rec), len(rec), len(rec)), 0},
+		{"testlen", "true", 200, "text/plain", fmt.Sprintf("%d\n%d\n%d\n", len(hdr), len(hdr), len(hdr)), 0},
+		{"testfail", "", 200, "text/plain", "", 3},
+		{"json", "", 200, "application/x-ndjson", "", 0},
+		{"nosuchformat", "", 400, "", "", 1},
+	} {
+		//the end is inclusive, so that is 3 records
+		values := testRange(time.Minute, 3*time.Minute)
+		values.Set("format", tc.format)
+		if tc.headersonly != "" {
+			values.Set("headersonly", tc.headersonly)
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != tc.code || len(errs) != tc.errs {
+			t.Errorf("%s: got code %d and errors %v", tc.format, h.Code, errs)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if h.ContentType != tc.ctype {
+			t.Errorf("%s: got the content type %q, want %q", tc.format, h.ContentType, tc.ctype)
+		}
+		if tc.body != "" && string(body) != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.format, body, tc.body)
+		}
+		for _, err := range errs {
+			if err != errtestformat {
+				t.Errorf("%s: got the error %v", tc.format, err)
+			}
+		}
+	}
+}
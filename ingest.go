@@ -0,0 +1,159 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/CSUNetSec/bgparchive/api"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//MAX_INGEST_SIZE is the largest file in bytes that can be uploaded to an archive
+const MAX_INGEST_SIZE = 1 << 30
+
+var (
+	errreadonly     = errors.New("the archive is read only")
+	errlocalonly    = errors.New("only archives on the local filesystem can be written to")
+	erringestname   = errors.New("name should be the file name of the upload, without a path")
+	erringestpat    = errors.New("the name of the upload doesn't match the patterns of the archive")
+	erringesttoobig = errors.New("the upload is larger than the max file size of the archive")
+	erringestbad    = errors.New("the upload is not an MRT file that can be dated")
+	erringestexists = errors.New("a file with this name is already in the archive")
+)
+
+//ArchiveIngest lets an operator upload MRT files to a writable archive, instead
+//of copying them to its directory. The file is dated like a scan would, put in
+//the year and month dir of its first date and added to the archive right away.
+//Requests must carry the shared secret token in an Authorization: Bearer header.
+type ArchiveIngest struct {
+	ar    *fsarchive
+	token string
+	api.GetNotAllowed
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+//NewArchiveIngest returns the upload resource of an archive. An empty token
+//rejects every request, and so does an archive that is not writable.
+func NewArchiveIngest(ar *fsarchive, token string) *ArchiveIngest {
+	return &ArchiveIngest{ar: ar, token: token}
+}
+
+//IngestResult is a file that was added to an archive by an upload
+type IngestResult struct {
+	Collector     string    `json:"collector"`
+	Descriminator string    `json:"descriminator"`
+	Path          string    `json:"path"`
+	Start         time.Time `json:"start"`
+	Size          int64     `json:"size"`
+}
+
+//PostBody stores the body of the request as the file of the name parameter.
+//The file is written next to the archive dirs with a temporary suffix, so that
+//scans and watches ignore it, and only linked into its month dir once it is
+//dated. The reply is sent once the archive has added it.
+func (ai *ArchiveIngest) PostBody(body io.Reader, values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	h := api.HdrReply{Code: 200, ContentType: "application/json"}
+	res, err := ai.store(body, values)
+	if err != nil {
+		h.Code = ingestCode(err)
+		countRequestError(h.Code)
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}()
+		return h, retc
+	}
+	go func() {
+		defer close(retc)
+		infof("ingest from %s: adding file:%s to archive:%s", values.Get("remoteaddr"), res.Path, ai.ar.descriminator)
+		if !ai.ar.requestDone("ADD " + res.Path) {
+			//the next scan of the archive will find the file
+			retc <- api.Reply{Data: nil, Err: errstopped}
+			return
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			retc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		retc <- api.Reply{Data: append(b, '\n'), Err: nil}
+	}()
+	return h, retc
+}
+
+//store writes the upload to the archive dir and returns where it was put
+func (ai *ArchiveIngest) store(body io.Reader, values url.Values) (res IngestResult, err error) {
+	ar := ai.ar
+	if !bearerAuthorized(values, ai.token) {
+		warnf("unauthorized ingest request from %s", values.Get("remoteaddr"))
+		return res, errunauth
+	}
+	if !ar.writable {
+		return res, errreadonly
+	}
+	if _, ok := ar.fs.(localFS); !ok {
+		return res, errlocalonly
+	}
+	name := values.Get("name")
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || isTempFile(name) {
+		return res, erringestname
+	}
+	tmp, err := ioutil.TempFile(ar.rootpathstr, "ingest-*.part")
+	if err != nil {
+		return res, err
+	}
+	defer os.Remove(tmp.Name())
+	sz, err := io.Copy(tmp, io.LimitReader(body, MAX_INGEST_SIZE+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return res, err
+	}
+	if sz > MAX_INGEST_SIZE {
+		return res, erringesttoobig
+	}
+	sdate, err := getFirstDate(ar.fs, tmp.Name())
+	if err != nil {
+		return res, erringestbad
+	}
+	dir := filepath.Join(ar.rootpathstr, filepath.FromSlash(sdate.UTC().Format(ar.dirlayouts[0])))
+	dest := filepath.Join(dir, name)
+	if !ar.matchesPattern(dest) {
+		return res, erringestpat
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return res, err
+	}
+	//unlike a rename, a link doesn't replace a file that is already there
+	if err := os.Link(tmp.Name(), dest); err != nil {
+		if os.IsExist(err) {
+			return res, erringestexists
+		}
+		return res, err
+	}
+	return IngestResult{Collector: ar.collectorstr, Descriminator: ar.descriminator, Path: dest, Start: sdate, Size: sz}, nil
+}
+
+//ingestCode is httpCode for the errors of the uploads
+func ingestCode(err error) int {
+	switch err {
+	case errreadonly, errlocalonly:
+		return 403
+	case erringestexists:
+		return 409
+	case erringesttoobig:
+		return 413
+	case erringestname, erringestpat, erringestbad, errunauth:
+		return httpCode(err)
+	}
+	return 500
+}
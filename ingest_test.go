@@ -0,0 +1,101 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testUpload posts the data to the ingest resource and returns the code and the errors
+func testUpload(ai *ArchiveIngest, name, token string, data []byte) (int, []byte, []error) {
+	values := url.Values{"name": {name}, "remoteaddr": {"127.0.0.1"}}
+	if token != "" {
+		values.Set("authorization", "Bearer "+token)
+	}
+	h, retc := ai.PostBody(bytes.NewReader(data), values)
+	var (
+		body []byte
+		errs []error
+	)
+	for r := range retc {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+			continue
+		}
+		body = append(body, r.Data...)
+	}
+	return h.Code, body, errs
+}
+
+func TestIngest(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ar.SetWritable(true)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	defer wg.Wait()
+	defer ar.Close()
+	ai := NewArchiveIngest(ar.fsarchive, "secret")
+	var upload []byte
+	for _, rec := range (testFile{start: 45 * time.Minute, n: 15, step: time.Minute}).records() {
+		upload = append(upload, rec...)
+	}
+	tests := []struct {
+		name  string
+		token string
+		data  []byte
+		code  int
+	}{
+		{"updates.20130101.0045", "wrong", upload, 401},
+		{"../updates.20130101.0045", "secret", upload, 400},
+		{"updates.20130101.0045", "secret", []byte("not an MRT file"), 400},
+		{"updates.20130101.0045", "secret", upload, 200},
+		{"updates.20130101.0045", "secret", upload, 409},
+	}
+	for _, tt := range tests {
+		code, body, errs := testUpload(ai, tt.name, tt.token, tt.data)
+		if code != tt.code {
+			t.Errorf("upload of %s with token %s: got code %d and errors %v, want %d", tt.name, tt.token, code, errs, tt.code)
+			continue
+		}
+		if code != 200 {
+			continue
+		}
+		var res IngestResult
+		if err := json.Unmarshal(body, &res); err != nil || !res.Start.Equal(testEpoch.Add(45*time.Minute)) || res.Size != int64(len(upload)) {
+			t.Errorf("upload of %s: got %s and error %v", tt.name, body, err)
+		}
+	}
+	//the uploaded file is queried right away
+	h, body, errs := testQuery(ar, testRange(45*time.Minute, 60*time.Minute-time.Second))
+	if h.Code != 200 || len(errs) != 0 || !bytes.Equal(body, upload) {
+		t.Errorf("the query of the upload got code %d, %d bytes and errors %v", h.Code, len(body), errs)
+	}
+}
+
+func TestIngestStopped(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ar.SetWritable(true)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	ar.Close()
+	wg.Wait()
+	var upload []byte
+	for _, rec := range (testFile{start: 45 * time.Minute, n: 15, step: time.Minute}).records() {
+		upload = append(upload, rec...)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, _, errs := testUpload(NewArchiveIngest(ar.fsarchive, "secret"), "updates.20130101.0045", "secret", upload); len(errs) != 1 || errs[0] != errstopped {
+			t.Errorf("an upload to a stopped archive got errors %v", errs)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("an upload to a stopped archive blocked")
+	}
+}
@@ -0,0 +1,53 @@
+package bgparchive
+
+import (
+	"fmt"
+	"github.com/CSUNetSec/bgparchive/api"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+//the log levels, from the most verbose
+const (
+	LOG_DEBUG = iota //every step of the queries and the continuous pulls
+	LOG_INFO         //the scans, the clients and the files added to the archives
+	LOG_WARN         //the errors of the files, the scans and the queries
+)
+
+var (
+	loglevel  int32 = LOG_INFO //accessed atomically
+	loglevels       = []string{"debug", "info", "warn"}
+)
+
+//SetLogLevel sets the least severe level that is logged, by its name.
+//The default is info. The debug level also logs every HTTP request.
+func SetLogLevel(a string) error {
+	for lvl, name := range loglevels {
+		if strings.EqualFold(a, name) {
+			atomic.StoreInt32(&loglevel, int32(lvl))
+			api.SetDebug(lvl == LOG_DEBUG)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level:%s. should be one of %s", a, strings.Join(loglevels, ", "))
+}
+
+func logf(lvl int, format string, v ...interface{}) {
+	if int32(lvl) < atomic.LoadInt32(&loglevel) {
+		return
+	}
+	log.Output(3, fmt.Sprintf(format, v...))
+}
+
+func debugf(format string, v ...interface{}) {
+	logf(LOG_DEBUG, format, v...)
+}
+
+func infof(format string, v ...interface{}) {
+	logf(LOG_INFO, format, v...)
+}
+
+func warnf(format string, v ...interface{}) {
+	logf(LOG_WARN, format, v...)
+}
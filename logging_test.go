@@ -0,0 +1,76 @@
+package bgparchive
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lockedBuffer is a bytes.Buffer that the log of other goroutines can write to
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Reset() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.buf.Reset()
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func TestLogLevels(t *testing.T) {
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel("info")
+	ar := newTestArchive(t, quarterFiles[:1])
+	for _, tc := range []struct {
+		level string
+		want  []string //the lines that are logged
+		not   []string //the lines that are not
+	}{
+		{"debug", []string{"a debug line", "an info line", "a warn line", "opening:"}, nil},
+		{"info", []string{"an info line", "a warn line"}, []string{"a debug line", "opening:"}},
+		{"warn", []string{"a warn line"}, []string{"a debug line", "an info line", "opening:"}},
+	} {
+		if err := SetLogLevel(tc.level); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		debugf("a debug line")
+		infof("an info line")
+		warnf("a warn line")
+		//the per file lines of a query
+		testQuery(ar, testRange(time.Minute, 14*time.Minute))
+		out := buf.String()
+		for _, w := range tc.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%s: %q is not logged", tc.level, w)
+			}
+		}
+		for _, n := range tc.not {
+			if strings.Contains(out, n) {
+				t.Errorf("%s: %q is logged", tc.level, n)
+			}
+		}
+	}
+	if err := SetLogLevel("verbose"); err == nil {
+		t.Error("an unknown level is accepted")
+	}
+}
@@ -0,0 +1,112 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	errmanifest   = errors.New("manifest describes the messages of a query. it can't be used with bundle")
+	errnomanifest = errors.New("manifests are only served by the raw MRT archives")
+)
+
+//QueryManifest describes what a query returns, so that a download can be
+//told apart from others and repeated. The records and bytes are those of the
+//messages that match the query, before its limit. Params are the parameters
+//of the query that change its messages, with since replaced by its range.
+type QueryManifest struct {
+	Collector     string              `json:"collector"`
+	Descriminator string              `json:"descriminator"`
+	Ranges        []ManifestRange     `json:"ranges"`
+	Params        map[string][]string `json:"params"`
+	Files         []ManifestFile      `json:"files"`
+	Records       int64               `json:"records"`
+	Bytes         int64               `json:"bytes"`
+}
+
+//ManifestRange is a range of a query
+type ManifestRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+//ManifestFile is an archive file with messages of a query. Its end is its
+//start plus the timedelta of the archive.
+type ManifestFile struct {
+	Name    string    `json:"name"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Size    int64     `json:"size"`
+	Records int64     `json:"records"`
+	Bytes   int64     `json:"bytes"`
+}
+
+//sendManifest scans the files of the ranges like the query would, one at a
+//time, and sends the manifest of the query once they are all counted.
+func (ar *fsarchive) sendManifest(ranges [][2]time.Time, values url.Values, qp *queryParams, rc chan api.Reply, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m := QueryManifest{Collector: ar.collectorstr, Descriminator: ar.descriminator, Params: make(map[string][]string)}
+		for k, v := range values {
+			if !cacheIgnoredValues[k] && k != "manifest" {
+				m.Params[k] = v
+			}
+		}
+		files := make(map[string]int) //index in m.Files, since the ranges can share files
+		quit := make(chan struct{})
+		defer close(quit)
+		for _, r := range ranges {
+			m.Ranges = append(m.Ranges, ManifestRange{Start: r[0], End: r[1]})
+			ef, i, j, err := ar.getFileIndexRange(qp.fileRange(r[0], r[1]))
+			if err != nil {
+				continue
+			}
+			if qp.emptyRange(r[0], r[1]) {
+				j = i
+			}
+			for k := i; k < j; k++ {
+				in := make(chan msgReply)
+				go func(ef ArchEntryFile) {
+					defer close(in)
+					scanFile(ar, ef, r[0], r[1], qp, nil, in, quit)
+				}(ef[k])
+				var recs, nb int64
+				for rep := range in {
+					if rep.Err == nil {
+						recs++
+						nb += int64(len(rep.Data))
+					}
+				}
+				if qp.cancelled() {
+					return
+				}
+				//like the file before the range, that is only scanned for its last messages
+				if recs == 0 {
+					continue
+				}
+				n, ok := files[ef[k].Path]
+				if !ok {
+					n = len(m.Files)
+					files[ef[k].Path] = n
+					m.Files = append(m.Files, ManifestFile{Name: filepath.Base(ef[k].Path), Start: ef[k].Sdate, End: ef[k].Sdate.Add(ar.timedelta), Size: ef[k].Sz})
+				}
+				m.Files[n].Records += recs
+				m.Files[n].Bytes += nb
+				m.Records += recs
+				m.Bytes += nb
+			}
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			rc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		rc <- api.Reply{Data: append(b, '\n'), Err: nil}
+	}()
+}
@@ -0,0 +1,88 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestFiles(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	tests := []struct {
+		name    string
+		a, b    time.Duration
+		params  map[string]string
+		files   []string
+		records int64
+	}{
+		{"in a file", 16 * time.Minute, 29 * time.Minute, nil, []string{ef[1].Path}, 14},
+		{"across files", 10 * time.Minute, 20 * time.Minute, nil, []string{ef[0].Path, ef[1].Path}, 11},
+		{"at the start of a file", 15 * time.Minute, 20 * time.Minute, map[string]string{"exact": "true"}, []string{ef[1].Path}, 5},
+		{"no matches", 16 * time.Minute, 29 * time.Minute, map[string]string{"peeras": "64512"}, nil, 0},
+	}
+	for _, tt := range tests {
+		values := testRange(tt.a, tt.b)
+		values.Set("manifest", "true")
+		for k, v := range tt.params {
+			values.Set(k, v)
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tt.name, h.Code, errs)
+			continue
+		}
+		var m QueryManifest
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var names []string
+		for _, f := range m.Files {
+			names = append(names, f.Name)
+		}
+		if len(names) != len(tt.files) {
+			t.Errorf("%s: got files %v, want %v", tt.name, names, tt.files)
+		} else {
+			for k := range names {
+				if names[k] != filepath.Base(tt.files[k]) {
+					t.Errorf("%s: got files %v, want %v", tt.name, names, tt.files)
+					break
+				}
+			}
+		}
+		if m.Records != tt.records {
+			t.Errorf("%s: got %d records, want %d", tt.name, m.Records, tt.records)
+		}
+	}
+}
+
+func TestManifestNotCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SetResultCache(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { resultcache = nil }()
+	ar := newTestArchive(t, quarterFiles)
+	for k := 0; k < 2; k++ {
+		values := testRange(16*time.Minute, 29*time.Minute)
+		values.Set("manifest", "true")
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("got code %d and errors %v", h.Code, errs)
+		}
+		if h.Cache != "" || h.ContentType != "application/json" {
+			t.Errorf("query %d: got cache %q and content type %q", k, h.Cache, h.ContentType)
+		}
+		if !json.Valid(body) {
+			t.Errorf("query %d: the manifest is not JSON", k)
+		}
+	}
+}
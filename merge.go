@@ -0,0 +1,130 @@
+package bgparchive
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+//mergeSrc is a file being merged and its next reply
+type mergeSrc struct {
+	in   chan msgReply
+	head msgReply
+	n    int //order the file was opened in, so that ties keep the file order
+}
+
+//mergeHeap orders the files being merged by the timestamp of their next reply.
+//Errors go first since they are sent as soon as they show up.
+type mergeHeap struct {
+	srcs []*mergeSrc
+	desc bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.srcs)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.srcs[i], h.srcs[j]
+	if (a.head.Err != nil) != (b.head.Err != nil) {
+		return a.head.Err != nil
+	}
+	ta, tb := a.head.ts, b.head.ts
+	if ta != tb {
+		return (!h.desc && ta < tb) || (h.desc && ta > tb)
+	}
+	return a.n < b.n
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.srcs[i], h.srcs[j] = h.srcs[j], h.srcs[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.srcs = append(h.srcs, x.(*mergeSrc))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.srcs[len(h.srcs)-1]
+	h.srcs = h.srcs[:len(h.srcs)-1]
+	return last
+}
+
+//mergeFiles sends the messages of the files (in ascending order) on out ordered
+//by their MRT timestamps, for queries with sorted=true. Adjacent files can overlap
+//by a few records, so sending them one after the other is not strictly ordered.
+//
+//A file is only opened once the merge reaches its first date (or in descending
+//order the end of its timedelta), so usually just one or two files are scanned
+//at a time and the memory use is that of the default order. The price is that
+//the next files aren't scanned ahead while the current one is sent, so the
+//messages come out slower than in the default order. The scanners of the open
+//files are not buffered either, so each one holds just its next message and a
+//range of many large files takes memory by the files open, not by the messages.
+//In descending order a file is still read whole before its last message is known.
+//
+//The messages are ordered by the timestamps the scanners carry along, so they
+//are transformed by the scanners. It returns the number of bytes scanned.
+func mergeFiles(ar *fsarchive, files TimeEntrySlice, ta, tb time.Time, qp *queryParams, trans transformer, out chan<- msgReply, quit <-chan struct{}) int64 {
+	var (
+		scanned int64
+		next    int //files opened so far
+	)
+	desc := qp.isDesc()
+	active := &mergeHeap{desc: desc}
+	file := func(n int) ArchEntryFile {
+		if desc {
+			return files[len(files)-1-n]
+		}
+		return files[n]
+	}
+	open := func() {
+		ef := file(next)
+		src := &mergeSrc{in: make(chan msgReply), n: next}
+		next++
+		go func() {
+			defer close(src.in)
+			atomic.AddInt64(&scanned, scanFile(ar, ef, ta, tb, qp, trans, src.in, quit))
+		}()
+		var ok bool
+		if src.head, ok = <-src.in; ok {
+			heap.Push(active, src)
+		}
+	}
+	//needed is true if the next file could have messages that go before t
+	needed := func(t time.Time) bool {
+		if next == len(files) {
+			return false
+		}
+		if desc {
+			return !file(next).Sdate.Add(ar.timedelta).Before(t)
+		}
+		return !file(next).Sdate.After(t)
+	}
+	for {
+		if active.Len() == 0 {
+			if next == len(files) {
+				return atomic.LoadInt64(&scanned)
+			}
+			open()
+			continue
+		}
+		best := active.srcs[0]
+		r := best.head
+		if r.Err == nil && needed(time.Unix(int64(r.ts), 0)) {
+			open()
+			continue
+		}
+		var ok bool
+		if best.head, ok = <-best.in; ok {
+			heap.Fix(active, 0)
+		} else {
+			heap.Pop(active)
+		}
+		select {
+		case out <- r:
+		case <-quit:
+			return atomic.LoadInt64(&scanned)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/url"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMergeFiles(t *testing.T) {
+	//every file after the first starts with a record of 30 seconds before it
+	var files []testFile
+	for k := 0; k < 6; k++ {
+		start := time.Duration(k) * 15 * time.Minute
+		var recs [][]byte
+		if k > 0 {
+			recs = append(recs, bgp4mpUpdate(testTs(start-30*time.Second), 174, "192.0.2.2", []uint32{174}, []string{"1.1.1.0/24"}, nil))
+		}
+		recs = append(recs, testFile{start: start, n: 15, step: time.Minute}.records()...)
+		files = append(files, testFile{start: start, recs: recs})
+	}
+	ar := newTestArchive(t, files)
+	cfs := &countingFS{archiveFS: ar.fs}
+	ar.fs = cfs
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		desc   bool
+	}{
+		{"ascending", url.Values{"sorted": {"true"}}, false},
+		{"descending", url.Values{"sorted": {"true"}, "order": {"desc"}}, true},
+	} {
+		cfs.max = 0
+		values := testRange(30*time.Second, 89*time.Minute)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		recs := splitRecords(t, body)
+		//the minutes from 1 to 89 and the 5 records before the files
+		if len(recs) != 89+5 {
+			t.Errorf("%s: got %d messages, want %d", tc.name, len(recs), 89+5)
+		}
+		for k := 1; k < len(recs); k++ {
+			a, b := binary.BigEndian.Uint32(recs[k-1]), binary.BigEndian.Uint32(recs[k])
+			if (!tc.desc && a > b) || (tc.desc && a < b) {
+				t.Errorf("%s: message %d at %d is out of order after %d", tc.name, k, b, a)
+				break
+			}
+		}
+		//a file is only opened once the merge gets to it
+		if cfs.max > 2 {
+			t.Errorf("%s: %d files were open at the same time", tc.name, cfs.max)
+		}
+	}
+}
+
+func TestMergeInterleaved(t *testing.T) {
+	//the even minutes in one file and the odd ones in the next
+	ar := newTestArchive(t, []testFile{
+		{start: 0, n: 15, step: 2 * time.Minute},
+		{start: time.Minute, n: 15, step: 2 * time.Minute},
+	})
+	for _, tc := range []struct {
+		name   string
+		sorted string
+	}{
+		{"file order", "false"},
+		{"sorted", "true"},
+	} {
+		values := testRange(0, 30*time.Minute)
+		values.Set("sorted", tc.sorted)
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		recs := splitRecords(t, body)
+		if len(recs) != 30 {
+			t.Errorf("%s: got %d messages, want 30", tc.name, len(recs))
+		}
+		inorder := true
+		for k := range recs {
+			if binary.BigEndian.Uint32(recs[k]) != testTs(time.Duration(k)*time.Minute) {
+				inorder = false
+			}
+		}
+		if inorder != (tc.sorted == "true") {
+			t.Errorf("%s: got the messages in order %v", tc.name, inorder)
+		}
+	}
+}
+
+//overlapFiles returns n files of 15 minutes of records every step, each one
+//starting 10 minutes after the last
+func overlapFiles(n int, step time.Duration) (files []testFile) {
+	for k := 0; k < n; k++ {
+		files = append(files, testFile{start: time.Duration(k) * 10 * time.Minute, n: int(15 * time.Minute / step), step: step})
+	}
+	return
+}
+
+func TestMergeReference(t *testing.T) {
+	ar := newTestArchive(t, overlapFiles(4, 7*time.Second))
+	values := testRange(0, 45*time.Minute)
+	h, body, errs := testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	//the messages in file order sorted by their timestamps, ties in file order
+	want := splitRecords(t, body)
+	sort.SliceStable(want, func(i, j int) bool {
+		return binary.BigEndian.Uint32(want[i]) < binary.BigEndian.Uint32(want[j])
+	})
+	values.Set("sorted", "true")
+	h, body, errs = testQuery(ar, values)
+	if h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("sorted: got code %d and errors %v", h.Code, errs)
+	}
+	got := splitRecords(t, body)
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for k := range got {
+		if !bytes.Equal(got[k], want[k]) {
+			t.Errorf("message %d at %d, want the one at %d", k, binary.BigEndian.Uint32(got[k]), binary.BigEndian.Uint32(want[k]))
+			break
+		}
+	}
+}
+
+//BenchmarkMergeFiles reports the most heap in use while the sorted reply of a
+//range of many files streams, which grows by the files open and not by the messages
+func BenchmarkMergeFiles(b *testing.B) {
+	ar := newTestArchive(b, overlapFiles(48, time.Second))
+	values := testRange(0, 8*time.Hour)
+	values.Set("sorted", "true")
+	values.Set("remoteaddr", "127.0.0.1")
+	b.ReportAllocs()
+	var (
+		ms   runtime.MemStats
+		peak uint64
+	)
+	for i := 0; i < b.N; i++ {
+		_, retc := ar.Get(values)
+		var n int64
+		for r := range retc {
+			if r.Err != nil {
+				b.Fatal(r.Err)
+			}
+			n += int64(len(r.Data))
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+		}
+		b.SetBytes(n)
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
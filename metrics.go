@@ -0,0 +1,82 @@
+package bgparchive
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//all the archive metrics are labeled by collector and descriminator
+//so that the updates and ribs archives of a collector can be told apart.
+var (
+	archiveLabels = []string{"collector", "descriminator"}
+
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgparchive",
+		Name:      "queries_total",
+		Help:      "Number of queries served.",
+	}, archiveLabels)
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bgparchive",
+		Name:      "query_duration_seconds",
+		Help:      "Time spent scanning the archive files for a query.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, archiveLabels)
+	bytesScanned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgparchive",
+		Name:      "scanned_bytes_total",
+		Help:      "Bytes of MRT records read from the archive files by queries.",
+	}, archiveLabels)
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgparchive",
+		Name:      "request_errors_total",
+		Help:      "Number of requests rejected before querying, by HTTP status code.",
+	}, []string{"code"})
+	contClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bgparchive",
+		Name:      "continuous_clients",
+		Help:      "Number of registered continuous pull clients.",
+	}, archiveLabels)
+	scanDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bgparchive",
+		Name:      "scan_duration_seconds",
+		Help:      "Time spent scanning or rescanning the archive filesystem.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, archiveLabels)
+	lastScan = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bgparchive",
+		Name:      "last_scan_timestamp_seconds",
+		Help:      "Unix time of the last successful scan of the archive.",
+	}, archiveLabels)
+
+	//MetricsRegistry holds all the archive metrics. It is exported so that
+	//programs embedding the archive can gather them in their own way.
+	MetricsRegistry = prometheus.NewRegistry()
+)
+
+func init() {
+	MetricsRegistry.MustRegister(queriesTotal, queryDuration, bytesScanned, requestErrors, contClients, scanDuration, lastScan)
+}
+
+//MetricsHandler returns the http.Handler that exposes MetricsRegistry
+//in the prometheus format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
+
+func countRequestError(code int) {
+	requestErrors.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func (fsa *fsarchive) observeQuery(startt time.Time, scanned int64) {
+	queriesTotal.WithLabelValues(fsa.collectorstr, fsa.descriminator).Inc()
+	queryDuration.WithLabelValues(fsa.collectorstr, fsa.descriminator).Observe(time.Since(startt).Seconds())
+	bytesScanned.WithLabelValues(fsa.collectorstr, fsa.descriminator).Add(float64(scanned))
+}
+
+func (fsa *fsarchive) observeScan(startt time.Time) {
+	scanDuration.WithLabelValues(fsa.collectorstr, fsa.descriminator).Observe(time.Since(startt).Seconds())
+	lastScan.WithLabelValues(fsa.collectorstr, fsa.descriminator).SetToCurrentTime()
+}
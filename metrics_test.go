@@ -0,0 +1,74 @@
+package bgparchive
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//scrapeMetric returns the value of the metric line that starts with name,
+//which includes its labels, in the scrape of MetricsHandler. It is 0 if the
+//metric has not been set yet.
+func scrapeMetric(t *testing.T, name string) float64 {
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		if rest := strings.TrimPrefix(sc.Text(), name+" "); rest != sc.Text() {
+			v, err := strconv.ParseFloat(rest, 64)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	const (
+		labels   = `{collector="testcol",descriminator="updates"}`
+		queries  = "bgparchive_queries_total" + labels
+		scanned  = "bgparchive_scanned_bytes_total" + labels
+		duration = "bgparchive_query_duration_seconds_count" + labels
+		errors   = `bgparchive_request_errors_total{code="400"}`
+		clients  = "bgparchive_continuous_clients" + labels
+	)
+	ar := newTestArchive(t, quarterFiles)
+	ar.contctx.Serve()
+	defer ar.contctx.Stop()
+	before := map[string]float64{}
+	for _, m := range []string{queries, scanned, duration, errors} {
+		before[m] = scrapeMetric(t, m)
+	}
+	//a query that scans the files, and a malformed one
+	values := testRange(10*time.Minute, 20*time.Minute)
+	values.Set("peeras", "3356")
+	if h, _, errs := testQuery(ar, values); h.Code != 200 || len(errs) != 0 {
+		t.Fatalf("got code %d and errors %v", h.Code, errs)
+	}
+	if h, _, _ := testQuery(ar, url.Values{"start": {"yesterday"}, "end": {"today"}}); h.Code != 400 {
+		t.Fatalf("a malformed query got code %d", h.Code)
+	}
+	for _, m := range []string{queries, duration, errors} {
+		if got := scrapeMetric(t, m); got != before[m]+1 {
+			t.Errorf("%s: got %v, want %v", m, got, before[m]+1)
+		}
+	}
+	if got := scrapeMetric(t, scanned); got <= before[scanned] {
+		t.Errorf("%s: got %v, want more than %v", scanned, got, before[scanned])
+	}
+	//the continuous clients are counted as they begin
+	for k := 1; k <= 2; k++ {
+		if h, _, _ := testQuery(ar, url.Values{"continuous": {"begin"}}); h.Extra == "" {
+			t.Fatalf("got code %d and no id", h.Code)
+		}
+		if got := scrapeMetric(t, clients); got != float64(k) {
+			t.Errorf("%s: got %v, want %d", clients, got, k)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package bgparchive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//OBJECT_TIMEOUT is how long a request to the object storage can take to answer.
+//reading the body of an answer is not limited.
+const OBJECT_TIMEOUT = 30 * time.Second
+
+//objectFS serves the files of an archive from an S3 (s3://bucket/prefix) or a
+//GCS (gs://bucket/prefix) bucket, through their common XML API. The paths
+//of the files are s3:// or gs:// URLs.
+//
+//Requests are signed with AWS signature version 4 if credentials are set in
+//the environment, and anonymous otherwise, which works for public buckets.
+//S3 uses AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+//AWS_REGION (us-east-1 by default). AWS_ENDPOINT_URL points s3:// at an S3
+//compatible store instead of AWS. GCS uses the HMAC keys in GCS_HMAC_ACCESS_ID
+//and GCS_HMAC_SECRET.
+type objectFS struct {
+	scheme  string
+	bucket  string
+	prefix  string
+	base    string //URL of the bucket, that keys are appended to
+	keyid   string
+	secret  string
+	token   string
+	region  string
+	service string
+	client  *http.Client
+}
+
+func newObjectFS(root string) *objectFS {
+	ofs := &objectFS{client: &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: OBJECT_TIMEOUT,
+	}}}
+	ofs.scheme, ofs.bucket, ofs.prefix = splitObjectURL(root)
+	switch ofs.scheme {
+	case "gs":
+		ofs.base = "https://storage.googleapis.com/" + ofs.bucket
+		ofs.keyid, ofs.secret = os.Getenv("GCS_HMAC_ACCESS_ID"), os.Getenv("GCS_HMAC_SECRET")
+		ofs.region, ofs.service = "auto", "storage"
+	default:
+		ofs.region, ofs.service = os.Getenv("AWS_REGION"), "s3"
+		if ofs.region == "" {
+			ofs.region = "us-east-1"
+		}
+		if ep := os.Getenv("AWS_ENDPOINT_URL"); ep != "" { //compatible stores want path style URLs
+			ofs.base = strings.TrimSuffix(ep, "/") + "/" + ofs.bucket
+		} else {
+			ofs.base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", ofs.bucket, ofs.region)
+		}
+		ofs.keyid, ofs.secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		ofs.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return ofs
+}
+
+//splitObjectURL splits scheme://bucket/key
+func splitObjectURL(a string) (scheme, bucket, key string) {
+	if i := strings.Index(a, "://"); i != -1 {
+		scheme, a = a[:i], a[i+3:]
+	}
+	if i := strings.Index(a, "/"); i != -1 {
+		return scheme, a[:i], a[i+1:]
+	}
+	return scheme, a, ""
+}
+
+func (ofs *objectFS) key(name string) string {
+	_, _, key := splitObjectURL(name)
+	return key
+}
+
+func (ofs *objectFS) name(key string) string {
+	return fmt.Sprintf("%s://%s/%s", ofs.scheme, ofs.bucket, key)
+}
+
+//do sends a request for the key, or for the bucket if the key is empty.
+//Only 200 and 206 answers are returned without an error.
+func (ofs *objectFS) do(method, key string, query url.Values, hdr http.Header) (*http.Response, error) {
+	u := ofs.base + "/" + (&url.URL{Path: key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if ofs.keyid != "" {
+		ofs.sign(req, time.Now().UTC())
+	}
+	resp, err := ofs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: method, Path: ofs.name(key), Err: os.ErrNotExist}
+		}
+		return nil, &os.PathError{Op: method, Path: ofs.name(key), Err: errors.New(resp.Status)}
+	}
+	return resp, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+//sign adds an AWS signature version 4 to a request without a body
+func (ofs *objectFS) sign(req *http.Request, now time.Time) {
+	amzdate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	if ofs.token != "" {
+		req.Header.Set("x-amz-security-token", ofs.token)
+	}
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonhdrs string
+	for _, k := range names {
+		canonhdrs += k + ":" + hdrs[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+	canonreq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery, //already sorted and escaped by do
+		canonhdrs,
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := strings.Join([]string{date, ofs.region, ofs.service, "aws4_request"}, "/")
+	reqhash := sha256.Sum256([]byte(canonreq))
+	tosign := strings.Join([]string{"AWS4-HMAC-SHA256", amzdate, scope, hex.EncodeToString(reqhash[:])}, "\n")
+	key := hmacSHA256([]byte("AWS4"+ofs.secret), date)
+	key = hmacSHA256(key, ofs.region)
+	key = hmacSHA256(key, ofs.service)
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		ofs.keyid, scope, signed, hex.EncodeToString(hmacSHA256(key, tosign))))
+}
+
+//objectInfo is the os.FileInfo of an object, or of a directory made up
+//from the slashes of the keys.
+type objectInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (oi objectInfo) Name() string       { return oi.name }
+func (oi objectInfo) Size() int64        { return oi.size }
+func (oi objectInfo) ModTime() time.Time { return oi.mtime }
+func (oi objectInfo) IsDir() bool        { return oi.dir }
+func (oi objectInfo) Sys() interface{}   { return nil }
+
+func (oi objectInfo) Mode() os.FileMode {
+	if oi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (ofs *objectFS) Stat(name string) (os.FileInfo, error) {
+	key := ofs.key(name)
+	resp, err := ofs.do("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{name: path.Base(key), size: resp.ContentLength, mtime: mtime}, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+//Walk lists all the objects under root and calls fn on them in the order
+//of their keys, and on the directories that their slashes make up before
+//their first object. The listing is done before fn is called.
+func (ofs *objectFS) Walk(root string, fn filepath.WalkFunc) error {
+	prefix := ofs.key(root)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var objs listBucketResult
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := ofs.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		objs.Contents = append(objs.Contents, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	if err := fn(root, objectInfo{name: path.Base(root), dir: true}, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	var (
+		seen    = make(map[string]bool) //dirs that fn has been called on
+		skipped []string                //dirs that fn returned SkipDir for
+	)
+	isSkipped := func(key string) bool {
+		for _, s := range skipped {
+			if strings.HasPrefix(key, s) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, o := range objs.Contents {
+		if strings.HasSuffix(o.Key, "/") || isSkipped(o.Key) { //placeholders of empty dirs
+			continue
+		}
+		//the dirs between the root and the object
+		parts := strings.Split(strings.TrimPrefix(o.Key, prefix), "/")
+		dir, skip := prefix, false
+		for _, p := range parts[:len(parts)-1] {
+			dir += p + "/"
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			err := fn(ofs.name(strings.TrimSuffix(dir, "/")), objectInfo{name: p, dir: true}, nil)
+			if err == filepath.SkipDir {
+				skipped, skip = append(skipped, dir), true
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if skip {
+			continue
+		}
+		err := fn(ofs.name(o.Key), objectInfo{name: path.Base(o.Key), size: o.Size, mtime: o.LastModified}, nil)
+		if err == filepath.SkipDir { //skips the rest of the dir of the object
+			skipped = append(skipped, dir)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ofs *objectFS) Open(name string) (archiveFile, error) {
+	fi, err := ofs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{ofs: ofs, name: name, info: fi}, nil
+}
+
+//objectFile reads an object with ranged GETs. Reads go through a single
+//request that is only reopened after a Seek.
+type objectFile struct {
+	ofs  *objectFS
+	name string
+	info os.FileInfo
+	off  int64
+	body io.ReadCloser
+}
+
+func (of *objectFile) Name() string {
+	return of.name
+}
+
+func (of *objectFile) Stat() (os.FileInfo, error) {
+	return of.info, nil
+}
+
+func (of *objectFile) get(from, to int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", from)
+	if to >= 0 {
+		rng += strconv.FormatInt(to, 10)
+	}
+	resp, err := of.ofs.do("GET", of.ofs.key(of.name), nil, http.Header{"Range": {rng}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (of *objectFile) Read(b []byte) (int, error) {
+	if of.off >= of.info.Size() {
+		return 0, io.EOF
+	}
+	if of.body == nil {
+		body, err := of.get(of.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		of.body = body
+	}
+	n, err := of.body.Read(b)
+	of.off += int64(n)
+	return n, err
+}
+
+func (of *objectFile) ReadAt(b []byte, off int64) (int, error) {
+	if off >= of.info.Size() {
+		return 0, io.EOF
+	}
+	body, err := of.get(off, off+int64(len(b))-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (of *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += of.off
+	case io.SeekEnd:
+		offset += of.info.Size()
+	}
+	if offset < 0 {
+		return of.off, fmt.Errorf("seek to negative offset in %s", of.name)
+	}
+	if offset != of.off && of.body != nil {
+		of.body.Close()
+		of.body = nil
+	}
+	of.off = offset
+	return offset, nil
+}
+
+func (of *objectFile) Close() error {
+	if of.body != nil {
+		//drain a little so that the connection can be reused
+		io.CopyN(ioutil.Discard, of.body, 4096)
+		return of.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//mockBucket is an S3 bucket in memory that answers the listings a page
+//of two objects at a time, and the HEAD and ranged GET requests of objects.
+type mockBucket struct {
+	name    string
+	objects map[string][]byte
+	mu      sync.Mutex
+	auths   []string //the Authorization headers of the requests
+}
+
+type mockListing struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (mb *mockBucket) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	mb.mu.Lock()
+	mb.auths = append(mb.auths, req.Header.Get("Authorization"))
+	mb.mu.Unlock()
+	if !strings.HasPrefix(req.URL.Path, "/"+mb.name+"/") {
+		http.NotFound(rw, req)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/"+mb.name+"/")
+	query := req.URL.Query()
+	if key == "" && query.Get("list-type") == "2" {
+		var keys []string
+		for k := range mb.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		from, _ := strconv.Atoi(query.Get("continuation-token"))
+		var res mockListing
+		for k := from; k < len(keys) && k < from+2; k++ {
+			res.Contents = append(res.Contents, struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}{keys[k], int64(len(mb.objects[keys[k]])), testEpoch})
+		}
+		if from+2 < len(keys) {
+			res.IsTruncated, res.NextContinuationToken = true, strconv.Itoa(from+2)
+		}
+		xml.NewEncoder(rw).Encode(res)
+		return
+	}
+	data, ok := mb.objects[key]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	//answers HEAD and Range requests
+	http.ServeContent(rw, req, key, testEpoch, bytes.NewReader(data))
+}
+
+//newMockBucket returns a bucket with the files under the prefix, served where
+//s3:// URLs point at
+func newMockBucket(t *testing.T, prefix string, files []testFile) *mockBucket {
+	mb := &mockBucket{name: "bucket", objects: make(map[string][]byte)}
+	for _, tf := range files {
+		var data []byte
+		for _, rec := range tf.records() {
+			data = append(data, rec...)
+		}
+		mb.objects[prefix+"/"+testEpoch.Add(tf.start).Format("2006.01")+"/"+tf.name()] = data
+	}
+	srv := httptest.NewServer(mb)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	return mb
+}
+
+func TestObjectStoreArchive(t *testing.T) {
+	//five files so that the listing takes three pages
+	files := append(quarterFiles, testFile{start: 45 * time.Minute, n: 15, step: time.Minute}, testFile{start: time.Hour, n: 15, step: time.Minute})
+	local := newTestArchive(t, files)
+	newMockBucket(t, "archive", files)
+	ar := NewMRTArchive("s3://bucket/archive", "updates", "testcol", 5, t.TempDir(), false)
+	ar.scan()
+	ar.setScanning(false)
+	ar.setEntryFiles(ar.tempentryfiles)
+	ef, lef := ar.getEntryFiles(), local.getEntryFiles()
+	if len(ef) != len(lef) {
+		t.Fatalf("got %d files, want %d", len(ef), len(lef))
+	}
+	for k := range ef {
+		if want := "s3://bucket/archive/2013.01/" + files[k].name(); ef[k].Path != want || !ef[k].Sdate.Equal(lef[k].Sdate) || ef[k].Sz != lef[k].Sz {
+			t.Errorf("got the file %s at %s of %d bytes, want %s at %s of %d bytes", ef[k].Path, ef[k].Sdate, ef[k].Sz, want, lef[k].Sdate, lef[k].Sz)
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		a, b   time.Duration
+		values map[string]string
+	}{
+		{"whole files", 15 * time.Minute, 45*time.Minute - time.Second, nil},
+		{"within files", 10 * time.Minute, 50 * time.Minute, nil},
+		{"filtered", 10 * time.Minute, 50 * time.Minute, map[string]string{"peeras": "3356"}},
+	} {
+		var bodies [2][]byte
+		for k, res := range []*mrtarchive{local, ar} {
+			values := testRange(tc.a, tc.b)
+			for p, v := range tc.values {
+				values.Set(p, v)
+			}
+			h, body, errs := testQuery(res, values)
+			if h.Code != 200 || len(errs) != 0 {
+				t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+			}
+			bodies[k] = body
+		}
+		if len(bodies[0]) == 0 || !bytes.Equal(bodies[0], bodies[1]) {
+			t.Errorf("%s: got %d bytes from the bucket, want the %d of the local files", tc.name, len(bodies[1]), len(bodies[0]))
+		}
+	}
+}
+
+func TestObjectStoreSigned(t *testing.T) {
+	mb := newMockBucket(t, "archive", quarterFiles[:1])
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	ofs := newArchiveFS("s3://bucket/archive")
+	var names []string
+	err := ofs.Walk("s3://bucket/archive", func(pathname string, fi os.FileInfo, err error) error {
+		if !fi.IsDir() {
+			names = append(names, pathname)
+		}
+		return err
+	})
+	if err != nil || len(names) != 1 {
+		t.Fatalf("got the files %v and the error %v", names, err)
+	}
+	if _, err := ofs.Stat("s3://bucket/archive/missing"); !os.IsNotExist(err) {
+		t.Errorf("a missing object got the error %v", err)
+	}
+	for _, auth := range mb.auths {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "Signature=") {
+			t.Errorf("got the Authorization %q", auth)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package bgparchive
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net"
+	"net/url"
+	"sort"
+)
+
+//PEERS_SAMPLE_FILES is how many of the most recent files without a peer
+//index are scanned by the peers resource.
+const PEERS_SAMPLE_FILES = 3
+
+//FilePeer is a BGP4MP peer that has records in an archive file
+type FilePeer struct {
+	IP net.IP
+	AS uint32
+}
+
+//PeerSet collects the distinct BGP4MP peers of the records of a file,
+//so that indextool can store them in the index.
+type PeerSet struct {
+	seen map[string]FilePeer
+}
+
+func NewPeerSet() *PeerSet {
+	return &PeerSet{seen: make(map[string]FilePeer)}
+}
+
+//Add adds the peer of the MRT record in data. Records that are not
+//BGP4MP are ignored, since peer filters never match them.
+func (ps *PeerSet) Add(data []byte) {
+	up, _, err := decodeBGP4MPHeader(data)
+	if err != nil {
+		return
+	}
+	ps.addPeer(FilePeer{IP: up.peerIP, AS: up.peerAS})
+}
+
+func (ps *PeerSet) addPeer(p FilePeer) {
+	key := string(p.IP.To16()) + string([]byte{byte(p.AS >> 24), byte(p.AS >> 16), byte(p.AS >> 8), byte(p.AS)})
+	if _, ok := ps.seen[key]; !ok {
+		ps.seen[key] = FilePeer{IP: append(net.IP(nil), p.IP...), AS: p.AS}
+	}
+}
+
+//Peers returns the peers added so far ordered by ASN and address
+func (ps *PeerSet) Peers() []FilePeer {
+	ret := make([]FilePeer, 0, len(ps.seen))
+	for _, p := range ps.seen {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].AS != ret[j].AS {
+			return ret[i].AS < ret[j].AS
+		}
+		return ret[i].IP.String() < ret[j].IP.String()
+	})
+	return ret
+}
+
+//mayHavePeers is false if the peers of the file are indexed and none of
+//them is a requested peer, so the file can be skipped by peer queries.
+func (qp *queryParams) mayHavePeers(ef ArchEntryFile) bool {
+	if qp == nil || !qp.filteringPeers() || !ef.PeersIndexed {
+		return true
+	}
+	for _, p := range ef.Peers {
+		for _, ip := range qp.peers {
+			if ip.Equal(p.IP) {
+				return true
+			}
+		}
+		for _, asn := range qp.peerases {
+			if asn == p.AS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//fsarpeers lists the BGP4MP peers that have records in an archive
+type fsarpeers struct {
+	*fsarchive
+	api.PutNotAllowed
+	api.PostNotAllowed
+	api.DeleteNotAllowed
+}
+
+func NewFsarpeers(a *fsarchive) *fsarpeers {
+	return &fsarpeers{fsarchive: a}
+}
+
+//ObservedPeer is a peer in the reply of the peers resource
+type ObservedPeer struct {
+	IP string `json:"ip"`
+	AS uint32 `json:"as"`
+}
+
+//PeersReply is the reply of the peers resource. Indexed is the number of
+//files whose peers came from the index and Sampled the number of files
+//without one that were scanned. If some files were neither, the peers
+//can be missing a few that only show up in them.
+type PeersReply struct {
+	Peers   []ObservedPeer `json:"peers"`
+	Files   int            `json:"files"`
+	Indexed int            `json:"indexed"`
+	Sampled int            `json:"sampled"`
+}
+
+func (fsp *fsarpeers) Get(values url.Values) (api.HdrReply, chan api.Reply) {
+	return fsp.GetContext(context.Background(), values)
+}
+
+//GetContext replies with the peers of the files of the start and end range,
+//or of all the files if they are not set.
+func (fsp *fsarpeers) GetContext(ctx context.Context, values url.Values) (api.HdrReply, chan api.Reply) {
+	retc := make(chan api.Reply)
+	files, err := fsp.peersFiles(values)
+	//scanning the files without an index is as much work as a query
+	sampling := err == nil && needsSampling(files)
+	if sampling && !acquireQuery() {
+		err = errbusy
+	}
+	if err != nil {
+		h := api.HdrReply{Code: httpCode(err)}
+		if err == errbusy {
+			h.RetryAfter = QUERY_RETRY_AFTER
+		}
+		countRequestError(h.Code)
+		go func() {
+			defer close(retc)
+			retc <- api.Reply{Data: nil, Err: codedError{error: err, code: h.Code}}
+		}()
+		return h, retc
+	}
+	go func() {
+		defer close(retc)
+		rep := fsp.peers(ctx, files)
+		if sampling {
+			releaseQuery()
+		}
+		b, err := json.Marshal(rep)
+		if err != nil {
+			retc <- api.Reply{Data: nil, Err: err}
+			return
+		}
+		select {
+		case retc <- api.Reply{Data: append(b, '\n'), Err: nil}:
+		case <-ctx.Done():
+		}
+	}()
+	return api.HdrReply{Code: 200, ContentType: "application/json"}, retc
+}
+
+//peersFiles returns the files of the start and end parameters
+func (fsp *fsarpeers) peersFiles(values url.Values) (TimeEntrySlice, error) {
+	astr, bstr := values.Get("start"), values.Get("end")
+	if astr == "" && bstr == "" {
+		return fsp.getQueryFiles(), nil
+	}
+	if astr == "" || bstr == "" {
+		return nil, errbadreq
+	}
+	loc, err := parseTZ(values.Get("tz"))
+	if err != nil {
+		return nil, err
+	}
+	ta, tb, err := parseTimePair(astr, bstr, loc)
+	if err != nil || tb.Before(ta) {
+		return nil, errbaddate
+	}
+	ef, i, j, err := fsp.getFileIndexRange(ta, tb)
+	if err != nil {
+		return nil, err
+	}
+	return ef[i:j], nil
+}
+
+//needsSampling is true if some of the files have no peer index
+func needsSampling(files TimeEntrySlice) bool {
+	for k := range files {
+		if !files[k].PeersIndexed {
+			return true
+		}
+	}
+	return false
+}
+
+//peers merges the indexed peers of the files with those of the most
+//recent files that have no peer index, which are scanned.
+func (fsp *fsarpeers) peers(ctx context.Context, files TimeEntrySlice) PeersReply {
+	ps := NewPeerSet()
+	rep := PeersReply{Files: len(files)}
+	for k := range files {
+		if !files[k].PeersIndexed {
+			continue
+		}
+		rep.Indexed++
+		for _, p := range files[k].Peers {
+			ps.addPeer(p)
+		}
+	}
+	for k := len(files) - 1; k >= 0 && rep.Sampled < PEERS_SAMPLE_FILES; k-- {
+		if files[k].PeersIndexed {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err := fsp.samplePeers(ctx, files[k], ps); err != nil {
+			warnf("failed sampling the peers of file:%s error:%s", files[k].Path, err)
+			continue
+		}
+		rep.Sampled++
+	}
+	peers := ps.Peers()
+	rep.Peers = make([]ObservedPeer, len(peers))
+	for k, p := range peers {
+		rep.Peers[k] = ObservedPeer{IP: p.IP.String(), AS: p.AS}
+	}
+	return rep
+}
+
+//samplePeers adds the peers of all the records of a file to ps
+func (fsp *fsarpeers) samplePeers(ctx context.Context, ef ArchEntryFile, ps *PeerSet) error {
+	file, err := fsp.fs.Open(ef.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := GetScanner(file)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ps.Add(scanner.Bytes())
+	}
+	return scanner.Err()
+}
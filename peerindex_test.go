@@ -0,0 +1,137 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeerSet(t *testing.T) {
+	ps := NewPeerSet()
+	for _, rec := range [][]byte{
+		bgp4mpUpdate(testTs(0), 3356, "192.0.2.2", []uint32{3356}, []string{"8.8.8.0/24"}, nil),
+		bgp4mpUpdate(testTs(0), 174, "192.0.2.3", []uint32{174}, []string{"8.8.8.0/24"}, nil),
+		bgp4mpStateChange(testTs(0), 3356, "192.0.2.1", 6, 1),
+		bgp4mpUpdate(testTs(0), 3356, "192.0.2.2", nil, nil, []string{"8.8.8.0/24"}),
+		//the same address with another ASN is another peer
+		bgp4mpUpdate(testTs(0), 65001, "192.0.2.2", []uint32{65001}, []string{"8.8.8.0/24"}, nil),
+		//not BGP4MP
+		ribRecord(testTs(0), TDV2_RIB_IPV4_UNICAST, "10.0.0.0/8", 1),
+	} {
+		ps.Add(rec)
+	}
+	want := []FilePeer{
+		{net.ParseIP("192.0.2.3").To4(), 174},
+		{net.ParseIP("192.0.2.1").To4(), 3356},
+		{net.ParseIP("192.0.2.2").To4(), 3356},
+		{net.ParseIP("192.0.2.2").To4(), 65001},
+	}
+	got := ps.Peers()
+	if len(got) != len(want) {
+		t.Fatalf("got the peers %v, want %v", got, want)
+	}
+	for k := range got {
+		if !got[k].IP.Equal(want[k].IP) || got[k].AS != want[k].AS {
+			t.Errorf("peer %d: got %v, want %v", k, got[k], want[k])
+		}
+	}
+}
+
+func TestPeerIndexSkips(t *testing.T) {
+	files := []testFile{
+		{start: 0, n: 15, step: time.Minute},
+		{start: 15 * time.Minute, n: 15, step: time.Minute},
+		{start: 30 * time.Minute, n: 15, step: time.Minute},
+	}
+	//the records of every file are of 192.0.2.1 AS3356, but the index of the
+	//second says they are of another peer so that skipping it shows
+	other := []FilePeer{{IP: net.ParseIP("192.0.2.9"), AS: 64512}}
+	for _, tc := range []struct {
+		name    string
+		values  url.Values
+		indexed bool
+		msgs    int
+	}{
+		{"not indexed", url.Values{"peeras": {"3356"}}, false, 45},
+		{"peer as", url.Values{"peeras": {"3356"}}, true, 30},
+		{"peer ip", url.Values{"peer": {"192.0.2.1"}}, true, 30},
+		{"indexed peer", url.Values{"peeras": {"64512"}}, true, 0},
+		{"no peer filter", url.Values{}, true, 45},
+	} {
+		ar := newTestArchive(t, files)
+		if tc.indexed {
+			ef := ar.getEntryFiles()
+			for k := range ef {
+				ef[k].Peers, ef[k].PeersIndexed = []FilePeer{{IP: net.ParseIP("192.0.2.1"), AS: 3356}}, true
+			}
+			ef[1].Peers = other
+			ar.setEntryFiles(ef)
+		}
+		values := testRange(0, 45*time.Minute-time.Second)
+		for k, v := range tc.values {
+			values[k] = v
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s: got code %d and errors %v", tc.name, h.Code, errs)
+		}
+		if n := len(splitRecords(t, body)); n != tc.msgs {
+			t.Errorf("%s: got %d messages, want %d", tc.name, n, tc.msgs)
+		}
+	}
+}
+
+func TestPeersSampling(t *testing.T) {
+	files := []testFile{
+		{start: 0, recs: [][]byte{bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356}, []string{"8.8.8.0/24"}, nil)}},
+		{start: 15 * time.Minute, recs: [][]byte{bgp4mpUpdate(testTs(15*time.Minute), 174, "192.0.2.2", []uint32{174}, []string{"8.8.8.0/24"}, nil)}},
+	}
+	for _, tc := range []struct {
+		name    string
+		indexed bool //the first file has a peer index
+		busy    bool //all the query slots are taken
+		code    int
+		want    PeersReply
+	}{
+		{"sampled", false, false, 200, PeersReply{Peers: []ObservedPeer{{"192.0.2.2", 174}, {"192.0.2.1", 3356}}, Files: 2, Sampled: 2}},
+		{"indexed and sampled", true, false, 200, PeersReply{Peers: []ObservedPeer{{"192.0.2.2", 174}, {"192.0.2.1", 65001}}, Files: 2, Indexed: 1, Sampled: 1}},
+		{"busy", false, true, 503, PeersReply{}},
+	} {
+		ar := newTestArchive(t, files)
+		if tc.indexed {
+			ef := ar.getQueryFiles()
+			ef[0].PeersIndexed, ef[0].Peers = true, []FilePeer{{IP: net.ParseIP("192.0.2.1"), AS: 65001}}
+		}
+		taken := 0
+		for tc.busy && acquireQuery() {
+			taken++
+		}
+		h, body, errs := testQuery(NewFsarpeers(ar.fsarchive), url.Values{})
+		for ; taken > 0; taken-- {
+			releaseQuery()
+		}
+		if h.Code != tc.code {
+			t.Errorf("%s: got code %d and errors %v, want %d", tc.name, h.Code, errs, tc.code)
+			continue
+		}
+		if n := len(querysem); n != 0 {
+			t.Errorf("%s: %d query slots are still taken", tc.name, n)
+		}
+		if tc.code != 200 {
+			if h.RetryAfter == 0 {
+				t.Errorf("%s: no Retry-After", tc.name)
+			}
+			continue
+		}
+		var got PeersReply
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%s: %s in %s", tc.name, err, body)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
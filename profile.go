@@ -0,0 +1,125 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errprofile = errors.New("profile times the messages of a query. it can't be used with bundle or manifest")
+
+//the phases of a query that profile=true times
+const (
+	PROF_GETIJ  = iota //finding the files of the ranges in the archive
+	PROF_OPEN          //opening the files and seeking to the range
+	PROF_SCAN          //reading the records from the files
+	PROF_DECODE        //parsing, filtering and transforming the records
+	PROF_SEND          //waiting for the client to take the records
+	PROF_PHASES
+)
+
+//queryProfile collects the durations of the phases of a query. The files
+//of a query are scanned concurrently so it is locked. Most phases overlap
+//across the files, so their sum is usually more than the total.
+type queryProfile struct {
+	mu     sync.Mutex
+	startt time.Time
+	phases [PROF_PHASES]time.Duration
+	files  []ProfileFile
+}
+
+//ProfilePhases are the durations of the phases of a query or a file, in
+//milliseconds. For a file, send is how long its scanner waited for the
+//query to take its messages, which is mostly the query waiting for the
+//client or for the files before it.
+type ProfilePhases struct {
+	GetijMs  float64 `json:"getijMs,omitempty"`
+	OpenMs   float64 `json:"openMs"`
+	ScanMs   float64 `json:"scanMs"`
+	DecodeMs float64 `json:"decodeMs"`
+	SendMs   float64 `json:"sendMs"`
+}
+
+//ProfileFile is the profile of one archive file of a query
+type ProfileFile struct {
+	Name string `json:"name"`
+	ProfilePhases
+	Records int64 `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+//QueryProfile is the X-Query-Profile trailer of a query with profile=true
+type QueryProfile struct {
+	TotalMs float64       `json:"totalMs"`
+	Phases  ProfilePhases `json:"phases"`
+	Files   []ProfileFile `json:"files"`
+}
+
+func newQueryProfile() *queryProfile {
+	return &queryProfile{startt: time.Now()}
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func profilePhases(p [PROF_PHASES]time.Duration) ProfilePhases {
+	return ProfilePhases{
+		GetijMs:  toMs(p[PROF_GETIJ]),
+		OpenMs:   toMs(p[PROF_OPEN]),
+		ScanMs:   toMs(p[PROF_SCAN]),
+		DecodeMs: toMs(p[PROF_DECODE]),
+		SendMs:   toMs(p[PROF_SEND]),
+	}
+}
+
+//profiling is true if the query times its phases
+func (qp *queryParams) profiling() bool {
+	return qp != nil && qp.prof != nil
+}
+
+//profNow returns the time a phase starts at, or the zero time if the query
+//is not profiled so that the records of the other queries aren't timed.
+func (qp *queryParams) profNow() time.Time {
+	if !qp.profiling() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+//profAdd adds the time since startt to a phase of the query
+func (qp *queryParams) profAdd(phase int, startt time.Time) {
+	if !qp.profiling() {
+		return
+	}
+	d := time.Since(startt)
+	qp.prof.mu.Lock()
+	qp.prof.phases[phase] += d
+	qp.prof.mu.Unlock()
+}
+
+//profFile adds the phases of a scanned file to the query. The time the file
+//waited to send is not added, since the query times its own sends to the client.
+func (qp *queryParams) profFile(path string, phases [PROF_PHASES]time.Duration, records, bytes int64) {
+	if !qp.profiling() {
+		return
+	}
+	qp.prof.mu.Lock()
+	defer qp.prof.mu.Unlock()
+	for i := range phases {
+		if i != PROF_SEND {
+			qp.prof.phases[i] += phases[i]
+		}
+	}
+	qp.prof.files = append(qp.prof.files, ProfileFile{Name: filepath.Base(path), ProfilePhases: profilePhases(phases), Records: records, Bytes: bytes})
+}
+
+//profileJSON returns the profile of the query so far as a JSON object
+func (qp *queryParams) profileJSON() ([]byte, error) {
+	qp.prof.mu.Lock()
+	p := QueryProfile{TotalMs: toMs(time.Since(qp.prof.startt)), Phases: profilePhases(qp.prof.phases), Files: qp.prof.files}
+	qp.prof.mu.Unlock()
+	return json.Marshal(p)
+}
@@ -0,0 +1,80 @@
+package bgparchive
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfileTrailer(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	ef := ar.getEntryFiles()
+	tests := []struct {
+		name   string
+		params map[string]string
+		files  []string
+	}{
+		{"raw", nil, []string{ef[1].Path, ef[2].Path}},
+		{"json", map[string]string{"format": "json"}, []string{ef[1].Path, ef[2].Path}},
+		{"sorted", map[string]string{"sorted": "true"}, []string{ef[1].Path, ef[2].Path}},
+	}
+	for _, tt := range tests {
+		//a range of whole files would be sent as the files are
+		values := testRange(16*time.Minute, 45*time.Minute)
+		values.Set("exact", "true")
+		values.Set("profile", "true")
+		for k, v := range tt.params {
+			values.Set(k, v)
+		}
+		h, body, errs := testQuery(ar, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Errorf("%s: got code %d and errors %v", tt.name, h.Code, errs)
+			continue
+		}
+		if tt.params["format"] == "" {
+			//the reply is just the messages
+			if n := len(splitRecords(t, body)); n != 29 {
+				t.Errorf("%s: got %d records, want 29", tt.name, n)
+			}
+		}
+		var p QueryProfile
+		if err := json.Unmarshal([]byte(h.TrailerValues()[PROFILE_TRAILER]), &p); err != nil {
+			t.Errorf("%s: the profile trailer:%s", tt.name, err)
+			continue
+		}
+		if p.TotalMs <= 0 {
+			t.Errorf("%s: got a total of %fms", tt.name, p.TotalMs)
+		}
+		if ph := p.Phases; ph.GetijMs < 0 || ph.OpenMs <= 0 || ph.ScanMs <= 0 || ph.DecodeMs <= 0 || ph.SendMs < 0 {
+			t.Errorf("%s: got phases %+v", tt.name, ph)
+		}
+		var recs int64
+		names := make(map[string]bool)
+		for _, f := range p.Files {
+			names[f.Name] = true
+			recs += f.Records
+		}
+		for _, f := range tt.files {
+			if !names[filepath.Base(f)] {
+				t.Errorf("%s: file %s is not in the profile %+v", tt.name, filepath.Base(f), p.Files)
+			}
+		}
+		if recs != 29 {
+			t.Errorf("%s: the files of the profile have %d records, want 29", tt.name, recs)
+		}
+	}
+}
+
+func TestProfileTrailerOnlyWhenProfiled(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	h, _, _ := testQuery(ar, testRange(16*time.Minute, 45*time.Minute))
+	for _, tr := range h.Trailers {
+		if tr == PROFILE_TRAILER {
+			t.Errorf("a query without profile=true announces the %s trailer", PROFILE_TRAILER)
+		}
+	}
+	if _, ok := h.TrailerValues()[PROFILE_TRAILER]; ok {
+		t.Errorf("a query without profile=true has a profile")
+	}
+}
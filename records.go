@@ -0,0 +1,65 @@
+package bgparchive
+
+import (
+	"context"
+	"github.com/CSUNetSec/bgparchive/api"
+	"net"
+	"time"
+)
+
+//MRTRecord is a record of an archive as returned to Go programs that use
+//the archive as a library, without going through HTTP.
+type MRTRecord struct {
+	Timestamp time.Time
+	Type      uint16
+	Subtype   uint16
+	//set for BGP4MP messages and state changes
+	PeerAS    uint32
+	PeerIP    net.IP
+	Announced []*net.IPNet //NLRI and MP_REACH prefixes of updates
+	Withdrawn []*net.IPNet //withdrawn and MP_UNREACH prefixes of updates
+	Raw       []byte       //the whole MRT record, header included
+	//if set the query failed and this is the last record sent
+	Err error
+}
+
+//Records sends the records of the archive from ta to tb on the returned channel,
+//in the order the HTTP queries return them, and closes it once they are all sent.
+//Cancelling ctx stops the query early. The channel must be read until it is
+//closed or ctx is cancelled, otherwise the query stays blocked.
+func (fsar *fsarchive) Records(ctx context.Context, ta, tb time.Time) <-chan MRTRecord {
+	ret := make(chan MRTRecord)
+	qp := &queryParams{done: ctx.Done(), slop: -1}
+	rc := make(chan api.Reply)
+	go func() {
+		defer close(rc)
+		transformAndSendBytes(fsar, ta.UTC(), tb.UTC(), qp, rc, nil, 0)
+	}()
+	go func() {
+		defer close(ret)
+		for r := range rc {
+			rec := newMRTRecord(r)
+			select {
+			case ret <- rec:
+			case <-ctx.Done():
+				for range rc { //let the query see the cancellation and finish
+				}
+				return
+			}
+		}
+	}()
+	return ret
+}
+
+func newMRTRecord(r api.Reply) MRTRecord {
+	if r.Err != nil {
+		return MRTRecord{Err: r.Err}
+	}
+	rec := MRTRecord{Timestamp: time.Unix(int64(msgTimestamp(r)), 0).UTC(), Raw: r.Data}
+	rec.Type, rec.Subtype, _ = mrtType(r.Data)
+	if up, err := decodeBGP4MP(r.Data); err == nil {
+		rec.PeerAS, rec.PeerIP = up.peerAS, up.peerIP
+		rec.Announced, rec.Withdrawn = up.announced, up.withdrawn
+	}
+	return rec
+}
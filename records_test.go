@@ -0,0 +1,103 @@
+package bgparchive
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecords(t *testing.T) {
+	recs := [][]byte{
+		bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24", "8.8.4.0/24"}, nil),
+		bgp4mpUpdate(testTs(time.Minute), 174, "192.0.2.2", nil, nil, []string{"1.1.1.0/24"}),
+		bgp4mpStateChange(testTs(2*time.Minute), 3356, "192.0.2.1", 6, 1),
+	}
+	ar := newTestArchive(t, []testFile{{start: 0, recs: recs}, quarterFiles[1], quarterFiles[2]})
+	for _, tc := range []struct {
+		name string
+		a, b time.Duration
+	}{
+		{"decoded", -30 * time.Second, 2*time.Minute + 30*time.Second},
+		{"files", -30 * time.Second, 45*time.Minute - time.Second},
+		{"within files", 20*time.Minute + 30*time.Second, 40*time.Minute + 30*time.Second},
+	} {
+		_, want, errs := testQuery(ar, testRange(tc.a, tc.b))
+		if len(errs) != 0 {
+			t.Fatalf("%s: %v", tc.name, errs)
+		}
+		var (
+			got  []byte
+			list []MRTRecord
+		)
+		for rec := range ar.Records(context.Background(), testEpoch.Add(tc.a), testEpoch.Add(tc.b)) {
+			if rec.Err != nil {
+				t.Fatalf("%s: %s", tc.name, rec.Err)
+			}
+			got = append(got, rec.Raw...)
+			list = append(list, rec)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes of records, want the %d of the query", tc.name, len(got), len(want))
+		}
+		if tc.name != "decoded" {
+			continue
+		}
+		if len(list) != 3 {
+			t.Fatalf("%s: got %d records, want 3", tc.name, len(list))
+		}
+		up, wd, sc := list[0], list[1], list[2]
+		if !up.Timestamp.Equal(testEpoch) || up.Type != MRT_BGP4MP || up.PeerAS != 3356 || up.PeerIP.String() != "192.0.2.1" ||
+			len(up.Announced) != 2 || up.Announced[1].String() != "8.8.4.0/24" || len(up.Withdrawn) != 0 {
+			t.Errorf("%s: got the update %+v", tc.name, up)
+		}
+		if wd.PeerAS != 174 || len(wd.Withdrawn) != 1 || wd.Withdrawn[0].String() != "1.1.1.0/24" || len(wd.Announced) != 0 {
+			t.Errorf("%s: got the withdrawal %+v", tc.name, wd)
+		}
+		if !sc.Timestamp.Equal(testEpoch.Add(2*time.Minute)) || sc.PeerAS != 3356 || len(sc.Announced)+len(sc.Withdrawn) != 0 {
+			t.Errorf("%s: got the state change %+v", tc.name, sc)
+		}
+	}
+	//a range out of the archive ends with the error of the query
+	var errs int
+	for rec := range ar.Records(context.Background(), testEpoch.Add(24*time.Hour), testEpoch.Add(25*time.Hour)) {
+		if rec.Err == nil {
+			t.Errorf("a range after the archive got a record at %s", rec.Timestamp)
+		}
+		errs++
+	}
+	if errs != 1 {
+		t.Errorf("a range after the archive got %d errors", errs)
+	}
+	//the channel is closed once the query sees the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	recc := ar.Records(ctx, testEpoch, testEpoch.Add(45*time.Minute))
+	<-recc
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		for range recc {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("cancelling didn't close the channel")
+	}
+}
+
+func TestRecordsBounds(t *testing.T) {
+	ar := newTestArchive(t, quarterFiles)
+	//the records a second around the range are included, like in the queries
+	for _, r := range [][2]time.Duration{{0, 2 * time.Minute}, {20 * time.Minute, 20 * time.Minute}} {
+		_, want, _ := testQuery(ar, testRange(r[0], r[1]))
+		var got []byte
+		for rec := range ar.Records(context.Background(), testEpoch.Add(r[0]), testEpoch.Add(r[1])) {
+			got = append(got, rec.Raw...)
+		}
+		if len(want) == 0 || !bytes.Equal(got, want) {
+			t.Errorf("from %s to %s: got %d bytes of records, want the %d of the query", r[0], r[1], len(got), len(want))
+		}
+	}
+}
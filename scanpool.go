@@ -0,0 +1,54 @@
+package bgparchive
+
+import (
+	"sync"
+	"time"
+)
+
+//DEFAULT_SCAN_OPEN_FILES is how many files a scan of the archive reads the
+//first date of at the same time unless SetScanOpenFiles is called.
+const DEFAULT_SCAN_OPEN_FILES = 8
+
+//firstDatePool reads the first dates of the files found by a walk of the
+//archive in parallel, with at most as many files open as it has slots.
+type firstDatePool struct {
+	fs  archiveFS
+	sem chan struct{}
+	wg  sync.WaitGroup
+	mu  sync.Mutex //serializes the done calls
+}
+
+func newFirstDatePool(fs archiveFS, openfiles int) *firstDatePool {
+	if openfiles < 1 {
+		openfiles = 1
+	}
+	return &firstDatePool{fs: fs, sem: make(chan struct{}, openfiles)}
+}
+
+//firstDate reads the first date of the file and calls done with it. It blocks
+//while all the slots are taken, so a walk never gets far ahead of the reads.
+//The done calls don't overlap, so they can add to the tempentryfiles. A nil
+//pool reads the file and calls done before returning.
+func (p *firstDatePool) firstDate(pathname string, fs archiveFS, done func(time.Time, error)) {
+	if p == nil {
+		done(getFirstDate(fs, pathname))
+		return
+	}
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		sdate, err := getFirstDate(p.fs, pathname)
+		<-p.sem
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		done(sdate, err)
+	}()
+}
+
+//wait returns once every done call has returned
+func (p *firstDatePool) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
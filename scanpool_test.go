@@ -0,0 +1,97 @@
+package bgparchive
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+//countingFS counts the files that are open at the same time
+type countingFS struct {
+	archiveFS
+	mu        sync.Mutex
+	open, max int
+}
+
+type countedFile struct {
+	archiveFile
+	fs *countingFS
+}
+
+func (cf countedFile) Close() error {
+	cf.fs.mu.Lock()
+	cf.fs.open--
+	cf.fs.mu.Unlock()
+	return cf.archiveFile.Close()
+}
+
+func (cfs *countingFS) Open(name string) (archiveFile, error) {
+	f, err := cfs.archiveFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	cfs.mu.Lock()
+	defer cfs.mu.Unlock()
+	if cfs.open++; cfs.open > cfs.max {
+		cfs.max = cfs.open
+	}
+	return countedFile{archiveFile: f, fs: cfs}, nil
+}
+
+func TestScanOpenFiles(t *testing.T) {
+	var files []testFile
+	for k := 0; k < 20; k++ {
+		files = append(files, testFile{start: time.Duration(k) * 15 * time.Minute, n: 2, step: time.Minute})
+	}
+	dir, _ := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+	for _, openfiles := range []int{0, 1, 3, 8} {
+		ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+		cfs := &countingFS{archiveFS: ar.fs}
+		ar.fs = cfs
+		ar.SetScanOpenFiles(openfiles)
+		ar.scan()
+		ar.setScanning(false)
+		ar.setEntryFiles(ar.tempentryfiles)
+		limit := openfiles
+		if limit < 1 {
+			limit = 1
+		}
+		if cfs.max > limit || cfs.open != 0 {
+			t.Errorf("%d open files: got %d at most and %d left open", openfiles, cfs.max, cfs.open)
+		}
+		ef := ar.getEntryFiles()
+		if len(ef) != len(files) {
+			t.Fatalf("%d open files: got %d of the %d files", openfiles, len(ef), len(files))
+		}
+		for k := range ef {
+			if want := testEpoch.Add(files[k].start); !ef[k].Sdate.Equal(want) {
+				t.Errorf("%d open files: file %d starts at %s, want %s", openfiles, k, ef[k].Sdate, want)
+			}
+		}
+	}
+}
+
+func BenchmarkScanOpenFiles(b *testing.B) {
+	//a tree of thousands of small files
+	var files []testFile
+	for k := 0; k < 3000; k++ {
+		files = append(files, testFile{start: time.Duration(k) * 15 * time.Minute, n: 1})
+	}
+	dir, _ := writeTestFiles(b, files)
+	defer os.RemoveAll(dir)
+	for _, openfiles := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("%d open files", openfiles), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+				ar.SetScanOpenFiles(openfiles)
+				ar.scan()
+				if len(ar.tempentryfiles) != len(files) {
+					b.Fatalf("got %d of the %d files", len(ar.tempentryfiles), len(files))
+				}
+			}
+		})
+	}
+}
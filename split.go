@@ -0,0 +1,47 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	ppmrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+//the MRT types of RFC 6396. Only used to find the next record in a
+//corrupt file, so records of other types are still split as usual.
+var knownMrtTypes = map[uint16]bool{
+	11:                true, //OSPFv2
+	MRT_TABLE_DUMP:    true,
+	MRT_TABLE_DUMP_V2: true,
+	MRT_BGP4MP:        true,
+	MRT_BGP4MP_ET:     true,
+	32:                true, //ISIS
+	33:                true, //ISIS_ET
+	48:                true, //OSPFv3
+	49:                true, //OSPFv3_ET
+}
+
+//implausibleLen is true if the length field of the MRT header at the start
+//of data declares a record that is larger than the max record size.
+func implausibleLen(data []byte) bool {
+	return int64(binary.BigEndian.Uint32(data[8:12])) > int64(maxrecordsize-ppmrt.MRT_HEADER_LEN)
+}
+
+//splitMrt is ppmrt.SplitMrt for the records of files that can be corrupt.
+//A header with a length larger than the max record size would have the
+//scanner grow its buffer up to it and then stop the file with ErrTooLong,
+//so instead the bytes up to the next header that looks valid are skipped
+//and the scan goes on from there.
+func splitMrt(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < ppmrt.MRT_HEADER_LEN || !implausibleLen(data) {
+		return ppmrt.SplitMrt(data, atEOF)
+	}
+	for k := 1; k+ppmrt.MRT_HEADER_LEN <= len(data); k++ {
+		if knownMrtTypes[binary.BigEndian.Uint16(data[k+4:k+6])] && !implausibleLen(data[k:]) {
+			return k, nil, nil
+		}
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	//the last bytes can be the start of a header that isn't all read yet
+	return len(data) - ppmrt.MRT_HEADER_LEN + 1, nil, nil
+}
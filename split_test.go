@@ -0,0 +1,58 @@
+package bgparchive
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func FuzzSplitMrt(f *testing.F) {
+	upd := bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil)
+	huge := append([]byte(nil), upd...)
+	huge[8], huge[9] = 0x7f, 0xff
+	for _, seed := range [][]byte{
+		nil,
+		upd,
+		upd[:5],
+		upd[:len(upd)-1],
+		append(append([]byte(nil), huge...), upd...),
+		append(append([]byte(nil), upd[:20]...), upd...),
+		bytes.Repeat([]byte{0xff}, 64),
+		bytes.Repeat(upd[:12], 3),
+	} {
+		f.Add(seed, true)
+		f.Add(seed, false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, atEOF bool) {
+		adv, tok, err := splitMrt(data, atEOF)
+		if err != nil {
+			return
+		}
+		if adv < 0 || adv > len(data) {
+			t.Fatalf("advanced %d bytes of %d", adv, len(data))
+		}
+		if len(tok) > adv {
+			t.Fatalf("a token of %d bytes after advancing %d", len(tok), adv)
+		}
+		//at the end of the file there is no more data to wait for
+		if atEOF && len(data) > 0 && adv == 0 {
+			t.Fatalf("no progress on the last %d bytes of a file", len(data))
+		}
+		//a scanner over the same bytes has to get to the end of them
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Split(splitMrt)
+		SetScannerBuffer(scanner)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for scanner.Scan() {
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("the scan of %d bytes doesn't end", len(data))
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package bgparchive
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//archiveFile is what the archive needs from an open file. *os.File is one.
+type archiveFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+//archiveFS is where the files of an archive are stored. Paths are the
+//ones given to Walk, so they are only meaningful to the same archiveFS.
+type archiveFS interface {
+	Open(name string) (archiveFile, error)
+	Stat(name string) (os.FileInfo, error)
+	//Walk works like filepath.Walk, including filepath.SkipDir
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+//newArchiveFS returns the archiveFS of a root path. s3:// and gs:// roots are
+//object storage buckets, and anything else is a local directory.
+func newArchiveFS(root string) archiveFS {
+	if strings.HasPrefix(root, "s3://") || strings.HasPrefix(root, "gs://") {
+		return newObjectFS(root)
+	}
+	return localFS{}
+}
+
+//localFS is the local filesystem
+type localFS struct{}
+
+func (localFS) Open(name string) (archiveFile, error) {
+	file, err := os.Open(name)
+	if err != nil { //don't return a nil *os.File in a non nil interface
+		return nil, err
+	}
+	return file, nil
+}
+
+func (localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
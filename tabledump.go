@@ -0,0 +1,125 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	"errors"
+	ppmrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"net"
+)
+
+//TABLE_DUMP (v1) type and its subtypes, which are the AFI of the prefix.
+const (
+	MRT_TABLE_DUMP = 12
+
+	TD_AFI_IPV4 = 1
+	TD_AFI_IPV6 = 2
+)
+
+//TABLE_DUMP_V2 type and the subtypes that carry RIB entries.
+const (
+	MRT_TABLE_DUMP_V2 = 13
+
+	TDV2_PEER_INDEX_TABLE           = 1
+	TDV2_RIB_IPV4_UNICAST           = 2
+	TDV2_RIB_IPV4_MULTICAST         = 3
+	TDV2_RIB_IPV6_UNICAST           = 4
+	TDV2_RIB_IPV6_MULTICAST         = 5
+	TDV2_RIB_GENERIC                = 6
+	TDV2_RIB_IPV4_UNICAST_ADDPATH   = 8
+	TDV2_RIB_IPV4_MULTICAST_ADDPATH = 9
+	TDV2_RIB_IPV6_UNICAST_ADDPATH   = 10
+	TDV2_RIB_IPV6_MULTICAST_ADDPATH = 11
+	TDV2_RIB_GENERIC_ADDPATH        = 12
+)
+
+var (
+	errnotrib       = errors.New("MRT record is not a TABLE_DUMP_V2 RIB record")
+	errnottabledump = errors.New("MRT record is not a TABLE_DUMP record")
+)
+
+//tableDumpEntry is a TABLE_DUMP (v1) record. Unlike TABLE_DUMP_V2 every record
+//is a single RIB entry, the route of one peer to a prefix, and the entries of
+//the same prefix are dumped one after the other.
+type tableDumpEntry struct {
+	prefix *net.IPNet
+	peerIP net.IP
+	peerAS uint32
+}
+
+//decodeTableDump walks a TABLE_DUMP record up to the path attributes. It
+//returns errnottabledump for anything that is not a TABLE_DUMP record.
+func decodeTableDump(data []byte) (*tableDumpEntry, error) {
+	typ, subtyp, err := mrtType(data)
+	if err != nil {
+		return nil, err
+	}
+	if typ != MRT_TABLE_DUMP {
+		return nil, errnottabledump
+	}
+	alen := net.IPv4len
+	switch subtyp {
+	case TD_AFI_IPV4:
+	case TD_AFI_IPV6:
+		alen = net.IPv6len
+	default:
+		return nil, errnottabledump
+	}
+	body := data[ppmrt.MRT_HEADER_LEN:]
+	//view and sequence number, prefix, prefix length, status, originated time, peer address, peer AS
+	if len(body) < 4+alen+2+4+alen+2 {
+		return nil, errshortmsg
+	}
+	body = body[4:]
+	pl := int(body[alen])
+	if pl > alen*8 {
+		return nil, errshortmsg
+	}
+	ent := &tableDumpEntry{prefix: &net.IPNet{IP: append(net.IP(nil), body[:alen]...), Mask: net.CIDRMask(pl, alen*8)}}
+	body = body[alen+2+4:]
+	ent.peerIP = append(net.IP(nil), body[:alen]...)
+	ent.peerAS = uint32(binary.BigEndian.Uint16(body[alen:]))
+	return ent, nil
+}
+
+//ribEntryCount returns the number of RIB entries of a TABLE_DUMP_V2 RIB record.
+//Each record is for a single prefix. It returns errnotrib for the peer index
+//table and for anything that is not a TABLE_DUMP_V2 record.
+func ribEntryCount(data []byte) (int, error) {
+	typ, subtyp, err := mrtType(data)
+	if err != nil {
+		return 0, err
+	}
+	if typ != MRT_TABLE_DUMP_V2 {
+		return 0, errnotrib
+	}
+	body := data[ppmrt.MRT_HEADER_LEN:]
+	switch subtyp {
+	case TDV2_RIB_IPV4_UNICAST, TDV2_RIB_IPV4_MULTICAST, TDV2_RIB_IPV6_UNICAST, TDV2_RIB_IPV6_MULTICAST,
+		TDV2_RIB_IPV4_UNICAST_ADDPATH, TDV2_RIB_IPV4_MULTICAST_ADDPATH, TDV2_RIB_IPV6_UNICAST_ADDPATH, TDV2_RIB_IPV6_MULTICAST_ADDPATH:
+		//sequence number
+		if len(body) < 5 {
+			return 0, errshortmsg
+		}
+		body = body[4:]
+	case TDV2_RIB_GENERIC, TDV2_RIB_GENERIC_ADDPATH:
+		//sequence number, afi and safi
+		if len(body) < 8 {
+			return 0, errshortmsg
+		}
+		body = body[7:]
+		if subtyp == TDV2_RIB_GENERIC_ADDPATH { //the NLRI has a path identifier
+			if len(body) < 5 {
+				return 0, errshortmsg
+			}
+			body = body[4:]
+		}
+	default:
+		return 0, errnotrib
+	}
+	//prefix length and prefix
+	pl := 1 + (int(body[0])+7)/8
+	if len(body) < pl+2 {
+		return 0, errshortmsg
+	}
+	return int(binary.BigEndian.Uint16(body[pl:])), nil
+}
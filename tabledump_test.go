@@ -0,0 +1,187 @@
+package bgparchive
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+//tableDumpRecord returns a TABLE_DUMP record of the route of the peer to the prefix
+func tableDumpRecord(ts uint32, prefix string, peer string, peeras uint16) []byte {
+	_, pnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		panic(err)
+	}
+	ip, pip, subtyp := pnet.IP.To4(), net.ParseIP(peer).To4(), uint16(TD_AFI_IPV4)
+	if ip == nil {
+		ip, pip, subtyp = pnet.IP.To16(), net.ParseIP(peer).To16(), TD_AFI_IPV6
+	}
+	ones, _ := pnet.Mask.Size()
+	body := []byte{0, 0, 0, 0} //view and sequence number
+	body = append(body, ip...)
+	body = append(body, byte(ones), 1)
+	body = append(body, make([]byte, 4)...) //originated time
+	body = append(body, pip...)
+	body = append(body, byte(peeras>>8), byte(peeras))
+	attrs := bgpAttr(0x40, 1, []byte{0})
+	body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+	return mrtRecord(ts, MRT_TABLE_DUMP, subtyp, append(body, attrs...))
+}
+
+func TestDecodeTableDump(t *testing.T) {
+	v4 := tableDumpRecord(testTs(0), "10.1.0.0/16", "192.0.2.1", 3356)
+	badsubtyp := append([]byte(nil), v4...)
+	binary.BigEndian.PutUint16(badsubtyp[6:], 3)
+	badlen := append([]byte(nil), v4...)
+	badlen[12+4+4] = 33
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		err    error
+		prefix string
+		peer   string
+		peeras uint32
+	}{
+		{"ipv4", v4, nil, "10.1.0.0/16", "192.0.2.1", 3356},
+		{"ipv6", tableDumpRecord(testTs(0), "2001:db8::/32", "2001:db8::1", 6939), nil, "2001:db8::/32", "2001:db8::1", 6939},
+		{"default route", tableDumpRecord(testTs(0), "0.0.0.0/0", "192.0.2.2", 1), nil, "0.0.0.0/0", "192.0.2.2", 1},
+		{"update", bgp4mpUpdate(testTs(0), 3356, "192.0.2.1", nil, []string{"10.0.0.0/8"}, nil), errnottabledump, "", "", 0},
+		{"unknown subtype", badsubtyp, errnottabledump, "", "", 0},
+		{"prefix length", badlen, errshortmsg, "", "", 0},
+		{"short", mrtRecord(testTs(0), MRT_TABLE_DUMP, TD_AFI_IPV4, v4[12:30]), errshortmsg, "", "", 0},
+	} {
+		ent, err := decodeTableDump(tc.data)
+		if err != tc.err {
+			t.Errorf("%s: got the error %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ent.prefix.String() != tc.prefix || !ent.peerIP.Equal(net.ParseIP(tc.peer)) || ent.peerAS != tc.peeras {
+			t.Errorf("%s: got %s from %s AS%d, want %s from %s AS%d", tc.name, ent.prefix, ent.peerIP, ent.peerAS, tc.prefix, tc.peer, tc.peeras)
+		}
+	}
+}
+
+func TestStatsTableDump(t *testing.T) {
+	ts := testTs(0)
+	rib := [][]byte{
+		tableDumpRecord(ts, "10.1.0.0/16", "192.0.2.1", 3356),
+		tableDumpRecord(ts, "10.1.0.0/16", "192.0.2.2", 174),
+		tableDumpRecord(ts, "10.1.0.0/16", "192.0.2.3", 2914),
+		tableDumpRecord(ts, "10.2.0.0/16", "192.0.2.1", 3356),
+		tableDumpRecord(ts, "2001:db8::/32", "2001:db8::1", 6939),
+		tableDumpRecord(ts, "2001:db8::/32", "2001:db8::2", 1299),
+	}
+	dir, _ := writeTestFiles(t, []testFile{
+		{start: 0, recs: rib},
+		{start: 15 * time.Minute, n: 3, step: time.Minute},
+	})
+	defer os.RemoveAll(dir)
+	st := NewFsarstat(scanTestArchive(dir).fsarchive)
+	for _, tc := range []struct {
+		a, b                    time.Duration
+		prefixes, entries, msgs int
+	}{
+		{0, time.Minute, 3, 6, 6},
+		{0, 30 * time.Minute, 3, 6, 9},
+		{15 * time.Minute, 30 * time.Minute, 0, 0, 3},
+	} {
+		values := testRange(tc.a, tc.b)
+		values.Set("bucket", "3600")
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s-%s: got code %d and errors %v", tc.a, tc.b, h.Code, errs)
+		}
+		var stats BgpStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("%s in %s", err, body)
+		}
+		sum := func(a []int) (n int) {
+			for _, v := range a {
+				n += v
+			}
+			return
+		}
+		if p, e := sum(stats.RibPrefixes), sum(stats.RibEntries); p != tc.prefixes || e != tc.entries || stats.TotalMsgs != int64(tc.msgs) {
+			t.Errorf("%s-%s: got %d prefixes, %d entries and %d messages, want %d, %d and %d", tc.a, tc.b, p, e, stats.TotalMsgs, tc.prefixes, tc.entries, tc.msgs)
+		}
+	}
+}
+
+//ribRecord returns a TABLE_DUMP_V2 RIB record of the prefix with one entry for
+//each of the first n peers of the peer index table.
+func ribRecord(ts uint32, subtyp uint16, prefix string, n int) []byte {
+	_, pnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := pnet.Mask.Size()
+	body := []byte{0, 0, 0, 1} //sequence number
+	if subtyp == TDV2_RIB_GENERIC {
+		body = append(body, 0, 1, 1) //afi and safi
+	}
+	body = append(body, byte(ones))
+	body = append(body, pnet.IP[:(ones+7)/8]...)
+	body = append(body, byte(n>>8), byte(n))
+	attrs := bgpAttr(0x40, 1, []byte{0})
+	for i := 0; i < n; i++ {
+		body = append(body, byte(i>>8), byte(i))
+		body = append(body, make([]byte, 4)...) //originated time
+		body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+		body = append(body, attrs...)
+	}
+	return mrtRecord(ts, MRT_TABLE_DUMP_V2, subtyp, body)
+}
+
+func TestStatsRib(t *testing.T) {
+	ts := testTs(0)
+	//collector id, an empty view name and no peers, which the stats skip
+	peerindex := mrtRecord(ts, MRT_TABLE_DUMP_V2, TDV2_PEER_INDEX_TABLE, []byte{192, 0, 2, 1, 0, 0, 0, 0})
+	rib := [][]byte{
+		peerindex,
+		ribRecord(ts, TDV2_RIB_IPV4_UNICAST, "10.1.0.0/16", 3),
+		ribRecord(ts, TDV2_RIB_IPV4_UNICAST, "10.2.0.0/16", 1),
+		ribRecord(ts+1, TDV2_RIB_IPV4_UNICAST, "10.3.0.0/24", 4),
+		ribRecord(ts+1, TDV2_RIB_IPV6_UNICAST, "2001:db8::/32", 2),
+		ribRecord(ts+1, TDV2_RIB_GENERIC, "10.4.0.0/16", 5),
+	}
+	dir, _ := writeTestFiles(t, []testFile{
+		{start: 0, recs: rib},
+		{start: 15 * time.Minute, n: 3, step: time.Minute},
+	})
+	defer os.RemoveAll(dir)
+	st := NewFsarstat(scanTestArchive(dir).fsarchive)
+	for _, tc := range []struct {
+		a, b                    time.Duration
+		prefixes, entries, msgs int
+	}{
+		{0, time.Minute, 5, 15, 5},
+		{0, 30 * time.Minute, 5, 15, 8},
+		{15 * time.Minute, 30 * time.Minute, 0, 0, 3},
+	} {
+		values := testRange(tc.a, tc.b)
+		values.Set("bucket", "3600")
+		h, body, errs := testQuery(st, values)
+		if h.Code != 200 || len(errs) != 0 {
+			t.Fatalf("%s-%s: got code %d and errors %v", tc.a, tc.b, h.Code, errs)
+		}
+		var stats BgpStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("%s in %s", err, body)
+		}
+		sum := func(a []int) (n int) {
+			for _, v := range a {
+				n += v
+			}
+			return
+		}
+		if p, e := sum(stats.RibPrefixes), sum(stats.RibEntries); p != tc.prefixes || e != tc.entries || stats.TotalMsgs != int64(tc.msgs) {
+			t.Errorf("%s-%s: got %d prefixes, %d entries and %d messages, want %d, %d and %d", tc.a, tc.b, p, e, stats.TotalMsgs, tc.prefixes, tc.entries, tc.msgs)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package bgparchive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/CSUNetSec/bgparchive/api"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the archives of the tests start at this time
+var testEpoch = time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//testTs returns the MRT timestamp of testEpoch plus d
+func testTs(d time.Duration) uint32 {
+	return uint32(testEpoch.Add(d).Unix())
+}
+
+//mrtRecord returns an MRT record of the type and subtype with the body
+func mrtRecord(ts uint32, typ, subtyp uint16, body []byte) []byte {
+	rec := make([]byte, 12, 12+len(body))
+	binary.BigEndian.PutUint32(rec, ts)
+	binary.BigEndian.PutUint16(rec[4:], typ)
+	binary.BigEndian.PutUint16(rec[6:], subtyp)
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(body)))
+	return append(rec, body...)
+}
+
+//encodePrefixes returns the length/prefix encoding of IPv4 or IPv6 prefixes
+func encodePrefixes(pfxs []string) []byte {
+	var ret []byte
+	for _, p := range pfxs {
+		_, pnet, err := net.ParseCIDR(p)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := pnet.Mask.Size()
+		ip := pnet.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ret = append(ret, byte(ones))
+		ret = append(ret, ip[:(ones+7)/8]...)
+	}
+	return ret
+}
+
+//bgpAttr returns a path attribute
+func bgpAttr(flags, code byte, val []byte) []byte {
+	if len(val) > 255 {
+		ret := []byte{flags | 0x10, code, byte(len(val) >> 8), byte(len(val))}
+		return append(ret, val...)
+	}
+	return append([]byte{flags, code, byte(len(val))}, val...)
+}
+
+//bgp4mpBody returns the BGP4MP_MESSAGE_AS4 body of a BGP message from an IPv4 peer
+func bgp4mpBody(peeras uint32, peer string, msgtype byte, msg []byte) []byte {
+	body := make([]byte, 12)
+	binary.BigEndian.PutUint32(body, peeras)
+	binary.BigEndian.PutUint32(body[4:], 65000)
+	binary.BigEndian.PutUint16(body[10:], AFI_IP)
+	body = append(body, net.ParseIP(peer).To4()...)
+	body = append(body, 10, 0, 0, 1)
+	hdr := make([]byte, BGP_HEADER_LEN)
+	for i := 0; i < BGP_MARKER_LEN; i++ {
+		hdr[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(hdr[BGP_MARKER_LEN:], uint16(BGP_HEADER_LEN+len(msg)))
+	hdr[BGP_MARKER_LEN+2] = msgtype
+	body = append(body, hdr...)
+	return append(body, msg...)
+}
+
+//bgpUpdate returns the BGP message of an update with an AS path of 4 byte
+//ASNs, the IPv4 prefixes and the attributes in extra
+func bgpUpdate(aspath []uint32, nlri, withdrawn []string, extra ...[]byte) []byte {
+	w := encodePrefixes(withdrawn)
+	msg := []byte{byte(len(w) >> 8), byte(len(w))}
+	msg = append(msg, w...)
+	var attrs []byte
+	attrs = append(attrs, bgpAttr(0x40, 1, []byte{0})...) //ORIGIN IGP
+	if len(aspath) > 0 {
+		seg := []byte{AS_SEQUENCE, byte(len(aspath))}
+		for _, a := range aspath {
+			seg = append(seg, byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+		}
+		attrs = append(attrs, bgpAttr(0x40, ATTR_AS_PATH, seg)...)
+	}
+	for _, e := range extra {
+		attrs = append(attrs, e...)
+	}
+	msg = append(msg, byte(len(attrs)>>8), byte(len(attrs)))
+	msg = append(msg, attrs...)
+	return append(msg, encodePrefixes(nlri)...)
+}
+
+//bgp4mpUpdate returns a BGP4MP_MESSAGE_AS4 record of an update
+func bgp4mpUpdate(ts uint32, peeras uint32, peer string, aspath []uint32, nlri, withdrawn []string) []byte {
+	return mrtRecord(ts, MRT_BGP4MP, BGP4MP_MESSAGE_AS4, bgp4mpBody(peeras, peer, BGP_UPDATE, bgpUpdate(aspath, nlri, withdrawn)))
+}
+
+//bgp4mpStateChange returns a BGP4MP_STATE_CHANGE_AS4 record
+func bgp4mpStateChange(ts uint32, peeras uint32, peer string, oldst, newst uint16) []byte {
+	body := bgp4mpBody(peeras, peer, 0, nil)[:20]
+	body = append(body, byte(oldst>>8), byte(oldst), byte(newst>>8), byte(newst))
+	return mrtRecord(ts, MRT_BGP4MP, BGP4MP_STATE_CHANGE_AS4, body)
+}
+
+//testFile is an archive file of a test. The updates of the file are made one
+//every step from its start, unless recs is set.
+type testFile struct {
+	start time.Duration //since testEpoch
+	n     int
+	step  time.Duration
+	recs  [][]byte
+}
+
+func (tf testFile) name() string {
+	return "updates." + testEpoch.Add(tf.start).Format("20060102.1504")
+}
+
+func (tf testFile) records() [][]byte {
+	if tf.recs != nil {
+		return tf.recs
+	}
+	var ret [][]byte
+	for k := 0; k < tf.n; k++ {
+		ret = append(ret, bgp4mpUpdate(testTs(tf.start+time.Duration(k)*tf.step), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil))
+	}
+	return ret
+}
+
+//writeTestFiles writes the files in the month dir of their start under a
+//temporary dir and returns the dir and the paths of the files
+func writeTestFiles(t testing.TB, files []testFile) (string, []string) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, tf := range files {
+		mdir := filepath.Join(dir, testEpoch.Add(tf.start).Format("2006.01"))
+		if err := os.MkdirAll(mdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		for _, rec := range tf.records() {
+			data = append(data, rec...)
+		}
+		p := filepath.Join(mdir, tf.name())
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return dir, paths
+}
+
+//writeTruncatedGzip writes the records gzipped without the end of the gzip
+//trailer, so that they are read but the decompressor fails after them
+func writeTruncatedGzip(t *testing.T, path string, recs [][]byte) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	for _, rec := range recs {
+		w.Write(rec)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(path, gz.Bytes()[:gz.Len()-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//newTestArchive returns a scanned updates archive of the files. The dir
+//is removed when the test is over.
+func newTestArchive(t testing.TB, files []testFile) *mrtarchive {
+	dir, _ := writeTestFiles(t, files)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return scanTestArchive(dir)
+}
+
+//scanTestArchive returns a scanned updates archive of the files in dir
+func scanTestArchive(dir string) *mrtarchive {
+	ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+	ar.scan()
+	ar.setScanning(false)
+	ar.setEntryFiles(ar.tempentryfiles)
+	return ar
+}
+
+//writeLiveFile writes an updates file of the records in the month dir of start
+func writeLiveFile(t *testing.T, dir string, start time.Time, ts []time.Time) {
+	mdir := filepath.Join(dir, start.Format("2006.01"))
+	if err := os.MkdirAll(mdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, tm := range ts {
+		data = append(data, bgp4mpUpdate(uint32(tm.Unix()), 3356, "192.0.2.1", []uint32{3356, 15169}, []string{"8.8.8.0/24"}, nil)...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mdir, "updates."+start.Format("20060102.1504")), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func minutes(base time.Time, from, to int) (ret []time.Time) {
+	for m := from; m < to; m++ {
+		ret = append(ret, base.Add(time.Duration(m)*time.Minute))
+	}
+	return
+}
+
+//testQuery returns the header, the bytes and the errors of the reply
+//of a query of the resource
+func testQuery(res api.Resource, values url.Values) (api.HdrReply, []byte, []error) {
+	if values.Get("remoteaddr") == "" {
+		values.Set("remoteaddr", "127.0.0.1")
+	}
+	h, retc := res.Get(values)
+	var (
+		body []byte
+		errs []error
+	)
+	for r := range retc {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+			continue
+		}
+		body = append(body, r.Data...)
+	}
+	return h, body, errs
+}
+
+//testRange returns the start and end values of testEpoch plus a and b
+func testRange(a, b time.Duration) url.Values {
+	return url.Values{
+		"start": {testEpoch.Add(a).Format("20060102150405")},
+		"end":   {testEpoch.Add(b).Format("20060102150405")},
+	}
+}
+
+//splitRecords splits a raw MRT reply in its records
+func splitRecords(t testing.TB, body []byte) [][]byte {
+	var ret [][]byte
+	for len(body) > 0 {
+		if len(body) < 12 {
+			t.Fatalf("%d trailing bytes in the reply", len(body))
+		}
+		n := 12 + int(binary.BigEndian.Uint32(body[8:12]))
+		if len(body) < n {
+			t.Fatalf("truncated record in the reply")
+		}
+		ret = append(ret, body[:n])
+		body = body[n:]
+	}
+	return ret
+}
@@ -0,0 +1,107 @@
+package bgparchive
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//newWatcher watches the root path of the archive and all the directories under it.
+//fsnotify is not recursive so every directory has to be added on its own.
+func (fsa *mrtarchive) newWatcher() (*fsnotify.Watcher, error) {
+	if _, ok := fsa.fs.(localFS); !ok {
+		return nil, errors.New("only archives on the local filesystem can be watched")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(fsa.rootpathstr, func(pathname string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return nil
+		}
+		return w.Add(pathname)
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//handleWatchEvent adds new files to the archive as they show up. Files that
+//can't be dated yet because they are still being written are kept in pending
+//and retried every time they are written to.
+func (fsa *mrtarchive) handleWatchEvent(w *fsnotify.Watcher, ev fsnotify.Event, pending map[string]bool) {
+	switch {
+	case ev.Op&fsnotify.Create == fsnotify.Create:
+		f, err := os.Stat(ev.Name)
+		if err != nil {
+			return
+		}
+		if f.IsDir() {
+			//watch the new dir, and pick up the files that were created
+			//in it before the watch was in place.
+			filepath.Walk(ev.Name, func(pathname string, f os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if f.IsDir() {
+					if err := w.Add(pathname); err != nil {
+						warnf("fsarchive:%s failed watching dir:%s error:%s", fsa.descriminator, pathname, err)
+					}
+				} else if fsa.addFile(pathname, f) != nil {
+					pending[pathname] = true
+				}
+				return nil
+			})
+			return
+		}
+		if fsa.addFile(ev.Name, f) != nil {
+			pending[ev.Name] = true
+		}
+	case ev.Op&fsnotify.Write == fsnotify.Write:
+		if !pending[ev.Name] {
+			return
+		}
+		if f, err := os.Stat(ev.Name); err == nil && fsa.addFile(ev.Name, f) == nil {
+			delete(pending, ev.Name)
+		}
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		delete(pending, ev.Name)
+	}
+}
+
+//addFile inserts a single file in the archive keeping the entries sorted,
+//and rewrites the index file. Files that don't match the archive patterns
+//or are already in it, maybe through another path, are ignored.
+func (fsa *mrtarchive) addFile(pathname string, f os.FileInfo) error {
+	if !f.Mode().IsRegular() || !fsa.matchesPattern(pathname) || isTempFile(pathname) {
+		return nil
+	}
+	sdate, err := getFirstDate(fsa.fs, pathname)
+	if err != nil {
+		return err
+	}
+	seen := fsa.seenFile(pathname, sdate, f.Size())
+	fsa.scanfiles, fsa.scanpaths = nil, nil
+	if seen {
+		return nil
+	}
+	ind := sort.Search(len(fsa.tempentryfiles), func(i int) bool {
+		return fsa.tempentryfiles[i].Sdate.After(sdate)
+	})
+	fsa.tempentryfiles = append(fsa.tempentryfiles, ArchEntryFile{})
+	copy(fsa.tempentryfiles[ind+1:], fsa.tempentryfiles[ind:])
+	fsa.tempentryfiles[ind] = ArchEntryFile{Path: pathname, Sdate: sdate, Sz: f.Size()}
+	infof("adding watched file:%s with date:%v to the archive\n", pathname, sdate)
+	fsa.setEntryFiles(fsa.tempentryfiles)
+	errg := fsa.tempentryfiles.ToFile(fmt.Sprintf("%s/%s-%s", fsa.savepath, fsa.descriminator, fsa.collectorstr))
+	if errg != nil {
+		warnf("%s", errg)
+	}
+	return nil
+}
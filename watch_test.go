@@ -0,0 +1,60 @@
+package bgparchive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchNewFiles(t *testing.T) {
+	dir, _ := writeTestFiles(t, quarterFiles)
+	defer os.RemoveAll(dir)
+	ar := NewMRTArchive(dir, "updates", "testcol", 5, dir, false)
+	ar.SetWatch(true)
+	var wg, scanwg sync.WaitGroup
+	ar.Serve(&wg, &scanwg)
+	defer wg.Wait()
+	defer ar.Close()
+	//the watch starts after the first scan
+	if !ar.request("SCAN") || !ar.request("SYNC") {
+		t.Fatal("the archive doesn't take requests")
+	}
+	for _, tc := range []struct {
+		name string
+		tf   testFile
+	}{
+		{"same month", testFile{start: 45 * time.Minute, n: 15, step: time.Minute}},
+		//the dir of the month is created after the watch started too
+		{"new month", testFile{start: 32 * 24 * time.Hour, n: 15, step: time.Minute}},
+	} {
+		mdir := filepath.Join(dir, testEpoch.Add(tc.tf.start).Format("2006.01"))
+		if err := os.MkdirAll(mdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		for _, rec := range tc.tf.records() {
+			data = append(data, rec...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(mdir, tc.tf.name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		//the file is added by the watcher, not by a rescan
+		var (
+			code int
+			body []byte
+		)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			h, b, _ := testQuery(ar, testRange(tc.tf.start, tc.tf.start+15*time.Minute-time.Second))
+			if code, body = h.Code, b; code == 200 && bytes.Equal(body, data) {
+				break
+			}
+		}
+		if code != 200 || !bytes.Equal(body, data) {
+			t.Errorf("%s: the new file wasn't added. got code %d and %d bytes, want %d", tc.name, code, len(body), len(data))
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package bgparchive
+
+import (
+	"github.com/CSUNetSec/bgparchive/api"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//WS_POLL_INTERVAL is how often a websocket client checks the archive for new files
+const WS_POLL_INTERVAL = 10 * time.Second
+
+//wsarchive pushes the messages of an archive to websocket clients as the
+//archive picks up new files, either by rescanning or by watching. It replaces
+//the continuous pulling with its rotating ids, that still works for the clients
+//that can't use websockets.
+type wsarchive struct {
+	*fsarchive
+	upgrader websocket.Upgrader
+	poll     time.Duration
+}
+
+func NewWsArchive(a *fsarchive) *wsarchive {
+	return &wsarchive{
+		fsarchive: a,
+		poll:      WS_POLL_INTERVAL,
+		upgrader: websocket.Upgrader{
+			//like the CORS header of the rest of the API anyone can connect
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+//ServeHTTP sends all the messages from start to now, and then the messages
+//of every new file of the archive as soon as it stops growing. The last file
+//might still be written at first, so it is sent again once it stops growing,
+//without the messages that were in the range up to now. The query
+//parameters of the updates are accepted. Raw MRT messages are sent as
+//binary messages and format=json as text messages. The messages up to now
+//and every new file are queried in a slot of the concurrency limit.
+func (wa *wsarchive) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	//like the api handlers, the address comes from the connection and not the client
+	req.Form["remoteaddr"] = strings.Split(req.RemoteAddr, ":")
+	qp, err := newQueryParams(req.Form)
+	if err != nil {
+		countRequestError(httpCode(err))
+		http.Error(w, err.Error(), httpCode(err))
+		return
+	}
+	loc, err := parseTZ(req.Form.Get("tz"))
+	if err != nil {
+		countRequestError(httpCode(err))
+		http.Error(w, err.Error(), httpCode(err))
+		return
+	}
+	sstr := req.Form.Get("start")
+	ta, _, err := parseTimePair(sstr, sstr, loc)
+	if err != nil {
+		countRequestError(httpCode(errbaddate))
+		http.Error(w, errbaddate.Error(), httpCode(errbaddate))
+		return
+	}
+	if time.Since(ta) > 24*time.Hour {
+		countRequestError(httpCode(errbigdt))
+		http.Error(w, errbigdt.Error(), httpCode(errbigdt))
+		return
+	}
+	if !acquireQuery() {
+		countRequestError(httpCode(errbusy))
+		w.Header().Set("Retry-After", strconv.Itoa(QUERY_RETRY_AFTER))
+		http.Error(w, errbusy.Error(), httpCode(errbusy))
+		return
+	}
+	conn, err := wa.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		releaseQuery()
+		warnf("websocket upgrade failed for %s:%s", req.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	infof("websocket client %s connected from %s", req.RemoteAddr, ta)
+	//the client isn't expected to send anything. reading is how we find out it's gone.
+	done := make(chan struct{})
+	qp.done = done
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	msgtype, trans := websocket.BinaryMessage, newQueryTransformer(qp)
+	if f, _ := lookupFormat(qp.format); f.text {
+		msgtype = websocket.TextMessage
+	}
+	//send forwards the replies to the client until they are exhausted, the client
+	//goes away or, if take is set, the limit of the request is reached.
+	send := func(rc chan api.Reply, take bool) bool {
+		for r := range rc {
+			if r.Err != nil {
+				warnf("websocket client %s error:%s", req.RemoteAddr, r.Err)
+				continue
+			}
+			if take && !qp.take() {
+				return false
+			}
+			if err := conn.WriteMessage(msgtype, r.Data); err != nil {
+				return false
+			}
+		}
+		return !qp.cancelled()
+	}
+	seen := make(map[string]bool)
+	now := time.Now()
+	var live string //the file that might still be written
+	efs := wa.getEntryFiles()
+	for k, ef := range efs {
+		if k == len(efs)-1 {
+			live = ef.Path
+			break
+		}
+		seen[ef.Path] = true
+	}
+	if _, _, _, err := wa.getFileIndexRange(ta, now); err == nil {
+		rc := make(chan api.Reply, FILE_REPLY_BUFSZ)
+		go func() {
+			defer close(rc)
+			transformAndSendBytes(wa.fsarchive, ta, now, qp, rc, trans, 0)
+		}()
+		//transformAndSendBytes already takes from the limit
+		ok := send(rc, false)
+		releaseQuery()
+		if !ok {
+			return
+		}
+	} else {
+		releaseQuery()
+		live = "" //nothing of it was sent
+	}
+	//files that have been added but might still be written, with their last size
+	growing := make(map[string]int64)
+	ticker := time.NewTicker(wa.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			infof("websocket client %s disconnected", req.RemoteAddr)
+			return
+		case <-ticker.C:
+		}
+		for _, ef := range wa.getEntryFiles() {
+			if seen[ef.Path] || ef.Sdate.Add(wa.timedelta).Before(ta) {
+				continue
+			}
+			fi, err := wa.fs.Stat(ef.Path)
+			if err != nil {
+				continue
+			}
+			if sz, ok := growing[ef.Path]; !ok || sz != fi.Size() {
+				growing[ef.Path] = fi.Size()
+				continue
+			}
+			if !acquireQuery() {
+				continue //try again on the next tick
+			}
+			delete(growing, ef.Path)
+			seen[ef.Path] = true
+			rc := make(chan api.Reply, FILE_REPLY_BUFSZ)
+			go func(ef ArchEntryFile) {
+				defer close(rc)
+				in := make(chan msgReply)
+				go func() {
+					defer close(in)
+					scanFile(wa.fsarchive, ef, ta, ef.Sdate.Add(24*time.Hour), qp, trans, in, done)
+				}()
+				for r := range in {
+					//the first query already sent these
+					if ef.Path == live && r.Err == nil && qp.inRange(time.Unix(int64(r.ts), 0), ta, now) {
+						continue
+					}
+					select {
+					case rc <- r.Reply:
+					case <-done:
+						return
+					}
+				}
+			}(ef)
+			ok := send(rc, true)
+			releaseQuery()
+			if !ok {
+				return
+			}
+		}
+	}
+}
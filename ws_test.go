@@ -0,0 +1,139 @@
+package bgparchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketLiveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Minute)
+	base := now.Add(-30 * time.Minute)
+	//the last file is still written: its last records come after the first query
+	writeLiveFile(t, dir, base, minutes(base, 0, 5))
+	writeLiveFile(t, dir, base.Add(15*time.Minute), append(minutes(base, 15, 20), minutes(now, 2, 5)...))
+	wa := NewWsArchive(scanTestArchive(dir).fsarchive)
+	wa.poll = 20 * time.Millisecond
+	srv := httptest.NewServer(wa)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?start="+base.Add(-5*time.Minute).Format("20060102150405"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	want := append(append(minutes(base, 0, 5), minutes(base, 15, 20)...), minutes(now, 2, 5)...)
+	for k, w := range want {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %s", k, err)
+		}
+		if len(msg) < 4 {
+			t.Fatalf("message %d is %d bytes", k, len(msg))
+		}
+		if ts := mrtTime(msg); !ts.Equal(w) {
+			t.Errorf("message %d: got %s, want %s", k, ts, w)
+		}
+	}
+	//nothing is sent twice
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := conn.ReadMessage(); err == nil {
+		t.Errorf("got an extra message of %s", mrtTime(msg))
+	}
+}
+
+func TestWebsocketBusy(t *testing.T) {
+	//take every slot but one
+	for k := 1; k < cap(querysem); k++ {
+		if !acquireQuery() {
+			t.Fatal("no query slot")
+		}
+		defer releaseQuery()
+	}
+	if !acquireQuery() {
+		t.Fatal("no query slot")
+	}
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Minute)
+	writeLiveFile(t, dir, now.Add(-10*time.Minute), minutes(now, -10, -5))
+	srv := httptest.NewServer(NewWsArchive(scanTestArchive(dir).fsarchive))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?start=" + now.Add(-10*time.Minute).Format("20060102150405")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("got %v and %v while all the slots are taken, want a 503", resp, err)
+	}
+	releaseQuery()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebsocketRemoteAddr(t *testing.T) {
+	var buf bytes.Buffer
+	SetAccessLog(&buf)
+	defer SetAccessLog(nil)
+	dir, err := ioutil.TempDir("", "bgparchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Minute)
+	writeLiveFile(t, dir, now.Add(-30*time.Minute), minutes(now, -30, -25))
+	srv := httptest.NewServer(NewWsArchive(scanTestArchive(dir).fsarchive))
+	defer srv.Close()
+	for _, param := range []string{"", "&remoteaddr=203.0.113.9"} {
+		accesslogmu.Lock()
+		buf.Reset()
+		accesslogmu.Unlock()
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?start=" + now.Add(-30*time.Minute).Format("20060102150405") + param
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		//the entry is written once the query is over
+		var ent AccessLogEntry
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			accesslogmu.Lock()
+			line := buf.String()
+			accesslogmu.Unlock()
+			if line != "" {
+				line = strings.SplitN(line, "\n", 2)[0]
+				if err := json.Unmarshal([]byte(line), &ent); err != nil {
+					t.Fatalf("%s in %s", err, line)
+				}
+				break
+			}
+		}
+		if ent.Remote != "127.0.0.1" {
+			t.Errorf("with %q: got the remote %q in the access log, want the address of the connection", param, ent.Remote)
+		}
+	}
+}